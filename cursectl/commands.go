@@ -0,0 +1,1331 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "cursectl",
+	Short: "Manage a running cursed through its admin API",
+	Long: `cursectl talks to the cursed admin listener (adminport), authenticating with
+the admin token or a client certificate signed by adminclientca.`,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+type exemption struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason"`
+	Expires     time.Time `json:"expires"`
+	Created     time.Time `json:"created"`
+}
+
+var exemptionsCmd = &cobra.Command{
+	Use:   "exemptions",
+	Short: "Manage key age exemptions",
+}
+
+var exemptionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List key age exemptions",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var exemptions []exemption
+		err = apiRequest(conf, "GET", "/exemptions", nil, &exemptions)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(exemptions)
+		}
+
+		var rows [][]string
+		for _, ex := range exemptions {
+			rows = append(rows, []string{ex.Fingerprint, ex.Expires.Format(time.RFC3339), ex.Reason})
+		}
+		return printTable([]string{"FINGERPRINT", "EXPIRES", "REASON"}, rows)
+	},
+}
+
+var exemptionsAddCmd = &cobra.Command{
+	Use:   "add FINGERPRINT",
+	Short: "Exempt a key from maxkeyage",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		reason, _ := cmd.Flags().GetString("reason")
+		expires, _ := cmd.Flags().GetDuration("expires")
+
+		ex := exemption{
+			Fingerprint: args[0],
+			Reason:      reason,
+			Expires:     time.Now().Add(expires),
+		}
+		err = apiRequest(conf, "POST", "/exemptions", ex, &ex)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(ex)
+		}
+		fmt.Printf("Exempted %s until %s\n", ex.Fingerprint, ex.Expires.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var exemptionsRemoveCmd = &cobra.Command{
+	Use:   "remove FINGERPRINT",
+	Short: "Remove a key age exemption",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return apiRequest(conf, "DELETE", "/exemptions?fingerprint="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+type keyListEntry struct {
+	Fingerprint string     `json:"fingerprint"`
+	List        string     `json:"list"`
+	Reason      string     `json:"reason"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+type keyAge struct {
+	Fingerprint string     `json:"fingerprint"`
+	User        string     `json:"user,omitempty"`
+	FirstSeen   *time.Time `json:"firstSeen,omitempty"`
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Status      string     `json:"status"`
+	Exemption   *exemption `json:"exemption,omitempty"`
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the key allowlist and denylist and look up key ages",
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list [allow|deny]",
+	Short: "List allowlisted and denylisted keys, or a user's keys and their ages",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		user, _ := cmd.Flags().GetString("user")
+		if user != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("--user can't be combined with a list name")
+			}
+			return listKeyAges(conf, user)
+		}
+		path := "/keylists"
+		if len(args) > 0 {
+			path += "?list=" + url.QueryEscape(args[0])
+		}
+		var entries []keyListEntry
+		err = apiRequest(conf, "GET", path, nil, &entries)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(entries)
+		}
+
+		var rows [][]string
+		for _, e := range entries {
+			expires := "-"
+			if e.Expires != nil {
+				expires = e.Expires.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{e.Fingerprint, e.List, e.Created.Format(time.RFC3339), expires, e.Reason})
+		}
+		return printTable([]string{"FINGERPRINT", "LIST", "CREATED", "EXPIRES", "REASON"}, rows)
+	},
+}
+
+// listKeyAges shows when each of user's keys was first and last seen and when it ages out
+func listKeyAges(conf *config, user string) error {
+	var ages []keyAge
+	err := apiRequest(conf, "GET", "/keyages?user="+url.QueryEscape(user), nil, &ages)
+	if err != nil {
+		return err
+	}
+	if conf.Output == "json" {
+		return printJSON(ages)
+	}
+
+	optTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	var rows [][]string
+	for _, ka := range ages {
+		status := ka.Status
+		if ka.Exemption != nil && ka.Status == "exempt" {
+			status += " until " + ka.Exemption.Expires.Local().Format(time.RFC3339)
+		}
+		rows = append(rows, []string{ka.Fingerprint, optTime(ka.FirstSeen), optTime(ka.LastSeen), optTime(ka.Expires), status})
+	}
+	return printTable([]string{"FINGERPRINT", "FIRST SEEN", "LAST SEEN", "EXPIRES", "STATUS"}, rows)
+}
+
+func keyListCmd(list, short string) *cobra.Command {
+	c := &cobra.Command{
+		Use:   list + " FINGERPRINT",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, err := getConf()
+			if err != nil {
+				return err
+			}
+			reason, _ := cmd.Flags().GetString("reason")
+
+			e := keyListEntry{Fingerprint: args[0], List: list, Reason: reason}
+			// Allowlisting is an exception to policy, so it lapses. Blocks don't
+			if list == "allow" {
+				expires, _ := cmd.Flags().GetDuration("expires")
+				t := time.Now().Add(expires)
+				e.Expires = &t
+			}
+			err = apiRequest(conf, "POST", "/keylists", e, &e)
+			if err != nil {
+				return err
+			}
+			if conf.Output == "json" {
+				return printJSON(e)
+			}
+			if e.Expires != nil {
+				fmt.Printf("Added %s to the %slist until %s\n", e.Fingerprint, e.List, e.Expires.Format(time.RFC3339))
+			} else {
+				fmt.Printf("Added %s to the %slist\n", e.Fingerprint, e.List)
+			}
+			return nil
+		},
+	}
+	c.Flags().String("reason", "", "why the key is listed (required)")
+	c.MarkFlagRequired("reason")
+	if list == "allow" {
+		c.Flags().Duration("expires", 30*24*time.Hour, "how long the key stays allowlisted")
+	}
+	return c
+}
+
+var keysRemoveCmd = &cobra.Command{
+	Use:   "remove FINGERPRINT",
+	Short: "Take a key off the allowlist or denylist",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return apiRequest(conf, "DELETE", "/keylists?fingerprint="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+type approval struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint"`
+	Principal   string    `json:"principal"`
+	Reason      string    `json:"reason"`
+	Status      string    `json:"status"`
+	Approver    string    `json:"approver,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+var approvalsCmd = &cobra.Command{
+	Use:   "approvals",
+	Short: "Review signing requests held for approval",
+}
+
+var approvalsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List approval requests",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var approvals []approval
+		err = apiRequest(conf, "GET", "/approvals", nil, &approvals)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(approvals)
+		}
+
+		var rows [][]string
+		for _, ap := range approvals {
+			rows = append(rows, []string{ap.ID, ap.Status, ap.User, ap.Principal, ap.Expires.Format(time.RFC3339), ap.Reason})
+		}
+		return printTable([]string{"ID", "STATUS", "USER", "PRINCIPAL", "EXPIRES", "REASON"}, rows)
+	},
+}
+
+func decideCmd(use, short string, approve bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " ID",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, err := getConf()
+			if err != nil {
+				return err
+			}
+			// cursed records the approver named by our credential, and refuses any other
+			approver, _ := cmd.Flags().GetString("approver")
+
+			var ap approval
+			err = apiRequest(conf, "POST", "/approvals", struct {
+				ID       string `json:"id"`
+				Approve  bool   `json:"approve"`
+				Approver string `json:"approver,omitempty"`
+			}{args[0], approve, approver}, &ap)
+			if err != nil {
+				return err
+			}
+			if conf.Output == "json" {
+				return printJSON(ap)
+			}
+			fmt.Printf("Request %s from %s for %s %s\n", ap.ID, ap.User, ap.Principal, ap.Status)
+			return nil
+		},
+	}
+}
+
+type delegation struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Principals []string   `json:"principals"`
+	Reason     string     `json:"reason"`
+	Issuer     string     `json:"issuer"`
+	Created    time.Time  `json:"created"`
+	Expires    time.Time  `json:"expires"`
+	Used       *time.Time `json:"used,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+var delegationsCmd = &cobra.Command{
+	Use:   "delegations",
+	Short: "Manage delegation tokens granting users extra principals",
+}
+
+var delegationsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List delegations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var delegations []delegation
+		err = apiRequest(conf, "GET", "/delegations", nil, &delegations)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(delegations)
+		}
+
+		var rows [][]string
+		for _, d := range delegations {
+			used := "-"
+			if d.Used != nil {
+				used = d.Used.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{d.ID, d.User, strings.Join(d.Principals, ","), d.Issuer, d.Expires.Format(time.RFC3339), used, d.Reason})
+		}
+		return printTable([]string{"ID", "USER", "PRINCIPALS", "ISSUER", "EXPIRES", "USED", "REASON"}, rows)
+	},
+}
+
+var delegationsCreateCmd = &cobra.Command{
+	Use:   "create USER",
+	Short: "Mint a single-use delegation token for a user",
+	Long: `create prints a token granting USER a certificate for the given principals,
+valid no later than the delegation expires. Hand it to the user, who runs
+jinx --delegation TOKEN --sshuser PRINCIPAL. The token isn't shown again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		principals, _ := cmd.Flags().GetStringSlice("principal")
+		window, _ := cmd.Flags().GetDuration("for")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		// cursed records whoever our credential names as the issuer
+		d := delegation{
+			User:       args[0],
+			Principals: principals,
+			Reason:     reason,
+			Expires:    time.Now().Add(window),
+		}
+		err = apiRequest(conf, "POST", "/delegations", d, &d)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(d)
+		}
+		fmt.Printf("Delegation %s for %s (%s) until %s\n%s\n", d.ID, d.User, strings.Join(d.Principals, ","), d.Expires.Format(time.RFC3339), d.Token)
+		return nil
+	},
+}
+
+var delegationsRevokeCmd = &cobra.Command{
+	Use:   "revoke ID",
+	Short: "Revoke a delegation",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return apiRequest(conf, "DELETE", "/delegations?id="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+type enrollment struct {
+	ID          string     `json:"id"`
+	User        string     `json:"user"`
+	Principals  []string   `json:"principals"`
+	Device      string     `json:"device,omitempty"`
+	Reason      string     `json:"reason"`
+	Issuer      string     `json:"issuer"`
+	Created     time.Time  `json:"created"`
+	Expires     time.Time  `json:"expires"`
+	Redeemed    *time.Time `json:"redeemed,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Code        string     `json:"code,omitempty"`
+}
+
+var enrollmentsCmd = &cobra.Command{
+	Use:   "enrollments",
+	Short: "Manage one-time enrollment codes for new users",
+}
+
+var enrollmentsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List enrollments",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var enrollments []enrollment
+		err = apiRequest(conf, "GET", "/enrollments", nil, &enrollments)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(enrollments)
+		}
+
+		var rows [][]string
+		for _, en := range enrollments {
+			redeemed, device := "-", "-"
+			if en.Redeemed != nil {
+				redeemed = en.Redeemed.Format(time.RFC3339)
+			}
+			if en.Device != "" {
+				device = en.Device
+			}
+			rows = append(rows, []string{en.User, strings.Join(en.Principals, ","), device, en.Issuer, en.Expires.Format(time.RFC3339), redeemed, en.Reason})
+		}
+		return printTable([]string{"USER", "PRINCIPALS", "DEVICE", "ISSUER", "EXPIRES", "REDEEMED", "REASON"}, rows)
+	},
+}
+
+var enrollmentsCreateCmd = &cobra.Command{
+	Use:   "create USER",
+	Short: "Issue a one-time enrollment code to a new user",
+	Long: `create prints a code that registers the first key USER requests a
+certificate for with jinx --enroll CODE, and with --device the device key
+they request it from. Until the enrollment expires, that key gets
+certificates for the given principals, whatever the key registry and
+USER's groups say. Creating another enrollment for USER replaces this one.
+The code isn't shown again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		principals, _ := cmd.Flags().GetStringSlice("principal")
+		device, _ := cmd.Flags().GetString("device")
+		window, _ := cmd.Flags().GetDuration("for")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		// cursed records whoever our credential names as the issuer
+		en := enrollment{
+			User:       args[0],
+			Principals: principals,
+			Device:     device,
+			Reason:     reason,
+			Expires:    time.Now().Add(window),
+		}
+		err = apiRequest(conf, "POST", "/enrollments", en, &en)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(en)
+		}
+		fmt.Printf("Enrollment %s for %s (%s) until %s\n%s\n", en.ID, en.User, strings.Join(en.Principals, ","), en.Expires.Format(time.RFC3339), en.Code)
+		return nil
+	},
+}
+
+var enrollmentsRevokeCmd = &cobra.Command{
+	Use:   "revoke USER",
+	Short: "Revoke a user's enrollment",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return apiRequest(conf, "DELETE", "/enrollments?user="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+type adminToken struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	Scopes          []string   `json:"scopes"`
+	Created         time.Time  `json:"created"`
+	Rotated         *time.Time `json:"rotated,omitempty"`
+	Expires         time.Time  `json:"expires"`
+	PreviousExpires *time.Time `json:"previousExpires,omitempty"`
+	Token           string     `json:"token,omitempty"`
+}
+
+var tokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manage scoped admin API tokens",
+}
+
+var tokensListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List scoped admin tokens",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var tokens []adminToken
+		err = apiRequest(conf, "GET", "/tokens", nil, &tokens)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(tokens)
+		}
+
+		var rows [][]string
+		for _, t := range tokens {
+			rotated := "-"
+			if t.Rotated != nil {
+				rotated = t.Rotated.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{t.ID, t.Name, strings.Join(t.Scopes, ","), t.Created.Format(time.RFC3339), rotated, t.Expires.Format(time.RFC3339)})
+		}
+		return printTable([]string{"ID", "NAME", "SCOPES", "CREATED", "ROTATED", "EXPIRES"}, rows)
+	},
+}
+
+var tokensCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Mint an admin token limited to some scopes",
+	Long: `create prints a token for the admin API that only reaches the endpoints its
+scopes cover: audit reads everything but changes nothing, revoke can revoke
+certificates, denylist keys and freeze issuance but not undo any of it, policy
+manages exemptions, approvals, delegations, key lists, tasks and the service
+mode, and admin can do anything.
+The token isn't shown again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		name, _ := cmd.Flags().GetString("name")
+		scopes, _ := cmd.Flags().GetStringSlice("scope")
+		window, _ := cmd.Flags().GetDuration("for")
+
+		t := adminToken{
+			Name:    name,
+			Scopes:  scopes,
+			Expires: time.Now().Add(window),
+		}
+		err = apiRequest(conf, "POST", "/tokens", t, &t)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(t)
+		}
+		fmt.Printf("Admin token %s (%s) with scopes %s until %s\n%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), t.Expires.Format(time.RFC3339), t.Token)
+		return nil
+	},
+}
+
+var tokensRotateCmd = &cobra.Command{
+	Use:   "rotate ID",
+	Short: "Replace a token's secret and extend its expiry",
+	Long: `rotate prints a new token for ID, valid for as long again as the old one was.
+The old token keeps working for --grace, so whatever uses it can be moved over.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		grace, _ := cmd.Flags().GetDuration("grace")
+
+		var t adminToken
+		err = apiRequest(conf, "POST", "/tokens/rotate", struct {
+			ID    string `json:"id"`
+			Grace int    `json:"grace"`
+		}{args[0], int(grace.Seconds())}, &t)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(t)
+		}
+		fmt.Printf("Admin token %s (%s) rotated, valid until %s\n%s\n", t.ID, t.Name, t.Expires.Format(time.RFC3339), t.Token)
+		if t.PreviousExpires != nil {
+			fmt.Printf("The previous token works until %s\n", t.PreviousExpires.Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+var tokensDeleteCmd = &cobra.Command{
+	Use:   "delete ID",
+	Short: "Delete a scoped admin token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return apiRequest(conf, "DELETE", "/tokens?id="+url.QueryEscape(args[0]), nil, nil)
+	},
+}
+
+var hostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "List hosts with an unexpired host certificate",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var hosts []struct {
+			Key         string    `json:"key"`
+			Principals  []string  `json:"principals"`
+			ValidBefore time.Time `json:"validBefore"`
+			Issued      time.Time `json:"issued"`
+		}
+		err = apiRequest(conf, "GET", "/hosts", nil, &hosts)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(hosts)
+		}
+
+		var rows [][]string
+		for _, h := range hosts {
+			for _, p := range h.Principals {
+				rows = append(rows, []string{p, h.Issued.Format(time.RFC3339), h.ValidBefore.Format(time.RFC3339)})
+			}
+		}
+		return printTable([]string{"HOST", "ISSUED", "VALID BEFORE"}, rows)
+	},
+}
+
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "List the certificates that are still valid, as exported for key management systems",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var inv struct {
+			Version      int       `json:"version"`
+			Generated    time.Time `json:"generated"`
+			CA           string    `json:"ca"`
+			Certificates []struct {
+				User        string    `json:"user"`
+				Principals  []string  `json:"principals"`
+				Serial      uint64    `json:"serial"`
+				KeyID       string    `json:"keyId"`
+				Fingerprint string    `json:"fingerprint"`
+				Issued      time.Time `json:"issued"`
+				Expires     time.Time `json:"expires"`
+			} `json:"certificates"`
+		}
+		err = apiRequest(conf, "GET", "/inventory", nil, &inv)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(inv)
+		}
+
+		var rows [][]string
+		for _, c := range inv.Certificates {
+			rows = append(rows, []string{c.User, strings.Join(c.Principals, ","), fmt.Sprint(c.Serial), c.Fingerprint, c.Expires.Format(time.RFC3339)})
+		}
+		return printTable([]string{"USER", "PRINCIPALS", "SERIAL", "KEY", "EXPIRES"}, rows)
+	},
+}
+
+type taskStatus struct {
+	Name         string     `json:"name"`
+	Interval     int        `json:"interval"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration float64    `json:"lastDuration,omitempty"`
+	Result       string     `json:"result,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+type override struct {
+	Kind    string    `json:"kind"`
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+var overridesCmd = &cobra.Command{
+	Use:   "overrides",
+	Short: "List exemptions, allowlisted keys, delegations and enrollments by when they expire",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		path := "/overrides"
+		if within, _ := cmd.Flags().GetDuration("within"); within > 0 {
+			path += "?within=" + strconv.Itoa(int(within.Seconds()))
+		}
+		var overrides []override
+		err = apiRequest(conf, "GET", path, nil, &overrides)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(overrides)
+		}
+
+		var rows [][]string
+		for _, o := range overrides {
+			rows = append(rows, []string{o.Kind, o.ID, o.User, o.Expires.Format(time.RFC3339), o.Reason})
+		}
+		return printTable([]string{"KIND", "ID", "USER", "EXPIRES", "REASON"}, rows)
+	},
+}
+
+var tasksCmd = &cobra.Command{
+	Use:   "tasks",
+	Short: "Show the maintenance task schedule and each task's last run",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var tasks []taskStatus
+		err = apiRequest(conf, "GET", "/tasks", nil, &tasks)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(tasks)
+		}
+
+		var rows [][]string
+		for _, t := range tasks {
+			interval, lastRun, nextRun := "disabled", "never", "-"
+			if t.Interval > 0 {
+				interval = (time.Duration(t.Interval) * time.Second).String()
+			}
+			if t.LastRun != nil {
+				lastRun = t.LastRun.Format(time.RFC3339)
+			}
+			if t.Running {
+				nextRun = "running"
+			} else if t.NextRun != nil {
+				nextRun = t.NextRun.Format(time.RFC3339)
+			}
+			result := t.Result
+			if t.Error != "" {
+				result = "error: " + t.Error
+			}
+			rows = append(rows, []string{t.Name, interval, lastRun, nextRun, result})
+		}
+		return printTable([]string{"TASK", "EVERY", "LAST RUN", "NEXT RUN", "RESULT"}, rows)
+	},
+}
+
+var tasksRunCmd = &cobra.Command{
+	Use:   "run NAME",
+	Short: "Run a maintenance task now, e.g. krl after blocking a key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var t taskStatus
+		err = apiRequest(conf, "POST", "/tasks?name="+url.QueryEscape(args[0]), nil, &t)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(t)
+		}
+		switch {
+		case t.Running:
+			fmt.Printf("%s is already running\n", t.Name)
+		case t.Error != "":
+			return fmt.Errorf("%s failed: %s", t.Name, t.Error)
+		case t.Result != "":
+			fmt.Printf("%s: %s\n", t.Name, t.Result)
+		default:
+			fmt.Printf("%s: done\n", t.Name)
+		}
+		return nil
+	},
+}
+
+// parseAge reads --older-than, a Go duration or a number of days such as 180d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("Invalid age %q, expected e.g. 180d or 720h", s)
+}
+
+type pruneReport struct {
+	Before     time.Time      `json:"before"`
+	DryRun     bool           `json:"dryRun"`
+	Archive    string         `json:"archive"`
+	Pruned     map[string]int `json:"pruned"`
+	Total      int            `json:"total"`
+	Compaction string         `json:"compaction"`
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune --older-than 180d",
+	Short: "Archive and delete history that expired long ago",
+	Long: `prune deletes records that expired before --older-than ago: issued
+certificates and their serials, approvals, delegations, exemptions and host
+records, along with keys users haven't been seen with since and undelivered
+audit events. Everything deleted is archived to a file in prunearchivedir
+first. --dry-run only counts what would go.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		olderThan, _ := cmd.Flags().GetString("older-than")
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return err
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		var rep pruneReport
+		err = apiRequest(conf, "POST", "/prune", map[string]interface{}{"before": time.Now().Add(-age), "dryRun": dryRun}, &rep)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(rep)
+		}
+
+		names := make([]string, 0, len(rep.Pruned))
+		for name := range rep.Pruned {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			rows = append(rows, []string{name, strconv.Itoa(rep.Pruned[name])})
+		}
+		err = printTable([]string{"BUCKET", "RECORDS"}, rows)
+		if err != nil {
+			return err
+		}
+		verb := "Pruned"
+		if rep.DryRun {
+			verb = "Would prune"
+		}
+		fmt.Printf("%s %d records from before %s\n", verb, rep.Total, rep.Before.Local().Format(time.RFC3339))
+		if rep.Archive != "" {
+			fmt.Printf("Archived to %s\n", rep.Archive)
+		}
+		if rep.Compaction != "" {
+			fmt.Printf("Database: %s\n", rep.Compaction)
+		}
+		return nil
+	},
+}
+
+type issuedCert struct {
+	KeyID         string     `json:"keyId"`
+	User          string     `json:"user"`
+	Fingerprint   string     `json:"fingerprint"`
+	SHA256        string     `json:"sha256"`
+	Principals    []string   `json:"principals"`
+	Issued        time.Time  `json:"issued"`
+	ValidBefore   time.Time  `json:"validBefore"`
+	Revoked       *time.Time `json:"revoked,omitempty"`
+	RevokedReason string     `json:"revokedReason,omitempty"`
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke unexpired certificates by user, key or issue time, and regenerate the KRL",
+	Long: `Revoke every unexpired certificate matching all of the given filters, e.g. all of a
+user's certificates, or everything issued during an incident window:
+
+    cursectl revoke --from 2026-10-14T09:00:00Z --to 2026-10-14T11:30:00Z --reason INC-123
+
+Use --dry-run to see what would be revoked first.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		req := map[string]interface{}{}
+		for _, name := range []string{"user", "fingerprint", "reason"} {
+			if v, _ := cmd.Flags().GetString(name); v != "" {
+				req[name] = v
+			}
+		}
+		if principals, _ := cmd.Flags().GetStringSlice("principal"); len(principals) > 0 {
+			req["principals"] = principals
+		}
+		for _, name := range []string{"from", "to"} {
+			v, _ := cmd.Flags().GetString(name)
+			if v == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("Invalid --%s %q, expected an RFC 3339 time like 2026-10-14T09:00:00Z", name, v)
+			}
+			req[name] = t
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		req["dryRun"] = dryRun
+
+		var res struct {
+			Revoked []issuedCert `json:"revoked"`
+			DryRun  bool         `json:"dryRun"`
+			KRL     string       `json:"krl"`
+		}
+		err = apiRequest(conf, "POST", "/revoke", req, &res)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(res)
+		}
+
+		var rows [][]string
+		for _, ic := range res.Revoked {
+			rows = append(rows, []string{ic.User, ic.SHA256, ic.Issued.Format(time.RFC3339), ic.ValidBefore.Format(time.RFC3339), ic.KeyID})
+		}
+		err = printTable([]string{"USER", "KEY", "ISSUED", "EXPIRES", "KEY ID"}, rows)
+		if err != nil {
+			return err
+		}
+		switch {
+		case res.DryRun:
+			fmt.Printf("%d certificates would be revoked\n", len(res.Revoked))
+		case res.KRL != "":
+			fmt.Printf("Revoked %d certificates, KRL: %s\n", len(res.Revoked), res.KRL)
+		default:
+			fmt.Printf("Revoked %d certificates\n", len(res.Revoked))
+		}
+		return nil
+	},
+}
+
+// freezeBy names who froze or unfroze: --by, or whoever runs cursectl
+func freezeBy(cmd *cobra.Command) (string, error) {
+	by, _ := cmd.Flags().GetString("by")
+	if by != "" {
+		return by, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine your username, pass --by: %v", err)
+	}
+	return u.Username, nil
+}
+
+var freezeCmd = &cobra.Command{
+	Use:   "freeze",
+	Short: "Emergency stop: halt all issuance, revoke panicprincipals certificates and push a KRL",
+	Long: `freeze is the containment step for a suspected compromise. cursed stops
+signing anything, revokes every unexpired certificate for the principals in
+panicprincipals and regenerates the KRL. The freeze survives restarts and
+reloads, and can only be lifted with cursectl unfreeze. While frozen,
+cursectl mode shows the reason.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		reason, _ := cmd.Flags().GetString("reason")
+		by, err := freezeBy(cmd)
+		if err != nil {
+			return err
+		}
+
+		var res struct {
+			Frozen  bool         `json:"frozen"`
+			Revoked []issuedCert `json:"revoked"`
+			KRL     string       `json:"krl"`
+			Errors  []string     `json:"errors"`
+		}
+		err = apiRequest(conf, "POST", "/freeze", map[string]string{"reason": reason, "by": by}, &res)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(res)
+		}
+		fmt.Printf("Issuance frozen, revoked %d certificates\n", len(res.Revoked))
+		if res.KRL != "" {
+			fmt.Printf("KRL: %s\n", res.KRL)
+		}
+		for _, e := range res.Errors {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", e)
+		}
+		return nil
+	},
+}
+
+var unfreezeCmd = &cobra.Command{
+	Use:   "unfreeze",
+	Short: "Lift a freeze and resume issuing certificates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		reason, _ := cmd.Flags().GetString("reason")
+		by, err := freezeBy(cmd)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Frozen bool `json:"frozen"`
+		}
+		err = apiRequest(conf, "DELETE", "/freeze", map[string]string{"reason": reason, "by": by}, &res)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(res)
+		}
+		fmt.Println("Issuance resumed")
+		return nil
+	},
+}
+
+type unsealStatus struct {
+	Sealed      bool     `json:"sealed"`
+	CA          string   `json:"ca"`
+	Threshold   int      `json:"threshold"`
+	Progress    int      `json:"progress"`
+	SubmittedBy []string `json:"submittedBy"`
+}
+
+func printUnsealStatus(st unsealStatus) {
+	if !st.Sealed {
+		fmt.Printf("CA key %s is unsealed\n", st.CA)
+		return
+	}
+	fmt.Printf("CA key %s is sealed, %d of %d shares submitted", st.CA, st.Progress, st.Threshold)
+	if len(st.SubmittedBy) > 0 {
+		fmt.Printf(" (%s)", strings.Join(st.SubmittedBy, ", "))
+	}
+	fmt.Println()
+}
+
+var unsealCmd = &cobra.Command{
+	Use:   "unseal",
+	Short: "Submit your share of the sealed CA key",
+	Long: `unseal reads your share of the CA key's unseal key from standard input, so it
+stays out of your shell history, and submits it. cursed starts signing once
+the threshold of operators set by cursed seal have submitted theirs. With
+--status, only shows how far unsealing has got.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+
+		var st unsealStatus
+		if status, _ := cmd.Flags().GetBool("status"); status {
+			err = apiRequest(conf, "GET", "/unseal", nil, &st)
+		} else {
+			fmt.Fprint(os.Stderr, "Unseal share: ")
+			share, rerr := bufio.NewReader(os.Stdin).ReadString('\n')
+			if rerr != nil && share == "" {
+				return fmt.Errorf("Unable to read share: %v", rerr)
+			}
+			err = apiRequest(conf, "POST", "/unseal", map[string]string{"share": strings.TrimSpace(share)}, &st)
+		}
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(st)
+		}
+		printUnsealStatus(st)
+		return nil
+	},
+}
+
+var sealCmd = &cobra.Command{
+	Use:   "seal",
+	Short: "Make cursed forget the CA key until a quorum of operators unseal it again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		reason, _ := cmd.Flags().GetString("reason")
+		var st unsealStatus
+		err = apiRequest(conf, "POST", "/seal", map[string]string{"reason": reason}, &st)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(st)
+		}
+		printUnsealStatus(st)
+		return nil
+	},
+}
+
+type serviceMode struct {
+	Mode    string `json:"mode"`
+	Message string `json:"message,omitempty"`
+}
+
+var modeCmd = &cobra.Command{
+	Use:   "mode [normal|readonly|maintenance]",
+	Short: "Show or change the service mode",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+
+		var mode serviceMode
+		if len(args) == 0 {
+			err = apiRequest(conf, "GET", "/mode", nil, &mode)
+		} else {
+			message, _ := cmd.Flags().GetString("message")
+			err = apiRequest(conf, "POST", "/mode", serviceMode{args[0], message}, &mode)
+		}
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(mode)
+		}
+		if mode.Message != "" {
+			fmt.Printf("%s: %s\n", mode.Mode, mode.Message)
+		} else {
+			fmt.Println(mode.Mode)
+		}
+		return nil
+	},
+}
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the cursed config file, like sending it SIGHUP",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Config string `json:"config"`
+		}
+		err = apiRequest(conf, "POST", "/reload", nil, &res)
+		if err != nil {
+			return err
+		}
+		if conf.Output == "json" {
+			return printJSON(res)
+		}
+		fmt.Printf("Reloaded %s\n", res.Config)
+		return nil
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print the daemon's expvar counters (denials, CA breaker state, memory)",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		var vars []byte
+		err = apiRequest(conf, "GET", "/debug/vars", nil, &vars)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(vars)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringP("output", "o", "text", "output format: text or json")
+	rootCmd.PersistentFlags().String("url", "", "admin listener URL (default from cursectl.yaml)")
+	viper.BindPFlag("output", rootCmd.PersistentFlags().Lookup("output"))
+	viper.BindPFlag("url", rootCmd.PersistentFlags().Lookup("url"))
+
+	exemptionsAddCmd.Flags().String("reason", "", "why the key is exempt (required)")
+	exemptionsAddCmd.Flags().Duration("expires", 7*24*time.Hour, "how long the exemption lasts")
+	exemptionsAddCmd.MarkFlagRequired("reason")
+	exemptionsCmd.AddCommand(exemptionsListCmd, exemptionsAddCmd, exemptionsRemoveCmd)
+
+	approveCmd := decideCmd("approve", "Approve a pending request", true)
+	rejectCmd := decideCmd("reject", "Reject a pending request", false)
+	for _, c := range []*cobra.Command{approveCmd, rejectCmd} {
+		c.Flags().String("approver", "", "fail unless this is who our credential names as the approver")
+	}
+	approvalsCmd.AddCommand(approvalsListCmd, approveCmd, rejectCmd)
+
+	keysListCmd.Flags().String("user", "", "show this user's keys with when they were first and last seen and when they age out")
+	overridesCmd.Flags().Duration("within", 0, "only those expiring within this long, e.g. 168h")
+
+	keysCmd.AddCommand(keysListCmd, keyListCmd("allow", "Allowlist a key"), keyListCmd("deny", "Block a key"), keysRemoveCmd)
+
+	delegationsCreateCmd.Flags().StringSlice("principal", nil, "principal to grant, may be repeated (required)")
+	delegationsCreateCmd.Flags().Duration("for", 4*time.Hour, "how long the delegation lasts")
+	delegationsCreateCmd.Flags().String("reason", "", "why the delegation is needed, e.g. an incident number (required)")
+	delegationsCreateCmd.MarkFlagRequired("principal")
+	delegationsCreateCmd.MarkFlagRequired("reason")
+	delegationsCmd.AddCommand(delegationsListCmd, delegationsCreateCmd, delegationsRevokeCmd)
+
+	enrollmentsCreateCmd.Flags().StringSlice("principal", nil, "principal to grant, may be repeated (required)")
+	enrollmentsCreateCmd.Flags().String("device", "", "device ID the user must redeem the code from, as recorded in the certificate")
+	enrollmentsCreateCmd.Flags().Duration("for", 72*time.Hour, "how long the enrollment lasts")
+	enrollmentsCreateCmd.Flags().String("reason", "", "why the user needs access before their groups sync, e.g. a ticket (required)")
+	enrollmentsCreateCmd.MarkFlagRequired("principal")
+	enrollmentsCreateCmd.MarkFlagRequired("reason")
+	enrollmentsCmd.AddCommand(enrollmentsListCmd, enrollmentsCreateCmd, enrollmentsRevokeCmd)
+
+	tasksCmd.AddCommand(tasksRunCmd)
+
+	tokensCreateCmd.Flags().String("name", "", "what the token is for, e.g. siem or oncall (required)")
+	tokensCreateCmd.Flags().StringSlice("scope", nil, "admin, audit, policy or revoke, may be repeated (required)")
+	tokensCreateCmd.Flags().Duration("for", 30*24*time.Hour, "how long the token lasts")
+	tokensCreateCmd.MarkFlagRequired("name")
+	tokensCreateCmd.MarkFlagRequired("scope")
+	tokensRotateCmd.Flags().Duration("grace", time.Hour, "how long the old token keeps working")
+	tokensCmd.AddCommand(tokensListCmd, tokensCreateCmd, tokensRotateCmd, tokensDeleteCmd)
+
+	modeCmd.Flags().String("message", "", "message returned to clients while not in normal mode")
+
+	freezeCmd.Flags().String("reason", "", "why issuance is frozen, e.g. an incident number (required)")
+	freezeCmd.Flags().String("by", "", "name recorded as freezing issuance (default your username)")
+	freezeCmd.MarkFlagRequired("reason")
+	unfreezeCmd.Flags().String("reason", "", "why it's safe to resume issuing (required)")
+	unfreezeCmd.Flags().String("by", "", "name recorded as lifting the freeze (default your username)")
+	unfreezeCmd.MarkFlagRequired("reason")
+
+	unsealCmd.Flags().Bool("status", false, "only show how many shares have been submitted")
+	sealCmd.Flags().String("reason", "", "why the CA key is sealed, e.g. an incident number (required)")
+	sealCmd.MarkFlagRequired("reason")
+
+	pruneCmd.Flags().String("older-than", "", "prune what expired or was last seen longer ago than this, e.g. 180d (required)")
+	pruneCmd.Flags().Bool("dry-run", false, "count the records that would be pruned without deleting them")
+	pruneCmd.MarkFlagRequired("older-than")
+
+	revokeCmd.Flags().String("user", "", "revoke certificates issued to this user")
+	revokeCmd.Flags().String("fingerprint", "", "revoke certificates for this key (SHA256:... or MD5 fingerprint)")
+	revokeCmd.Flags().StringSlice("principal", nil, "revoke certificates granting this principal, may be repeated")
+	revokeCmd.Flags().String("from", "", "revoke certificates issued at or after this time (RFC 3339)")
+	revokeCmd.Flags().String("to", "", "revoke certificates issued at or before this time (RFC 3339)")
+	revokeCmd.Flags().String("reason", "", "why the certificates are revoked, e.g. an incident number (required)")
+	revokeCmd.Flags().Bool("dry-run", false, "list the certificates that would be revoked without revoking them")
+
+	rootCmd.AddCommand(exemptionsCmd, keysCmd, approvalsCmd, delegationsCmd, enrollmentsCmd, freezeCmd, hostsCmd, inventoryCmd, modeCmd, overridesCmd, pruneCmd, reloadCmd, revokeCmd, sealCmd, statsCmd, tasksCmd, tokensCmd, unfreezeCmd, unsealCmd)
+}
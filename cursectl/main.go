@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type config struct {
+	client *http.Client
+
+	CACert   string
+	Cert     string
+	Insecure bool
+	Key      string
+	Output   string
+	Timeout  int
+	Token    string
+	URL      string
+}
+
+func main() {
+	err := rootCmd.Execute()
+	if err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+func init() {
+	viper.SetConfigName("cursectl") // name of config file (without extension)
+	viper.AddConfigPath("/etc/curse")
+	viper.AddConfigPath("$HOME/.cursectl/")
+	if dir, err := os.UserConfigDir(); err == nil {
+		viper.AddConfigPath(filepath.Join(dir, "cursectl"))
+	}
+	viper.ReadInConfig()
+
+	// Let the token come from the environment rather than a config file
+	viper.SetEnvPrefix("cursectl")
+	viper.BindEnv("token")
+
+	viper.SetDefault("cacert", "")
+	viper.SetDefault("cert", "")
+	viper.SetDefault("insecure", false)
+	viper.SetDefault("key", "")
+	viper.SetDefault("output", "text")
+	viper.SetDefault("timeout", 30)
+	viper.SetDefault("token", "")
+	viper.SetDefault("url", "https://127.0.0.1:8443")
+}
+
+func getConf() (*config, error) {
+	// Read config into a struct
+	var conf config
+	err := viper.Unmarshal(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to process config: %v", err)
+	}
+
+	// Verify config options
+	switch conf.Output {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("Invalid output %q (valid: text, json)", conf.Output)
+	}
+	if !strings.HasPrefix(conf.URL, "https://") {
+		return nil, fmt.Errorf("url must be an https:// URL of the cursed admin listener")
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	conf.Token, err = resolveToken(conf.Token)
+	if err != nil {
+		return nil, err
+	}
+	if (conf.Cert == "") != (conf.Key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+	if conf.Token == "" && conf.Cert == "" {
+		return nil, fmt.Errorf("token (or $CURSECTL_TOKEN), or cert and key, are required")
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.Insecure}
+	if conf.CACert != "" {
+		caPEM, err := ioutil.ReadFile(expandHome(conf.CACert))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read cacert: %v", err)
+		}
+		tlsConf, err = pinnedTLSConfig(conf.URL, caPEM)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cacert %s: %v", conf.CACert, err)
+		}
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(expandHome(conf.Cert), expandHome(conf.Key))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	conf.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConf},
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}
+
+	return &conf, nil
+}
+
+// pinnedTLSConfig trusts certificates issued by the CAs in caPEM, and also accepts the exact
+// certificates in it, since most cursed installs use a self-signed sslcert without SANs
+func pinnedTLSConfig(rawURL string, caPEM []byte) (*tls.Config, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	var pinned [][]byte
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		roots.AddCert(cert)
+		pinned = append(pinned, block.Bytes)
+	}
+	if len(pinned) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return &tls.Config{
+		// Verification is done below instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("admin listener sent no certificate")
+			}
+			for _, p := range pinned {
+				if bytes.Equal(rawCerts[0], p) {
+					return nil
+				}
+			}
+			var err error
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				certs[i], err = x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+			}
+			intermediates := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err = certs[0].Verify(x509.VerifyOptions{
+				DNSName:       u.Hostname(),
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}, nil
+}
+
+// resolveToken accepts the same env: and file: references as cursed's admintoken
+func resolveToken(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		token, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s not set", name)
+		}
+		return token, nil
+	case strings.HasPrefix(value, "file:"):
+		token, err := ioutil.ReadFile(expandHome(strings.TrimPrefix(value, "file:")))
+		if err != nil {
+			return "", fmt.Errorf("Unable to read token file: %v", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	return value, nil
+}
+
+// apiRequest calls the admin API, sending in (if any) as JSON and decoding the response into
+// out (if any)
+func apiRequest(conf *config, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, conf.URL+path, body)
+	if err != nil {
+		return fmt.Errorf("Invalid url %s: %v", conf.URL, err)
+	}
+	if conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.Token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := conf.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Admin API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var p struct {
+			Detail    string `json:"detail"`
+			RequestID string `json:"requestId"`
+		}
+		if json.Unmarshal(respBody, &p) == nil && p.Detail != "" {
+			return fmt.Errorf("%s: %s (request %s)", resp.Status, p.Detail, p.RequestID)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	switch v := out.(type) {
+	case nil:
+	case *[]byte:
+		*v = respBody
+	default:
+		err = json.Unmarshal(respBody, out)
+		if err != nil {
+			return fmt.Errorf("Failed to parse response: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func expandHome(path string) string {
+	// Swap out $HOME for the user's home dir in path (%USERPROFILE% on Windows)
+	home := os.Getenv("HOME")
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	if strings.HasPrefix(path, "$HOME") && home != "" {
+		path = filepath.Join(home, strings.TrimPrefix(path, "$HOME"))
+	}
+
+	return path
+}
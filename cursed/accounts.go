@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// accountExists reports whether the remote account a certificate is requested for exists,
+// so certificates for mistyped or decommissioned accounts are never issued. With accountcheck
+// nss that's getpwnam on this host, which must resolve the same accounts as the targets (e.g.
+// through sssd), with ldap an entry matching ldapaccountfilter
+func accountExists(ctx context.Context, conf *config, account string) (bool, error) {
+	for _, exempt := range conf.AccountCheckExempt {
+		if account == exempt {
+			return true, nil
+		}
+	}
+
+	switch conf.AccountCheck {
+	case "nss":
+		_, err := user.Lookup(account)
+		if _, unknown := err.(user.UnknownUserError); unknown {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("Account lookup for %s failed: %w", account, err)
+		}
+	case "ldap":
+		entries, err := ldapSearch(ctx, conf, fmt.Sprintf(conf.LDAPAccountFilter, ldap.EscapeFilter(account)), []string{"dn"})
+		if err != nil {
+			return false, fmt.Errorf("Account lookup for %s failed: %w", account, err)
+		}
+		return len(entries) > 0, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func serveAdmin(store *confStore) {
+	conf := store.load()
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", adminOnly(store, expvar.Handler()))
+	mux.HandleFunc("/exemptions", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		exemptionsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/keylists", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		keyListsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/overrides", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		overridesHandler(w, r, conf)
+	})
+	mux.HandleFunc("/approvals", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		approvalsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/delegations", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		delegationsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/enrollments", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		enrollmentsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/hosts", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		hostsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/hosts/", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		hostsHandler(w, r, conf)
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		revokeHandler(w, r, conf)
+	})
+	mux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		inventoryHandler(w, r, conf)
+	})
+	mux.HandleFunc("/keyages", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		keyAgesHandler(w, r, conf)
+	})
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		snapshotHandler(w, r, conf)
+	})
+	mux.HandleFunc("/prune", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		pruneHandler(w, r, conf)
+	})
+	mux.HandleFunc("/unseal", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		unsealHandler(w, r, conf)
+	})
+	mux.HandleFunc("/seal", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		sealHandler(w, r, conf)
+	})
+	mux.HandleFunc("/freeze", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		freezeHandler(w, r, conf)
+	})
+	mux.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		tasksHandler(w, r, conf)
+	})
+	mux.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		modeHandler(w, r, conf)
+	})
+	mux.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		adminTokensHandler(w, r, conf)
+	})
+	mux.HandleFunc("/tokens/rotate", func(w http.ResponseWriter, r *http.Request) {
+		conf := store.load()
+		if !checkAdminAuth(w, r, conf) {
+			return
+		}
+		adminTokenRotateHandler(w, r, conf)
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminAuth(w, r, store.load()) {
+			return
+		}
+		reloadHandler(w, r, store)
+	})
+
+	// Clients with a certificate from adminclientca don't need the token
+	srv := newServer(conf, net.JoinHostPort(conf.AdminAddr, strconv.Itoa(conf.AdminPort)), withRequestID(withHeaders(store, mux)))
+	if conf.adminClientCAs != nil {
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  conf.adminClientCAs,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	log.Printf("Starting HTTPS admin server on %s", srv.Addr)
+	err := serveTLS(conf, srv)
+	if err != nil {
+		log.Fatalf("Admin listener service: %v", err)
+	}
+}
+
+func adminOnly(store *confStore, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminAuth(w, r, store.load()) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func checkAdminAuth(w http.ResponseWriter, r *http.Request, conf *config) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if conf.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) == 1 {
+		return true
+	}
+
+	// Scoped tokens from /tokens only reach the endpoints their scopes cover
+	t, err := checkAdminToken(conf, token)
+	if err != nil {
+		log.Printf("Invalid admin credentials from %s: %v", r.RemoteAddr, err)
+		problemError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !t.allows(r) {
+		log.Printf("Admin token %s (%s) with scopes %v refused %s %s from %s", t.ID, t.Name, t.Scopes, r.Method, r.URL.Path, r.RemoteAddr)
+		problemError(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// adminIdentity names who a request checkAdminAuth let through is from: the subject of
+// their client certificate, or the name of their admin token. The shared admintoken names
+// nobody, and gets ""
+func adminIdentity(r *http.Request, conf *config) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	t, err := checkAdminToken(conf, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return ""
+	}
+	return t.Name
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminGet fetches path from our own admin listener, so subcommands can read state from
+// the running daemon, which holds the database lock
+func adminGet(conf *config, path string) ([]byte, error) {
+	if conf.AdminPort == 0 {
+		return nil, fmt.Errorf("adminport must be set to use this command")
+	}
+
+	// Pin the listener's certificate rather than trusting whatever name it was issued for
+	certPEM, err := ioutil.ReadFile(conf.SSLCert)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sslcert: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to parse sslcert")
+	}
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+					return fmt.Errorf("admin listener certificate does not match sslcert")
+				}
+				return nil
+			},
+		},
+	}
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+
+	addr := conf.AdminAddr
+	if addr == "" || addr == "0.0.0.0" {
+		addr = "127.0.0.1"
+	} else if addr == "::" {
+		addr = "::1"
+	}
+	req, err := http.NewRequest("GET", "https://"+net.JoinHostPort(addr, strconv.Itoa(conf.AdminPort))+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.AdminToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Admin API request failed (is cursed running?): %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var p problem
+		if json.Unmarshal(body, &p) == nil && p.Detail != "" {
+			return nil, fmt.Errorf("Admin API returned %s: %s (request %s)", resp.Status, p.Detail, p.RequestID)
+		}
+		return nil, fmt.Errorf("Admin API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+func printSSHFP(conf *config) error {
+	records, err := adminGet(conf, "/hosts/sshfp")
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(records)
+	return err
+}
+
+func writeKnownHosts(conf *config, file string) error {
+	body, err := adminGet(conf, "/hosts/known_hosts")
+	if err != nil {
+		return err
+	}
+	var skh signedKnownHosts
+	err = json.Unmarshal(body, &skh)
+	if err != nil {
+		return fmt.Errorf("Failed to parse known_hosts bundle: %v", err)
+	}
+
+	err = ioutil.WriteFile(file, []byte(skh.KnownHosts), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write known_hosts: %v", err)
+	}
+	err = ioutil.WriteFile(file+".sig", []byte(skh.Signature), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write known_hosts signature: %v", err)
+	}
+
+	fmt.Printf("Wrote %s and %s.sig\n", file, file)
+	caPub, err := ioutil.ReadFile(conf.CAPubKeyFile)
+	if err == nil {
+		fmt.Printf("To verify, put this line in an allowed_signers file:\n")
+		fmt.Printf("    curse-ca namespaces=%q %s\n", knownHostsNamespace, bytes.TrimSpace(caPub))
+		fmt.Printf("and run:\n")
+		fmt.Printf("    ssh-keygen -Y verify -f allowed_signers -I curse-ca -n %s -s %s.sig < %s\n", knownHostsNamespace, file, file)
+	}
+	return nil
+}
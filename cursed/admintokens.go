@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var adminTokenBucket = []byte("admintokens")
+
+// Scopes a scoped admin token can be given. audit reads every endpoint but changes nothing,
+// revoke takes certificates and keys away but can't give them back, policy manages
+// exemptions, approvals, delegations, key lists, tasks and the service mode, and admin can do
+// anything admintoken can
+const (
+	scopeAdmin  = "admin"
+	scopeAudit  = "audit"
+	scopePolicy = "policy"
+	scopeRevoke = "revoke"
+)
+
+// Endpoints each scope may use with any method. Those listed nowhere, like /snapshot, /prune,
+// /seal and /tokens itself, need admintoken, a client certificate or the admin scope. The
+// revoke scope is checked by revokeAllows instead
+var scopePaths = map[string][]string{
+	scopePolicy: {"/approvals", "/delegations", "/enrollments", "/exemptions", "/freeze", "/keylists", "/mode", "/overrides", "/reload", "/tasks"},
+}
+
+// Endpoints the audit scope may GET
+var auditPaths = []string{"/approvals", "/debug/vars", "/delegations", "/enrollments", "/exemptions", "/freeze", "/hosts", "/inventory", "/keyages", "/keylists", "/mode", "/overrides", "/revoke", "/tasks", "/unseal"}
+
+// adminToken is an admin API credential limited to some scopes, expiring, and rotatable
+// without downtime: after a rotation the previous secret keeps working for a grace period
+type adminToken struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Rotated *time.Time `json:"rotated,omitempty"`
+	Expires time.Time  `json:"expires"`
+	// Only hashes of the secrets are stored. The token itself is returned once, when it's
+	// created or rotated
+	SecretHash      string     `json:"secretHash,omitempty"`
+	PreviousHash    string     `json:"previousHash,omitempty"`
+	PreviousExpires *time.Time `json:"previousExpires,omitempty"`
+	Token           string     `json:"token,omitempty"`
+}
+
+var errAdminTokenNotFound = fmt.Errorf("Admin token not found")
+
+func validScope(scope string) bool {
+	switch scope {
+	case scopeAdmin, scopeAudit, scopePolicy, scopeRevoke:
+		return true
+	}
+	return false
+}
+
+func matchPath(paths []string, p string) bool {
+	for _, prefix := range paths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the token's scopes cover a request
+func (t *adminToken) allows(r *http.Request) bool {
+	for _, scope := range t.Scopes {
+		switch {
+		case scope == scopeAdmin:
+			return true
+		case scope == scopeAudit && (r.Method == http.MethodGet || r.Method == http.MethodHead) && matchPath(auditPaths, r.URL.Path):
+			return true
+		case scope == scopeRevoke && revokeAllows(r):
+			return true
+		case matchPath(scopePaths[scope], r.URL.Path):
+			return true
+		}
+	}
+	return false
+}
+
+// revokeAllows reports whether a request only takes something away: revoking certificates,
+// freezing issuance or denylisting a key. Lifting a freeze, allowlisting and removing key
+// list entries give access back, and need the policy scope
+func revokeAllows(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	switch r.URL.Path {
+	case "/freeze", "/revoke":
+		return true
+	case "/keylists":
+		return requestedKeyList(r) == keyListDeny
+	}
+	return false
+}
+
+// requestedKeyList reads which list a key list entry is for, leaving the body for
+// keyListsHandler. Bodies too large for it are read only as far as its limit
+func requestedKeyList(r *http.Request) string {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16+1))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+	var e keyListEntry
+	if json.Unmarshal(body, &e) != nil {
+		return ""
+	}
+	return e.List
+}
+
+// checkAdminToken finds the scoped token matching a bearer token (ID.secret), current or
+// still within its rotation grace period
+func checkAdminToken(conf *config, token string) (*adminToken, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || conf.db == nil {
+		return nil, errAdminTokenNotFound
+	}
+	var t *adminToken
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(adminTokenBucket)
+		if bucket == nil {
+			return errAdminTokenNotFound
+		}
+		var err error
+		t, err = readAdminToken(bucket, parts[0])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	hash := []byte(hashDelegationSecret(parts[1]))
+	switch {
+	case !now.Before(t.Expires):
+		return nil, fmt.Errorf("Admin token %s expired at %s", t.ID, t.Expires.Format(time.RFC3339))
+	case subtle.ConstantTimeCompare(hash, []byte(t.SecretHash)) == 1:
+		return t, nil
+	case t.PreviousHash != "" && t.PreviousExpires != nil && now.Before(*t.PreviousExpires) &&
+		subtle.ConstantTimeCompare(hash, []byte(t.PreviousHash)) == 1:
+		return t, nil
+	}
+	return nil, errAdminTokenNotFound
+}
+
+// newAdminSecret returns a fresh secret and its hash
+func newAdminSecret() (string, string, error) {
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	s := hex.EncodeToString(secret)
+	return s, hashDelegationSecret(s), nil
+}
+
+func adminTokensHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := listAdminTokens(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tokens)
+	case http.MethodPost:
+		var t adminToken
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&t)
+		if err != nil {
+			problemError(w, "Unable to parse admin token", http.StatusBadRequest)
+			return
+		}
+		if t.Name == "" || len(t.Scopes) == 0 {
+			problemError(w, "name and scopes are required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range t.Scopes {
+			if !validScope(scope) {
+				problemError(w, fmt.Sprintf("Unknown scope %q, expected admin, audit, policy or revoke", scope), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		maxExpires := now.Add(time.Duration(conf.AdminTokenMaxTTL) * time.Second)
+		if !t.Expires.After(now) || t.Expires.After(maxExpires) {
+			problemError(w, fmt.Sprintf("expires must be in the future and at most %ds away (admintokenmaxttl)", conf.AdminTokenMaxTTL), http.StatusBadRequest)
+			return
+		}
+
+		id := make([]byte, 8)
+		_, err = rand.Read(id)
+		secret, hash := "", ""
+		if err == nil {
+			secret, hash, err = newAdminSecret()
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		t.ID = hex.EncodeToString(id)
+		t.SecretHash = hash
+		t.Created = now
+		t.Rotated, t.PreviousHash, t.PreviousExpires, t.Token = nil, "", nil, ""
+
+		err = conf.db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(adminTokenBucket)
+			if err != nil {
+				return err
+			}
+			return putAdminToken(bucket, t)
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Admin token %s (%s) created with scopes %v until %s", t.ID, t.Name, t.Scopes, t.Expires.Format(time.RFC3339))
+		conf.webhooks.send(auditEvent{
+			Event:   "admin_token_created",
+			Message: fmt.Sprintf("Admin token %s (%s) with scopes %s", t.ID, t.Name, strings.Join(t.Scopes, ",")),
+		})
+		t.SecretHash = ""
+		t.Token = t.ID + "." + secret
+		writeJSON(w, t)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		err := conf.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(adminTokenBucket)
+			if bucket == nil || bucket.Get([]byte(id)) == nil {
+				return errAdminTokenNotFound
+			}
+			return bucket.Delete([]byte(id))
+		})
+		if err == errAdminTokenNotFound {
+			problemError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin token %s deleted", id)
+		conf.webhooks.send(auditEvent{Event: "admin_token_deleted", Message: "Admin token " + id})
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminTokenRotateHandler gives a token a new secret and a new expiry as far off as the
+// last one was. The old secret keeps working for grace seconds, so whatever uses it can be
+// moved over first
+func adminTokenRotateHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID    string `json:"id"`
+		Grace int    `json:"grace"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		problemError(w, "Unable to parse rotation request", http.StatusBadRequest)
+		return
+	}
+	if req.Grace < 0 || req.Grace > conf.AdminTokenMaxTTL {
+		problemError(w, fmt.Sprintf("grace must be between 0 and %ds (admintokenmaxttl)", conf.AdminTokenMaxTTL), http.StatusBadRequest)
+		return
+	}
+	secret, hash, err := newAdminSecret()
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var t *adminToken
+	err = conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(adminTokenBucket)
+		if bucket == nil {
+			return errAdminTokenNotFound
+		}
+		var err error
+		t, err = readAdminToken(bucket, req.ID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		issued := t.Created
+		if t.Rotated != nil {
+			issued = *t.Rotated
+		}
+		lifetime := t.Expires.Sub(issued)
+		if max := time.Duration(conf.AdminTokenMaxTTL) * time.Second; lifetime > max {
+			lifetime = max
+		}
+		t.PreviousHash, t.PreviousExpires = "", nil
+		if req.Grace > 0 {
+			previousExpires := now.Add(time.Duration(req.Grace) * time.Second)
+			if previousExpires.After(t.Expires) {
+				previousExpires = t.Expires
+			}
+			t.PreviousHash, t.PreviousExpires = t.SecretHash, &previousExpires
+		}
+		t.SecretHash = hash
+		t.Rotated = &now
+		t.Expires = now.Add(lifetime)
+		return putAdminToken(bucket, *t)
+	})
+	if err == errAdminTokenNotFound {
+		problemError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin token %s (%s) rotated, previous secret valid for %ds", t.ID, t.Name, req.Grace)
+	conf.webhooks.send(auditEvent{
+		Event:   "admin_token_rotated",
+		Message: fmt.Sprintf("Admin token %s (%s)", t.ID, t.Name),
+	})
+	t.SecretHash, t.PreviousHash = "", ""
+	t.Token = t.ID + "." + secret
+	writeJSON(w, t)
+}
+
+func readAdminToken(bucket *bolt.Bucket, id string) (*adminToken, error) {
+	val := bucket.Get([]byte(id))
+	if val == nil {
+		return nil, errAdminTokenNotFound
+	}
+	t := &adminToken{}
+	err := json.Unmarshal(val, t)
+	if err != nil {
+		return nil, fmt.Errorf("Admin token record %s corrupted: %v", id, err)
+	}
+
+	return t, nil
+}
+
+func putAdminToken(bucket *bolt.Bucket, t adminToken) error {
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(t.ID), val)
+}
+
+func listAdminTokens(conf *config) ([]adminToken, error) {
+	tokens := make([]adminToken, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(adminTokenBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var t adminToken
+			err := json.Unmarshal(v, &t)
+			if err != nil {
+				return fmt.Errorf("Admin token record %s corrupted: %v", k, err)
+			}
+			t.SecretHash, t.PreviousHash = "", ""
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+
+	return tokens, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// scopedTokenConf returns a config whose database holds one token with scopes, and the
+// bearer token for it
+func scopedTokenConf(t *testing.T, scopes ...string) (*config, string) {
+	dir, err := ioutil.TempDir("", "cursed-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := bolt.Open(filepath.Join(dir, "cursed.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	secret, hash, err := newAdminSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := adminToken{ID: "0123456789abcdef", Name: "test", Scopes: scopes, SecretHash: hash, Expires: time.Now().Add(time.Hour)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(adminTokenBucket)
+		if err != nil {
+			return err
+		}
+		return putAdminToken(bucket, tok)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config{db: db}, tok.ID + "." + secret
+}
+
+// TestRevokeScopeCantRestore checks a revoke token can take access away but gets 403 on
+// everything that would give it back
+func TestRevokeScopeCantRestore(t *testing.T) {
+	conf, token := scopedTokenConf(t, scopeRevoke)
+	policyConf, policyToken := scopedTokenConf(t, scopePolicy)
+
+	cases := []struct {
+		method, path, body string
+		allowed            bool
+	}{
+		{http.MethodPost, "/revoke", `{"user":"alice","reason":"left"}`, true},
+		{http.MethodPost, "/freeze", `{"reason":"incident","by":"sec"}`, true},
+		{http.MethodPost, "/keylists", `{"fingerprint":"SHA256:x","list":"deny","reason":"leaked"}`, true},
+		{http.MethodPost, "/keylists", `{"fingerprint":"SHA256:x","list":"allow","reason":"vendor"}`, false},
+		{http.MethodPost, "/keylists", `{"fingerprint":"SHA256:x","reason":"no list"}`, false},
+		{http.MethodPost, "/keylists", `not json`, false},
+		{http.MethodDelete, "/keylists?fingerprint=SHA256:x", "", false},
+		{http.MethodDelete, "/freeze", `{"reason":"over","by":"sec"}`, false},
+		{http.MethodDelete, "/revoke", "", false},
+		{http.MethodPost, "/exemptions", `{}`, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		ok := checkAdminAuth(w, r, conf)
+		switch {
+		case c.allowed && !ok:
+			t.Errorf("revoke scope refused %s %s %s: %d", c.method, c.path, c.body, w.Code)
+		case !c.allowed && ok:
+			t.Errorf("revoke scope allowed %s %s %s", c.method, c.path, c.body)
+		case !c.allowed && w.Code != http.StatusForbidden:
+			t.Errorf("%s %s %s got %d, want 403", c.method, c.path, c.body, w.Code)
+		}
+		if ok {
+			// The handler must still see the whole body
+			b, _ := ioutil.ReadAll(r.Body)
+			if string(b) != c.body {
+				t.Errorf("%s %s body left as %q, want %q", c.method, c.path, b, c.body)
+			}
+		}
+	}
+
+	// Giving access back is policy's job
+	for _, c := range cases[3:9] {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer "+policyToken)
+		w := httptest.NewRecorder()
+		if c.path != "/revoke" && !checkAdminAuth(w, r, policyConf) {
+			t.Errorf("policy scope refused %s %s: %d", c.method, c.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var approvalBucket = []byte("approvals")
+
+// Set on responses to requests held for approval, with the approval ID
+const approvalHeader = "X-Curse-Approval"
+
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalUsed     = "used"
+)
+
+// approval records a signing request held for a human sign-off. Once approved, the same
+// user resubmitting the same key for the same principal gets their certificate
+type approval struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint"`
+	Principal   string    `json:"principal"`
+	Reason      string    `json:"reason"`
+	Status      string    `json:"status"`
+	Approver    string    `json:"approver,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// checkApproval returns the latest matching request, creating a pending one if there is
+// none. An approved request is only used up by consumeApproval, once its certificate is signed
+func checkApproval(conf *config, user, fp, principal, reason string) (*approval, error) {
+	var found *approval
+	created := false
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(approvalBucket)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err = bucket.ForEach(func(k, v []byte) error {
+			var ap approval
+			err := unmarshalRecord(conf, approvalBucket, k, v, &ap)
+			if err != nil {
+				return fmt.Errorf("Approval record %s corrupted: %v", k, err)
+			}
+			if ap.User != user || ap.Fingerprint != fp || ap.Principal != principal ||
+				ap.Status == approvalUsed || now.After(ap.Expires) {
+				return nil
+			}
+			if found == nil || ap.Created.After(found.Created) {
+				found = &ap
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if found != nil {
+			return nil
+		}
+
+		id := make([]byte, 8)
+		_, err = rand.Read(id)
+		if err != nil {
+			return err
+		}
+		found = &approval{
+			ID:          hex.EncodeToString(id),
+			User:        user,
+			Fingerprint: fp,
+			Principal:   principal,
+			Reason:      reason,
+			Status:      approvalPending,
+			Created:     now,
+			Expires:     now.Add(time.Duration(conf.ApprovalTTL) * time.Second),
+		}
+		created = true
+		return putApproval(conf, bucket, *found)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		log.Printf("Approval %s requested: user[%s] principal[%s] sshKey[%s] %s", found.ID, user, principal, fp, reason)
+		conf.webhooks.send(auditEvent{
+			Event:       "approval_requested",
+			User:        user,
+			Fingerprint: fp,
+			Principals:  []string{principal},
+			Approval:    found.ID,
+			Message:     reason,
+		})
+	}
+
+	return found, nil
+}
+
+// consumeApproval marks approval id used, failing if another request used it first. An
+// approval is good for one certificate
+func consumeApproval(conf *config, id string) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalBucket)
+		if bucket == nil {
+			return errApprovalNotFound
+		}
+		val := bucket.Get([]byte(id))
+		if val == nil {
+			return errApprovalNotFound
+		}
+		var ap approval
+		err := unmarshalRecord(conf, approvalBucket, []byte(id), val, &ap)
+		if err != nil {
+			return fmt.Errorf("Approval record %s corrupted: %v", id, err)
+		}
+		if ap.Status != approvalApproved {
+			return denyf(reasonPrincipalDenied, "Approval %s was already used", id)
+		}
+		ap.Status = approvalUsed
+		return putApproval(conf, bucket, ap)
+	})
+}
+
+func putApproval(conf *config, bucket *bolt.Bucket, ap approval) error {
+	val, err := marshalRecord(conf, approvalBucket, []byte(ap.ID), ap)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(ap.ID), val)
+}
+
+func approvalsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		approvals, err := listApprovals(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, approvals)
+	case http.MethodPost:
+		var req struct {
+			ID       string `json:"id"`
+			Approve  bool   `json:"approve"`
+			Approver string `json:"approver"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			problemError(w, "Unable to parse approval", http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" {
+			problemError(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		// The approver is whoever the admin credential belongs to, so nobody can sign off their
+		// own request under another name
+		approver := adminIdentity(r, conf)
+		if approver == "" {
+			problemError(w, "Approvals need a credential naming the approver: a client certificate or an admin token", http.StatusForbidden)
+			return
+		}
+		if req.Approver != "" && req.Approver != approver {
+			problemError(w, fmt.Sprintf("approver %q doesn't match your credential (%s)", req.Approver, approver), http.StatusForbidden)
+			return
+		}
+
+		ap, err := decideApproval(conf, req.ID, req.Approve, approver)
+		switch err {
+		case nil:
+		case errApprovalNotFound:
+			problemError(w, err.Error(), http.StatusNotFound)
+			return
+		case errApprovalNotPending, errSelfApproval:
+			problemError(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Approval %s %s by %s: user[%s] principal[%s]", ap.ID, ap.Status, ap.Approver, ap.User, ap.Principal)
+		conf.webhooks.send(auditEvent{
+			Event:       "approval_" + ap.Status,
+			User:        ap.User,
+			Fingerprint: ap.Fingerprint,
+			Principals:  []string{ap.Principal},
+			Approval:    ap.ID,
+			Message:     "by " + ap.Approver,
+		})
+		writeJSON(w, ap)
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var (
+	errApprovalNotFound   = fmt.Errorf("Approval not found")
+	errApprovalNotPending = fmt.Errorf("Approval is no longer pending")
+	errSelfApproval       = fmt.Errorf("Users cannot approve their own requests")
+)
+
+func decideApproval(conf *config, id string, approve bool, approver string) (*approval, error) {
+	var ap approval
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalBucket)
+		if bucket == nil {
+			return errApprovalNotFound
+		}
+		val := bucket.Get([]byte(id))
+		if val == nil {
+			return errApprovalNotFound
+		}
+		err := unmarshalRecord(conf, approvalBucket, []byte(id), val, &ap)
+		if err != nil {
+			return fmt.Errorf("Approval record %s corrupted: %v", id, err)
+		}
+		if ap.Status != approvalPending || time.Now().After(ap.Expires) {
+			return errApprovalNotPending
+		}
+		if ap.User == approver {
+			return errSelfApproval
+		}
+
+		ap.Approver = approver
+		ap.Status = approvalRejected
+		if approve {
+			ap.Status = approvalApproved
+		}
+		return putApproval(conf, bucket, ap)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ap, nil
+}
+
+func listApprovals(conf *config) ([]approval, error) {
+	approvals := make([]approval, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var ap approval
+			err := unmarshalRecord(conf, approvalBucket, k, v, &ap)
+			if err != nil {
+				return fmt.Errorf("Approval record %s corrupted: %v", k, err)
+			}
+			if ap.Expires.After(time.Now()) {
+				approvals = append(approvals, ap)
+			}
+			return nil
+		})
+	})
+
+	return approvals, err
+}
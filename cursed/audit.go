@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// auditContext is what's known so far about the request being handled. It travels in the
+// request's context from the handler through validation, policy and signing, so every log
+// line and audit event for the request names the same request ID, users, addresses and key
+// without each call site spelling them out
+type auditContext struct {
+	mu          sync.Mutex
+	request     string
+	user        string
+	remoteUser  string
+	userIP      string
+	bastionIP   string
+	fingerprint string
+	keyID       string
+	// Labels for the tenants metrics, not logged
+	tenant string
+	policy string
+}
+
+type auditKey struct{}
+
+// withAudit starts the audit context for a signing request, unless ctx already has one
+func withAudit(ctx context.Context, p httpParams) context.Context {
+	if ctx.Value(auditKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, auditKey{}, &auditContext{
+		request:    requestID(ctx),
+		user:       p.bastionUser,
+		remoteUser: p.remoteUser,
+		userIP:     p.userIP,
+		bastionIP:  p.bastionIP,
+		tenant:     p.tenant,
+	})
+}
+
+// auditFrom returns ctx's audit context. Requests turned away before there is one, e.g. for
+// failed authentication, get one with just the request ID
+func auditFrom(ctx context.Context) *auditContext {
+	if a, ok := ctx.Value(auditKey{}).(*auditContext); ok {
+		return a
+	}
+	return &auditContext{request: requestID(ctx)}
+}
+
+// note records the user and key once they're known. Empty values change nothing
+func (a *auditContext) note(user, fp, keyID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if user != "" {
+		a.user = user
+	}
+	if fp != "" {
+		a.fingerprint = fp
+	}
+	if keyID != "" {
+		a.keyID = keyID
+	}
+}
+
+// notePolicy records the tier or other policy the request falls under, empty for none
+func (a *auditContext) notePolicy(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = name
+}
+
+// String formats the fields known so far like the rest of our log lines, e.g.
+// request[...] user[alice] remoteUser[root] sshKey[...]
+func (a *auditContext) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var b strings.Builder
+	for _, f := range []struct{ name, val string }{
+		{"request", a.request},
+		{"user", a.user},
+		{"remoteUser", a.remoteUser},
+		{"userIP", a.userIP},
+		{"bastionIP", a.bastionIP},
+		{"sshKey", a.fingerprint},
+		{"keyId", a.keyID},
+	} {
+		if f.val == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s[%s]", f.name, f.val)
+	}
+	return b.String()
+}
+
+// event fills in the request, user and key of an audit event from the context
+func (a *auditContext) event(ev auditEvent) auditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ev.Request = a.request
+	if ev.User == "" {
+		ev.User = a.user
+	}
+	if ev.Fingerprint == "" {
+		ev.Fingerprint = a.fingerprint
+	}
+	return ev
+}
+
+// logf logs a line about the request ctx belongs to, followed by its audit fields
+func logf(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if fields := auditFrom(ctx).String(); fields != "" {
+		msg += " " + fields
+	}
+	log.Print(msg)
+}
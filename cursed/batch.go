@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type batchRequest struct {
+	CertType   string     `json:"certType"`
+	BastionIP  string     `json:"bastionIP"`
+	BreakGlass bool       `json:"breakGlass"`
+	Cmd        string     `json:"cmd"`
+	RemoteUser string     `json:"remoteUser"`
+	UserIP     string     `json:"userIP"`
+	Keys       []batchKey `json:"keys"`
+}
+
+type batchKey struct {
+	Key        string   `json:"key"`
+	KeyBlob    string   `json:"keyBlob"`
+	KeySig     string   `json:"keySig"`
+	KeyTime    string   `json:"keyTime"`
+	Principals []string `json:"principals"`
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	release, ok := limitIP(w, r, conf)
+	if !ok {
+		return
+	}
+	defer release()
+	bastionUser, identity, ok := authenticate(w, r, conf)
+	if !ok {
+		return
+	}
+	releaseUser, ok := limitUser(w, r, conf, bastionUser)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Decode our shared parameters and list of keys
+	var br batchRequest
+	body, err := requestBody(r)
+	if err != nil {
+		problemError(w, "Unable to decompress batch request", http.StatusBadRequest)
+		return
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, body, 1<<20)).Decode(&br)
+	if err != nil {
+		problemError(w, "Unable to parse batch request", http.StatusBadRequest)
+		return
+	}
+	if len(br.Keys) == 0 {
+		deny(w, r, conf, reasonBadRequest, bastionUser, "No keys in batch request", http.StatusBadRequest)
+		return
+	}
+	if len(br.Keys) > conf.MaxBatchSize {
+		errMsg := fmt.Sprintf("Batch too large: %d keys (max %d)", len(br.Keys), conf.MaxBatchSize)
+		deny(w, r, conf, reasonQuota, bastionUser, errMsg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var certType uint32
+	switch br.CertType {
+	case "", "user":
+		certType = ssh.UserCert
+	case "host":
+		if !conf.AllowHostCerts {
+			deny(w, r, conf, reasonPrincipalDenied, bastionUser, "Host certificates are disabled", http.StatusForbidden)
+			return
+		}
+		certType = ssh.HostCert
+	default:
+		problemError(w, "Invalid certType", http.StatusBadRequest)
+		return
+	}
+
+	// Sign each key independently so one bad key doesn't fail the whole batch
+	results := make([]signResult, len(br.Keys))
+	for i, bk := range br.Keys {
+		key, err := submittedKey(bk.Key, bk.KeyBlob)
+		if err != nil {
+			logDenial(r.Context(), conf, reasonBadKey, bastionUser, "", err.Error())
+			results[i] = signResult{Error: err.Error(), Reason: reasonBadKey}
+			continue
+		}
+		bk.Key = key
+		if certType == ssh.HostCert {
+			results[i] = signHostKey(r.Context(), conf, httpParams{bastionUser: bastionUser, breakGlass: br.BreakGlass, identity: identity}, bk)
+		} else {
+			p := httpParams{
+				identity:    identity,
+				asn:         asnAsserted(r, conf),
+				bastionIP:   br.BastionIP,
+				bastionUser: bastionUser,
+				breakGlass:  br.BreakGlass,
+				cmd:         br.Cmd,
+				key:         bk.Key,
+				keySig:      bk.KeySig,
+				keyTime:     bk.KeyTime,
+				mfa:         mfaAsserted(r, conf),
+				remoteUser:  br.RemoteUser,
+				tenant:      tenantAsserted(r, conf),
+				userIP:      br.UserIP,
+			}
+			results[i] = signUserKey(r.Context(), conf, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []signResult `json:"results"`
+	}{results})
+}
+
+func signHostKey(ctx context.Context, conf *config, p httpParams, bk batchKey) (res signResult) {
+	bastionUser := p.bastionUser
+	ctx = withAudit(ctx, httpParams{bastionUser: bastionUser})
+	auditFrom(ctx).notePolicy(hostPolicy)
+	err := clockDenial(conf)
+	if err != nil {
+		logDenial(ctx, conf, reasonClockSkew, bastionUser, "", err.Error())
+		return signResult{Error: err.Error(), Reason: reasonClockSkew}
+	}
+
+	va := conf.clock.Now()
+	vb := va.Add(conf.hostDur)
+
+	pk, err := parseSubmittedKey(bk.Key)
+	if err != nil {
+		logf(ctx, "Rejected batch key %.64q: %v", bk.Key, err)
+		logDenial(ctx, conf, reasonBadKey, bastionUser, "", err.Error())
+		return signResult{Error: err.Error(), Reason: reasonBadKey}
+	}
+	fp := ssh.FingerprintLegacyMD5(pk)
+
+	keyID := fmt.Sprintf("host%v requestedBy[%s] sshKey[%s] valid to[%s]",
+		bk.Principals, bastionUser, fp, vb.Format(time.RFC3339))
+	auditFrom(ctx).note("", fp, keyID)
+	rl := logRequest(conf, "host", "Batch request: |%s|", keyID)
+	defer func() { rl.finish(res.Error != "") }()
+
+	if bastionUser == "" || !conf.userRegex.MatchString(bastionUser) {
+		logDenial(ctx, conf, reasonBadUser, bastionUser, fp, "Param validation failure: username is invalid")
+		return signResult{Fingerprint: fp, Error: "Param validation failure: username is invalid", Reason: reasonBadUser}
+	}
+	if len(bk.Principals) == 0 {
+		logDenial(ctx, conf, reasonBadRequest, bastionUser, fp, "Param validation failure: principals missing from request")
+		return signResult{Fingerprint: fp, Error: "Param validation failure: principals missing from request", Reason: reasonBadRequest}
+	}
+
+	// Only hostcertrequesters may pose as hosts, and only as the ones they're granted
+	err = checkHostCertRequester(ctx, conf, p, bk.Principals)
+	if _, denied := err.(*denial); denied {
+		logDenial(ctx, conf, reasonPrincipalDenied, bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied}
+	}
+	if err != nil {
+		return lookupFailed(ctx, fp, err)
+	}
+
+	// A certificate for the CA's own host would let its holder pose as the CA
+	err = checkInfra(ctx, conf, bastionUser, fp, true, p.breakGlass, bk.Principals...)
+	if err != nil {
+		logDenial(ctx, conf, reasonInfraPrincipal, bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonInfraPrincipal}
+	}
+
+	// The allowlist is for user keys, but leaked host keys are blocked all the same
+	err = checkKeyLists(conf, pk, false)
+	if _, denied := err.(*denial); denied {
+		logDenial(ctx, conf, reasonOf(err), bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonOf(err)}
+	}
+	if err != nil {
+		logf(ctx, "%v", err)
+		return signResult{Fingerprint: fp, Error: "Server error"}
+	}
+
+	// Host certificates carry no critical options, and no extensions but the metadata
+	cc := certConfig{
+		certType:    ssh.HostCert,
+		extensions:  withMetadata(ctx, conf, nil),
+		keyID:       keyID,
+		principals:  bk.Principals,
+		validAfter:  va,
+		validBefore: vb,
+	}
+	cc.serial, err = conf.lease.serial()
+	if err != nil {
+		logf(ctx, "Not signing host key: %v", err)
+		return signResult{Fingerprint: fp, Error: "CA backend is unavailable, try again shortly", Reason: reasonCAUnavailable}
+	}
+	authorizedKey, err := signPubKey(ctx, conf.caSigner, pk, cc)
+	if err == errCAUnavailable {
+		return signResult{Fingerprint: fp, Error: "CA backend is unavailable, try again shortly", Reason: reasonCAUnavailable}
+	}
+	if err != nil {
+		return lookupFailed(ctx, fp, err)
+	}
+
+	err = recordIssued(conf, bastionUser, pk, cc)
+	if err != nil {
+		logf(ctx, "Unable to record certificate: %v", err)
+	}
+
+	// Remember the host so we can publish SSHFP records and known_hosts for it
+	err = recordHost(conf, pk, bk.Principals, vb)
+	if err != nil {
+		logf(ctx, "Unable to record host certificate: %v", err)
+	}
+
+	countRequest(conf, auditFrom(ctx), "issued")
+	ev := auditFrom(ctx).event(auditEvent{
+		Event:       "issued",
+		KeyID:       keyID,
+		Principals:  cc.principals,
+		ValidBefore: &vb,
+	})
+	conf.decisions.record(ev)
+	err = conf.webhooks.send(ev)
+	if err != nil && conf.AuditStrict {
+		logf(ctx, "Refusing to issue certificate, audit event not persisted: %v", err)
+		return signResult{Fingerprint: fp, Error: "Audit log unavailable"}
+	}
+
+	return signResult{Fingerprint: fp, Certificate: string(authorizedKey)}
+}
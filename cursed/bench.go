@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// benchResult is what `cursed bench` prints, for capacity planning and for CI to compare
+// against a performance budget
+type benchResult struct {
+	Target      string       `json:"target"`
+	Signer      string       `json:"signer,omitempty"`
+	CAKeyType   string       `json:"caKeyType,omitempty"`
+	Concurrency int          `json:"concurrency"`
+	Seconds     float64      `json:"seconds"`
+	Requests    int          `json:"requests"`
+	Errors      int          `json:"errors"`
+	PerSecond   float64      `json:"perSecond"`
+	Latency     benchLatency `json:"latencyMs"`
+	FirstError  string       `json:"firstError,omitempty"`
+}
+
+type benchLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Throwaway user keys, made up front so generating them isn't what gets measured
+const benchKeys = 64
+
+// runBench issues certificates as fast as -c workers can for -d and prints the throughput and
+// latency as JSON. By default it signs in process with the CA signer cursed.yaml configures,
+// the key file or the agent holding it on a hardware token, which is the ceiling whatever
+// sits in front. With -url it loads a running server end to end instead, through the
+// reverse proxy or straight at cursed with proxyuser and proxypass, so the database, audit
+// log and policy are included. Those certificates are real: point it at staging
+func runBench(conf *config, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	concurrency := fs.Int("c", 8, "concurrent requests")
+	duration := fs.Duration("d", 10*time.Second, "how long to run")
+	target := fs.String("url", "", "signing endpoint to load end to end, instead of the CA signer")
+	users := fs.Int("users", 1, "spread -url requests over this many users (bench-1, bench-2...) to stay under per-user limits")
+	principal := fs.String("principal", "bench", "principal to request")
+	maxP99 := fs.Duration("max-p99", 0, "fail if the 99th percentile latency is above this")
+	minRate := fs.Float64("min-rate", 0, "fail if fewer certificates than this are issued per second")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *duration <= 0 || *users < 1 {
+		return fmt.Errorf("-c, -d and -users must be positive")
+	}
+
+	keys := make([]ssh.PublicKey, benchKeys)
+	for i := range keys {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			keys[i], err = ssh.NewPublicKey(pub)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	res := benchResult{Target: "signer", Concurrency: *concurrency}
+	var issue func(n int) error
+	if *target == "" {
+		signer, name, err := benchSigner(conf)
+		if err != nil {
+			return err
+		}
+		res.Signer, res.CAKeyType = name, signer.PublicKey().Type()
+		issue = func(n int) error {
+			now := time.Now()
+			_, err := signPubKey(context.Background(), signer, keys[n%benchKeys], certConfig{
+				certType:    ssh.UserCert,
+				extensions:  conf.exts,
+				keyID:       fmt.Sprintf("bench[%d]", n),
+				principals:  []string{*principal},
+				validAfter:  now,
+				validBefore: now.Add(time.Minute),
+			})
+			return err
+		}
+	} else {
+		res.Target = *target
+		client := &http.Client{Timeout: 30 * time.Second}
+		issue = func(n int) error {
+			form := url.Values{}
+			form.Set("key", authorizedKey(keys[n%benchKeys]))
+			form.Set("remoteUser", *principal)
+			form.Set("userIP", "127.0.0.1")
+			req, err := http.NewRequest("POST", *target, strings.NewReader(form.Encode()))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set(conf.UserHeader, fmt.Sprintf("bench-%d", n%*users+1))
+			req.SetBasicAuth(conf.ProxyUser, conf.ProxyPass)
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s %s", resp.Status, resp.Header.Get(reasonHeader))
+			}
+			return nil
+		}
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var mine []time.Duration
+			var errs int
+			var first error
+			for n := w; time.Now().Before(deadline); n += *concurrency {
+				t := time.Now()
+				err := issue(n)
+				if err != nil {
+					errs++
+					if first == nil {
+						first = err
+					}
+					continue
+				}
+				mine = append(mine, time.Since(t))
+			}
+			mu.Lock()
+			latencies = append(latencies, mine...)
+			res.Errors += errs
+			if first != nil && res.FirstError == "" {
+				res.FirstError = first.Error()
+			}
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.Seconds = elapsed.Seconds()
+	res.Requests = len(latencies) + res.Errors
+	res.PerSecond = float64(len(latencies)) / elapsed.Seconds()
+	if len(latencies) > 0 {
+		res.Latency = benchLatency{
+			P50: percentile(latencies, 50),
+			P90: percentile(latencies, 90),
+			P99: percentile(latencies, 99),
+			Max: float64(latencies[len(latencies)-1]) / float64(time.Millisecond),
+		}
+	}
+
+	err = printIndented(res)
+	if err != nil {
+		return err
+	}
+	log.Printf("%.0f certificates/s, p99 %.1fms, %d errors", res.PerSecond, res.Latency.P99, res.Errors)
+	if len(latencies) == 0 {
+		return fmt.Errorf("No certificates issued: %s", res.FirstError)
+	}
+	if *maxP99 > 0 && res.Latency.P99 > float64(*maxP99)/float64(time.Millisecond) {
+		return fmt.Errorf("p99 latency %.1fms is over the %s budget", res.Latency.P99, *maxP99)
+	}
+	if *minRate > 0 && res.PerSecond < *minRate {
+		return fmt.Errorf("%.0f certificates/s is under the %.0f/s budget", res.PerSecond, *minRate)
+	}
+	return nil
+}
+
+// benchSigner loads the CA signer as the daemon would, naming where it signs
+func benchSigner(conf *config) (ssh.Signer, string, error) {
+	switch {
+	case conf.CAAgentSocket != "":
+		signer, err := loadAgentSigner(conf.CAAgentSocket, conf.CAPubKeyFile)
+		return signer, "caagentsocket " + conf.CAAgentSocket, err
+	case conf.SealedCAKeyFile != "":
+		return nil, "", fmt.Errorf("The CA key is sealed, bench a running, unsealed cursed with -url")
+	}
+	signer, err := loadCAKey(conf.CAKeyFile)
+	return signer, "cakeyfile", err
+}
+
+// percentile returns the pth percentile of sorted latencies in milliseconds
+func percentile(sorted []time.Duration, p int) float64 {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The benchmarks sign in parallel as cursed does under load, one per CA signer, so they can
+// be compared without a running server:
+//
+//	go test -run '^$' -bench Sign -cpu 1,4,8 ./cursed
+//
+// BenchmarkSignAgent uses an in-process agent. To measure a KMS or HSM behind its agent,
+// point CURSE_BENCH_AGENT_SOCKET at the agent and CURSE_BENCH_CA_PUB at the CA public key
+
+func benchUserKey(b *testing.B) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return pk
+}
+
+func benchSign(b *testing.B, signer ssh.Signer) {
+	pk := benchUserKey(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			now := time.Now()
+			_, err := signPubKey(context.Background(), signer, pk, certConfig{
+				certType:    ssh.UserCert,
+				extensions:  map[string]string{"permit-pty": ""},
+				keyID:       fmt.Sprintf("bench[%d]", n),
+				principals:  []string{"bench"},
+				validAfter:  now,
+				validBefore: now.Add(time.Minute),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			n++
+		}
+	})
+}
+
+func benchLocalSigner(b *testing.B, key crypto.Signer) ssh.Signer {
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return signer
+}
+
+func BenchmarkSignLocalEd25519(b *testing.B) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchSign(b, benchLocalSigner(b, key))
+}
+
+func BenchmarkSignLocalECDSA(b *testing.B) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchSign(b, benchLocalSigner(b, key))
+}
+
+func BenchmarkSignLocalRSA(b *testing.B) {
+	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchSign(b, benchLocalSigner(b, key))
+}
+
+// BenchmarkSignAgent signs through loadAgentSigner, a connection to the agent per signature
+// as with caagentsocket
+func BenchmarkSignAgent(b *testing.B) {
+	socket, pubFile := os.Getenv("CURSE_BENCH_AGENT_SOCKET"), os.Getenv("CURSE_BENCH_CA_PUB")
+	if socket == "" {
+		dir, err := ioutil.TempDir("", "curse-bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		socket, pubFile = benchAgent(b, dir)
+	}
+
+	signer, err := loadAgentSigner(socket, pubFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchSign(b, signer)
+}
+
+// benchAgent serves an agent holding a fresh ed25519 CA key in dir, returning its socket and
+// the file with the key's public half
+func benchAgent(b *testing.B, dir string) (string, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer := benchLocalSigner(b, key)
+	pubFile := filepath.Join(dir, "ca.pub")
+	err = ioutil.WriteFile(pubFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket, pubFile
+}
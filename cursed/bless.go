@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// blessRequest is the payload bastion wrapper scripts send to a BLESS Lambda
+type blessRequest struct {
+	BastionIP       string `json:"bastion_ip"`
+	BastionUser     string `json:"bastion_user"`
+	BastionUserIP   string `json:"bastion_user_ip"`
+	Command         string `json:"command"`
+	PublicKeyToSign string `json:"public_key_to_sign"`
+	RemoteUsernames string `json:"remote_usernames"`
+	KMSAuthToken    string `json:"kmsauth_token,omitempty"`
+}
+
+// blessResponse is what the BLESS Lambda returns: the certificate, or an error type and
+// message. Errors are returned rather than raised, so they come back with a 200 like BLESS's
+type blessResponse struct {
+	Certificate  string `json:"certificate,omitempty"`
+	ErrorType    string `json:"errorType,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+func blessError(w http.ResponseWriter, errType, msg string) {
+	log.Printf("Request %s failed: BLESS %s: %s", w.Header().Get(requestIDHeader), errType, msg)
+	writeJSON(w, blessResponse{ErrorType: errType, ErrorMessage: msg})
+}
+
+// blessHandler signs a key for a BLESS request. It answers both on /bless and on the Lambda
+// Invoke API path, so wrappers using boto3 only need endpoint_url pointed at the reverse
+// proxy. The proxy authenticates the user as usual, and bastion_user has to match them:
+// BLESS trusted the bastion's IAM role to vouch for its users, we don't
+func blessHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/2015-03-31/functions/") && !strings.HasSuffix(r.URL.Path, "/invocations") {
+		problemError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	release, ok := limitIP(w, r, conf)
+	if !ok {
+		return
+	}
+	defer release()
+	bastionUser, identity, ok := authenticate(w, r, conf)
+	if !ok {
+		return
+	}
+	releaseUser, ok := limitUser(w, r, conf, bastionUser)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	var br blessRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&br)
+	if err != nil {
+		blessError(w, "InputValidationError", "Unable to parse request: "+err.Error())
+		return
+	}
+	if normalizeUser(br.BastionUser, conf) != bastionUser {
+		errMsg := "bastion_user " + br.BastionUser + " doesn't match the authenticated user"
+		logDenial(r.Context(), conf, reasonBadUser, bastionUser, "", errMsg)
+		blessError(w, "InputValidationError", errMsg)
+		return
+	}
+	if strings.Contains(br.RemoteUsernames, ",") {
+		blessError(w, "InputValidationError", "Only one of remote_usernames may be requested, cursed expands it to the principals the user is granted")
+		return
+	}
+
+	res := signUserKey(r.Context(), conf, httpParams{
+		identity:    identity,
+		bastionIP:   br.BastionIP,
+		bastionUser: bastionUser,
+		cmd:         br.Command,
+		key:         br.PublicKeyToSign,
+		asn:         asnAsserted(r, conf),
+		mfa:         mfaAsserted(r, conf),
+		remoteUser:  strings.TrimSpace(br.RemoteUsernames),
+		tenant:      tenantAsserted(r, conf),
+		userIP:      br.BastionUserIP,
+	})
+	if res.Error != "" {
+		errType := res.Reason
+		switch {
+		case res.status == http.StatusBadRequest:
+			errType = "InputValidationError"
+		case errType == "":
+			errType = "InternalError"
+		}
+		blessError(w, errType, res.Error)
+		return
+	}
+
+	writeJSON(w, blessResponse{Certificate: res.Certificate})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Default sshd_config fragment for hosts trusting our CA. Certificates are issued with the
+// remote username as their only principal, which sshd accepts without an
+// AuthorizedPrincipalsFile, so that's left for sites mapping principals differently
+const defaultSSHDTemplate = `# Managed by cursed bootstrap-host
+TrustedUserCAKeys {{.CAKeyFile}}
+RevokedKeys {{.RevokedKeysFile}}
+#AuthorizedPrincipalsFile /etc/ssh/auth_principals/%u
+`
+
+type bootstrapData struct {
+	CAKey           string
+	CAKeyFile       string
+	RevokedKeysFile string
+}
+
+type bootstrapFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+	// Existing files are left alone, so we don't wipe out revocations
+	keep bool
+}
+
+func bootstrapFiles(conf *config) ([]bootstrapFile, error) {
+	caKey, err := caPublicKey(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tmplText := defaultSSHDTemplate
+	if conf.BootstrapTemplate != "" {
+		b, err := ioutil.ReadFile(conf.BootstrapTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read bootstraptemplate: %v", err)
+		}
+		tmplText = string(b)
+	}
+	tmpl, err := template.New("sshd").Parse(tmplText)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse bootstraptemplate: %v", err)
+	}
+
+	data := bootstrapData{
+		CAKey:           strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey))),
+		CAKeyFile:       conf.BootstrapCAKeyFile,
+		RevokedKeysFile: conf.BootstrapRevokedKeysFile,
+	}
+	var sshdConf bytes.Buffer
+	err = tmpl.Execute(&sshdConf, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render bootstraptemplate: %v", err)
+	}
+
+	return []bootstrapFile{
+		{path: conf.BootstrapCAKeyFile, content: data.CAKey + "\n", mode: 0644},
+		{path: conf.BootstrapRevokedKeysFile, content: "", mode: 0644, keep: true},
+		{path: conf.BootstrapSSHDFile, content: sshdConf.String(), mode: 0644},
+	}, nil
+}
+
+// caPublicKey reads the CA public key, falling back to deriving it from the private key when
+// run on the CA host itself
+func caPublicKey(conf *config) (ssh.PublicKey, error) {
+	keyBytes, err := ioutil.ReadFile(conf.CAPubKeyFile)
+	if err == nil {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse CA public key: '%v'", err)
+		}
+		return pk, nil
+	}
+	if conf.CAAgentSocket != "" {
+		return nil, fmt.Errorf("Failed to read CA public key file: '%v'", err)
+	}
+
+	signer, err := loadCAKey(conf.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+func bootstrapHost(conf *config, write bool) error {
+	files, err := bootstrapFiles(conf)
+	if err != nil {
+		return err
+	}
+
+	// Without --write we print a script doing the same, for piping to the target host:
+	// cursed bootstrap-host | ssh root@host sh
+	if !write {
+		fmt.Print(bootstrapScript(files))
+		return nil
+	}
+
+	for _, f := range files {
+		if _, err := os.Stat(f.path); f.keep && err == nil {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(f.path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory for %s: %v", f.path, err)
+		}
+		err = ioutil.WriteFile(f.path, []byte(f.content), f.mode)
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %v", f.path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", f.path)
+	}
+	fmt.Fprintln(os.Stderr, "Check the configuration with `sshd -t` and reload sshd to apply it")
+
+	return nil
+}
+
+func bootstrapScript(files []bootstrapFile) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n# Generated by cursed bootstrap-host\nset -e\n")
+	for _, f := range files {
+		fmt.Fprintf(&b, "\nmkdir -p %s\n", shellQuote(filepath.Dir(f.path)))
+		if f.keep {
+			fmt.Fprintf(&b, "[ -e %[1]s ] || : > %[1]s\n", shellQuote(f.path))
+		} else {
+			content := f.content
+			if !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+			fmt.Fprintf(&b, "cat > %s <<'CURSE_EOF'\n%sCURSE_EOF\n", shellQuote(f.path), content)
+		}
+		fmt.Fprintf(&b, "chmod %o %s\n", f.mode, shellQuote(f.path))
+	}
+	b.WriteString("\nsshd -t\necho 'sshd configuration is valid, reload sshd to apply it'\n")
+
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
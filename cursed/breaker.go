@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errCAUnavailable = errors.New("CA signing backend unavailable")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breakerSigner stops sending signatures to a CA backend that keeps failing. After threshold
+// consecutive failures it opens and fails fast for cooldown, then lets a single trial
+// signature through (half-open) to decide whether to close again.
+type breakerSigner struct {
+	signer    ssh.Signer
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+	rejected int
+}
+
+func newBreakerSigner(signer ssh.Signer, threshold int, cooldown time.Duration) *breakerSigner {
+	b := &breakerSigner{signer: signer, threshold: threshold, cooldown: cooldown, state: breakerClosed}
+	expvar.Publish("cabreaker", expvar.Func(b.stats))
+	return b
+}
+
+func (b *breakerSigner) PublicKey() ssh.PublicKey {
+	return b.signer.PublicKey()
+}
+
+func (b *breakerSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return b.SignWithAlgorithm(rand, data, "")
+}
+
+func (b *breakerSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return b.SignContext(context.Background(), rand, data, algorithm)
+}
+
+func (b *breakerSigner) SignContext(ctx context.Context, rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if !b.allow() {
+		return nil, errCAUnavailable
+	}
+
+	var sig *ssh.Signature
+	var err error
+	if cs, ok := b.signer.(contextSigner); ok {
+		sig, err = cs.SignContext(ctx, rand, data, algorithm)
+	} else if as, ok := b.signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+		sig, err = as.SignWithAlgorithm(rand, data, algorithm)
+	} else {
+		sig, err = b.signer.Sign(rand, data)
+	}
+
+	// A signature abandoned by the client says nothing about the backend, nor does a CA key
+	// that is still sealed
+	if err != nil && (ctx.Err() != nil || err == errCAUnavailable) {
+		b.mu.Lock()
+		b.trial = false
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.record(err)
+
+	return sig, err
+}
+
+func (b *breakerSigner) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.rejected++
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		// Only the trial signature goes through until we know how it went
+		if b.trial {
+			b.rejected++
+			return false
+		}
+		b.trial = true
+	}
+
+	return true
+}
+
+func (b *breakerSigner) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Printf("CA backend recovered, closing circuit breaker")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Printf("CA backend failing (%d consecutive errors, last: %v), opening circuit breaker for %v", b.failures, err, b.cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// ready reports whether signatures are currently being passed to the backend
+func (b *breakerSigner) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != breakerOpen || time.Since(b.openedAt) >= b.cooldown
+}
+
+func (b *breakerSigner) stats() interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":    b.state,
+		"failures": b.failures,
+		"rejected": b.rejected,
+	}
+}
+
+// caReady reports whether the CA backend is usable, for load balancer health checks
+func caReady(conf *config) bool {
+	b, ok := conf.caSigner.(*breakerSigner)
+	return !ok || b.ready()
+}
+
+// notReady returns why the node shouldn't be given requests, along with the denial reason
+// to report, or nil while it can sign
+func notReady(conf *config) (string, error) {
+	if conf.seal != nil && conf.seal.isSealed() {
+		return reasonCAUnavailable, errors.New("CA key is sealed")
+	}
+	if !caReady(conf) {
+		return reasonCAUnavailable, errCAUnavailable
+	}
+	if !conf.lease.valid() {
+		return reasonCAUnavailable, errLeaseLost
+	}
+	err := clockDenial(conf)
+	if err != nil {
+		return reasonClockSkew, err
+	}
+	return "", nil
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if conf.ClockNTPServer != "" {
+		clock.Lock()
+		w.Header().Set(clockSkewHeader, strconv.FormatFloat(clock.offset.Seconds(), 'f', 3, 64))
+		clock.Unlock()
+	}
+	reason, err := notReady(conf)
+	if err != nil {
+		w.Header().Set(reasonHeader, reason)
+		problemError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
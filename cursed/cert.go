@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"strconv"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -19,6 +20,7 @@ type certConfig struct {
 	extensions  map[string]string
 	keyID       string
 	principals  []string
+	serial      uint64
 	srcAddr     string
 	validAfter  time.Time
 	validBefore time.Time
@@ -29,27 +31,16 @@ func checkPubKeyAge(conf *config, fp string) (bool, error) {
 
 	// Check if this fingerprint exists in our DB
 	err := conf.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(conf.bucketName)
-		if bucket == nil {
+		if tx.Bucket(conf.bucketName) == nil {
 			msg := "WARNING: Did not find DB bucket %q. This should only happen with a new db file"
 			return fmt.Errorf(msg, conf.bucketName)
 		}
 
-		// Get timestamp string from database and convert to int
-		val := bucket.Get([]byte(fp))
-		if len(val) == 0 {
-			keyBirthday = 0
-			return nil
-		}
-
-		// Convert byte array to string to int64 (gross, I know)
-		kb, err := strconv.ParseInt(string(val), 10, 64)
+		var err error
+		keyBirthday, err = getBirthday(tx, conf, fp)
 		if err != nil {
-			msg := "ERROR: Timestamp in db corrupted for key %s: %v"
-			return fmt.Errorf(msg, fp, err)
+			return fmt.Errorf("ERROR: %v", err)
 		}
-		keyBirthday = int64(kb)
-
 		return nil
 	})
 	if err != nil {
@@ -60,23 +51,20 @@ func checkPubKeyAge(conf *config, fp string) (bool, error) {
 	// If this is a new key, add it to the database with a timestamp
 	if keyBirthday == 0 {
 		err = conf.db.Update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists(conf.bucketName)
-			if err != nil {
-				return err
-			}
-
-			// Convert unix timestamp to string to byte array and store in the DB (gross, I know)
-			now := strconv.FormatInt(time.Now().Unix(), 10)
-			err = bucket.Put([]byte(fp), []byte(now))
-			if err != nil {
-				return err
-			}
-			return nil
+			return putBirthday(tx, conf, fp, time.Now())
 		})
 	} else if keyBirthday > 0 {
 		kb := time.Unix(keyBirthday, 0)
 		keyAge := time.Now().Sub(kb)
 		if keyAge > conf.keyLifeSpan {
+			// Check for an unexpired exemption before rejecting the key
+			ex, err := getExemption(conf, fp)
+			if err != nil {
+				log.Printf("Unable to read key age exemption for %s: %v", fp, err)
+			} else if ex != nil && ex.Expires.After(time.Now()) {
+				log.Printf("Key age exemption applied for %s: %s", fp, ex.Reason)
+				return false, nil
+			}
 			return true, nil
 		}
 	} else {
@@ -104,18 +92,35 @@ func loadCAKey(keyFile string) (ssh.Signer, error) {
 	return sk, nil
 }
 
-func signPubKey(signer ssh.Signer, rawKey []byte, cc certConfig) ([]byte, error) {
-	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(rawKey) // FIXME look into handling additional fields
-	if err != nil {
-		err = fmt.Errorf("Failed to parse pubkey: %v", err)
-		return nil, err
+// boundSigner hands a request's context to a contextSigner, for ssh.Certificate.SignCert
+// which only knows ssh.Signer
+type boundSigner struct {
+	contextSigner
+	ctx context.Context
+}
+
+func (b boundSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return b.SignContext(b.ctx, rand, data, "")
+}
+
+func (b boundSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return b.SignContext(b.ctx, rand, data, algorithm)
+}
+
+// signPubKey certifies pubKey as cc describes. A signer that supports it stops waiting for
+// the signature once ctx is done
+func signPubKey(ctx context.Context, signer ssh.Signer, pubKey ssh.PublicKey, cc certConfig) ([]byte, error) {
+	if cs, ok := signer.(contextSigner); ok {
+		signer = boundSigner{cs, ctx}
 	}
 
 	critOpt := make(map[string]string)
 	if cc.command != "" {
 		critOpt["force-command"] = cc.command
 	}
-	critOpt["source-address"] = cc.srcAddr
+	if cc.srcAddr != "" {
+		critOpt["source-address"] = cc.srcAddr
+	}
 
 	perms := ssh.Permissions{
 		CriticalOptions: critOpt,
@@ -125,7 +130,7 @@ func signPubKey(signer ssh.Signer, rawKey []byte, cc certConfig) ([]byte, error)
 	// Make a cert from our pubkey
 	cert := &ssh.Certificate{
 		Key:             pubKey,
-		Serial:          0,
+		Serial:          cc.serial,
 		CertType:        cc.certType,
 		KeyId:           cc.keyID,
 		ValidPrincipals: cc.principals,
@@ -134,9 +139,12 @@ func signPubKey(signer ssh.Signer, rawKey []byte, cc certConfig) ([]byte, error)
 		Permissions:     perms,
 	}
 
-	err = cert.SignCert(rand.Reader, signer)
+	err := cert.SignCert(rand.Reader, signer)
+	if err == errCAUnavailable {
+		return nil, err
+	}
 	if err != nil {
-		err = fmt.Errorf("Failed to sign pubkey: %v", err)
+		err = fmt.Errorf("Failed to sign pubkey: %w", err)
 		return nil, err
 	}
 	authorizedKey := ssh.MarshalAuthorizedKey(cert)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace for signatures over the client configuration bundle, see signSSHSig
+const clientConfigNamespace = "curse-client-config"
+
+// clientBundle is what /.well-known/curse-client serves: a jinx.yaml signed by the CA key, so
+// `jinx setup` can configure a laptop from nothing but the server's URL and the CA
+// fingerprint, whatever sits between it and us
+type clientBundle struct {
+	Config    string `json:"config"`
+	CAKey     string `json:"caKey"`
+	Signature string `json:"signature"`
+}
+
+// clientConfig is clientconfigfile and, once the first request has signed it, the response.
+// Signing waits for the first request since the CA key may still be sealed at startup
+type clientConfig struct {
+	config []byte
+	mu     sync.Mutex
+	signed *cachedResponse
+}
+
+// loadClientConfig reads clientconfigfile, making sure jinx will be able to parse it
+func loadClientConfig(file string) (*clientConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read clientconfigfile: %v", err)
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err = v.ReadConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid clientconfigfile %s: %v", file, err)
+	}
+	if !v.IsSet("url") && !v.IsSet("urls") && !v.IsSet("discoveryurl") && !v.IsSet("discoverdomain") {
+		return nil, fmt.Errorf("clientconfigfile %s doesn't tell jinx where to find us (url, urls, discoveryurl or discoverdomain)", file)
+	}
+	return &clientConfig{config: b}, nil
+}
+
+func clientConfigHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cc := conf.clientConfig
+	if cc == nil {
+		problemError(w, "No clientconfigfile configured", http.StatusNotFound)
+		return
+	}
+
+	cc.mu.Lock()
+	if cc.signed == nil {
+		sig, err := signSSHSig(conf.caSigner, clientConfigNamespace, cc.config)
+		if err != nil {
+			cc.mu.Unlock()
+			log.Printf("Failed to sign client configuration: %v", err)
+			w.Header().Set(reasonHeader, reasonCAUnavailable)
+			problemError(w, errCAUnavailable.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := json.Marshal(clientBundle{
+			Config:    string(cc.config),
+			CAKey:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(conf.caSigner.PublicKey()))),
+			Signature: string(sig),
+		})
+		cc.signed = newCachedResponse(body)
+	}
+	signed := cc.signed
+	cc.mu.Unlock()
+	signed.serve(w, r, "application/json", "public, max-age=300")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds between the NTP epoch (1900) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// Set on /readyz responses, the signed offset in seconds of the system clock from NTP
+const clockSkewHeader = "X-Curse-Clock-Skew"
+
+// timeSource gives the time certificates are issued at. Certificates are only valid for
+// minutes, so a signer whose clock wanders hands out ones that are already expired, or that
+// stay valid for longer than policy allows
+type timeSource interface {
+	Now() time.Time
+}
+
+type systemTime struct{}
+
+func (systemTime) Now() time.Time { return time.Now() }
+
+// ntpTime is the system clock corrected by the offset last measured against clockntpserver,
+// for clockskewaction: correct
+type ntpTime struct{}
+
+func (ntpTime) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return time.Now().Add(clock.offset)
+}
+
+// Result of the last clock check. The skew in seconds is also published on the admin
+// listener's /debug/vars
+var (
+	clock struct {
+		sync.Mutex
+		offset  time.Duration
+		checked time.Time
+	}
+	clockSkew = expvar.NewFloat("clockskew")
+)
+
+func newTimeSource(conf *config) timeSource {
+	if conf.ClockSkewAction == "correct" {
+		return ntpTime{}
+	}
+	return systemTime{}
+}
+
+// checkClock is the clock maintenance task. It measures the system clock's offset from
+// clockntpserver, with the same SNTP exchange ntpdate uses
+func checkClock(conf *config) (string, error) {
+	offset, err := ntpOffset(conf.ClockNTPServer)
+	if err != nil {
+		return "", err
+	}
+
+	clock.Lock()
+	clock.offset = offset
+	clock.checked = time.Now()
+	clock.Unlock()
+	clockSkew.Set(offset.Seconds())
+
+	msg := fmt.Sprintf("clock offset %s from %s", offset, conf.ClockNTPServer)
+	if clockSkewed(conf) {
+		msg += fmt.Sprintf(", more than clockmaxskew (%ds)", conf.ClockMaxSkew)
+	}
+	return msg, nil
+}
+
+// clockSkewed reports whether the last check found the system clock off by more than
+// clockmaxskew. Corrected time is only as far off as the check, so it never is
+func clockSkewed(conf *config) bool {
+	if conf.ClockNTPServer == "" || conf.ClockSkewAction == "correct" {
+		return false
+	}
+	clock.Lock()
+	defer clock.Unlock()
+	return math.Abs(clock.offset.Seconds()) > float64(conf.ClockMaxSkew)
+}
+
+// clockDenial refuses signing while the clock is skewed, unless clockskewaction is warn
+func clockDenial(conf *config) error {
+	if !clockSkewed(conf) || conf.ClockSkewAction != "refuse" {
+		return nil
+	}
+	clock.Lock()
+	defer clock.Unlock()
+	return denyf(reasonClockSkew, "Signer clock is off by %s, refusing to sign until it's corrected", clock.offset)
+}
+
+func ntpOffset(server string) (time.Duration, error) {
+	if !strings.Contains(server, ":") {
+		server += ":123"
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Client request: leap indicator 0, version 3, mode 3
+	req := make([]byte, 48)
+	req[0] = 0x1b
+	sent := time.Now()
+	_, err = conn.Write(req)
+	if err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, fmt.Errorf("No answer from %s: %v", server, err)
+	}
+	received := time.Now()
+	if n < 48 || resp[0]&0x07 != 4 {
+		return 0, fmt.Errorf("Invalid NTP response from %s", server)
+	}
+	// Stratum 0 is a kiss-o'-death, the server telling us to go away
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("%s refused the NTP request (%s)", server, strings.TrimRight(string(resp[12:16]), "\x00"))
+	}
+
+	serverReceived := ntpTimestamp(resp[32:40])
+	serverSent := ntpTimestamp(resp[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func ntpTimestamp(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(secs, frac*1e9>>32)
+}
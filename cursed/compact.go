@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Free space, as a share of the database file, above which the compact task asks for a
+// `cursed compact`
+const compactFreeRatio = 0.5
+
+// checkCompaction reports how much of the database file is free pages. bolt reuses free
+// pages but never shrinks the file, and can only be rewritten while nothing has it open
+func checkCompaction(conf *config) (string, error) {
+	var size int64
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	free := int64(conf.db.Stats().FreePageN) * int64(conf.db.Info().PageSize)
+
+	msg := fmt.Sprintf("%d of %d bytes free", free, size)
+	if size > 0 && float64(free)/float64(size) > compactFreeRatio {
+		msg += ", run `cursed compact` while cursed is stopped to reclaim them"
+	}
+	return msg, nil
+}
+
+// runCompact rewrites the database into a new file with no free pages, then swaps it in
+func runCompact(conf *config) error {
+	// Don't wait forever on the file lock if the daemon is still running
+	src, err := bolt.Open(conf.DBFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("Could not open database file (is cursed running?): %v", err)
+	}
+	defer src.Close()
+
+	tmpFile := conf.DBFile + ".compact"
+	os.Remove(tmpFile)
+	dst, err := bolt.Open(tmpFile, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, nb)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to compact database: %v", err)
+	}
+
+	before, _ := os.Stat(conf.DBFile)
+	after, _ := os.Stat(tmpFile)
+	err = os.Rename(tmpFile, conf.DBFile)
+	if err != nil {
+		return err
+	}
+	if before != nil && after != nil {
+		fmt.Printf("Compacted %s from %d to %d bytes\n", conf.DBFile, before.Size(), after.Size())
+	}
+
+	return nil
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	// The audit spool keys records by sequence number
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		// A nil value is a nested bucket
+		if v == nil {
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), nb)
+		}
+		return dst.Put(k, v)
+	})
+}
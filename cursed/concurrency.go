@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// concurrencySlots counts signing requests in flight per key. Unlike a rate limit it never
+// gets in the way of a client that waits for its answers, only of one that keeps piling on
+// requests, e.g. a job retrying in a tight loop against a slow CA backend
+type concurrencySlots struct {
+	sync.Mutex
+	active map[string]int
+}
+
+var (
+	ipSlots   = &concurrencySlots{active: make(map[string]int)}
+	userSlots = &concurrencySlots{active: make(map[string]int)}
+)
+
+// enter takes one of max slots for key, answering 429 if they're all in use. The returned
+// func gives the slot back. A max of 0 means no limit
+func (s *concurrencySlots) enter(w http.ResponseWriter, r *http.Request, conf *config, key string, max int, user, what string) (func(), bool) {
+	if max <= 0 {
+		return func() {}, true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.active[key] >= max {
+		w.Header().Set("Retry-After", "1")
+		deny(w, r, conf, reasonQuota, user, fmt.Sprintf("Too many concurrent requests from %s %s (max %d)", what, key, max), http.StatusTooManyRequests)
+		return nil, false
+	}
+	s.active[key]++
+
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		s.active[key]--
+		if s.active[key] <= 0 {
+			delete(s.active, key)
+		}
+	}, true
+}
+
+// clientIP is the address limits apply to. Behind the reverse proxy every request comes from
+// the proxy, so clientipheader names the header it puts the real address in
+func clientIP(r *http.Request, conf *config) string {
+	if conf.ClientIPHeader != "" {
+		// X-Forwarded-For style lists end with the address the proxy itself saw
+		parts := strings.Split(r.Header.Get(conf.ClientIPHeader), ",")
+		ip := strings.TrimSpace(parts[len(parts)-1])
+		if validIP(ip) {
+			return ip
+		}
+	}
+
+	return remoteIP(r)
+}
+
+func limitIP(w http.ResponseWriter, r *http.Request, conf *config) (func(), bool) {
+	return ipSlots.enter(w, r, conf, clientIP(r, conf), conf.MaxConcurrentPerIP, "", "source IP")
+}
+
+func limitUser(w http.ResponseWriter, r *http.Request, conf *config, user string) (func(), bool) {
+	return userSlots.enter(w, r, conf, user, conf.MaxConcurrentPerUser, user, "user")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Top-level keys in either a YAML (key: val) or TOML (key = val) config file
+var configKeyRegex = regexp.MustCompile(`^([A-Za-z0-9_]+)\s*[:=]`)
+
+// Environment variables we read ourselves rather than as config options
+var configEnvVars = map[string]bool{"CURSED_CONFIG": true, "CURSED_SANDBOXED": true}
+
+// configCommand runs `cursed config validate [file]` or `cursed config print-defaults`
+func configCommand(args []string) error {
+	switch {
+	case len(args) > 0 && args[0] == "validate":
+		file := ""
+		if len(args) > 1 {
+			file = args[1]
+		}
+		return validateConfig(file)
+	case len(args) > 0 && args[0] == "print-defaults":
+		v := viper.New()
+		setDefaults(v)
+		v.SetConfigType("yaml")
+		return v.WriteConfigTo(os.Stdout)
+	}
+	return fmt.Errorf("Usage: cursed config validate [file] | cursed config print-defaults")
+}
+
+// configSchema maps each option name to the type it's decoded into
+func configSchema() map[string]reflect.Type {
+	schema := make(map[string]reflect.Type)
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		schema[strings.ToLower(f.Name)] = f.Type
+	}
+	return schema
+}
+
+// validateConfig checks every option in the config file against the schema, reporting unknown
+// options and values of the wrong type with their line numbers, then runs the same checks as
+// startup so nothing is left to surface as a runtime failure
+func validateConfig(file string) error {
+	if file != "" {
+		viper.SetConfigFile(file)
+	}
+	err := viper.ReadInConfig()
+	if file == "" {
+		file = viper.ConfigFileUsed()
+	}
+	if file == "" {
+		return fmt.Errorf("No config file found in /opt/curse/etc, /etc/curse or the working directory")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	lines, err := configKeyLines(file)
+	if err != nil {
+		return err
+	}
+
+	schema := configSchema()
+	var problems []string
+	for _, kl := range lines {
+		t, ok := schema[kl.key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown option %q%s", file, kl.line, kl.key, suggestOption(kl.key, schema)))
+			continue
+		}
+		err = viper.UnmarshalKey(kl.key, reflect.New(t).Interface())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: invalid value %q for %s, expected %s",
+				file, kl.line, fmt.Sprint(viper.Get(kl.key)), kl.key, typeName(t)))
+		}
+	}
+
+	// A typo in an override is as easy to miss as one in the file. Variables holding secrets
+	// (proxypass: env:CURSED_PROXY_PASS) aren't overrides
+	secretVars := make(map[string]bool)
+	for _, key := range viper.AllKeys() {
+		if v := viper.GetString(key); strings.HasPrefix(v, "env:") {
+			secretVars[strings.TrimPrefix(v, "env:")] = true
+		}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, "CURSED_") && !configEnvVars[name] && !secretVars[name] {
+			env = append(env, name)
+		}
+	}
+	sort.Strings(env)
+	for _, name := range env {
+		key := strings.ToLower(strings.TrimPrefix(name, "CURSED_"))
+		if _, ok := schema[key]; !ok {
+			problems = append(problems, fmt.Sprintf("environment variable %s: unknown option %q%s", name, key, suggestOption(key, schema)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+
+	_, err = getConf()
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	fmt.Printf("%s: OK\n", file)
+	return nil
+}
+
+type configKeyLine struct {
+	key  string
+	line int
+}
+
+// configKeyLines finds the line each top-level option is set on. TOML tables ([[tiers]]) end
+// the top-level section, so their contents are checked by decoding rather than by name
+func configKeyLines(file string) ([]configKeyLine, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []configKeyLine
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := scanner.Text()
+		if strings.HasPrefix(text, "[") {
+			break
+		}
+		if m := configKeyRegex.FindStringSubmatch(text); m != nil {
+			lines = append(lines, configKeyLine{key: strings.ToLower(m[1]), line: n})
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// suggestOption offers the closest known option for a misspelt one
+func suggestOption(key string, schema map[string]reflect.Type) string {
+	best, bestDist := "", 3
+	for name := range schema {
+		d := editDistance(key, name)
+		if d < bestDist || (d == bestDist && best != "" && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// typeName describes a config type the way the example config does
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets whose records are encrypted with dbkey: who was issued what, from where, which
+// keys they've used, who asked for approval and who gave it, which session principals map
+// to which accounts, which hosts hold certificates, and the certificates kept for idempotent
+// replay. The key age bucket (conf.bucketName) is too, through getBirthday and putBirthday.
+// The rest hold policy rather than history: key lists, exemptions, delegations, enrollments,
+// admin tokens and the freeze stay readable so they can be inspected and fixed by hand
+var encryptedBuckets = [][]byte{approvalBucket, expiryBucket, hostBucket, idempotencyBucket, issuedBucket, keyHistoryBucket, sessionPrincipalBucket}
+
+// Sealed records start with sealedPrefix, which no JSON record or birthday can, then the key
+// ID, nonce and ciphertext, bound to their bucket and key as additional data so a record
+// can't be copied over another. Records written before dbkey was set have no prefix, and are
+// read as they are until every record has been sealed
+var sealedPrefix = []byte("CSE2")
+
+// Set in metaBucket once every record of encryptedBuckets and every key birthday is sealed.
+// From then on a record in the clear can only have been planted, and is refused
+var dbSealedKey = []byte("dbsealed")
+
+// Length of the key ID after sealedPrefix, the start of the key's SHA-256
+const dbKeyIDLen = 8
+
+// dbCipher encrypts records of encryptedBuckets with dbkey, and decrypts them with it or any
+// of dbpreviouskeys, so the key can be rotated while old records are re-encrypted by the
+// rekey task. A nil dbCipher leaves records in the clear
+type dbCipher struct {
+	current []byte
+	keys    map[string]cipher.AEAD
+	// Non-zero once dbSealedKey is set, read and written atomically
+	sealedOnly int32
+}
+
+// newDBCipher builds the cipher from dbkey and dbpreviouskeys, each 32 hex-encoded bytes or
+// a secret reference to them (env:, file: or vault:)
+func newDBCipher(current string, previous []string) (*dbCipher, error) {
+	if current == "" {
+		if len(previous) > 0 {
+			return nil, fmt.Errorf("dbpreviouskeys requires dbkey")
+		}
+		return nil, nil
+	}
+	c := &dbCipher{keys: make(map[string]cipher.AEAD)}
+	for i, ref := range append([]string{current}, previous...) {
+		secret, err := resolveSecret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve database key: %v", err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(secret))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Database keys must be 32 hex-encoded bytes, e.g. from `openssl rand -hex 32`")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := sum[:dbKeyIDLen]
+		if i == 0 {
+			c.current = id
+		}
+		c.keys[string(id)] = gcm
+	}
+	return c, nil
+}
+
+// recordAAD is the additional data sealing the record under key in bucket name
+func recordAAD(name, key []byte) []byte {
+	aad := append(append([]byte{}, name...), 0)
+	return append(aad, key...)
+}
+
+// isSealed reports whether val is an encrypted record
+func isSealed(val []byte) bool {
+	return bytes.HasPrefix(val, sealedPrefix)
+}
+
+// seal encrypts val, to be stored under key in bucket name
+func (c *dbCipher) seal(name, key, val []byte) ([]byte, error) {
+	if c == nil {
+		return val, nil
+	}
+	gcm := c.keys[string(c.current)]
+	out := append(append([]byte{}, sealedPrefix...), c.current...)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, val, recordAAD(name, key)), nil
+}
+
+// open decrypts val, read from under key in bucket name
+func (c *dbCipher) open(name, key, val []byte) ([]byte, error) {
+	if !isSealed(val) {
+		if c != nil && atomic.LoadInt32(&c.sealedOnly) != 0 {
+			return nil, fmt.Errorf("record isn't encrypted, though every record was sealed with dbkey")
+		}
+		return val, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("record is encrypted and dbkey isn't set")
+	}
+	val = val[len(sealedPrefix):]
+	if len(val) < dbKeyIDLen {
+		return nil, fmt.Errorf("encrypted record truncated")
+	}
+	gcm, ok := c.keys[string(val[:dbKeyIDLen])]
+	if !ok {
+		return nil, fmt.Errorf("record is encrypted with key %x, which is neither dbkey nor in dbpreviouskeys", val[:dbKeyIDLen])
+	}
+	val = val[dbKeyIDLen:]
+	if len(val) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted record truncated")
+	}
+	return gcm.Open(nil, val[:gcm.NonceSize()], val[gcm.NonceSize():], recordAAD(name, key))
+}
+
+// isCurrent reports whether val is sealed with dbkey, or is in the clear without one
+func (c *dbCipher) isCurrent(val []byte) bool {
+	if c == nil {
+		return !isSealed(val)
+	}
+	return bytes.HasPrefix(val, append(append([]byte{}, sealedPrefix...), c.current...))
+}
+
+// marshalRecord encodes v to be stored under key in name, one of encryptedBuckets
+func marshalRecord(conf *config, name, key []byte, v interface{}) ([]byte, error) {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return conf.dbCipher.seal(name, key, val)
+}
+
+// unmarshalRecord decodes the record under key in name, one of encryptedBuckets
+func unmarshalRecord(conf *config, name, key, val []byte, v interface{}) error {
+	plain, err := conf.dbCipher.open(name, key, val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// rekeyRecords re-encrypts records of encryptedBuckets that aren't under dbkey: those
+// written before it was set, or under a key since moved to dbpreviouskeys. The old bytes
+// linger in bolt's free pages until `cursed compact`
+func rekeyRecords(conf *config) (string, error) {
+	done := 0
+	for _, name := range append([][]byte{conf.bucketName}, encryptedBuckets...) {
+		// A batch per transaction, so signing isn't held up behind one long write
+		for {
+			n, err := rekeyBatch(conf, name, 500)
+			done += n
+			if err != nil {
+				return "", fmt.Errorf("Rekeying %s: %v", name, err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+	// Everything is under dbkey now, and all writes are while it's set
+	err := markSealed(conf)
+	if err != nil {
+		return "", err
+	}
+	if done == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("re-encrypted %d records", done), nil
+}
+
+func rekeyBatch(conf *config, name []byte, max int) (int, error) {
+	n := 0
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		// Writing while iterating confuses bolt's cursor
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(updates) >= max || conf.dbCipher.isCurrent(v) {
+				return nil
+			}
+			plain, err := conf.dbCipher.open(name, k, v)
+			if err != nil {
+				return fmt.Errorf("record %s: %v", k, err)
+			}
+			sealed, err := conf.dbCipher.seal(name, k, plain)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = sealed
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, val := range updates {
+			err = bucket.Put([]byte(k), val)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(updates)
+		return nil
+	})
+	return n, err
+}
+
+// getBirthday returns when the key with fingerprint fp was first seen, or 0 if it hasn't been
+func getBirthday(tx *bolt.Tx, conf *config, fp string) (int64, error) {
+	bucket := tx.Bucket(conf.bucketName)
+	if bucket == nil {
+		return 0, nil
+	}
+	val := bucket.Get([]byte(fp))
+	if len(val) == 0 {
+		return 0, nil
+	}
+	plain, err := conf.dbCipher.open(conf.bucketName, []byte(fp), val)
+	if err != nil {
+		return 0, fmt.Errorf("Birthday of key %s unreadable: %v", fp, err)
+	}
+	kb, err := strconv.ParseInt(string(plain), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Timestamp in db corrupted for key %s: %v", fp, err)
+	}
+	return kb, nil
+}
+
+// putBirthday records t as when the key with fingerprint fp was first seen
+func putBirthday(tx *bolt.Tx, conf *config, fp string, t time.Time) error {
+	bucket, err := tx.CreateBucketIfNotExists(conf.bucketName)
+	if err != nil {
+		return err
+	}
+	val, err := conf.dbCipher.seal(conf.bucketName, []byte(fp), []byte(strconv.FormatInt(t.Unix(), 10)))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(fp), val)
+}
+
+// sealRecords encrypts the records of encryptedBuckets and the key birthdays written before
+// dbkey was set, and marks the database as sealed so none in the clear are read again. If
+// dbkey is set later, the rekey task does the same
+func sealRecords(tx *bolt.Tx, conf *config) error {
+	if conf.dbCipher == nil {
+		return nil
+	}
+	for _, name := range append([][]byte{conf.bucketName}, encryptedBuckets...) {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			continue
+		}
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if isSealed(v) {
+				return nil
+			}
+			sealed, err := conf.dbCipher.seal(name, k, v)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = sealed
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, val := range updates {
+			err = bucket.Put([]byte(k), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&conf.dbCipher.sealedOnly, 1)
+	return meta.Put(dbSealedKey, []byte("1"))
+}
+
+// markSealed records that every record is sealed with dbkey, if it wasn't already
+func markSealed(conf *config) error {
+	if atomic.LoadInt32(&conf.dbCipher.sealedOnly) != 0 {
+		return nil
+	}
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(dbSealedKey, []byte("1"))
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&conf.dbCipher.sealedOnly, 1)
+	log.Printf("Every database record is now sealed with dbkey, records in the clear will be refused")
+	return nil
+}
+
+// loadSealed reads whether every record was sealed with dbkey. Without dbkey, records are
+// written in the clear from now on, so the mark is dropped for the rekey task to set again
+// once dbkey is back
+func loadSealed(conf *config) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil || meta.Get(dbSealedKey) == nil {
+			return nil
+		}
+		if conf.dbCipher == nil {
+			log.Printf("dbkey isn't set, so new records are written in the clear and encrypted ones can't be read")
+			return meta.Delete(dbSealedKey)
+		}
+		atomic.StoreInt32(&conf.dbCipher.sealedOnly, 1)
+		return nil
+	})
+}
+
+// keepSealed carries over whether every record is sealed from the cipher a reload replaces
+func (c *dbCipher) keepSealed(old *dbCipher) error {
+	switch {
+	case old == nil:
+		return nil
+	case c == nil:
+		return fmt.Errorf("dbkey can't be unset by a reload, restart cursed to write records in the clear")
+	}
+	atomic.StoreInt32(&c.sealedOnly, atomic.LoadInt32(&old.sealedOnly))
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDBCipherOpen checks records open under their own bucket and key only, and records in
+// the clear are refused once the database is marked sealed
+func TestDBCipherOpen(t *testing.T) {
+	c, err := newDBCipher("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.seal(issuedBucket, []byte("a"), []byte(`{"user":"alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := c.open(issuedBucket, []byte("a"), sealed)
+	if err != nil || !bytes.Equal(plain, []byte(`{"user":"alice"}`)) {
+		t.Errorf("open = %q, %v", plain, err)
+	}
+	if _, err = c.open(issuedBucket, []byte("b"), sealed); err == nil {
+		t.Errorf("record opened under another key")
+	}
+	if _, err = c.open(approvalBucket, []byte("a"), sealed); err == nil {
+		t.Errorf("record opened in another bucket")
+	}
+
+	if _, err = c.open(issuedBucket, []byte("a"), []byte(`{}`)); err != nil {
+		t.Errorf("record in the clear refused before the database was sealed: %v", err)
+	}
+	atomic.StoreInt32(&c.sealedOnly, 1)
+	if _, err = c.open(issuedBucket, []byte("a"), []byte(`{}`)); err == nil {
+		t.Errorf("record in the clear read after the database was sealed")
+	}
+
+	// A reload keeps the mark, and can't drop dbkey
+	next, err := newDBCipher("ffeeddccbbaa99887766554433221100ffeeddccbbaa99887766554433221100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = next.keepSealed(c); err != nil || atomic.LoadInt32(&next.sealedOnly) == 0 {
+		t.Errorf("keepSealed = %v, or dropped the mark", err)
+	}
+	var none *dbCipher
+	if err = none.keepSealed(c); err == nil {
+		t.Errorf("reload unset dbkey")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Decisions buffered while the decision log service is unreachable, oldest dropped first
+const decisionBufferMax = 10000
+
+// decisionEvent is an entry in OPA's decision log format, so cursed decisions can go to the
+// same service as those of OPA sidecars. input and result are ours, see decisionFromAudit
+type decisionEvent struct {
+	Labels     map[string]string      `json:"labels"`
+	DecisionID string                 `json:"decision_id"`
+	Path       string                 `json:"path"`
+	Input      map[string]interface{} `json:"input"`
+	Result     map[string]interface{} `json:"result"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+type decisionLogger struct {
+	client *http.Client
+	labels map[string]string
+	queue  chan decisionEvent
+	url    string
+}
+
+func startDecisionLogs(conf *config) *decisionLogger {
+	if conf.DecisionLogURL == "" {
+		return nil
+	}
+
+	id, _ := os.Hostname()
+	dl := &decisionLogger{
+		client: &http.Client{Timeout: 10 * time.Second},
+		labels: map[string]string{"app": "cursed", "id": id, "version": version},
+		queue:  make(chan decisionEvent, 1000),
+		url:    conf.DecisionLogURL,
+	}
+	go dl.run(time.Duration(conf.DecisionLogInterval) * time.Second)
+
+	return dl
+}
+
+// decisionFromAudit describes an issued or denied event as a decision. Other events, like
+// reminders and key changes, aren't decisions and return false
+func decisionFromAudit(ev auditEvent) (map[string]interface{}, map[string]interface{}, bool) {
+	input := map[string]interface{}{"user": ev.User}
+	if ev.Fingerprint != "" {
+		input["fingerprint"] = ev.Fingerprint
+	}
+	if len(ev.Principals) > 0 {
+		input["principals"] = ev.Principals
+	}
+	if ev.Delegation != "" {
+		input["delegation"] = ev.Delegation
+	}
+
+	switch ev.Event {
+	case "issued":
+		result := map[string]interface{}{"allow": true, "key_id": ev.KeyID}
+		if ev.ValidBefore != nil {
+			result["valid_before"] = ev.ValidBefore
+		}
+		return input, result, true
+	case "denied":
+		return input, map[string]interface{}{"allow": false, "reason": ev.Reason, "message": ev.Message}, true
+	}
+	return nil, nil, false
+}
+
+// record queues a decision for the next batch. It is a no-op without a decisionlogurl, and
+// never blocks a signing request
+func (dl *decisionLogger) record(ev auditEvent) {
+	if dl == nil {
+		return
+	}
+	input, result, ok := decisionFromAudit(ev)
+	if !ok {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40 // UUIDv4, as OPA uses
+	id[8] = id[8]&0x3f | 0x80
+
+	de := decisionEvent{
+		Labels:     dl.labels,
+		DecisionID: fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Path:       "curse/sign",
+		Input:      input,
+		Result:     result,
+		Timestamp:  time.Now().UTC(),
+	}
+	select {
+	case dl.queue <- de:
+	default:
+		log.Printf("Decision log queue full, dropping decision %s", de.DecisionID)
+	}
+}
+
+// run uploads what has accumulated every interval, like OPA's decision log plugin: a gzipped
+// JSON array POSTed to the service. Failed batches are kept for the next attempt
+func (dl *decisionLogger) run(interval time.Duration) {
+	var pending []decisionEvent
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case de := <-dl.queue:
+			pending = append(pending, de)
+			if len(pending) > decisionBufferMax {
+				log.Printf("Decision log buffer full, dropping %d decisions", len(pending)-decisionBufferMax)
+				pending = pending[len(pending)-decisionBufferMax:]
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+			err := dl.upload(pending)
+			if err != nil {
+				log.Printf("Decision log upload of %d decisions failed: %v", len(pending), err)
+				continue
+			}
+			pending = nil
+		}
+	}
+}
+
+func (dl *decisionLogger) upload(batch []decisionEvent) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	err := json.NewEncoder(gz).Encode(batch)
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dl.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", dl.url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var delegationBucket = []byte("delegations")
+
+// delegation grants a user principals they wouldn't otherwise get, e.g. root during an
+// incident. It's minted by an admin, good for one certificate valid until Expires, and
+// stands in for team mappings and tier approval. MFA requirements still apply
+type delegation struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Principals []string   `json:"principals"`
+	Reason     string     `json:"reason"`
+	Issuer     string     `json:"issuer"`
+	Created    time.Time  `json:"created"`
+	Expires    time.Time  `json:"expires"`
+	Used       *time.Time `json:"used,omitempty"`
+	// Only the hash of the token's secret half is stored. The token itself is returned once,
+	// when the delegation is created
+	SecretHash string `json:"secretHash,omitempty"`
+	Token      string `json:"token,omitempty"`
+}
+
+var errDelegationNotFound = fmt.Errorf("Delegation not found")
+
+func (d *delegation) allows(principal string) bool {
+	for _, p := range d.Principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+func hashDelegationSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDelegation validates a delegation token (ID.secret) presented by user for principal,
+// without consuming it
+func checkDelegation(conf *config, user, principal, token string) (*delegation, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, denyf(reasonPrincipalDenied, "Malformed delegation token")
+	}
+	d, err := getDelegation(conf, parts[0])
+	if err == errDelegationNotFound {
+		return nil, denyf(reasonPrincipalDenied, "Unknown delegation token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashDelegationSecret(parts[1])), []byte(d.SecretHash)) != 1 {
+		return nil, denyf(reasonPrincipalDenied, "Unknown delegation token")
+	}
+	switch {
+	case d.User != user:
+		return nil, denyf(reasonPrincipalDenied, "Delegation %s was issued to another user", d.ID)
+	case d.Used != nil:
+		return nil, denyf(reasonPrincipalDenied, "Delegation %s was already used at %s", d.ID, d.Used.Format(time.RFC3339))
+	case !time.Now().Before(d.Expires):
+		return nil, denyf(reasonPrincipalDenied, "Delegation %s expired at %s", d.ID, d.Expires.Format(time.RFC3339))
+	case !d.allows(principal):
+		return nil, denyf(reasonPrincipalDenied, "Delegation %s doesn't grant principal %s", d.ID, principal)
+	}
+
+	return d, nil
+}
+
+// consumeDelegation marks a delegation used, failing if another request got there first
+func consumeDelegation(conf *config, id string) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(delegationBucket)
+		if bucket == nil {
+			return errDelegationNotFound
+		}
+		d, err := readDelegation(bucket, id)
+		if err != nil {
+			return err
+		}
+		if d.Used != nil {
+			return denyf(reasonPrincipalDenied, "Delegation %s was already used at %s", d.ID, d.Used.Format(time.RFC3339))
+		}
+		now := time.Now()
+		d.Used = &now
+		return putDelegation(bucket, *d)
+	})
+}
+
+func delegationsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		delegations, err := listDelegations(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, delegations)
+	case http.MethodPost:
+		var d delegation
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&d)
+		if err != nil {
+			problemError(w, "Unable to parse delegation", http.StatusBadRequest)
+			return
+		}
+		if d.User == "" || len(d.Principals) == 0 || d.Reason == "" {
+			problemError(w, "user, principals and reason are required", http.StatusBadRequest)
+			return
+		}
+		// The issuer is whoever the admin credential belongs to, not whatever the request
+		// says, so nobody can delegate to themselves under another name
+		d.Issuer = adminIdentity(r, conf)
+		if d.Issuer == "" {
+			problemError(w, "Delegations need a credential naming the issuer: a client certificate or an admin token", http.StatusForbidden)
+			return
+		}
+		if d.Issuer == d.User {
+			problemError(w, "Users cannot delegate to themselves", http.StatusConflict)
+			return
+		}
+		now := time.Now()
+		maxExpires := now.Add(time.Duration(conf.DelegationMaxTTL) * time.Second)
+		if !d.Expires.After(now) || d.Expires.After(maxExpires) {
+			problemError(w, fmt.Sprintf("expires must be in the future and at most %ds away (delegationmaxttl)", conf.DelegationMaxTTL), http.StatusBadRequest)
+			return
+		}
+
+		id := make([]byte, 8)
+		secret := make([]byte, 16)
+		_, err = rand.Read(id)
+		if err == nil {
+			_, err = rand.Read(secret)
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		d.ID = hex.EncodeToString(id)
+		d.SecretHash = hashDelegationSecret(hex.EncodeToString(secret))
+		d.Created = now
+		d.Used = nil
+		d.Token = ""
+
+		err = conf.db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(delegationBucket)
+			if err != nil {
+				return err
+			}
+			return putDelegation(bucket, d)
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Delegation %s created by %s: user[%s] principals%v until %s: %s", d.ID, d.Issuer, d.User, d.Principals, d.Expires.Format(time.RFC3339), d.Reason)
+		conf.webhooks.send(auditEvent{
+			Event:      "delegation_created",
+			User:       d.User,
+			Principals: d.Principals,
+			Delegation: d.ID,
+			Message:    d.Reason + " (by " + d.Issuer + ")",
+		})
+		d.SecretHash = ""
+		d.Token = d.ID + "." + hex.EncodeToString(secret)
+		writeJSON(w, d)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		err := conf.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(delegationBucket)
+			if bucket == nil || bucket.Get([]byte(id)) == nil {
+				return errDelegationNotFound
+			}
+			return bucket.Delete([]byte(id))
+		})
+		if err == errDelegationNotFound {
+			problemError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Delegation %s revoked", id)
+		conf.webhooks.send(auditEvent{Event: "delegation_revoked", Delegation: id})
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func readDelegation(bucket *bolt.Bucket, id string) (*delegation, error) {
+	val := bucket.Get([]byte(id))
+	if val == nil {
+		return nil, errDelegationNotFound
+	}
+	d := &delegation{}
+	err := json.Unmarshal(val, d)
+	if err != nil {
+		return nil, fmt.Errorf("Delegation record %s corrupted: %v", id, err)
+	}
+
+	return d, nil
+}
+
+func getDelegation(conf *config, id string) (*delegation, error) {
+	var d *delegation
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(delegationBucket)
+		if bucket == nil {
+			return errDelegationNotFound
+		}
+		var err error
+		d, err = readDelegation(bucket, id)
+		return err
+	})
+
+	return d, err
+}
+
+func putDelegation(bucket *bolt.Bucket, d delegation) error {
+	val, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(d.ID), val)
+}
+
+func listDelegations(conf *config) ([]delegation, error) {
+	delegations := make([]delegation, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(delegationBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var d delegation
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return fmt.Errorf("Delegation record %s corrupted: %v", k, err)
+			}
+			d.SecretHash = ""
+			delegations = append(delegations, d)
+			return nil
+		})
+	})
+
+	return delegations, err
+}
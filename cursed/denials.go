@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Machine-readable reasons returned in the X-Curse-Reason header (and batch results) whenever
+// a request is denied, so clients and dashboards can tell user error from attack patterns
+const (
+	reasonApprovalRequired = "APPROVAL_REQUIRED"
+	reasonAuthFailed       = "AUTH_FAILED"
+	reasonBadIP            = "BAD_IP"
+	reasonBadKey           = "BAD_KEY"
+	reasonBadRequest       = "BAD_REQUEST"
+	reasonBadUser          = "BAD_USER"
+	reasonCAUnavailable    = "CA_UNAVAILABLE"
+	reasonClockSkew        = "CLOCK_SKEW"
+	reasonCmdDenied        = "CMD_DENIED"
+	reasonDeviceDenied     = "DEVICE_DENIED"
+	reasonFrozen           = "FROZEN"
+	reasonHoneytoken       = "HONEYTOKEN"
+	reasonInfraPrincipal   = "INFRA_PRINCIPAL"
+	reasonKeyBlocked       = "KEY_BLOCKED"
+	reasonKeyTooOld        = "KEY_TOO_OLD"
+	reasonMaintenance      = "MAINTENANCE"
+	reasonNoMFA            = "NO_MFA"
+	reasonPrincipalDenied  = "PRINCIPAL_DENIED"
+	reasonQuota            = "QUOTA"
+	reasonReadOnly         = "READ_ONLY"
+	reasonRisk             = "RISK"
+	reasonTimeout          = "TIMEOUT"
+	reasonUnknownAccount   = "UNKNOWN_ACCOUNT"
+)
+
+const reasonHeader = "X-Curse-Reason"
+
+// Where to send the user to fix a denial, passed to problemError like the reason
+const remediationHeader = "X-Curse-Remediation"
+
+// What a client can do about a denial by itself, by reason. jinx regenerates its key pair on
+// regenerate_key
+var reasonActions = map[string]string{
+	reasonKeyTooOld: "regenerate_key",
+}
+
+// Denial counts by reason, published on the admin listener at /debug/vars
+var denialCounts = expvar.NewMap("denials")
+
+type denial struct {
+	reason string
+	msg    string
+}
+
+func (d *denial) Error() string {
+	return d.msg
+}
+
+func denyf(reason, format string, args ...interface{}) error {
+	return &denial{reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+func reasonOf(err error) string {
+	if d, ok := err.(*denial); ok {
+		return d.reason
+	}
+
+	return reasonBadRequest
+}
+
+func logDenial(ctx context.Context, conf *config, reason, user, fp, msg string) {
+	a := auditFrom(ctx)
+	a.note(user, fp, "")
+	denialCounts.Add(reason, 1)
+	countRequest(conf, a, reason)
+	log.Printf("Denied: reason[%s] %s %s", reason, msg, a)
+	ev := a.event(auditEvent{
+		Event:   "denied",
+		Reason:  reason,
+		Message: msg,
+	})
+	conf.webhooks.send(ev)
+	conf.decisions.record(ev)
+}
+
+func deny(w http.ResponseWriter, r *http.Request, conf *config, reason, user, msg string, status int) {
+	logDenial(r.Context(), conf, reason, user, "", msg)
+	w.Header().Set(reasonHeader, reason)
+	problemError(w, msg, status)
+}
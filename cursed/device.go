@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Certificate extension recording which enrolled device requested the certificate
+const deviceExtension = "device-id@curse"
+
+// Enrolled devices sign this payload with their device key to prove where a request came from.
+// The client side lives in jinx/device.go and must stay in sync
+func devicePayload(ts, key string) []byte {
+	return []byte("curse-device-v1\n" + ts + "\n" + strings.TrimSpace(key))
+}
+
+func loadDeviceKeys(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read device keys file: %v", err)
+	}
+
+	// authorized_keys format, with the device ID (e.g. an MDM serial number) as the comment
+	devices := make(map[string]string)
+	for len(bytes.TrimSpace(data)) > 0 {
+		pk, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse device keys file: %v", err)
+		}
+		if comment == "" {
+			return nil, fmt.Errorf("Device key %s has no device ID comment", ssh.FingerprintSHA256(pk))
+		}
+		devices[ssh.FingerprintSHA256(pk)] = comment
+		data = rest
+	}
+
+	return devices, nil
+}
+
+// verifyDevice checks the request's device assertion, returning the device's ID. Devices come
+// from devicekeysfile, or are the one a user's enrollment names
+func verifyDevice(p httpParams, conf *config, en *enrollment) (string, error) {
+	if p.deviceKey == "" {
+		if conf.RequireDevice || (en != nil && en.Device != "") {
+			return "", denyf(reasonDeviceDenied, "device assertion missing from request")
+		}
+		return "", nil
+	}
+
+	dk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.deviceKey))
+	if err != nil {
+		return "", denyf(reasonDeviceDenied, "unable to parse device key")
+	}
+	deviceID, ok := conf.devices[ssh.FingerprintSHA256(dk)]
+	if !ok {
+		deviceID, ok = enrolledDevice(en, ssh.FingerprintSHA256(dk))
+	}
+	if !ok {
+		return "", denyf(reasonDeviceDenied, "device %s is not enrolled", ssh.FingerprintSHA256(dk))
+	}
+
+	// Reject stale assertions so a captured one can't be replayed indefinitely
+	ts, err := strconv.ParseInt(p.deviceTime, 10, 64)
+	if err != nil {
+		return "", denyf(reasonDeviceDenied, "invalid device assertion timestamp")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(conf.DeviceSkew)*time.Second {
+		return "", denyf(reasonDeviceDenied, "device assertion timestamp outside allowed window")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(p.deviceSig)
+	if err != nil {
+		return "", denyf(reasonDeviceDenied, "invalid device signature encoding")
+	}
+	var sig ssh.Signature
+	err = ssh.Unmarshal(sigBytes, &sig)
+	if err != nil {
+		return "", denyf(reasonDeviceDenied, "invalid device signature")
+	}
+	err = dk.Verify(devicePayload(p.deviceTime, p.key), &sig)
+	if err != nil {
+		return "", denyf(reasonDeviceDenied, "device signature verification failed")
+	}
+
+	return deviceID, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var enrollmentBucket = []byte("enrollments")
+
+// enrollment lets a new user in before the key registry and their groups know about them.
+// A security admin issues it with a one-time code, which the user redeems with their first
+// key, and with the device named in it if there is one. Until it expires, that key (on that
+// device) is then good for the enrollment's principals without a code. Records are keyed by
+// user, so a new enrollment replaces the last
+type enrollment struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Principals []string   `json:"principals"`
+	Device     string     `json:"device,omitempty"`
+	Reason     string     `json:"reason"`
+	Issuer     string     `json:"issuer"`
+	Created    time.Time  `json:"created"`
+	Expires    time.Time  `json:"expires"`
+	Redeemed   *time.Time `json:"redeemed,omitempty"`
+	// What redeeming the code registered: the key's fingerprint, and the SHA-256 fingerprint
+	// of the device key
+	Fingerprint string `json:"fingerprint,omitempty"`
+	DeviceKey   string `json:"deviceKey,omitempty"`
+	// As with delegations only the hash of the code is stored, and the code itself returned
+	// once, when the enrollment is created
+	SecretHash string `json:"secretHash,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+var errEnrollmentNotFound = fmt.Errorf("Enrollment not found")
+
+// Codes are read out or typed in, so they're base32 in groups, and compared without the
+// dashes and regardless of case
+var enrollmentEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func normalizeEnrollmentCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func (en *enrollment) allows(principal string) bool {
+	for _, p := range en.Principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEnrollment returns the enrollment a request from user with key fp goes ahead on,
+// without redeeming it. With a code, the user's enrollment must match it; without one, only
+// an enrollment already redeemed with fp counts, and nil means the request doesn't use one
+func checkEnrollment(conf *config, user, fp, code string) (*enrollment, error) {
+	en, err := getEnrollment(conf, user)
+	if err == errEnrollmentNotFound {
+		if code != "" {
+			return nil, denyf(reasonPrincipalDenied, "Unknown enrollment code")
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if code == "" {
+		if en.Redeemed == nil || en.Fingerprint != fp || !time.Now().Before(en.Expires) {
+			return nil, nil
+		}
+		return en, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashDelegationSecret(normalizeEnrollmentCode(code))), []byte(en.SecretHash)) != 1 {
+		return nil, denyf(reasonPrincipalDenied, "Unknown enrollment code")
+	}
+	switch {
+	case !time.Now().Before(en.Expires):
+		return nil, denyf(reasonPrincipalDenied, "Enrollment %s expired at %s", en.ID, en.Expires.Format(time.RFC3339))
+	case en.Redeemed != nil && en.Fingerprint != fp:
+		return nil, denyf(reasonPrincipalDenied, "Enrollment %s was already redeemed with another key at %s", en.ID, en.Redeemed.Format(time.RFC3339))
+	}
+
+	return en, nil
+}
+
+// enrolledDevice returns the device ID for device key fp under en: the enrolled device, or
+// the one named by an enrollment about to be redeemed
+func enrolledDevice(en *enrollment, fp string) (string, bool) {
+	if en == nil || en.Device == "" {
+		return "", false
+	}
+	if en.DeviceKey == fp || (en.Redeemed == nil && en.DeviceKey == "") {
+		return en.Device, true
+	}
+	return "", false
+}
+
+// redeemEnrollment registers fp and the request's device key with en, failing if another
+// request redeemed it first
+func redeemEnrollment(conf *config, en *enrollment, fp, deviceKey string) (*enrollment, error) {
+	var redeemed *enrollment
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(enrollmentBucket)
+		if bucket == nil {
+			return errEnrollmentNotFound
+		}
+		cur, err := readEnrollment(bucket, en.User)
+		if err != nil {
+			return err
+		}
+		if cur.ID != en.ID {
+			return denyf(reasonPrincipalDenied, "Enrollment %s was replaced", en.ID)
+		}
+		if cur.Redeemed != nil {
+			return denyf(reasonPrincipalDenied, "Enrollment %s was already redeemed at %s", en.ID, cur.Redeemed.Format(time.RFC3339))
+		}
+		now := time.Now()
+		cur.Redeemed = &now
+		cur.Fingerprint = fp
+		if deviceKey != "" {
+			dk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(deviceKey))
+			if err != nil {
+				return denyf(reasonDeviceDenied, "unable to parse device key")
+			}
+			cur.DeviceKey = ssh.FingerprintSHA256(dk)
+		}
+		redeemed = cur
+		return putEnrollment(bucket, *cur)
+	})
+
+	return redeemed, err
+}
+
+func enrollmentsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		enrollments, err := listEnrollments(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, enrollments)
+	case http.MethodPost:
+		var en enrollment
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&en)
+		if err != nil {
+			problemError(w, "Unable to parse enrollment", http.StatusBadRequest)
+			return
+		}
+		if en.User == "" || len(en.Principals) == 0 || en.Reason == "" {
+			problemError(w, "user, principals and reason are required", http.StatusBadRequest)
+			return
+		}
+		// As with delegations, the issuer is whoever the admin credential belongs to
+		en.Issuer = adminIdentity(r, conf)
+		if en.Issuer == "" {
+			problemError(w, "Enrollments need a credential naming the issuer: a client certificate or an admin token", http.StatusForbidden)
+			return
+		}
+		if en.Issuer == en.User {
+			problemError(w, "Users cannot enroll themselves", http.StatusConflict)
+			return
+		}
+		now := time.Now()
+		maxExpires := now.Add(time.Duration(conf.EnrollmentMaxTTL) * time.Second)
+		if !en.Expires.After(now) || en.Expires.After(maxExpires) {
+			problemError(w, fmt.Sprintf("expires must be in the future and at most %ds away (enrollmentmaxttl)", conf.EnrollmentMaxTTL), http.StatusBadRequest)
+			return
+		}
+
+		id := make([]byte, 8)
+		secret := make([]byte, 10)
+		_, err = rand.Read(id)
+		if err == nil {
+			_, err = rand.Read(secret)
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		code := enrollmentEncoding.EncodeToString(secret)
+		en.ID = hex.EncodeToString(id)
+		en.SecretHash = hashDelegationSecret(code)
+		en.Created = now
+		en.Redeemed = nil
+		en.Fingerprint = ""
+		en.DeviceKey = ""
+		en.Code = ""
+
+		err = conf.db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(enrollmentBucket)
+			if err != nil {
+				return err
+			}
+			return putEnrollment(bucket, en)
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Enrollment %s created by %s: user[%s] principals%v until %s: %s", en.ID, en.Issuer, en.User, en.Principals, en.Expires.Format(time.RFC3339), en.Reason)
+		conf.webhooks.send(auditEvent{
+			Event:      "enrollment_created",
+			User:       en.User,
+			Principals: en.Principals,
+			Message:    en.Reason + " (by " + en.Issuer + ")",
+		})
+		en.SecretHash = ""
+		en.Code = strings.Join([]string{code[0:4], code[4:8], code[8:12], code[12:16]}, "-")
+		writeJSON(w, en)
+	case http.MethodDelete:
+		user := r.URL.Query().Get("user")
+		err := conf.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(enrollmentBucket)
+			if bucket == nil || bucket.Get([]byte(user)) == nil {
+				return errEnrollmentNotFound
+			}
+			return bucket.Delete([]byte(user))
+		})
+		if err == errEnrollmentNotFound {
+			problemError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Enrollment for %s revoked", user)
+		conf.webhooks.send(auditEvent{Event: "enrollment_revoked", User: user})
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func readEnrollment(bucket *bolt.Bucket, user string) (*enrollment, error) {
+	val := bucket.Get([]byte(user))
+	if val == nil {
+		return nil, errEnrollmentNotFound
+	}
+	en := &enrollment{}
+	err := json.Unmarshal(val, en)
+	if err != nil {
+		return nil, fmt.Errorf("Enrollment record for %s corrupted: %v", user, err)
+	}
+
+	return en, nil
+}
+
+func getEnrollment(conf *config, user string) (*enrollment, error) {
+	var en *enrollment
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(enrollmentBucket)
+		if bucket == nil {
+			return errEnrollmentNotFound
+		}
+		var err error
+		en, err = readEnrollment(bucket, user)
+		return err
+	})
+
+	return en, err
+}
+
+func putEnrollment(bucket *bolt.Bucket, en enrollment) error {
+	val, err := json.Marshal(en)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(en.User), val)
+}
+
+func listEnrollments(conf *config) ([]enrollment, error) {
+	enrollments := make([]enrollment, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(enrollmentBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var en enrollment
+			err := json.Unmarshal(v, &en)
+			if err != nil {
+				return fmt.Errorf("Enrollment record for %s corrupted: %v", k, err)
+			}
+			en.SecretHash = ""
+			enrollments = append(enrollments, en)
+			return nil
+		})
+	})
+
+	return enrollments, err
+}
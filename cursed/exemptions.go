@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var exemptionBucket = []byte("pubkeyexemptions")
+
+type exemption struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason"`
+	Expires     time.Time `json:"expires"`
+	Created     time.Time `json:"created"`
+}
+
+func exemptionsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		exemptions, err := listExemptions(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, exemptions)
+	case http.MethodPost:
+		var ex exemption
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&ex)
+		if err != nil {
+			problemError(w, "Unable to parse exemption", http.StatusBadRequest)
+			return
+		}
+		if ex.Fingerprint == "" || ex.Reason == "" {
+			problemError(w, "fingerprint and reason are required", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		maxExpires := now.Add(time.Duration(conf.ExemptionMaxTTL) * time.Second)
+		if !ex.Expires.After(now) || ex.Expires.After(maxExpires) {
+			problemError(w, fmt.Sprintf("expires must be in the future and at most %ds away (exemptionmaxttl)", conf.ExemptionMaxTTL), http.StatusBadRequest)
+			return
+		}
+		ex.Created = now
+
+		err = putExemption(conf, ex)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Added key age exemption for %s until %s: %s", ex.Fingerprint, ex.Expires.Format(time.RFC3339), ex.Reason)
+		writeJSON(w, ex)
+	case http.MethodDelete:
+		fp := r.URL.Query().Get("fingerprint")
+		if fp == "" {
+			problemError(w, "fingerprint is required", http.StatusBadRequest)
+			return
+		}
+		err := deleteExemption(conf, fp)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Removed key age exemption for %s", fp)
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putExemption(conf *config, ex exemption) error {
+	val, err := json.Marshal(ex)
+	if err != nil {
+		return err
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(exemptionBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(ex.Fingerprint), val)
+	})
+}
+
+func deleteExemption(conf *config, fp string) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exemptionBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(fp))
+	})
+}
+
+func listExemptions(conf *config) ([]exemption, error) {
+	exemptions := make([]exemption, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exemptionBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var ex exemption
+			err := json.Unmarshal(v, &ex)
+			if err != nil {
+				return fmt.Errorf("Exemption record corrupted for key %s: %v", k, err)
+			}
+			exemptions = append(exemptions, ex)
+			return nil
+		})
+	})
+
+	return exemptions, err
+}
+
+func getExemption(conf *config, fp string) (*exemption, error) {
+	var ex *exemption
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exemptionBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(fp))
+		if val == nil {
+			return nil
+		}
+		ex = &exemption{}
+		return json.Unmarshal(val, ex)
+	})
+
+	return ex, err
+}
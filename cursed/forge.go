@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forgeTeam maps a GitHub team ("org/team") or GitLab group path to the principals its
+// members may request
+type forgeTeam struct {
+	Team       string
+	Principals []string
+}
+
+// forgeIdentity is a user authenticated against GitHub or GitLab with an OAuth access token
+// or personal access token, or described by a SAML assertion
+type forgeIdentity struct {
+	login      string
+	principals []string
+	// GitHub teams ("org/team"), GitLab group paths or SAML groups the user belongs to
+	groups []string
+	keys   []ssh.PublicKey
+	// SAML assertions don't list keys, so keyregistry checks them as for proxy users
+	saml bool
+}
+
+func (id *forgeIdentity) allows(principal string) bool {
+	for _, p := range id.principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+func (id *forgeIdentity) hasKey(pk ssh.PublicKey) bool {
+	for _, k := range id.keys {
+		if string(k.Marshal()) == string(pk.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func forgeAuth(ctx context.Context, token string, conf *config) (*forgeIdentity, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var login string
+	var teams, rawKeys []string
+	var err error
+	switch conf.AuthMode {
+	case "github":
+		login, teams, rawKeys, err = githubUser(ctx, client, conf.forgeURL, token)
+	case "gitlab":
+		login, teams, rawKeys, err = gitlabUser(ctx, client, conf.forgeURL, token)
+	default:
+		return nil, fmt.Errorf("Unsupported forge %s", conf.AuthMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := &forgeIdentity{login: login, groups: teams}
+	for _, ft := range conf.ForgeTeams {
+		for _, t := range teams {
+			if strings.EqualFold(ft.Team, t) {
+				id.principals = append(id.principals, ft.Principals...)
+			}
+		}
+	}
+	for _, rk := range rawKeys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rk))
+		if err == nil {
+			id.keys = append(id.keys, pk)
+		}
+	}
+
+	return id, nil
+}
+
+func githubUser(ctx context.Context, client *http.Client, api, token string) (string, []string, []string, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	err := forgeGet(ctx, client, api+"/user", token, &user)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// Team listing needs the read:org scope. Only the first page is read, which covers
+	// anyone in fewer than 100 teams
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	err = forgeGet(ctx, client, api+"/user/teams?per_page=100", token, &teams)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var names []string
+	for _, t := range teams {
+		names = append(names, t.Organization.Login+"/"+t.Slug)
+	}
+
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	err = forgeGet(ctx, client, api+"/users/"+url.PathEscape(user.Login)+"/keys?per_page=100", token, &keys)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var rawKeys []string
+	for _, k := range keys {
+		rawKeys = append(rawKeys, k.Key)
+	}
+
+	return user.Login, names, rawKeys, nil
+}
+
+func gitlabUser(ctx context.Context, client *http.Client, api, token string) (string, []string, []string, error) {
+	var user struct {
+		Username string `json:"username"`
+	}
+	err := forgeGet(ctx, client, api+"/api/v4/user", token, &user)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var groups []struct {
+		FullPath string `json:"full_path"`
+	}
+	err = forgeGet(ctx, client, api+"/api/v4/groups?min_access_level=10&per_page=100", token, &groups)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var names []string
+	for _, g := range groups {
+		names = append(names, g.FullPath)
+	}
+
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	err = forgeGet(ctx, client, api+"/api/v4/user/keys?per_page=100", token, &keys)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var rawKeys []string
+	for _, k := range keys {
+		rawKeys = append(rawKeys, k.Key)
+	}
+
+	return user.Username, names, rawKeys, nil
+}
+
+func forgeGet(ctx context.Context, client *http.Client, u, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Forge request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Forge request %s returned %s", req.URL.Path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	freezeBucket = []byte("freeze")
+	freezeKey    = []byte("state")
+)
+
+// freezeState is kept in the database while issuance is frozen, so restarting cursed (or an
+// attacker getting it restarted) doesn't lift the freeze
+type freezeState struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	Since  time.Time `json:"since"`
+}
+
+func freezeMessage(fs freezeState) string {
+	return "Certificate issuance is frozen: " + fs.Reason
+}
+
+func loadFreeze(conf *config) (*freezeState, error) {
+	var fs *freezeState
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(freezeBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get(freezeKey)
+		if val == nil {
+			return nil
+		}
+		fs = &freezeState{}
+		return json.Unmarshal(val, fs)
+	})
+
+	return fs, err
+}
+
+// restoreFreeze puts a freeze left in the database back in place at startup
+func restoreFreeze(conf *config) error {
+	fs, err := loadFreeze(conf)
+	if err != nil || fs == nil {
+		return err
+	}
+	log.Printf("Certificate issuance frozen since %s by %s: %s", fs.Since.Format(time.RFC3339), fs.By, fs.Reason)
+	conf.mode.freeze(freezeMessage(*fs))
+	return nil
+}
+
+func saveFreeze(conf *config, fs *freezeState) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(freezeBucket)
+		if bucket == nil {
+			return fmt.Errorf("Freeze bucket missing, run cursed migrate")
+		}
+		if fs == nil {
+			return bucket.Delete(freezeKey)
+		}
+		val, err := json.Marshal(fs)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(freezeKey, val)
+	})
+}
+
+// freezeHandler is the incident response switch. POST stops all issuance, revokes every
+// unexpired certificate for the panicprincipals and pushes a new KRL; DELETE lifts the freeze
+func freezeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	var req struct {
+		Reason string `json:"reason"`
+		By     string `json:"by"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		fs, err := loadFreeze(conf)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct {
+			Frozen bool `json:"frozen"`
+			*freezeState
+		}{fs != nil, fs})
+		return
+	case http.MethodPost, http.MethodDelete:
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			problemError(w, "Unable to parse freeze request", http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" || req.By == "" {
+			problemError(w, "reason and by are required", http.StatusBadRequest)
+			return
+		}
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err := saveFreeze(conf, nil)
+		if err == nil {
+			err = conf.mode.unfreeze(conf.Mode, conf.MaintenanceMessage)
+		}
+		if err != nil {
+			log.Printf("Unable to lift the freeze: %v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Certificate issuance unfrozen by %s: %s", req.By, req.Reason)
+		conf.webhooks.send(auditEvent{Event: "unfrozen", User: req.By, Reason: req.Reason})
+		writeJSON(w, struct {
+			Frozen bool `json:"frozen"`
+		}{false})
+		return
+	}
+
+	// Stop issuing first, the rest can take a while
+	fs := freezeState{Reason: req.Reason, By: req.By, Since: time.Now()}
+	conf.mode.freeze(freezeMessage(fs))
+	log.Printf("Certificate issuance frozen by %s: %s", req.By, req.Reason)
+	conf.webhooks.send(auditEvent{Event: "frozen", User: req.By, Reason: req.Reason})
+	res := struct {
+		Frozen  bool         `json:"frozen"`
+		Revoked []issuedCert `json:"revoked"`
+		KRL     string       `json:"krl,omitempty"`
+		Errors  []string     `json:"errors,omitempty"`
+	}{Frozen: true, Revoked: []issuedCert{}}
+
+	// The freeze holds in memory regardless, but wouldn't outlive a restart
+	err := saveFreeze(conf, &fs)
+	if err != nil {
+		log.Printf("Unable to save the freeze: %v", err)
+		res.Errors = append(res.Errors, "freeze not saved, it will be lifted if cursed restarts: "+err.Error())
+	}
+
+	if len(conf.PanicPrincipals) > 0 {
+		reason := "Freeze: " + req.Reason
+		revoked, err := revokeIssued(conf, revokeRequest{Principals: conf.PanicPrincipals, Reason: reason})
+		if err != nil {
+			log.Printf("Unable to revoke panicprincipals certificates: %v", err)
+			res.Errors = append(res.Errors, "revoking certificates: "+err.Error())
+		} else {
+			res.Revoked = revoked
+			announceRevoked(conf, revoked, reason)
+		}
+	}
+
+	// Push a fresh KRL even with nothing newly revoked, in case the last one never went out
+	if conf.KRLFile != "" {
+		res.KRL, err = writeKRL(conf)
+		if err != nil {
+			log.Printf("Unable to regenerate KRL after freezing: %v", err)
+			res.Errors = append(res.Errors, "regenerating KRL: "+err.Error())
+		}
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// gitHost describes a Git server reached over SSH as Account, usually git. Requests for that
+// principal get a certificate that can do nothing but run Command, the server's git shell,
+// with no pty or forwarding. Roles map the user's groups (see groupextension) to principals
+// standing for repo roles, which the server lists in its AuthorizedPrincipalsFile. Without
+// roles the certificate carries Account, for servers like Gitolite that learn the user from
+// the forced command instead
+type gitHost struct {
+	Name    string
+	Account string
+	Command string
+	Roles   []gitRole
+}
+
+// gitRole grants Principals to members of Group, or to everyone with "*". %u in a principal
+// is replaced with the user's name
+type gitRole struct {
+	Group      string
+	Principals []string
+}
+
+func validateGitHosts(hosts []gitHost, groupExtension string) error {
+	accounts := make(map[string]bool)
+	for _, gh := range hosts {
+		if gh.Name == "" {
+			return fmt.Errorf("Every githosts entry needs a name")
+		}
+		if gh.Account == "" {
+			return fmt.Errorf("Git host %s has no account", gh.Name)
+		}
+		if accounts[gh.Account] {
+			return fmt.Errorf("Git host %s reuses account %s", gh.Name, gh.Account)
+		}
+		accounts[gh.Account] = true
+		if gh.Command == "" {
+			return fmt.Errorf("Git host %s has no command", gh.Name)
+		}
+		for _, role := range gh.Roles {
+			if role.Group == "" || len(role.Principals) == 0 {
+				return fmt.Errorf("Every role of git host %s needs a group and principals", gh.Name)
+			}
+			if role.Group != "*" && groupExtension == "" {
+				return fmt.Errorf("Git host %s maps groups to roles, which needs groupextension", gh.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchGitHost returns the git host whose account is principal, if any
+func matchGitHost(conf *config, principal string) *gitHost {
+	for i, gh := range conf.GitHosts {
+		if gh.Account == principal {
+			return &conf.GitHosts[i]
+		}
+	}
+	return nil
+}
+
+// command returns the forced command for user, with %u replaced by their name
+func (gh *gitHost) command(user string) string {
+	return strings.NewReplacer("%u", user, "%%", "%").Replace(gh.Command)
+}
+
+// principals returns the principals user's groups are granted on the git host
+func (gh *gitHost) principals(user string, groups []string) []string {
+	if len(gh.Roles) == 0 {
+		return []string{gh.Account}
+	}
+
+	member := map[string]bool{"*": true}
+	for _, g := range groups {
+		member[g] = true
+	}
+	seen := make(map[string]bool)
+	var principals []string
+	for _, role := range gh.Roles {
+		if !member[role.Group] {
+			continue
+		}
+		for _, pr := range role.Principals {
+			pr = strings.Replace(pr, "%u", user, -1)
+			if !seen[pr] {
+				seen[pr] = true
+				principals = append(principals, pr)
+			}
+		}
+	}
+	return principals
+}
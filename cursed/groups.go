@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Certificate extension listing the user's groups, comma separated, so sudoers generators and
+// AuthorizedPrincipalsCommand helpers on the target host don't need a directory lookup of
+// their own. sshd ignores extensions it doesn't know
+const groupsExtension = "groups@curse"
+
+// userGroups looks up the groups for the groupextension setting
+func userGroups(ctx context.Context, conf *config, p httpParams) ([]string, error) {
+	var raw []string
+	switch conf.GroupExtension {
+	case "ldap":
+		var err error
+		raw, err = conf.groupCache.fetch(ctx, lookupKey(p.bastionUser), func(ctx context.Context) ([]string, error) {
+			return ldapGroups(ctx, conf, p.bastionUser)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Group lookup for %s failed: %w", p.bastionUser, err)
+		}
+	case "forge", "saml":
+		if p.identity != nil {
+			raw = p.identity.groups
+		}
+	}
+
+	var groups []string
+	for _, g := range raw {
+		if g == "" || strings.IndexFunc(g, func(r rune) bool { return r == ',' || r < ' ' }) >= 0 {
+			log.Printf("Leaving group %q out of the certificate for %s", g, p.bastionUser)
+			continue
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+// ldapGroups looks up the names of user's groups in ldapgroupattr
+func ldapGroups(ctx context.Context, conf *config, user string) ([]string, error) {
+	values, err := ldapAttr(ctx, conf, user, conf.LDAPGroupAttr)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		names = append(names, ldapGroupName(v))
+	}
+	return names, nil
+}
+
+// ldapGroupName turns a memberOf DN such as cn=admins,ou=groups,dc=example,dc=com into the
+// group's name. Attributes holding plain names are returned as is
+func ldapGroupName(v string) string {
+	dn, err := ldap.ParseDN(v)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return v
+	}
+
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+// withExtension returns a copy of exts with name set, leaving the shared configured map alone
+func withExtension(exts map[string]string, name, value string) map[string]string {
+	res := make(map[string]string, len(exts)+1)
+	for k, v := range exts {
+		res[k] = v
+	}
+	res[name] = value
+
+	return res
+}
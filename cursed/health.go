@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/netutil"
+)
+
+// serveHealth runs the plaintext listener for L4 load balancers that can't do TLS or send
+// credentials. It only answers /healthz, with a bare status: anything else, including why a
+// node isn't ready, stays on the authenticated listeners
+func serveHealth(store *confStore) {
+	conf := store.load()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthzHandler(w, r, store.load())
+	})
+
+	srv := newServer(conf, net.JoinHostPort(conf.HealthAddr, strconv.Itoa(conf.HealthPort)), withHeaders(store, mux))
+	log.Printf("Starting HTTP health check server on %s", srv.Addr)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("Health check listener service: %v", err)
+	}
+	if conf.HTTPMaxConns > 0 {
+		ln = netutil.LimitListener(ln, conf.HTTPMaxConns)
+	}
+	err = srv.Serve(ln)
+	if err != nil {
+		log.Fatalf("Health check listener service: %v", err)
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := notReady(conf); err != nil {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
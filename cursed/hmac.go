@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	hmacSignatureHeader = "X-Curse-Signature"
+	hmacTimestampHeader = "X-Curse-Timestamp"
+)
+
+// verifyProxyHMAC checks the proxy's signature over method, path, timestamp and body. The
+// timestamp is bounded by proxyhmacskew so captured requests can't be replayed later.
+func verifyProxyHMAC(r *http.Request, conf *config) error {
+	ts := r.Header.Get(hmacTimestampHeader)
+	sig, err := hex.DecodeString(r.Header.Get(hmacSignatureHeader))
+	if ts == "" || err != nil || len(sig) == 0 {
+		return fmt.Errorf("Missing or malformed %s/%s headers", hmacSignatureHeader, hmacTimestampHeader)
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid %s header: %v", hmacTimestampHeader, err)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(conf.ProxyHMACSkew)*time.Second {
+		return fmt.Errorf("Request timestamp outside allowed skew: %v", skew)
+	}
+
+	// Read the body for signing and put it back for the handler
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("Unable to read request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(conf.ProxyHMACKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), ts)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("Invalid request signature")
+	}
+
+	return nil
+}
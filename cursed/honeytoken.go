@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Requests for honeytoken principals, published on the admin listener at /debug/vars
+var honeytokenHits = expvar.NewInt("honeytokens")
+
+func validateHoneytokens(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid honeytokenprincipals pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchHoneytoken returns the first of principals matching a honeytokenprincipals pattern
+func matchHoneytoken(conf *config, principals ...string) string {
+	for _, pattern := range conf.HoneytokenPrincipals {
+		for _, principal := range principals {
+			if ok, _ := path.Match(pattern, principal); ok {
+				return principal
+			}
+		}
+	}
+	return ""
+}
+
+// honeytokenDenial denies a request naming a honeytoken principal and raises the alarm.
+// Nobody has a reason to ask for one, so whoever did is probably trying stolen credentials.
+// The client gets the same answer as for any other principal it may not have, so the
+// tripwire isn't given away
+func honeytokenDenial(ctx context.Context, conf *config, p httpParams, fp, principal string) signResult {
+	honeytokenHits.Add(1)
+	a := auditFrom(ctx)
+	a.note(p.bastionUser, fp, "")
+	msg := fmt.Sprintf("Honeytoken principal %s requested", principal)
+	detail := fmt.Sprintf("%s by %s", msg, a)
+	log.Printf("ALERT: %s", detail)
+	logDenial(ctx, conf, reasonHoneytoken, p.bastionUser, fp, msg)
+	conf.webhooks.send(a.event(auditEvent{
+		Event:      "honeytoken",
+		Principals: []string{principal},
+		Message:    detail,
+	}))
+
+	// Don't hold up the response on the mail server, the attacker shouldn't notice a delay
+	if conf.SMTPAddr != "" && conf.HoneytokenAlertEmail != "" {
+		go func() {
+			body := fmt.Sprintf("%s at %s.\r\n\r\nThe request was denied. Treat %s's credentials as compromised until shown otherwise.",
+				detail, time.Now().Format(time.RFC1123), p.bastionUser)
+			err := sendEmail(conf, conf.HoneytokenAlertEmail, "ALERT: SSH honeytoken principal requested", body)
+			if err != nil {
+				log.Printf("Failed to email honeytoken alert to %s: %v", conf.HoneytokenAlertEmail, err)
+			}
+		}()
+	}
+
+	errMsg := fmt.Sprintf("Principal %s is not permitted", principal)
+	return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// hostCertRequester lets User, or members of Group (see groupextension), request host
+// certificates through /batch for principals matching Hosts, patterns as in tiers. A host
+// certificate from this CA is trusted by every client using /knownhosts, so nobody gets one
+// unless an entry grants it, and only for the hosts it names
+type hostCertRequester struct {
+	User  string
+	Group string
+	Hosts []string
+}
+
+func validateHostCertRequesters(conf *config) error {
+	if conf.AllowHostCerts && len(conf.HostCertRequesters) == 0 {
+		return fmt.Errorf("allowhostcerts requires hostcertrequesters")
+	}
+	for _, hr := range conf.HostCertRequesters {
+		if (hr.User == "") == (hr.Group == "") {
+			return fmt.Errorf("Every hostcertrequesters entry needs a user or a group, not both")
+		}
+		if hr.Group != "" && conf.GroupExtension == "" {
+			return fmt.Errorf("hostcertrequesters for group %s needs groupextension", hr.Group)
+		}
+		if len(hr.Hosts) == 0 {
+			return fmt.Errorf("hostcertrequesters entry for %s%s has no hosts", hr.User, hr.Group)
+		}
+		for _, pattern := range hr.Hosts {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Invalid host pattern %q in hostcertrequesters: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkHostCertRequester denies p.bastionUser host certificates for any of principals no
+// hostcertrequesters entry of theirs grants
+func checkHostCertRequester(ctx context.Context, conf *config, p httpParams, principals []string) error {
+	var patterns []string
+	var groups []string
+	looked := false
+	for _, hr := range conf.HostCertRequesters {
+		switch {
+		case hr.User != "":
+			if hr.User != p.bastionUser {
+				continue
+			}
+		default:
+			if !looked {
+				var err error
+				groups, err = userGroups(ctx, conf, p)
+				if err != nil {
+					return err
+				}
+				looked = true
+			}
+			if !stringInSlice(hr.Group, groups) {
+				continue
+			}
+		}
+		patterns = append(patterns, hr.Hosts...)
+	}
+	if len(patterns) == 0 {
+		return denyf(reasonPrincipalDenied, "%s may not request host certificates", p.bastionUser)
+	}
+
+	for _, principal := range principals {
+		granted := false
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, principal); ok {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return denyf(reasonPrincipalDenied, "%s may not request host certificates for %s", p.bastionUser, principal)
+		}
+	}
+	return nil
+}
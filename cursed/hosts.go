@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var hostBucket = []byte("hostcerts")
+
+// Namespace for signatures over the known_hosts bundle, see signSSHSig
+const knownHostsNamespace = "curse-known-hosts"
+
+// hostRecord is kept for every host certificate we issue, keyed by host key fingerprint
+type hostRecord struct {
+	Key         string    `json:"key"`
+	Principals  []string  `json:"principals"`
+	ValidBefore time.Time `json:"validBefore"`
+	Issued      time.Time `json:"issued"`
+}
+
+func recordHost(conf *config, pk ssh.PublicKey, principals []string, vb time.Time) error {
+	hr := hostRecord{
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))),
+		Principals:  principals,
+		ValidBefore: vb,
+		Issued:      time.Now(),
+	}
+	fp := []byte(ssh.FingerprintSHA256(pk))
+	val, err := marshalRecord(conf, hostBucket, fp, hr)
+	if err != nil {
+		return err
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(hostBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(fp, val)
+	})
+}
+
+// listHosts returns hosts with an unexpired certificate
+func listHosts(conf *config) ([]hostRecord, error) {
+	hosts := make([]hostRecord, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hostBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var hr hostRecord
+			err := unmarshalRecord(conf, hostBucket, k, v, &hr)
+			if err != nil {
+				return fmt.Errorf("Host record corrupted for key %s: %v", k, err)
+			}
+			if hr.ValidBefore.After(time.Now()) {
+				hosts = append(hosts, hr)
+			}
+			return nil
+		})
+	})
+
+	return hosts, err
+}
+
+// SSHFP algorithm numbers from RFC 4255, 6594 and 7479
+var sshfpAlgorithms = map[string]int{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+func sshfpRecords(hosts []hostRecord) (string, error) {
+	var b strings.Builder
+	for _, hr := range hosts {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hr.Key))
+		if err != nil {
+			return "", fmt.Errorf("Host record has an invalid key: %v", err)
+		}
+		alg, ok := sshfpAlgorithms[pk.Type()]
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256(pk.Marshal())
+		for _, name := range hr.Principals {
+			if !strings.HasSuffix(name, ".") {
+				name += "."
+			}
+			fmt.Fprintf(&b, "%s IN SSHFP %d 2 %x\n", name, alg, sum)
+		}
+	}
+
+	return b.String(), nil
+}
+
+func knownHostsBundle(conf *config, hosts []hostRecord) string {
+	// The CA lines let clients trust any certificate we sign, the host keys cover clients
+	// that don't support host certificates
+	bundle := knownHostsLines(conf)
+	for _, hr := range hosts {
+		bundle += fmt.Sprintf("%s %s\n", strings.Join(hr.Principals, ","), hr.Key)
+	}
+
+	return bundle
+}
+
+type signedKnownHosts struct {
+	KnownHosts string `json:"knownHosts"`
+	Signature  string `json:"signature"`
+}
+
+func hostsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hosts, err := listHosts(conf)
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/hosts":
+		writeJSON(w, hosts)
+	case "/hosts/sshfp":
+		records, err := sshfpRecords(hosts)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(records))
+	case "/hosts/known_hosts":
+		// Sign in the same request so the signature always matches the bundle we return
+		bundle := knownHostsBundle(conf, hosts)
+		sig, err := signSSHSig(conf.caSigner, knownHostsNamespace, []byte(bundle))
+		if err != nil {
+			log.Printf("Failed to sign known_hosts bundle: %v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, signedKnownHosts{bundle, string(sig)})
+	default:
+		http.NotFound(w, r)
+	}
+}
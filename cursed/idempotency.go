@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var idempotencyBucket = []byte("idempotency")
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// Set on responses replayed from an earlier request with the same key
+	replayedHeader = "Idempotent-Replayed"
+)
+
+var validIdempotencyKey = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// errIdempotencyMismatch means a key was reused for a different request, which is a client bug
+// rather than a retry
+var errIdempotencyMismatch = fmt.Errorf("%s was already used for a different request", idempotencyHeader)
+
+type idempotentResult struct {
+	Hash        string    `json:"hash"`
+	Certificate string    `json:"certificate"`
+	Expires     time.Time `json:"expires"`
+}
+
+// requestHash identifies what was asked for. Device assertions are left out since clients
+// re-sign them with a fresh timestamp on every attempt
+func requestHash(p httpParams) string {
+	h := sha256.New()
+	for _, f := range []string{p.key, p.remoteUser, p.cmd, p.userIP, p.bastionIP} {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Keys belong to the user that sent them, so one user can't replay another's certificate
+func idempotencyID(user, key string) []byte {
+	return []byte(user + "\x00" + key)
+}
+
+// lookupIdempotent returns the certificate issued earlier for this user and key, if any
+func lookupIdempotent(conf *config, user, key string, p httpParams) (string, bool, error) {
+	var res idempotentResult
+	found := false
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		if bucket == nil {
+			return nil
+		}
+		id := idempotencyID(user, key)
+		val := bucket.Get(id)
+		if val == nil {
+			return nil
+		}
+		err := unmarshalRecord(conf, idempotencyBucket, id, val, &res)
+		if err != nil {
+			return fmt.Errorf("Idempotency record corrupted for %s: %v", user, err)
+		}
+		found = time.Now().Before(res.Expires)
+		return nil
+	})
+	if err != nil || !found {
+		return "", false, err
+	}
+	if res.Hash != requestHash(p) {
+		return "", false, errIdempotencyMismatch
+	}
+
+	return res.Certificate, true, nil
+}
+
+// checkReplay returns why a certificate stored for an Idempotency-Key mustn't be handed out
+// again, if something has changed since it was issued: its key blocked, the certificate
+// revoked, or one of its principals made a honeytoken. The service mode was checked before
+// the request got this far
+func checkReplay(conf *config, cert string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cert))
+	if err != nil {
+		return fmt.Errorf("Stored certificate unreadable: %v", err)
+	}
+	c, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Stored certificate is a plain %s key", pub.Type())
+	}
+	if principal := matchHoneytoken(conf, c.ValidPrincipals...); principal != "" {
+		return denyf(reasonHoneytoken, "Principal %s is a honeytoken", principal)
+	}
+	err = checkKeyLists(conf, c.Key, conf.KeyAllowlist)
+	if err != nil {
+		return err
+	}
+	ic, err := certRevocation(conf, c.KeyId)
+	if err != nil {
+		return err
+	}
+	if ic != nil {
+		return denyf(reasonKeyBlocked, "Certificate %s was revoked: %s", c.KeyId, ic.RevokedReason)
+	}
+	return nil
+}
+
+// storeIdempotent remembers an issued certificate for idempotencyttl, dropping expired
+// records while it's at it
+func storeIdempotent(conf *config, user, key string, p httpParams, cert string) error {
+	id := idempotencyID(user, key)
+	val, err := marshalRecord(conf, idempotencyBucket, id, idempotentResult{
+		Hash:        requestHash(p),
+		Certificate: cert,
+		Expires:     time.Now().Add(time.Duration(conf.IdempotencyTTL) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var expired [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			var res idempotentResult
+			if unmarshalRecord(conf, idempotencyBucket, k, v, &res) != nil || now.After(res.Expires) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return bucket.Put(id, val)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestCheckReplay checks a stored certificate stops being replayed once its key is blocked,
+// it's revoked, or its principal becomes a honeytoken
+func TestCheckReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursed-idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := bolt.Open(filepath.Join(dir, "cursed.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             pk,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice-1",
+		ValidPrincipals: []string{"deploy"},
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := string(ssh.MarshalAuthorizedKey(cert))
+
+	conf := &config{db: db, krlResponse: &krlCache{}}
+	if err = checkReplay(conf, stored); err != nil {
+		t.Fatalf("unchanged certificate not replayed: %v", err)
+	}
+
+	conf.HoneytokenPrincipals = []string{"dep*"}
+	if err = checkReplay(conf, stored); reasonOf(err) != reasonHoneytoken {
+		t.Errorf("certificate for a honeytoken principal replayed: %v", err)
+	}
+	conf.HoneytokenPrincipals = nil
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(issuedBucket)
+		if err != nil {
+			return err
+		}
+		revoked := time.Now()
+		val, err := marshalRecord(conf, issuedBucket, []byte(cert.KeyId), issuedCert{
+			KeyID: cert.KeyId, ValidBefore: time.Now().Add(time.Hour), Revoked: &revoked, RevokedReason: "laptop stolen",
+		})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(cert.KeyId), val)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkReplay(conf, stored); reasonOf(err) != reasonKeyBlocked {
+		t.Errorf("revoked certificate replayed: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(issuedBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putKeyListEntry(conf, keyListEntry{Fingerprint: ssh.FingerprintSHA256(pk), List: keyListDeny, Reason: "compromised", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkReplay(conf, stored); reasonOf(err) != reasonKeyBlocked {
+		t.Errorf("certificate for a blocked key replayed: %v", err)
+	}
+}
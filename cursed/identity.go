@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Requests whose identity sources named different users, published on the admin listener
+// at /debug/vars
+var identityMismatches = expvar.NewInt("identitymismatches")
+
+// identitySource is one entry of userheaders: a header holding the username, or with a claim
+// ("X-Forwarded-Access-Token:preferred_username"), a JWT whose payload claim holds it
+type identitySource struct {
+	header string
+	claim  string
+}
+
+func (s identitySource) String() string {
+	if s.claim == "" {
+		return s.header
+	}
+	return s.header + ":" + s.claim
+}
+
+// value returns the user the source names, or an empty string when the request doesn't carry
+// it. The token's signature isn't checked: like a plain header, it's trusted because only the
+// authenticated reverse proxy can send it
+func (s identitySource) value(r *http.Request) (string, error) {
+	val := r.Header.Get(s.header)
+	if s.claim == "" || val == "" {
+		return val, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(val), "Bearer "), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%s is not a JWT", s.header)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("%s payload is not base64url: %v", s.header, err)
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return "", fmt.Errorf("%s payload is not JSON: %v", s.header, err)
+	}
+	switch v := claims[s.claim].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s claim %s is not a string", s.header, s.claim)
+	}
+}
+
+// parseIdentitySources reads userheaders, falling back to userheader on its own
+func parseIdentitySources(userHeader string, userHeaders []string) ([]identitySource, error) {
+	if len(userHeaders) == 0 {
+		return []identitySource{{header: userHeader}}, nil
+	}
+	var sources []identitySource
+	for _, entry := range userHeaders {
+		header, claim := entry, ""
+		if i := strings.Index(entry, ":"); i >= 0 {
+			header, claim = entry[:i], entry[i+1:]
+		}
+		header, claim = strings.TrimSpace(header), strings.TrimSpace(claim)
+		if header == "" || (claim == "" && strings.Contains(entry, ":")) {
+			return nil, fmt.Errorf("Invalid userheaders entry %q (valid: Header or Header:claim)", entry)
+		}
+		sources = append(sources, identitySource{header: header, claim: claim})
+	}
+	return sources, nil
+}
+
+// describeIdentitySources names the configured sources for error messages
+func describeIdentitySources(conf *config) string {
+	names := make([]string, len(conf.identitySources))
+	for i, s := range conf.identitySources {
+		names[i] = s.String()
+	}
+	return strings.Join(names, " or ")
+}
+
+// proxyUser returns the user asserted by the reverse proxy. The first source present wins,
+// and every other source present must name the same user: a disagreement means one of them
+// was forged or mangled on the way, so it's logged as a possible spoofing attempt and, unless
+// userheadermismatch is log, denied
+func proxyUser(w http.ResponseWriter, r *http.Request, conf *config) (string, bool) {
+	var user string
+	var from identitySource
+	for _, src := range conf.identitySources {
+		val, err := src.value(r)
+		if err != nil {
+			log.Printf("Unreadable identity from %s: %v", r.RemoteAddr, err)
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+		if val == "" {
+			continue
+		}
+		val = normalizeUser(val, conf)
+		if user == "" {
+			user, from = val, src
+			continue
+		}
+		if val == user {
+			continue
+		}
+
+		identityMismatches.Add(1)
+		msg := fmt.Sprintf("Identity mismatch, possible spoofing attempt: %s says %q but %s says %q, from %s",
+			from, user, src, val, r.RemoteAddr)
+		log.Printf("%s", msg)
+		conf.webhooks.send(auditEvent{Event: "identity_mismatch", User: user, Message: msg})
+		if conf.UserHeaderMismatch != "log" {
+			deny(w, r, conf, reasonAuthFailed, user, "Unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+	}
+	return user, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Requests for principals of the CA's own infrastructure, refused and let through with
+// break-glass, published on the admin listener at /debug/vars
+var infraRequests = expvar.NewMap("infra")
+
+func validateInfraPrincipals(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid infraprincipals pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchInfra returns the first of principals matching an infraprincipals pattern. Host
+// certificates naming the host cursed runs on match too, whatever the patterns
+func matchInfra(conf *config, host bool, principals ...string) string {
+	for _, pattern := range conf.InfraPrincipals {
+		for _, principal := range principals {
+			if ok, _ := path.Match(pattern, principal); ok {
+				return principal
+			}
+		}
+	}
+	if !host {
+		return ""
+	}
+	self, err := os.Hostname()
+	if err != nil || self == "" {
+		return ""
+	}
+	self = strings.ToLower(strings.TrimSuffix(self, "."))
+	for _, principal := range principals {
+		p := strings.ToLower(strings.TrimSuffix(principal, "."))
+		if p == self || strings.HasPrefix(p, self+".") || strings.HasPrefix(self, p+".") {
+			return principal
+		}
+	}
+	return ""
+}
+
+// checkInfra refuses certificates for the accounts and hosts of the CA and bastions. Anyone
+// holding one could reach the CA key, or stand in for the CA host, and so sign whatever they
+// liked. A request with break-glass set is let through, but raises the same alarm as a
+// refused one, so it's never quiet
+func checkInfra(ctx context.Context, conf *config, user, fp string, host, breakGlass bool, principals ...string) error {
+	principal := matchInfra(conf, host, principals...)
+	if principal == "" {
+		return nil
+	}
+
+	a := auditFrom(ctx)
+	a.note(user, fp, "")
+	event, counter := "infra_denied", "denied"
+	detail := fmt.Sprintf("Refused certificate for infrastructure principal %s requested by %s", principal, a)
+	if breakGlass {
+		event, counter = "infra_breakglass", "breakglass"
+		detail = fmt.Sprintf("Break-glass certificate for infrastructure principal %s requested by %s", principal, a)
+	}
+	infraRequests.Add(counter, 1)
+	log.Printf("ALERT: %s", detail)
+	conf.webhooks.send(a.event(auditEvent{
+		Event:      event,
+		Principals: []string{principal},
+		Message:    detail,
+	}))
+	if conf.SMTPAddr != "" && conf.InfraAlertEmail != "" {
+		go func() {
+			body := fmt.Sprintf("%s at %s.", detail, time.Now().Format(time.RFC1123))
+			err := sendEmail(conf, conf.InfraAlertEmail, "ALERT: SSH certificate requested for CA infrastructure", body)
+			if err != nil {
+				log.Printf("Failed to email infrastructure alert to %s: %v", conf.InfraAlertEmail, err)
+			}
+		}()
+	}
+
+	if breakGlass {
+		return nil
+	}
+	return denyf(reasonInfraPrincipal, "Principal %s belongs to the CA infrastructure, request it with break-glass if you must", principal)
+}
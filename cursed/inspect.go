@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type inspectRequest struct {
+	Cert string `form:"cert"`
+}
+
+// inspectResult is a certificate as ssh-keygen -L would show it, plus what only we can tell:
+// whether we signed it and whether its key has since been blocked
+type inspectResult struct {
+	CertType        string            `json:"certType"`
+	Serial          uint64            `json:"serial"`
+	KeyID           string            `json:"keyId"`
+	ValidPrincipals []string          `json:"validPrincipals"`
+	CriticalOptions map[string]string `json:"criticalOptions"`
+	Extensions      map[string]string `json:"extensions"`
+	Fingerprint     string            `json:"fingerprint"`
+	CAFingerprint   string            `json:"caFingerprint"`
+	SignedByCA      bool              `json:"signedByCA"`
+	ValidAfter      time.Time         `json:"validAfter"`
+	ValidBefore     time.Time         `json:"validBefore"`
+	Expired         bool              `json:"expired"`
+	Revoked         bool              `json:"revoked"`
+	RevokedReason   string            `json:"revokedReason,omitempty"`
+	Valid           bool              `json:"valid"`
+}
+
+func inspectHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.PostFormValue("cert")))
+	if err != nil {
+		problemError(w, "Unable to parse certificate", http.StatusBadRequest)
+		return
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		problemError(w, "Not a certificate", http.StatusBadRequest)
+		return
+	}
+
+	res, err := inspectCert(conf, cert)
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func inspectCert(conf *config, cert *ssh.Certificate) (inspectResult, error) {
+	res := inspectResult{
+		CertType:        "user",
+		Serial:          cert.Serial,
+		KeyID:           cert.KeyId,
+		ValidPrincipals: cert.ValidPrincipals,
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		Fingerprint:     ssh.FingerprintLegacyMD5(cert.Key),
+		CAFingerprint:   ssh.FingerprintSHA256(cert.SignatureKey),
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0),
+	}
+	if cert.CertType == ssh.HostCert {
+		res.CertType = "host"
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		res.ValidBefore = time.Time{}
+	}
+
+	// Anyone can build a certificate naming our CA, so check the signature rather than the name
+	caKey := conf.caSigner.PublicKey().Marshal()
+	res.SignedByCA = bytes.Equal(cert.SignatureKey.Marshal(), caKey) && certSignatureValid(cert)
+
+	now := uint64(time.Now().Unix())
+	res.Expired = now >= cert.ValidBefore
+
+	err := checkKeyLists(conf, cert.Key, false)
+	if _, denied := err.(*denial); denied {
+		res.Revoked = true
+		res.RevokedReason = err.Error()
+	} else if err != nil {
+		return res, err
+	}
+	if !res.Revoked && res.SignedByCA {
+		ic, err := certRevocation(conf, cert.KeyId)
+		if err != nil {
+			return res, err
+		}
+		if ic != nil {
+			res.Revoked = true
+			res.RevokedReason = fmt.Sprintf("Certificate revoked at %s: %s", ic.Revoked.Format(time.RFC3339), ic.RevokedReason)
+		}
+	}
+
+	res.Valid = res.SignedByCA && !res.Revoked && now >= cert.ValidAfter && !res.Expired
+	return res, nil
+}
+
+// certSignatureValid checks the CA signature over everything in the certificate that comes
+// before it, which x/crypto/ssh only does as part of authenticating a connection
+func certSignatureValid(cert *ssh.Certificate) bool {
+	if cert.Signature == nil {
+		return false
+	}
+	marshaled := cert.Marshal()
+	sig := ssh.Marshal(cert.Signature)
+	signedLen := len(marshaled) - 4 - len(sig)
+	if signedLen < 0 || binary.BigEndian.Uint32(marshaled[signedLen:]) != uint32(len(sig)) {
+		return false
+	}
+
+	return cert.SignatureKey.Verify(marshaled[:signedLen], cert.Signature) == nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bgentry/speakeasy"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Extension marking a certificate as the root's endorsement of an intermediate CA key
+const intermediateExtension = "intermediate-ca@curse"
+
+// sshd doesn't follow certificate chains, it only trusts the keys in TrustedUserCAKeys. So the
+// hierarchy lives in userland: an offline root key certifies each intermediate CA key with
+// an SSH certificate, cursed signs with an intermediate and publishes the certificates at
+// /ca/chain, and `cursed trust` on each host checks them against the root it has pinned and
+// writes out the intermediate keys to trust
+
+// runIntermediate generates an intermediate CA key, signed by the root key, as NAME,
+// NAME.pub and NAME-cert.pub
+func runIntermediate(rootKeyFile, name string, days int) error {
+	rootBytes, err := ioutil.ReadFile(rootKeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read root key: %v", err)
+	}
+	root, err := ssh.ParsePrivateKey(rootBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		var pass string
+		pass, err = speakeasy.Ask("Root key passphrase: ")
+		if err != nil {
+			return fmt.Errorf("Input error: %v", err)
+		}
+		root, err = ssh.ParsePrivateKeyWithPassphrase(rootBytes, []byte(pass))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to parse root key: %v", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	env := filepath.Base(name)
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             sshPub,
+		CertType:        ssh.HostCert,
+		KeyId:           "intermediate " + env,
+		ValidPrincipals: []string{env},
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.AddDate(0, 0, days).Unix()),
+		Permissions:     ssh.Permissions{Extensions: map[string]string{intermediateExtension: ""}},
+	}
+	err = cert.SignCert(rand.Reader, root)
+	if err != nil {
+		return fmt.Errorf("Failed to sign intermediate: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "curse intermediate "+env)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		path    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{name, pem.EncodeToMemory(block), 0600},
+		{name + ".pub", ssh.MarshalAuthorizedKey(sshPub), 0644},
+		{name + "-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644},
+	}
+	for _, f := range files {
+		err = ioutil.WriteFile(f.path, f.content, f.mode)
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %v", f.path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", f.path)
+	}
+	fmt.Fprintf(os.Stderr, "Valid until %s. Add %s-cert.pub to cachain before switching cakeyfile to it\n", now.AddDate(0, 0, days).Format(time.RFC3339), name)
+	return nil
+}
+
+func parseIntermediate(line []byte) (*ssh.Certificate, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	if _, ok := cert.Extensions[intermediateExtension]; !ok {
+		return nil, fmt.Errorf("certificate %q is not for an intermediate CA", cert.KeyId)
+	}
+	return cert, nil
+}
+
+// loadCAChain reads the cachain certificates into the /ca/chain response. Expired ones are
+// an error, since hosts would drop them
+func loadCAChain(conf *config) error {
+	var chain bytes.Buffer
+	for _, file := range conf.CAChain {
+		b, err := ioutil.ReadFile(expandHome(file))
+		if err != nil {
+			return fmt.Errorf("Failed to read cachain certificate: %v", err)
+		}
+		cert, err := parseIntermediate(bytes.TrimSpace(b))
+		if err != nil {
+			return fmt.Errorf("Invalid cachain certificate %s: %v", file, err)
+		}
+		vb := time.Unix(int64(cert.ValidBefore), 0)
+		switch {
+		case time.Now().After(vb):
+			return fmt.Errorf("cachain certificate %s expired on %s", file, vb.Format(time.RFC3339))
+		case time.Now().AddDate(0, 0, 14).After(vb):
+			log.Printf("cachain certificate %s expires on %s, rotate to a new intermediate", file, vb.Format(time.RFC3339))
+		}
+		chain.Write(ssh.MarshalAuthorizedKey(cert))
+	}
+	if chain.Len() > 0 {
+		conf.caChain = newCachedResponse(chain.Bytes())
+	}
+	return nil
+}
+
+// checkCAChain makes sure hosts trusting the chain will accept what we sign
+func checkCAChain(conf *config) error {
+	if conf.caChain == nil {
+		return nil
+	}
+	caKey := conf.caSigner.PublicKey().Marshal()
+	for _, line := range bytes.Split(bytes.TrimSpace(conf.caChain.body), []byte("\n")) {
+		cert, err := parseIntermediate(line)
+		if err == nil && bytes.Equal(cert.Key.Marshal(), caKey) {
+			return nil
+		}
+	}
+	return fmt.Errorf("None of the cachain certificates is for the CA key, hosts wouldn't trust its certificates")
+}
+
+func caChainHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if conf.caChain == nil {
+		problemError(w, "No cachain configured", http.StatusNotFound)
+		return
+	}
+	conf.caChain.serve(w, r, "text/plain", "no-cache")
+}
+
+// runTrust reads a chain (as served at /ca/chain) and prints the key of every intermediate
+// the root has certified and that is currently valid, for a host's TrustedUserCAKeys
+func runTrust(rootPubFile string, in io.Reader) error {
+	b, err := ioutil.ReadFile(rootPubFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read root public key: %v", err)
+	}
+	root, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return fmt.Errorf("Failed to parse root public key: %v", err)
+	}
+
+	trusted := 0
+	checker := ssh.CertChecker{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cert, err := parseIntermediate([]byte(line))
+		if err == nil && !bytes.Equal(cert.SignatureKey.Marshal(), root.Marshal()) {
+			err = fmt.Errorf("certificate %q is not signed by the root", cert.KeyId)
+		}
+		if err == nil {
+			// Checks the validity period and the root's signature
+			principal := ""
+			if len(cert.ValidPrincipals) > 0 {
+				principal = cert.ValidPrincipals[0]
+			}
+			err = checker.CheckCert(principal, cert)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping: %v\n", err)
+			continue
+		}
+		fmt.Printf("%s %s valid until %s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert.Key))), cert.KeyId,
+			time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+		trusted++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// Installing an empty file would lock everyone out
+	if trusted == 0 {
+		return fmt.Errorf("No valid intermediates in the chain")
+	}
+	return nil
+}
+
+// intermediateDays parses the optional validity argument of `cursed intermediate`
+func intermediateDays(args []string) (int, error) {
+	if len(args) == 0 {
+		return 90, nil
+	}
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 1 {
+		return 0, fmt.Errorf("Invalid validity %q, expected a number of days", args[0])
+	}
+	return days, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Formats understood by `cursed export` and `cursed import`, for migrating between cursed and
+// Teleport or step-ca, or running them side by side while hosts move over. teleport is the
+// output of `tctl auth export`, step-roots step-ca's /ssh/roots response that `step ssh
+// config` installs on hosts, and step-ca the SSH CA key files and durations in its ca.json
+const interopFormats = "teleport, step-roots or step-ca"
+
+// foreignCA is a CA key found in another CA's export
+type foreignCA struct {
+	key   ssh.PublicKey
+	hosts string // known_hosts pattern, for host CAs
+	user  bool
+	name  string
+}
+
+// stepRoots is step-ca's /ssh/roots response. Keys are base64 of the SSH wire format
+type stepRoots struct {
+	UserKey []string `json:"userKey,omitempty"`
+	HostKey []string `json:"hostKey,omitempty"`
+}
+
+type stepClaims struct {
+	EnableSSHCA                bool   `json:"enableSSHCA"`
+	MinUserSSHCertDuration     string `json:"minUserSSHCertDuration,omitempty"`
+	MaxUserSSHCertDuration     string `json:"maxUserSSHCertDuration,omitempty"`
+	DefaultUserSSHCertDuration string `json:"defaultUserSSHCertDuration,omitempty"`
+	MaxHostSSHCertDuration     string `json:"maxHostSSHCertDuration,omitempty"`
+	DefaultHostSSHCertDuration string `json:"defaultHostSSHCertDuration,omitempty"`
+}
+
+// stepConfig is the part of ca.json we translate. Claims may also be set per provisioner,
+// which we don't try to map
+type stepConfig struct {
+	SSH struct {
+		HostKey string `json:"hostKey,omitempty"`
+		UserKey string `json:"userKey,omitempty"`
+	} `json:"ssh"`
+	Authority struct {
+		Claims *stepClaims `json:"claims,omitempty"`
+	} `json:"authority"`
+}
+
+// step-ca's default for user certificates we don't set a shorter one for
+const stepMinUserDuration = 5 * time.Minute
+
+func runExport(conf *config, format string) error {
+	caKey, err := caPublicKey(conf)
+	if err != nil {
+		return err
+	}
+	hostCA := conf.AllowHostCerts || len(conf.KnownHostsDomains) > 0
+
+	switch format {
+	case "teleport":
+		fmt.Printf("cert-authority %s clustername=%s&type=user\n", authorizedKey(caKey), url.QueryEscape(conf.instanceID))
+		if hostCA {
+			for _, hosts := range knownHostsPatterns(conf) {
+				fmt.Printf("@cert-authority %s %s type=host\n", hosts, authorizedKey(caKey))
+			}
+		}
+		return nil
+	case "step-roots":
+		roots := stepRoots{UserKey: []string{base64.StdEncoding.EncodeToString(caKey.Marshal())}}
+		if hostCA {
+			roots.HostKey = roots.UserKey
+		}
+		return printIndented(roots)
+	case "step-ca":
+		// step-ca signs with key files of its own, not an agent or a sealed key
+		if conf.CAAgentSocket != "" || conf.SealedCAKeyFile != "" {
+			return fmt.Errorf("step-ca needs the CA key as a file, which caagentsocket and sealedcakeyfile don't provide")
+		}
+		var sc stepConfig
+		sc.SSH.UserKey = conf.CAKeyFile
+		if conf.AllowHostCerts {
+			sc.SSH.HostKey = conf.CAKeyFile
+		}
+		dur := time.Duration(conf.Duration) * time.Second
+		claims := &stepClaims{
+			EnableSSHCA:                true,
+			DefaultUserSSHCertDuration: dur.String(),
+			MaxUserSSHCertDuration:     dur.String(),
+		}
+		if dur < stepMinUserDuration {
+			claims.MinUserSSHCertDuration = dur.String()
+		}
+		if conf.AllowHostCerts {
+			claims.DefaultHostSSHCertDuration = conf.hostDur.String()
+			claims.MaxHostSSHCertDuration = conf.hostDur.String()
+		}
+		sc.Authority.Claims = claims
+		return printIndented(sc)
+	}
+	return fmt.Errorf("Unknown export format %q, expected %s", format, interopFormats)
+}
+
+// runImport prints what another CA's export means for us. Trust bundles become a
+// TrustedUserCAKeys file trusting both CAs, or with knownHosts the known_hosts lines for
+// their host CAs and ours. step-ca's ca.json becomes the matching cursed.yaml settings
+func runImport(conf *config, format, file string, knownHosts bool) error {
+	in := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var cas []foreignCA
+	var err error
+	switch format {
+	case "teleport":
+		cas, err = parseTeleportExport(in)
+	case "step-roots":
+		cas, err = parseStepRoots(in)
+	case "step-ca":
+		return importStepConfig(in)
+	default:
+		return fmt.Errorf("Unknown import format %q, expected %s", format, interopFormats)
+	}
+	if err != nil {
+		return err
+	}
+
+	caKey, err := caPublicKey(conf)
+	if err != nil {
+		return err
+	}
+	found := 0
+	if knownHosts {
+		if conf.AllowHostCerts || len(conf.KnownHostsDomains) > 0 {
+			for _, hosts := range knownHostsPatterns(conf) {
+				fmt.Printf("@cert-authority %s %s curse\n", hosts, authorizedKey(caKey))
+			}
+		}
+		for _, ca := range cas {
+			if !ca.user {
+				fmt.Printf("@cert-authority %s %s %s\n", ca.hosts, authorizedKey(ca.key), ca.name)
+				found++
+			}
+		}
+	} else {
+		fmt.Printf("%s curse\n", authorizedKey(caKey))
+		for _, ca := range cas {
+			if ca.user {
+				fmt.Printf("%s %s\n", authorizedKey(ca.key), ca.name)
+				found++
+			}
+		}
+	}
+	// A bundle with only our key would quietly lock out everyone still on the other CA
+	if found == 0 {
+		return fmt.Errorf("No CA keys of that type found in %s", file)
+	}
+	return nil
+}
+
+// parseTeleportExport reads `tctl auth export` output: user CAs as authorized_keys
+// cert-authority lines, host CAs as known_hosts @cert-authority lines, both with a comment
+// like clustername=example.com&type=user
+func parseTeleportExport(in io.Reader) ([]foreignCA, error) {
+	var cas []foreignCA
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ca := foreignCA{}
+		var comment string
+		if strings.HasPrefix(line, "@") {
+			marker, hosts, key, c, _, err := ssh.ParseKnownHosts([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse %q: %v", line, err)
+			}
+			if marker != "cert-authority" {
+				continue
+			}
+			ca.key, ca.hosts, comment = key, strings.Join(hosts, ","), c
+		} else {
+			key, c, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse %q: %v", line, err)
+			}
+			ca.key, ca.hosts, comment = key, "*", c
+		}
+
+		q, _ := url.ParseQuery(comment)
+		ca.user = q.Get("type") == "user" || (q.Get("type") == "" && !strings.HasPrefix(line, "@"))
+		ca.name = "teleport"
+		if cluster := q.Get("clustername"); cluster != "" {
+			ca.name += ":" + cluster
+		}
+		cas = append(cas, ca)
+	}
+	return cas, scanner.Err()
+}
+
+func parseStepRoots(in io.Reader) ([]foreignCA, error) {
+	var roots stepRoots
+	err := json.NewDecoder(in).Decode(&roots)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse step-ca roots: %v", err)
+	}
+
+	var cas []foreignCA
+	for i, keys := range [][]string{roots.UserKey, roots.HostKey} {
+		for _, k := range keys {
+			b, err := base64.StdEncoding.DecodeString(k)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid step-ca root %q: %v", k, err)
+			}
+			key, err := ssh.ParsePublicKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid step-ca root %q: %v", k, err)
+			}
+			cas = append(cas, foreignCA{key: key, hosts: "*", user: i == 0, name: "step-ca"})
+		}
+	}
+	return cas, nil
+}
+
+// importStepConfig prints the cursed.yaml settings matching ca.json's SSH CA
+func importStepConfig(in io.Reader) error {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var sc stepConfig
+	err = json.Unmarshal(b, &sc)
+	if err != nil {
+		return fmt.Errorf("Failed to parse ca.json: %v", err)
+	}
+	if sc.SSH.UserKey == "" {
+		return fmt.Errorf("ca.json has no SSH user CA (ssh.userKey)")
+	}
+
+	fmt.Println("# Settings for the SSH user CA of step-ca")
+	fmt.Printf("cakeyfile: %s\n", sc.SSH.UserKey)
+	if c := sc.Authority.Claims; c != nil {
+		for _, d := range []struct{ name, val string }{
+			{"duration", c.DefaultUserSSHCertDuration},
+			{"hostduration", c.DefaultHostSSHCertDuration},
+		} {
+			if d.val == "" {
+				continue
+			}
+			dur, err := time.ParseDuration(d.val)
+			if err != nil {
+				return fmt.Errorf("Invalid duration %q in ca.json: %v", d.val, err)
+			}
+			fmt.Printf("%s: %d\n", d.name, int(dur.Seconds()))
+		}
+	}
+
+	// cursed signs host certificates with the user CA key
+	if sc.SSH.HostKey != "" && sc.SSH.HostKey != sc.SSH.UserKey {
+		fmt.Fprintf(os.Stderr, "step-ca signs host certificates with %s, which cursed doesn't use. Keep its key in known_hosts (cursed import step-roots --known-hosts) until hosts are re-certified\n", sc.SSH.HostKey)
+	}
+	// step-ca encrypts its keys by default, which we can't read
+	if _, err := loadCAKey(sc.SSH.UserKey); err != nil {
+		fmt.Fprintf(os.Stderr, "%v. If the key is encrypted, decrypt a copy for cursed with: step crypto change-pass --no-password --insecure\n", err)
+	}
+	return nil
+}
+
+// knownHostsPatterns is where hosts should accept our host certificates
+func knownHostsPatterns(conf *config) []string {
+	if len(conf.KnownHostsDomains) > 0 {
+		return conf.KnownHostsDomains
+	}
+	return []string{"*"}
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func printIndented(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// inventoryVersion goes up whenever a field of the inventory changes meaning or goes away.
+// New fields can be added without bumping it, so consumers should ignore ones they don't know
+const inventoryVersion = 1
+
+// inventory lists every user certificate that is still valid, for asset inventory and key
+// management platforms. It's served at /inventory on the admin listener and written to
+// inventoryfile
+type inventory struct {
+	Version      int             `json:"version"`
+	Generated    time.Time       `json:"generated"`
+	CA           string          `json:"ca"`
+	Certificates []inventoryCert `json:"certificates"`
+}
+
+// inventoryCert is one active certificate. Fingerprint is the SHA256 fingerprint of the
+// certified key, and serial is 0 unless leasefile is set
+type inventoryCert struct {
+	User        string    `json:"user"`
+	Principals  []string  `json:"principals"`
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"keyId"`
+	Fingerprint string    `json:"fingerprint"`
+	Issued      time.Time `json:"issued"`
+	Expires     time.Time `json:"expires"`
+}
+
+// buildInventory collects the unexpired, unrevoked certificates from the issued records,
+// oldest first
+func buildInventory(conf *config) (*inventory, error) {
+	now := time.Now()
+	inv := &inventory{
+		Version:      inventoryVersion,
+		Generated:    now.UTC(),
+		CA:           ssh.FingerprintSHA256(conf.caSigner.PublicKey()),
+		Certificates: make([]inventoryCert, 0),
+	}
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(issuedBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var ic issuedCert
+			err := unmarshalRecord(conf, issuedBucket, k, v, &ic)
+			if err != nil {
+				return fmt.Errorf("Issued certificate record %s corrupted: %v", k, err)
+			}
+			if ic.Revoked != nil || !now.Before(ic.ValidBefore) {
+				return nil
+			}
+			inv.Certificates = append(inv.Certificates, inventoryCert{
+				User:        ic.User,
+				Principals:  ic.Principals,
+				Serial:      ic.Serial,
+				KeyID:       ic.KeyID,
+				Fingerprint: ic.SHA256,
+				Issued:      ic.Issued.UTC(),
+				Expires:     ic.ValidBefore.UTC(),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(inv.Certificates, func(i, j int) bool {
+		return inv.Certificates[i].Issued.Before(inv.Certificates[j].Issued)
+	})
+	return inv, nil
+}
+
+// writeInventory replaces inventoryfile atomically, so a collector picking it up never
+// reads half an export
+func writeInventory(conf *config) (string, error) {
+	conf.inventoryMu.Lock()
+	defer conf.inventoryMu.Unlock()
+	inv, err := buildInventory(conf)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(conf.InventoryFile), ".inventory")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to write %s: %v", conf.InventoryFile, err)
+	}
+	// A fenced instance only has a stale view of what was issued
+	if !conf.lease.valid() {
+		return "", errLeaseLost
+	}
+	err = os.Rename(tmp.Name(), conf.InventoryFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write %s: %v", conf.InventoryFile, err)
+	}
+
+	return fmt.Sprintf("wrote %d certificates to %s", len(inv.Certificates), conf.InventoryFile), nil
+}
+
+func inventoryHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv, err := buildInventory(conf)
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, inv)
+}
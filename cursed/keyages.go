@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// keyAge explains where a key stands against maxkeyage, so support can tell a user exactly
+// when their key will stop being signed. Expires is unset when maxkeyage is -1
+type keyAge struct {
+	Fingerprint string     `json:"fingerprint"`
+	User        string     `json:"user,omitempty"`
+	FirstSeen   *time.Time `json:"firstSeen,omitempty"`
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Status      string     `json:"status"`
+	Exemption   *exemption `json:"exemption,omitempty"`
+}
+
+// Key age statuses. A key is expiring within keyreminderdays of its expiry, or a week when
+// reminders are off
+const (
+	keyAgeOK        = "ok"
+	keyAgeExpiring  = "expiring"
+	keyAgeExpired   = "expired"
+	keyAgeExempt    = "exempt"
+	keyAgeUnlimited = "unlimited"
+	keyAgeUnknown   = "unknown"
+)
+
+func keyAgesHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := r.FormValue("user")
+	fp := normalizeFingerprint(r.FormValue("fingerprint"))
+	if user == "" && fp == "" {
+		problemError(w, "user or fingerprint is required", http.StatusBadRequest)
+		return
+	}
+
+	var seen []seenKey
+	if user != "" {
+		var err error
+		seen, err = userKeys(conf, user)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if fp != "" {
+		// Narrow a user's keys down to the one asked about, keeping when it was last seen
+		var match []seenKey
+		for _, sk := range seen {
+			if sk.Fingerprint == fp {
+				match = append(match, sk)
+			}
+		}
+		if len(match) == 0 {
+			match = []seenKey{{Fingerprint: fp}}
+		}
+		seen = match
+	}
+
+	ages := make([]keyAge, 0, len(seen))
+	for _, sk := range seen {
+		ka, err := getKeyAge(conf, sk)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		ka.User = user
+		ages = append(ages, ka)
+	}
+	writeJSON(w, ages)
+}
+
+// userKeys returns the keys user has had certificates for, most recently used first
+func userKeys(conf *config, user string) ([]seenKey, error) {
+	var history []seenKey
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keyHistoryBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(user))
+		if val == nil {
+			return nil
+		}
+		err := unmarshalRecord(conf, keyHistoryBucket, []byte(user), val, &history)
+		if err != nil {
+			return fmt.Errorf("Key history corrupted for user %s: %v", user, err)
+		}
+		return nil
+	})
+	return history, err
+}
+
+// getKeyAge looks up the birthday recorded by checkPubKeyAge and works out the key's status
+// the same way it does
+func getKeyAge(conf *config, sk seenKey) (keyAge, error) {
+	ka := keyAge{Fingerprint: sk.Fingerprint, Status: keyAgeUnknown}
+	if !sk.LastSeen.IsZero() {
+		lastSeen := sk.LastSeen.UTC()
+		ka.LastSeen = &lastSeen
+	}
+
+	var kb int64
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		var err error
+		kb, err = getBirthday(tx, conf, sk.Fingerprint)
+		return err
+	})
+	if err != nil {
+		return ka, err
+	}
+	ex, err := getExemption(conf, sk.Fingerprint)
+	if err != nil {
+		return ka, fmt.Errorf("Unable to read key age exemption for %s: %v", sk.Fingerprint, err)
+	}
+	ka.Exemption = ex
+	if kb == 0 {
+		return ka, nil
+	}
+	firstSeen := time.Unix(kb, 0).UTC()
+	ka.FirstSeen = &firstSeen
+
+	if conf.MaxKeyAge < 0 {
+		ka.Status = keyAgeUnlimited
+		return ka, nil
+	}
+	expires := firstSeen.Add(conf.keyLifeSpan)
+	ka.Expires = &expires
+
+	lead := 7 * 24 * time.Hour
+	if conf.KeyReminderDays > 0 {
+		lead = time.Duration(conf.KeyReminderDays) * 24 * time.Hour
+	}
+	now := time.Now()
+	switch {
+	case now.Before(expires.Add(-lead)):
+		ka.Status = keyAgeOK
+	case now.Before(expires):
+		ka.Status = keyAgeExpiring
+	case ex != nil && ex.Expires.After(now):
+		ka.Status = keyAgeExempt
+	default:
+		ka.Status = keyAgeExpired
+	}
+	return ka, nil
+}
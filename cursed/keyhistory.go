@@ -0,0 +1,132 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var keyHistoryBucket = []byte("keyhistory")
+
+// Number of distinct keys remembered per user
+const keyHistorySize = 5
+
+// Unexpected key changes, published on the admin listener at /debug/vars
+var keyChanges = expvar.NewInt("keychanges")
+
+// seenKey is a key in a user's history, with the networks and devices it was last used from
+type seenKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Networks    []string  `json:"networks,omitempty"`
+	Devices     []string  `json:"devices,omitempty"`
+}
+
+// loadKeyHistory returns user's key history, most recently used first
+func loadKeyHistory(conf *config, user string) ([]seenKey, error) {
+	var history []seenKey
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keyHistoryBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(user))
+		if val == nil {
+			return nil
+		}
+		return unmarshalRecord(conf, keyHistoryBucket, []byte(user), val, &history)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Key history corrupted for user %s: %v", user, err)
+	}
+	return history, nil
+}
+
+// checkKeyContinuity reports whether fp is a key we haven't seen from user within the last
+// keycontinuitydays, returning the key they used most recently. A user's first key, and the
+// replacement for a key that has reached maxkeyage, are expected and don't count
+func checkKeyContinuity(conf *config, user, fp string) (bool, string, error) {
+	if conf.KeyContinuityDays <= 0 {
+		return false, "", nil
+	}
+
+	var history []seenKey
+	var prevBirthday int64
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keyHistoryBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(user))
+		if val == nil {
+			return nil
+		}
+		err := unmarshalRecord(conf, keyHistoryBucket, []byte(user), val, &history)
+		if err != nil {
+			return fmt.Errorf("Key history corrupted for user %s: %v", user, err)
+		}
+		if len(history) > 0 {
+			// An unreadable birthday only loses the aged out key's pass
+			prevBirthday, _ = getBirthday(tx, conf, history[0].Fingerprint)
+		}
+		return nil
+	})
+	if err != nil || len(history) == 0 {
+		return false, "", err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -conf.KeyContinuityDays)
+	for _, sk := range history {
+		if sk.Fingerprint == fp && sk.LastSeen.After(cutoff) {
+			return false, "", nil
+		}
+	}
+
+	// Rotating a key that has aged out is exactly what we ask users to do
+	prev := history[0].Fingerprint
+	if conf.MaxKeyAge >= 0 && prevBirthday > 0 &&
+		time.Unix(prevBirthday, 0).Add(conf.keyLifeSpan).Before(time.Now().AddDate(0, 0, 7)) {
+		return false, "", nil
+	}
+
+	return true, prev, nil
+}
+
+// recordKeySeen moves fp to the front of the user's key history, noting the network and
+// device it was used from. It's kept whether or not keycontinuitydays is set, since /keyages
+// uses it to find a user's keys and riskrestrictions where they use them from
+func recordKeySeen(conf *config, user, fp, network, device string) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(keyHistoryBucket)
+		if err != nil {
+			return err
+		}
+
+		var history []seenKey
+		if val := bucket.Get([]byte(user)); val != nil {
+			err = unmarshalRecord(conf, keyHistoryBucket, []byte(user), val, &history)
+			if err != nil {
+				return fmt.Errorf("Key history corrupted for user %s: %v", user, err)
+			}
+		}
+
+		updated := []seenKey{{Fingerprint: fp, LastSeen: time.Now()}}
+		for _, sk := range history {
+			if sk.Fingerprint == fp {
+				updated[0].Networks, updated[0].Devices = sk.Networks, sk.Devices
+			} else if len(updated) < keyHistorySize {
+				updated = append(updated, sk)
+			}
+		}
+		updated[0].Networks = rememberSource(updated[0].Networks, network)
+		updated[0].Devices = rememberSource(updated[0].Devices, device)
+
+		val, err := marshalRecord(conf, keyHistoryBucket, []byte(user), updated)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), val)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var keyListBucket = []byte("keylists")
+
+const (
+	keyListAllow = "allow"
+	keyListDeny  = "deny"
+)
+
+// keyListEntry puts a key on the allowlist or the denylist. A fingerprint is on at most one
+// of them, so adding it to one list takes it off the other. Allowlist entries are exceptions
+// and expire, at most keyallowlistmaxttl after they're added; denylist entries last until
+// they're removed
+type keyListEntry struct {
+	Fingerprint string     `json:"fingerprint"`
+	List        string     `json:"list"`
+	Reason      string     `json:"reason"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// Entries may use either fingerprint format ssh-keygen prints, SHA256:... or MD5:aa:bb:...
+func normalizeFingerprint(fp string) string {
+	return strings.TrimPrefix(strings.TrimSpace(fp), "MD5:")
+}
+
+// checkKeyLists refuses denylisted keys, and keys missing from the allowlist when
+// requireAllowlisted is set. Lists are read from the database on every request, so entries
+// take effect immediately
+func checkKeyLists(conf *config, pk ssh.PublicKey, requireAllowlisted bool) error {
+	var entry *keyListEntry
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keyListBucket)
+		if bucket == nil {
+			return nil
+		}
+		for _, fp := range []string{ssh.FingerprintSHA256(pk), ssh.FingerprintLegacyMD5(pk)} {
+			val := bucket.Get([]byte(fp))
+			if val == nil {
+				continue
+			}
+			entry = &keyListEntry{}
+			err := json.Unmarshal(val, entry)
+			if err != nil {
+				return fmt.Errorf("Key list record corrupted for key %s: %v", fp, err)
+			}
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry != nil && entry.List == keyListDeny:
+		return denyf(reasonKeyBlocked, "Key %s is blocked: %s", ssh.FingerprintSHA256(pk), entry.Reason)
+	case requireAllowlisted && entry != nil && entry.Expires != nil && !time.Now().Before(*entry.Expires):
+		return denyf(reasonKeyBlocked, "Key %s was allowlisted until %s", ssh.FingerprintSHA256(pk), entry.Expires.Format(time.RFC3339))
+	case requireAllowlisted && entry == nil:
+		return denyf(reasonKeyBlocked, "Key %s is not on the allowlist", ssh.FingerprintSHA256(pk))
+	}
+
+	return nil
+}
+
+func keyListsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := listKeyLists(conf, r.URL.Query().Get("list"))
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	case http.MethodPost:
+		var e keyListEntry
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&e)
+		if err != nil {
+			problemError(w, "Unable to parse key list entry", http.StatusBadRequest)
+			return
+		}
+		e.Fingerprint = normalizeFingerprint(e.Fingerprint)
+		if e.Fingerprint == "" || e.Reason == "" {
+			problemError(w, "fingerprint and reason are required", http.StatusBadRequest)
+			return
+		}
+		if e.List != keyListAllow && e.List != keyListDeny {
+			problemError(w, "list must be allow or deny", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		switch {
+		case e.List == keyListDeny && e.Expires != nil:
+			problemError(w, "Denylist entries don't expire", http.StatusBadRequest)
+			return
+		case e.List == keyListAllow:
+			maxExpires := now.Add(time.Duration(conf.KeyAllowlistMaxTTL) * time.Second)
+			if e.Expires == nil || !e.Expires.After(now) || e.Expires.After(maxExpires) {
+				problemError(w, fmt.Sprintf("expires must be in the future and at most %ds away (keyallowlistmaxttl)", conf.KeyAllowlistMaxTTL), http.StatusBadRequest)
+				return
+			}
+		}
+		e.Created = now
+
+		err = putKeyListEntry(conf, e)
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if e.Expires != nil {
+			log.Printf("Added %s to the %slist until %s: %s", e.Fingerprint, e.List, e.Expires.Format(time.RFC3339), e.Reason)
+		} else {
+			log.Printf("Added %s to the %slist: %s", e.Fingerprint, e.List, e.Reason)
+		}
+		writeJSON(w, e)
+	case http.MethodDelete:
+		fp := normalizeFingerprint(r.URL.Query().Get("fingerprint"))
+		if fp == "" {
+			problemError(w, "fingerprint is required", http.StatusBadRequest)
+			return
+		}
+		err := conf.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(keyListBucket)
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Delete([]byte(fp))
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		invalidateKRL(conf)
+		log.Printf("Removed %s from the key lists", fp)
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putKeyListEntry(conf *config, e keyListEntry) error {
+	val, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(keyListBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(e.Fingerprint), val)
+	})
+	if err == nil && e.List == keyListDeny {
+		invalidateKRL(conf)
+	}
+	return err
+}
+
+// listKeyLists returns the entries on list, or on both lists if it's empty
+func listKeyLists(conf *config, list string) ([]keyListEntry, error) {
+	entries := make([]keyListEntry, 0)
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keyListBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var e keyListEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return fmt.Errorf("Key list record corrupted for key %s: %v", k, err)
+			}
+			if list == "" || e.List == list {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+	})
+
+	return entries, err
+}
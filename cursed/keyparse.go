@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Longest key line accepted from a client. A 16384-bit RSA key is under 3KB
+const maxSubmittedKeyLength = 8192
+
+// parseSubmittedKey parses a public key sent for signing. ssh.ParseAuthorizedKey is meant for
+// whole authorized_keys files, so it would also take several keys, options like command= and
+// arbitrary comments, none of which belong in a signing request or its log lines. The
+// comment is dropped, everything else is rejected
+func parseSubmittedKey(raw string) (ssh.PublicKey, error) {
+	if len(raw) > maxSubmittedKeyLength {
+		return nil, fmt.Errorf("key is longer than %d bytes", maxSubmittedKeyLength)
+	}
+	line := strings.TrimSpace(raw)
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("only one key may be submitted per request")
+	}
+	for _, c := range line {
+		if c < 0x20 || c == 0x7f {
+			return nil, fmt.Errorf("key contains control characters")
+		}
+	}
+
+	pk, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse authorized key")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(comment)); err == nil {
+		return nil, fmt.Errorf("only one key may be submitted per request")
+	}
+	if len(options) > 0 {
+		return nil, fmt.Errorf("key must not have authorized_keys options")
+	}
+	if _, ok := pk.(*ssh.Certificate); ok {
+		return nil, fmt.Errorf("key is a certificate, submit the public key instead")
+	}
+
+	return pk, nil
+}
+
+// parseKeyBlob parses a public key sent as the base64 of its SSH wire encoding, as in the
+// middle field of an authorized_keys line. With no key type, comment or options around it
+// there's nothing to be ambiguous about, so it's held to the letter: standard padded base64
+// with nothing else in it, and one key with no trailing data
+func parseKeyBlob(blob string) (ssh.PublicKey, error) {
+	if len(blob) > maxSubmittedKeyLength {
+		return nil, fmt.Errorf("keyBlob is longer than %d bytes", maxSubmittedKeyLength)
+	}
+	// DecodeString skips newlines, which we don't want to
+	if strings.ContainsAny(blob, " \t\r\n") {
+		return nil, fmt.Errorf("keyBlob contains whitespace")
+	}
+	data, err := base64.StdEncoding.Strict().DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("keyBlob is not valid base64")
+	}
+	pk, err := ssh.ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse keyBlob")
+	}
+	if _, ok := pk.(*ssh.Certificate); ok {
+		return nil, fmt.Errorf("keyBlob is a certificate, submit the public key instead")
+	}
+	return pk, nil
+}
+
+// submittedKey returns the key a request asks to have signed, from either the key line or
+// keyBlob, as an authorized_keys line without a comment
+func submittedKey(key, blob string) (string, error) {
+	if blob == "" {
+		return key, nil
+	}
+	if key != "" {
+		return "", fmt.Errorf("key and keyBlob are mutually exclusive")
+	}
+	pk, err := parseKeyBlob(blob)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))), nil
+}
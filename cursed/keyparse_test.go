@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func fuzzKeyLine(seed byte) string {
+	pub := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public()
+	if seed != 0 {
+		s := make([]byte, ed25519.SeedSize)
+		s[0] = seed
+		pub = ed25519.NewKeyFromSeed(s).Public()
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+}
+
+// FuzzParseSubmittedKey checks parseSubmittedKey never panics, and only ever accepts a
+// single key on a single line with no options
+func FuzzParseSubmittedKey(f *testing.F) {
+	one, two := fuzzKeyLine(0), fuzzKeyLine(1)
+	for _, seed := range []string{
+		one,
+		one + " alice@laptop",
+		one + "\n" + two,
+		one + "\r\n" + two,
+		one + " " + two,
+		one + " comment " + two,
+		"garbage\n" + one,
+		`command="/bin/sh" ` + one,
+		`no-pty,from="10.0.0.0/8" ` + one,
+		one + " \x00\x1b[31m",
+		one + "\x7f",
+		"\t" + one + "\t",
+		one + " " + strings.Repeat("A", maxSubmittedKeyLength),
+		strings.Repeat(one+" ", 200),
+		"ssh-ed25519 " + strings.Repeat("A", 2*maxSubmittedKeyLength),
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		pk, err := parseSubmittedKey(raw)
+		if err != nil {
+			return
+		}
+		if pk == nil {
+			t.Fatalf("accepted %q without a key", raw)
+		}
+		line := strings.TrimSpace(raw)
+		if strings.ContainsAny(line, "\r\n") {
+			t.Fatalf("accepted more than one line: %q", raw)
+		}
+		_, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			t.Fatalf("accepted %q, which ssh can't parse: %v", raw, err)
+		}
+		if len(options) > 0 {
+			t.Fatalf("accepted options %v in %q", options, raw)
+		}
+		if len(rest) > 0 {
+			t.Fatalf("accepted %q with trailing data %q", raw, rest)
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(comment)); err == nil {
+			t.Fatalf("accepted a second key in the comment of %q", raw)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// registeredKey reports whether pk is one of the keys registered for user in the configured
+// key registry, so a stolen bastion login can't get an arbitrary key signed
+func registeredKey(ctx context.Context, conf *config, user string, pk ssh.PublicKey) (bool, error) {
+	var rawKeys []string
+	var err error
+	switch conf.KeyRegistry {
+	case "ldap":
+		rawKeys, err = ldapKeys(ctx, conf, user)
+	case "github":
+		rawKeys, err = githubKeys(ctx, conf, user)
+	default:
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Key registry lookup for %s failed: %w", user, err)
+	}
+
+	for _, rk := range rawKeys {
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rk))
+		if err == nil && string(k.Marshal()) == string(pk.Marshal()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func ldapKeys(ctx context.Context, conf *config, user string) ([]string, error) {
+	return ldapAttr(ctx, conf, user, conf.LDAPKeyAttr)
+}
+
+// ldapAttr returns the values of attr on the user's LDAP entry
+func ldapAttr(ctx context.Context, conf *config, user, attr string) ([]string, error) {
+	entries, err := ldapSearch(ctx, conf, fmt.Sprintf(conf.LDAPUserFilter, ldap.EscapeFilter(user)), []string{attr})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("expected one LDAP entry for %s, found %d", user, len(entries))
+	}
+
+	return entries[0].GetAttributeValues(attr), nil
+}
+
+// ldapSearch returns up to two entries beneath ldapbasedn matching filter. The ldap package
+// doesn't take a context, so ctx's deadline is applied to the connection instead
+func ldapSearch(ctx context.Context, conf *config, filter string, attrs []string) ([]*ldap.Entry, error) {
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	l, err := ldap.DialURL(conf.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	l.SetTimeout(timeout)
+
+	if conf.LDAPBindDN != "" {
+		err = l.Bind(conf.LDAPBindDN, conf.LDAPBindPass)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := l.Search(ldap.NewSearchRequest(conf.LDAPBaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 2, 10, false, filter, attrs, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Entries, nil
+}
+
+func githubKeys(ctx context.Context, conf *config, user string) ([]string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	api := conf.forgeURL
+	if conf.AuthMode != "github" {
+		api = "https://api.github.com"
+	}
+
+	// Public keys are world-readable, so no token is needed
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	err := forgeGet(ctx, client, api+"/users/"+url.PathEscape(user)+"/keys?per_page=100", "", &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var rawKeys []string
+	for _, k := range keys {
+		rawKeys = append(rawKeys, k.Key)
+	}
+	return rawKeys, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func knownHostsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(conf.KnownHostsDomains) == 0 {
+		problemError(w, "No knownhostsdomains configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, knownHostsLines(conf))
+}
+
+func knownHostsLines(conf *config) string {
+	// Trust host certificates signed by our CA for each configured domain pattern
+	caKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(conf.caSigner.PublicKey())))
+	lines := ""
+	for _, domain := range conf.KnownHostsDomains {
+		lines += fmt.Sprintf("@cert-authority %s %s\n", domain, caKey)
+	}
+
+	return lines
+}
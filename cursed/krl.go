@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH key revocation list format, see PROTOCOL.krl in the OpenSSH source
+const (
+	krlMagic                    = 0x5353484b524c0a00
+	krlFormatVersion            = 1
+	krlSectionCertificates      = 1
+	krlSectionFingerprintSHA256 = 5
+	krlCertSectionKeyID         = 0x23
+)
+
+// buildKRL returns a KRL revoking every denylisted key and every revoked, unexpired
+// certificate, for sshd's RevokedKeys. Entries given as MD5 fingerprints can't be expressed
+// in a KRL and are counted in skipped
+func buildKRL(conf *config) ([]byte, int, error) {
+	entries, err := listKeyLists(conf, keyListDeny)
+	if err != nil {
+		return nil, 0, err
+	}
+	keyIDs, err := revokedKeyIDs(conf)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(keyIDs)
+
+	var hashes [][]byte
+	skipped := 0
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Fingerprint, "SHA256:") {
+			skipped++
+			continue
+		}
+		h, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(e.Fingerprint, "SHA256:"))
+		if err != nil || len(h) != 32 {
+			skipped++
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+
+	now := uint64(time.Now().Unix())
+	var krl bytes.Buffer
+	binary.Write(&krl, binary.BigEndian, uint64(krlMagic))
+	binary.Write(&krl, binary.BigEndian, uint32(krlFormatVersion))
+	binary.Write(&krl, binary.BigEndian, now) // krl_version, increasing with each regeneration
+	binary.Write(&krl, binary.BigEndian, now) // generated_date
+	binary.Write(&krl, binary.BigEndian, uint64(0))
+	krl.Write(ssh.Marshal(struct{ Reserved, Comment string }{"", "curse denylist"}))
+
+	// Serials are only unique with a leasefile, so certificates are revoked by key ID, scoped
+	// to our CA
+	if len(keyIDs) > 0 {
+		var ids bytes.Buffer
+		for _, id := range keyIDs {
+			ids.Write(ssh.Marshal(struct{ KeyID string }{id}))
+		}
+		section := ssh.Marshal(struct {
+			CAKey    []byte
+			Reserved string
+		}{conf.caSigner.PublicKey().Marshal(), ""})
+		section = append(section, krlCertSectionKeyID)
+		section = append(section, ssh.Marshal(struct{ Data []byte }{ids.Bytes()})...)
+		krl.WriteByte(krlSectionCertificates)
+		krl.Write(ssh.Marshal(struct{ Data []byte }{section}))
+	}
+
+	if len(hashes) > 0 {
+		var section bytes.Buffer
+		for _, h := range hashes {
+			section.Write(ssh.Marshal(struct{ Hash []byte }{h}))
+		}
+		krl.WriteByte(krlSectionFingerprintSHA256)
+		krl.Write(ssh.Marshal(struct{ Data []byte }{section.Bytes()}))
+	}
+
+	return krl.Bytes(), skipped, nil
+}
+
+// writeKRL regenerates krlfile, replacing it atomically so sshd never reads half a list
+func writeKRL(conf *config) (string, error) {
+	conf.krlMu.Lock()
+	defer conf.krlMu.Unlock()
+	krl, skipped, err := buildKRL(conf)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(conf.KRLFile), ".krl")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(krl)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to write %s: %v", conf.KRLFile, err)
+	}
+	// A fenced instance only has a stale view of the revocations
+	if !conf.lease.valid() {
+		return "", errLeaseLost
+	}
+	err = os.Rename(tmp.Name(), conf.KRLFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write %s: %v", conf.KRLFile, err)
+	}
+
+	msg := fmt.Sprintf("wrote %s", conf.KRLFile)
+	if skipped > 0 {
+		msg += fmt.Sprintf(", skipped %d denylist entries with MD5 fingerprints", skipped)
+	}
+	return msg, nil
+}
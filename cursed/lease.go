@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errLeaseLost = errors.New("This cursed no longer holds the storage lease, another instance has taken over")
+
+// leaseRecord is the content of leasefile. Epoch goes up with every new holder
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Epoch   uint64    `json:"epoch"`
+	Expires time.Time `json:"expires"`
+}
+
+// lease fences off other cursed instances sharing our storage, e.g. a forgotten old one
+// pointed at the same NFS export, where bolt's file lock can't be relied on. Only the holder
+// allocates serials and writes the KRL. Serials carry the epoch in their upper 32 bits, so
+// two holders can't allocate the same one even while their leases briefly overlap
+type lease struct {
+	mu      sync.Mutex
+	file    string
+	ttl     time.Duration
+	holder  string
+	epoch   uint64
+	expires time.Time
+	next    uint32
+	lost    bool
+}
+
+func readLease(file string) (*leaseRecord, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec leaseRecord
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, fmt.Errorf("%s corrupted: %v", file, err)
+	}
+	return &rec, nil
+}
+
+// writeLease replaces file atomically, so a reader never sees half a record
+func writeLease(file string, rec leaseRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".lease")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// acquireLease takes leasefile over if it's free or its holder stopped renewing it
+func acquireLease(file string, ttl time.Duration) (*lease, error) {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{file: file, ttl: ttl, holder: fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))}
+
+	rec, err := readLease(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read lease: %v", err)
+	}
+	if rec != nil && time.Now().Before(rec.Expires) {
+		return nil, fmt.Errorf("%s is held by %s until %s, is another cursed still running against this storage?", file, rec.Holder, rec.Expires.Format(time.RFC3339))
+	}
+	if rec != nil {
+		l.epoch = rec.Epoch
+	}
+	l.epoch++
+	l.expires = time.Now().Add(ttl)
+	err = writeLease(file, leaseRecord{l.holder, l.epoch, l.expires})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write lease: %v", err)
+	}
+
+	// Two instances starting together can both find the lease free. The last rename wins,
+	// so give the other one time to land and see who that was
+	time.Sleep(time.Second)
+	rec, err = readLease(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read lease: %v", err)
+	}
+	if rec == nil || rec.Holder != l.holder {
+		return nil, fmt.Errorf("Lost the race for %s to another cursed starting at the same time", file)
+	}
+
+	log.Printf("Acquired storage lease %s (epoch %d)", file, l.epoch)
+	go l.keepAlive()
+	return l, nil
+}
+
+// keepAlive renews the lease every third of its ttl. Once another holder shows up in the
+// file we are fenced for good, and have to be restarted to compete for the lease again
+func (l *lease) keepAlive() {
+	for range time.Tick(l.ttl / 3) {
+		err := l.renew()
+		if err == errLeaseLost {
+			log.Printf("%v, refusing to sign or write the KRL", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to renew storage lease: %v", err)
+		}
+	}
+}
+
+func (l *lease) renew() error {
+	rec, err := readLease(l.file)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rec == nil || rec.Holder != l.holder || rec.Epoch != l.epoch {
+		l.lost = true
+		return errLeaseLost
+	}
+	expires := time.Now().Add(l.ttl)
+	err = writeLease(l.file, leaseRecord{l.holder, l.epoch, expires})
+	if err != nil {
+		return err
+	}
+	l.expires = expires
+	return nil
+}
+
+// valid reports whether we still hold the lease. A holder that can't renew stops a quarter
+// ttl before the lease runs out, leaving room for clock differences between hosts
+func (l *lease) valid() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.lost && time.Now().Before(l.expires.Add(-l.ttl/4))
+}
+
+// serial allocates the next certificate serial. Without a leasefile every serial is 0
+func (l *lease) serial() (uint64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	if !l.valid() {
+		return 0, errLeaseLost
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next == ^uint32(0) {
+		return 0, fmt.Errorf("Serials for lease epoch %d exhausted, restart cursed", l.epoch)
+	}
+	l.next++
+	return l.epoch<<32 | uint64(l.next), nil
+}
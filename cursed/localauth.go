@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const otpHeader = "X-Curse-OTP"
+
+type localUser struct {
+	hash       string
+	totpSecret string
+}
+
+// loadLocalUsers reads a users file with one "username:argon2id-hash:totp-secret" entry per line,
+// as printed by `cursed useradd`
+func loadLocalUsers(path string) (map[string]localUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open local users file: %v", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]localUser)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || !strings.HasPrefix(fields[1], "$argon2id$") {
+			return nil, fmt.Errorf("Invalid entry on line %d of %s", n, path)
+		}
+		users[fields[0]] = localUser{hash: fields[1], totpSecret: fields[2]}
+	}
+
+	return users, scanner.Err()
+}
+
+// Each password check takes 64MB for argon2id, so only as many run at once as there are
+// CPUs to run them, and the rest wait their turn
+var passwordSlots = make(chan struct{}, runtime.NumCPU())
+
+// loginFailures counts failed local logins by user and by source IP. After loginmaxfailures
+// within loginlockout seconds, further attempts are refused for loginlockout seconds without
+// checking the password, so passwords and codes can't be guessed online
+type loginFailures struct {
+	sync.Mutex
+	entries map[string]*failureCount
+}
+
+type failureCount struct {
+	n      int
+	first  time.Time
+	locked time.Time
+}
+
+func (lf *loginFailures) lockedOut(key string, now time.Time) bool {
+	lf.Lock()
+	defer lf.Unlock()
+	fc := lf.entries[key]
+	return fc != nil && now.Before(fc.locked)
+}
+
+func (lf *loginFailures) fail(key string, now time.Time, conf *config) {
+	lockout := time.Duration(conf.LoginLockout) * time.Second
+	lf.Lock()
+	defer lf.Unlock()
+	fc := lf.entries[key]
+	if fc == nil || now.Sub(fc.first) > lockout {
+		fc = &failureCount{first: now}
+		lf.entries[key] = fc
+	}
+	fc.n++
+	if fc.n >= conf.LoginMaxFailures {
+		fc.locked = now.Add(lockout)
+		log.Printf("Locking out local logins for %s until %s after %d failures", key, fc.locked.Format(time.RFC3339), fc.n)
+		fc.n = 0
+		fc.first = now
+	}
+
+	// Forget what no longer matters, so a spray of usernames can't grow the map forever
+	if len(lf.entries) > 10000 {
+		for k, e := range lf.entries {
+			if now.Sub(e.first) > lockout && !now.Before(e.locked) {
+				delete(lf.entries, k)
+			}
+		}
+	}
+}
+
+func (lf *loginFailures) clear(key string) {
+	lf.Lock()
+	defer lf.Unlock()
+	delete(lf.entries, key)
+}
+
+// totpSteps holds the time step of each user's last accepted code, so a code seen over
+// someone's shoulder can't be used again while it's still valid
+type totpSteps struct {
+	sync.Mutex
+	steps map[string]int64
+}
+
+func checkLocalAuth(user, pass, otp, ip string, conf *config) error {
+	now := time.Now()
+	if conf.localFailures.lockedOut("user "+user, now) || conf.localFailures.lockedOut("ip "+ip, now) {
+		return denyf(reasonQuota, "Too many failed logins, try again later")
+	}
+
+	err := checkCredentials(user, pass, otp, now, conf)
+	if err != nil {
+		conf.localFailures.fail("user "+user, now, conf)
+		conf.localFailures.fail("ip "+ip, now, conf)
+		return err
+	}
+	conf.localFailures.clear("user " + user)
+	return nil
+}
+
+func checkCredentials(user, pass, otp string, now time.Time, conf *config) error {
+	passwordSlots <- struct{}{}
+	defer func() { <-passwordSlots }()
+
+	lu, ok := conf.localUsers[user]
+	if !ok {
+		// Burn the same time as a real check so usernames can't be probed by timing
+		checkPassword(pass, dummyHash)
+		return denyf(reasonAuthFailed, "Invalid username or password")
+	}
+
+	if !checkPassword(pass, lu.hash) {
+		return denyf(reasonAuthFailed, "Invalid username or password")
+	}
+	step, ok := checkTOTP(otp, lu.totpSecret, now)
+	if !ok {
+		return denyf(reasonNoMFA, "Missing or invalid authenticator code")
+	}
+
+	used := conf.lastTOTPSteps
+	used.Lock()
+	defer used.Unlock()
+	if step <= used.steps[user] {
+		return denyf(reasonNoMFA, "Authenticator code already used, wait for the next one")
+	}
+	used.steps[user] = step
+	return nil
+}
+
+var dummyHash = "$argon2id$v=19$m=65536,t=3,p=4$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+func hashPassword(pass string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, 3, 64*1024, 4, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=65536,t=3,p=4$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(pass, hash string) bool {
+	// Parse a PHC-format hash: $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var mem, iter uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iter, &threads)
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	try := argon2.IDKey([]byte(pass), salt, iter, mem, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(try, key) == 1
+}
+
+// checkTOTP returns the time step otp is the code for, if it's valid
+func checkTOTP(otp, secret string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(otp) != 6 {
+		return 0, false
+	}
+
+	// Allow one 30 second step of clock drift in either direction
+	step := now.Unix() / 30
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, s)), []byte(otp)) == 1 {
+			return s, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	// RFC 6238 TOTP with HMAC-SHA1 and 6 digits
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func userAdd(name string) error {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	reader := bufio.NewReader(os.Stdin)
+	pass, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Input error: %v", err)
+	}
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		return fmt.Errorf("Password must not be empty")
+	}
+
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return fmt.Errorf("Unable to hash password: %v", err)
+	}
+	secret := make([]byte, 20)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return fmt.Errorf("Unable to generate TOTP secret: %v", err)
+	}
+	totp := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+
+	fmt.Fprintf(os.Stderr, "Add this line to your localusersfile:\n")
+	fmt.Printf("%s:%s:%s\n", name, hash, totp)
+	fmt.Fprintf(os.Stderr, "Add this to the user's authenticator app:\n")
+	fmt.Fprintf(os.Stderr, "otpauth://totp/curse:%s?secret=%s&issuer=curse\n", name, totp)
+
+	return nil
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>CURSE login</title></head>
+<body>
+<h1>Request an SSH certificate</h1>
+{{if .}}<p><strong>{{.}}</strong></p>{{end}}
+<form method="POST" action="login">
+<p><label>Username <input name="username" autocomplete="username" required></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><label>Authenticator code <input name="otp" inputmode="numeric" autocomplete="one-time-code" required></label></p>
+<p><label>Remote user <input name="remoteUser" required></label></p>
+<p><label>Source IP <input name="bastionIP" required></label></p>
+<p><label>Public key<br><textarea name="key" rows="4" cols="80" required></textarea></label></p>
+<p><button type="submit">Sign</button></p>
+</form>
+</body>
+</html>
+`))
+
+// loginRequest is the form posted by the login page, as read by loginHandler
+type loginRequest struct {
+	Username   string `form:"username"`
+	Password   string `form:"password"`
+	OTP        string `form:"otp"`
+	Key        string `form:"key"`
+	RemoteUser string `form:"remoteUser"`
+	BastionIP  string `form:"bastionIP"`
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet:
+		loginPage.Execute(w, "")
+		return
+	case http.MethodPost:
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	release, ok := limitIP(w, r, conf)
+	if !ok {
+		return
+	}
+	defer release()
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+
+	user := normalizeUser(r.PostFormValue("username"), conf)
+	err := checkLocalAuth(user, r.PostFormValue("password"), r.PostFormValue("otp"), clientIP(r, conf), conf)
+	if err != nil {
+		log.Printf("Failed local login for %q from %s", user, r.RemoteAddr)
+		logDenial(r.Context(), conf, reasonOf(err), user, "", err.Error())
+		w.Header().Set(reasonHeader, reasonOf(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		loginPage.Execute(w, "Invalid username, password or code")
+		return
+	}
+
+	p := httpParams{
+		asn:         asnAsserted(r, conf),
+		bastionIP:   r.PostFormValue("bastionIP"),
+		bastionUser: user,
+		key:         r.PostFormValue("key"),
+		mfa:         true,
+		remoteUser:  r.PostFormValue("remoteUser"),
+		tenant:      tenantAsserted(r, conf),
+		userIP:      remoteIP(r),
+	}
+	res := signUserKey(r.Context(), conf, p)
+	if res.Error != "" {
+		w.Header().Set(reasonHeader, res.Reason)
+		w.WriteHeader(res.status)
+		loginPage.Execute(w, res.Error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", `attachment; filename="id-cert.pub"`)
+	w.Write([]byte(res.Certificate))
+}
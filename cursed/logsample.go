@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Requests seen per kind of certificate, and the request lines sampled out, published on the
+// admin listener's /debug/vars
+var (
+	logCounts  = map[string]*uint64{"host": new(uint64), "user": new(uint64)}
+	logSampled = expvar.NewMap("logsampled")
+)
+
+// requestLog is the line logged for a signing request. Fleets renewing host certificates
+// every few minutes make these most of the log, so with logsamplehosts or logsampleusers
+// above 1 only one request in N gets its line. Whatever happens to the others is still
+// logged: denial and error lines are never sampled, and a request that fails gets its line
+// written after all, so the failure has its context
+type requestLog struct {
+	kind    string
+	line    string
+	written bool
+}
+
+func logRequest(conf *config, kind, format string, args ...interface{}) *requestLog {
+	n := conf.LogSampleUsers
+	if kind == "host" {
+		n = conf.LogSampleHosts
+	}
+	rl := &requestLog{kind: kind, line: fmt.Sprintf(format, args...)}
+	if n <= 1 || (atomic.AddUint64(logCounts[kind], 1)-1)%uint64(n) == 0 {
+		log.Print(rl.line)
+		rl.written = true
+	}
+	return rl
+}
+
+// finish writes a sampled out line for a request that failed, and counts the rest
+func (rl *requestLog) finish(failed bool) {
+	switch {
+	case rl.written:
+	case failed:
+		log.Print(rl.line)
+	default:
+		logSampled.Add(rl.kind, 1)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a background refresh of a stale answer may take
+const lookupRefreshTimeout = 30 * time.Second
+
+// Hits, misses and stale answers of each lookupCache, as <name>.hit, <name>.miss,
+// <name>.stale and <name>.refreshfailed
+var lookupCacheCounts = expvar.NewMap("lookupcache")
+
+// lookupCache remembers the answers of slow lookups run on every signing request, such as
+// directory groups, so a slow directory doesn't add its latency to each of them. An answer is
+// used as is for ttl, then for up to stale longer while it's refreshed in the background, so
+// the directory being slow or briefly down doesn't hold up signing either. Failed or denied
+// lookups aren't remembered. A nil lookupCache looks up every time
+type lookupCache struct {
+	sync.Mutex
+	name    string
+	ttl     time.Duration
+	stale   time.Duration
+	entries map[string]*lookupEntry
+}
+
+type lookupEntry struct {
+	values     []string
+	fetched    time.Time
+	refreshing bool
+}
+
+// newLookupCache returns a cache for name, counted under it in lookupCacheCounts. ttl and
+// stale are in seconds, and a ttl of 0 turns caching off
+func newLookupCache(name string, ttl, stale int) *lookupCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &lookupCache{
+		name:    name,
+		ttl:     time.Duration(ttl) * time.Second,
+		stale:   time.Duration(stale) * time.Second,
+		entries: make(map[string]*lookupEntry),
+	}
+}
+
+// lookupKey joins what a lookup was asked into a key, with a separator no part can contain
+func lookupKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// fetch returns the answer for key, calling lookup with ctx when there's none fresh enough.
+// A stale answer is returned straight away, and lookup run again in the background without
+// ctx, which ends with the request
+func (lc *lookupCache) fetch(ctx context.Context, key string, lookup func(context.Context) ([]string, error)) ([]string, error) {
+	if lc == nil {
+		return lookup(ctx)
+	}
+
+	lc.Lock()
+	e := lc.entries[key]
+	if e != nil {
+		age := time.Since(e.fetched)
+		if age < lc.ttl {
+			lc.Unlock()
+			lookupCacheCounts.Add(lc.name+".hit", 1)
+			return e.values, nil
+		}
+		if age < lc.ttl+lc.stale {
+			if !e.refreshing {
+				e.refreshing = true
+				go lc.refresh(key, lookup)
+			}
+			lc.Unlock()
+			lookupCacheCounts.Add(lc.name+".stale", 1)
+			return e.values, nil
+		}
+	}
+	lc.Unlock()
+
+	lookupCacheCounts.Add(lc.name+".miss", 1)
+	values, err := lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lc.put(key, values)
+	return values, nil
+}
+
+func (lc *lookupCache) refresh(key string, lookup func(context.Context) ([]string, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupRefreshTimeout)
+	defer cancel()
+	values, err := lookup(ctx)
+	if err != nil {
+		// The stale answer is served until it's too old, then looked up in the foreground
+		lookupCacheCounts.Add(lc.name+".refreshfailed", 1)
+		log.Printf("Refreshing %s lookup failed: %v", lc.name, err)
+		lc.Lock()
+		if e := lc.entries[key]; e != nil {
+			e.refreshing = false
+		}
+		lc.Unlock()
+		return
+	}
+	lc.put(key, values)
+}
+
+func (lc *lookupCache) put(key string, values []string) {
+	now := time.Now()
+	lc.Lock()
+	defer lc.Unlock()
+	lc.entries[key] = &lookupEntry{values: values, fetched: now}
+
+	// Forget what's too old to serve, so users who've moved on don't grow the map forever
+	if len(lc.entries) > 10000 {
+		for k, e := range lc.entries {
+			if now.Sub(e.fetched) >= lc.ttl+lc.stale && !e.refreshing {
+				delete(lc.entries, k)
+			}
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -13,52 +19,469 @@ import (
 	"github.com/spf13/viper"
 )
 
+// Overridden at build time with -ldflags "-X main.version=$(cat VERSION)"
+var version = "dev"
+
 type config struct {
-	bucketName  []byte
-	caSigner    ssh.Signer
-	db          *bolt.DB
-	dur         time.Duration
-	exts        map[string]string
-	keyLifeSpan time.Duration
-	userRegex   *regexp.Regexp
-
-	Addr            string
-	CAKeyFile       string
-	DBFile          string
-	Duration        int
-	Extensions      []string
-	ForceCmd        bool
-	MaxKeyAge       int
-	Port            int
-	ProxyUser       string
-	ProxyPass       string
-	RequireClientIP bool
-	SSLKey          string
-	SSLCert         string
-	UserHeader      string
+	adminClientCAs  *x509.CertPool
+	bucketName      []byte
+	caChain         *cachedResponse
+	caResponse      *caCache
+	caSigner        ssh.Signer
+	clientConfig    *clientConfig
+	clock           timeSource
+	cmdRegexes      []*regexp.Regexp
+	db              *bolt.DB
+	dbCipher        *dbCipher
+	decisions       *decisionLogger
+	mirror          *mirror
+	devices         map[string]string
+	dur             time.Duration
+	exts            map[string]string
+	forgeURL        string
+	groupCache      *lookupCache
+	hostDur         time.Duration
+	identitySources []identitySource
+	instanceID      string
+	inventoryMu     *sync.Mutex
+	krlMu           *sync.Mutex
+	krlResponse     *krlCache
+	lastTOTPSteps   *totpSteps
+	localFailures   *loginFailures
+	localUsers      map[string]localUser
+	policyVersion   string
+	principalCache  *lookupCache
+	principalsCmd   []string
+	riskHours       *workHours
+	riskScorer      riskScorer
+	samlCerts       []*x509.Certificate
+	seal            *sealedSigner
+	tasks           *taskTable
+	tenantLabels    *labelSets
+	keyLifeSpan     time.Duration
+	lease           *lease
+	mode            *serviceMode
+	userRegex       *regexp.Regexp
+	webhooks        *webhookSender
+
+	AccountCheck             string
+	AccountCheckExempt       []string
+	Addr                     string
+	AdminAddr                string
+	AdminClientCA            string
+	AdminPort                int
+	AdminToken               string
+	AdminTokenMaxTTL         int
+	AllowHostCerts           bool
+	ApprovalTTL              int
+	AuditSpoolKeyFile        string
+	AuditSpoolMax            int
+	AuditStrict              bool
+	AuthMode                 string
+	AutoMigrate              bool
+	BLESS                    bool
+	Backdate                 int
+	BootstrapCAKeyFile       string
+	BootstrapRevokedKeysFile string
+	BootstrapSSHDFile        string
+	BootstrapTemplate        string
+	CAAgentSocket            string
+	CABreakerCooldown        int
+	CABreakerThreshold       int
+	CAChain                  []string
+	CAKeyFile                string
+	CAPubKeyFile             string
+	CertReminderMins         int
+	ClientConfigFile         string
+	ClientIPHeader           string
+	ClockCheckInterval       int
+	ClockMaxSkew             int
+	ClockNTPServer           string
+	ClockSkewAction          string
+	CmdAllowMeta             bool
+	CmdAllowlist             []string
+	CmdRegex                 []string
+	CompactInterval          int
+	DBFile                   string
+	DBKey                    string
+	DBPreviousKeys           []string
+	DBRekeyInterval          int
+	DecisionLogInterval      int
+	DecisionLogURL           string
+	DelegationMaxTTL         int
+	DeviceKeysFile           string
+	DeviceSkew               int
+	Duration                 int
+	EnrollmentMaxTTL         int
+	ExemptionMaxTTL          int
+	Extensions               []string
+	ForceCmd                 bool
+	ForgeTeams               []forgeTeam
+	ForgeURL                 string
+	GitHosts                 []gitHost
+	GroupExtension           string
+	HealthAddr               string
+	HealthPort               int
+	HostCertRequesters       []hostCertRequester
+	HostDuration             int
+	HoneytokenAlertEmail     string
+	HoneytokenPrincipals     []string
+	HTTPIdleTimeout          int
+	HTTPMaxConns             int
+	HTTPReadTimeout          int
+	HTTPWriteTimeout         int
+	IdempotencyTTL           int
+	InfraAlertEmail          string
+	InfraPrincipals          []string
+	InstanceID               string
+	InventoryFile            string
+	InventoryInterval        int
+	KeyAgeRemediationURL     string
+	KeyAllowlist             bool
+	KeyAllowlistMaxTTL       int
+	KeyChangeApproval        bool
+	KeyContinuityDays        int
+	KeyRegistry              string
+	KeyReminderDays          int
+	KnownHostsDomains        []string
+	Listeners                []listener
+	KRLFile                  string
+	KRLInterval              int
+	LDAPAccountFilter        string
+	LDAPBaseDN               string
+	LDAPBindDN               string
+	LDAPBindPass             string
+	LDAPGroupAttr            string
+	LDAPKeyAttr              string
+	LDAPURL                  string
+	LDAPUserFilter           string
+	LeaseFile                string
+	LeaseTTL                 int
+	LocalUsersFile           string
+	LoginLockout             int
+	LoginMaxFailures         int
+	LogSampleHosts           int
+	LogSampleUsers           int
+	LookupCacheStale         int
+	LookupCacheTTL           int
+	MaxConcurrentPerIP       int
+	MaxConcurrentPerUser     int
+	MFAHeader                string
+	MaintenanceMessage       string
+	MaxBatchSize             int
+	MaxKeyAge                int
+	MaxStartDelay            int
+	MetadataExtension        bool
+	MetricsMaxPolicies       int
+	MetricsMaxTenants        int
+	MetricsTenantHeader      string
+	MirrorPercent            float64
+	MirrorProxyPass          string
+	MirrorProxyUser          string
+	MirrorURL                string
+	Mode                     string
+	OverrideInterval         int
+	OverrideWarnDays         int
+	PanicPrincipals          []string
+	PolicyVersion            string
+	Port                     int
+	PossessionSkew           int
+	PrincipalsCommand        string
+	PrincipalsToken          string
+	PrincipalsURL            string
+	ProxyHMACKey             string
+	ProxyHMACSkew            int
+	ProxyUser                string
+	ProxyPass                string
+	PruneArchiveDir          string
+	PruneInterval            int
+	PruneRetentionDays       int
+	ReminderEmailDomain      string
+	ReminderInterval         int
+	RequireClientIP          bool
+	RequireDevice            bool
+	RequirePossession        bool
+	ResponseHeaders          []responseHeader
+	RiskApprovalScore        float64
+	RiskASNHeader            string
+	RiskDenyScore            float64
+	RiskFailOpen             bool
+	RiskMFAScore             float64
+	RiskRestrictions         []riskRestriction
+	RiskRestrictScore        float64
+	RiskScoreToken           string
+	RiskScoreURL             string
+	RiskWorkDays             []string
+	RiskWorkHours            string
+	RiskWorkZone             string
+	SAMLEntityID             string
+	SAMLGroups               []samlGroup
+	SAMLGroupsAttr           string
+	SAMLHeader               string
+	SAMLIdPCert              string
+	SAMLPrincipalsAttr       string
+	SAMLUserAttr             string
+	Sandbox                  bool
+	SealedCAKeyFile          string
+	SessionExtension         bool
+	SessionPrincipals        bool
+	SignerSocket             string
+	SMTPAddr                 string
+	SMTPFrom                 string
+	SMTPPass                 string
+	SMTPUser                 string
+	SourceAddressMode        string
+	SourceAddresses          []string
+	SSLKey                   string
+	SSLCert                  string
+	StandbyCAFile            string
+	StandbyInterval          int
+	StandbyPrimary           string
+	StandbyToken             string
+	Tiers                    []tier
+	TransferProfiles         []transferProfile
+	UserCase                 string
+	UserHeader               string
+	UserHeaderMismatch       string
+	UserHeaders              []string
+	UserMaxLength            int
+	UserNormalize            string
+	UserRegex                string
+	VaultMount               string
+	WebhookRetries           int
+	WebhookSecret            string
+	WebhookURLs              []string
 }
 
 func main() {
+	// Print a local users file entry for standalone authentication
+	if len(os.Args) > 2 && os.Args[1] == "useradd" {
+		err := userAdd(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Check the config file without starting, or print every option's default
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		err := configCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Offline root CA tooling: generate an intermediate signed by the root, or check a
+	// published chain against the root and print the intermediates for TrustedUserCAKeys
+	if len(os.Args) > 3 && os.Args[1] == "intermediate" {
+		days, err := intermediateDays(os.Args[4:])
+		if err == nil {
+			err = runIntermediate(os.Args[2], os.Args[3], days)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "trust" {
+		in := os.Stdin
+		if len(os.Args) > 3 {
+			f, err := os.Open(os.Args[3])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		err := runTrust(os.Args[2], in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Process/load our config options
 	conf, err := getConf()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Convert our cert validity duration and pubkey lifespan from int to time.Duration
-	conf.dur = time.Duration(conf.Duration) * time.Second
-	if conf.MaxKeyAge < 0 {
-		// Negative MaxKeyAge means unlimited age keys, set lifespan to 100 years
-		conf.keyLifeSpan = 100 * 365 * 24 * time.Hour
-	} else {
-		conf.keyLifeSpan = time.Duration(conf.MaxKeyAge) * 24 * time.Hour
+	// Lint the tiers and principal mappings, and check example requests get the decisions
+	// they should, so policy changes can be gated in CI
+	if len(os.Args) > 1 && os.Args[1] == "policy" {
+		err = policyCommand(conf, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Print SSHFP records, or write a signed known_hosts bundle, for hosts we've certified
+	if len(os.Args) > 1 && os.Args[1] == "sshfp" {
+		err = printSSHFP(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "known-hosts" {
+		err = writeKnownHosts(conf, os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Translate our CA to Teleport or step-ca formats and theirs to ours, for migrations and
+	// fleets trusting both during the transition
+	if len(os.Args) > 2 && os.Args[1] == "export" {
+		err = runExport(conf, os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 3 && os.Args[1] == "import" {
+		err = runImport(conf, os.Args[2], os.Args[3], len(os.Args) > 4 && os.Args[4] == "--known-hosts")
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Print (or with --write, install) the sshd configuration for hosts trusting our CA
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap-host" {
+		err = bootstrapHost(conf, len(os.Args) > 2 && os.Args[2] == "--write")
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Bring the database schema up to date and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = runMigrate(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Rewrite the database without its free pages, with the daemon stopped
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		err = runCompact(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// Load the CA key into an ssh.Signer
-	conf.caSigner, err = loadCAKey(conf.CAKeyFile)
+	// Keep a copy of the primary's database as a warm standby, or make the copy live
+	if len(os.Args) > 1 && os.Args[1] == "standby" {
+		err = runStandby(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "promote" {
+		err = runPromote(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Encrypt the CA key into sealedcakeyfile and split the key to it among operators
+	if len(os.Args) > 3 && os.Args[1] == "seal" {
+		n, threshold, err := sealShares(os.Args[2:])
+		if err == nil {
+			err = runSeal(conf, n, threshold)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Hold the CA key for an unprivileged cursed (see caagentsocket) and serve nothing else
+	if len(os.Args) > 1 && os.Args[1] == "signer" {
+		err = runSigner(conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Measure how many certificates the CA signer, or a running server, issues a second
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		err = runBench(conf, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Confine ourselves before touching any network input
+	if conf.Sandbox {
+		writable := []string{filepath.Dir(conf.DBFile)}
+		if conf.KRLFile != "" {
+			writable = append(writable, filepath.Dir(conf.KRLFile))
+		}
+		if conf.LeaseFile != "" {
+			writable = append(writable, filepath.Dir(conf.LeaseFile))
+		}
+		if conf.InventoryFile != "" {
+			writable = append(writable, filepath.Dir(conf.InventoryFile))
+		}
+		if conf.PruneArchiveDir != filepath.Dir(conf.DBFile) {
+			writable = append(writable, conf.PruneArchiveDir)
+		}
+		err = sandbox(writable, len(conf.principalsCmd) > 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load the CA key into an ssh.Signer, find it in the configured ssh-agent, or wait for
+	// operators to unseal it
+	if conf.CAAgentSocket != "" {
+		conf.caSigner, err = loadAgentSigner(conf.CAAgentSocket, conf.CAPubKeyFile)
+	} else if conf.SealedCAKeyFile != "" {
+		conf.seal, err = loadSealedSigner(conf.SealedCAKeyFile)
+		if err == nil {
+			conf.caSigner = conf.seal
+			log.Printf("CA key %s is sealed, waiting for %d unseal shares", ssh.FingerprintSHA256(conf.seal.PublicKey()), conf.seal.sealed.Threshold)
+		}
+	} else {
+		conf.caSigner, err = loadCAKey(conf.CAKeyFile)
+	}
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	if conf.CABreakerThreshold > 0 {
+		conf.caSigner = newBreakerSigner(conf.caSigner, conf.CABreakerThreshold, time.Duration(conf.CABreakerCooldown)*time.Second)
+	}
+	err = checkCAChain(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A standby copy only becomes ours to write to once promoted
+	err = checkNotStandby(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Fence off any other cursed sharing our storage before touching the database, which
+	// bolt's lock alone won't do on network filesystems
+	if conf.LeaseFile != "" {
+		conf.lease, err = acquireLease(conf.LeaseFile, time.Duration(conf.LeaseTTL)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Open our key tracking database file
 	conf.db, err = bolt.Open(conf.DBFile, 0600, nil)
@@ -66,30 +489,72 @@ func main() {
 		log.Fatalf("Could not open database file %v", err)
 	}
 	defer conf.db.Close()
+	err = checkSchema(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = loadSealed(conf)
+	if err != nil {
+		log.Fatalf("Unable to read database encryption state: %v", err)
+	}
+	err = restoreFreeze(conf)
+	if err != nil {
+		log.Fatalf("Unable to read freeze state: %v", err)
+	}
 
-	// Set our web handler function
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		webHandler(w, r, conf)
-	})
-
-	// Start our listener service
-	addrPort := fmt.Sprintf("%s:%d", conf.Addr, conf.Port)
-	log.Printf("Starting HTTPS server on %s", addrPort)
-	err = http.ListenAndServeTLS(addrPort, conf.SSLCert, conf.SSLKey, nil)
+	// Start delivering audit events to any configured webhooks
+	conf.webhooks, err = startWebhooks(conf)
 	if err != nil {
-		log.Fatalf("Listener service: %v", err)
+		log.Fatalf("%v", err)
 	}
+
+	// Upload decision logs for the policy observability stack, if configured
+	conf.decisions = startDecisionLogs(conf)
+
+	// Copy a sample of signing requests to staging, if configured
+	conf.mirror = startMirror(conf)
+
+	// From here on the config is only read through the store, and swapped on SIGHUP
+	store := &confStore{}
+	store.store(conf)
+	go watchReload(store)
+
+	// Expiry reminders, pruning, KRL regeneration and the like run on their own schedules
+	runScheduler(store)
+
+	// Start the admin API on its own listener if enabled
+	if conf.AdminPort > 0 {
+		go serveAdmin(store)
+	}
+
+	// Plaintext /healthz for load balancers that can't authenticate, if enabled
+	if conf.HealthPort > 0 {
+		go serveHealth(store)
+	}
+
+	// Start our listener services, and stop if any of them fails
+	handler := withRequestID(withHeaders(store, mainMux(store)))
+	failed := make(chan error, len(conf.Listeners))
+	for _, l := range conf.Listeners {
+		log.Printf("Starting HTTPS server on %s (%s, TLS %s+) as instance %s, policy version %s", l.address(), l.Family, l.TLSMinVersion, conf.instanceID, conf.policyVersion)
+		go func(l listener) {
+			err := serveListener(conf, l, handler)
+			failed <- fmt.Errorf("%s: %v", l.address(), err)
+		}(l)
+	}
+	log.Fatalf("Listener service: %v", <-failed)
 }
 
 func init() {
-	//if cfgFile != "" { // enable ability to specify config file via flag
-	//	viper.SetConfigFile(cfgFile)
-	//}
-
 	viper.SetConfigName("cursed") // name of config file (without extension)
 	viper.AddConfigPath("/opt/curse/etc/")
 	viper.AddConfigPath("/etc/curse/")
 	viper.AddConfigPath(".")
+	// CURSED_CONFIG overrides the search path, e.g. for a `cursed signer` running as a user
+	// that can't read the main config
+	if cfgFile := os.Getenv("CURSED_CONFIG"); cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	}
 	viper.ReadInConfig()
 
 	// If a config file is found, read it in.
@@ -97,20 +562,201 @@ func init() {
 		log.Printf("Using config file: %s", viper.ConfigFileUsed())
 	}
 
-	viper.SetDefault("addr", "127.0.0.1")
-	viper.SetDefault("cakeyfile", "/opt/curse/etc/user_ca")
-	viper.SetDefault("dbfile", "/opt/curse/etc/cursed.db")
-	viper.SetDefault("duration", 2*60)
-	viper.SetDefault("extensions", []string{"permit-pty"})
-	viper.SetDefault("forcecmd", false)
-	viper.SetDefault("maxkeyage", 90)
-	viper.SetDefault("port", 81)
-	viper.SetDefault("proxyuser", "")
-	viper.SetDefault("proxypass", "")
-	viper.SetDefault("requireclientip", true)
-	viper.SetDefault("sslkey", "/opt/curse/etc/server.key")
-	viper.SetDefault("sslcert", "/opt/curse/etc/server.crt")
-	viper.SetDefault("userheader", "REMOTE_USER")
+	// Any option can also be set in the environment, e.g. CURSED_PORT=8443
+	viper.SetEnvPrefix("cursed")
+	viper.AutomaticEnv()
+
+	setDefaults(viper.GetViper())
+}
+
+// setDefaults is split out of init so `cursed config print-defaults` can list the defaults
+// without whatever the config file overrides
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("accountcheck", "")
+	v.SetDefault("accountcheckexempt", []string{})
+	v.SetDefault("addr", "127.0.0.1")
+	v.SetDefault("adminaddr", "127.0.0.1")
+	v.SetDefault("adminclientca", "")
+	v.SetDefault("adminport", 0)
+	v.SetDefault("admintoken", "")
+	v.SetDefault("admintokenmaxttl", 90*24*60*60)
+	v.SetDefault("allowhostcerts", false)
+	v.SetDefault("approvalttl", 60*60)
+	v.SetDefault("auditspoolkeyfile", "")
+	v.SetDefault("auditspoolmax", 10000)
+	v.SetDefault("auditstrict", false)
+	v.SetDefault("authmode", "proxy")
+	v.SetDefault("automigrate", true)
+	v.SetDefault("backdate", 0)
+	v.SetDefault("bless", false)
+	v.SetDefault("bootstrapcakeyfile", "/etc/ssh/curse_user_ca.pub")
+	v.SetDefault("bootstraprevokedkeysfile", "/etc/ssh/curse_revoked_keys")
+	v.SetDefault("bootstrapsshdfile", "/etc/ssh/sshd_config.d/50-curse.conf")
+	v.SetDefault("bootstraptemplate", "")
+	v.SetDefault("caagentsocket", "")
+	v.SetDefault("cabreakercooldown", 30)
+	v.SetDefault("cabreakerthreshold", 5)
+	v.SetDefault("cachain", []string{})
+	v.SetDefault("cakeyfile", "/opt/curse/etc/user_ca")
+	v.SetDefault("capubkeyfile", "/opt/curse/etc/user_ca.pub")
+	v.SetDefault("certremindermins", 0)
+	v.SetDefault("clientconfigfile", "")
+	v.SetDefault("clientipheader", "")
+	v.SetDefault("clockcheckinterval", 300)
+	v.SetDefault("clockmaxskew", 5)
+	v.SetDefault("clockntpserver", "")
+	v.SetDefault("clockskewaction", "refuse")
+	v.SetDefault("cmdallowmeta", false)
+	v.SetDefault("cmdallowlist", []string{})
+	v.SetDefault("cmdregex", []string{})
+	v.SetDefault("compactinterval", 24*60*60)
+	v.SetDefault("dbfile", "/opt/curse/etc/cursed.db")
+	v.SetDefault("dbkey", "")
+	v.SetDefault("dbpreviouskeys", []string{})
+	v.SetDefault("dbrekeyinterval", 60*60)
+	v.SetDefault("decisionloginterval", 5)
+	v.SetDefault("decisionlogurl", "")
+	v.SetDefault("delegationmaxttl", 12*60*60)
+	v.SetDefault("devicekeysfile", "")
+	v.SetDefault("deviceskew", 300)
+	v.SetDefault("duration", 2*60)
+	v.SetDefault("enrollmentmaxttl", 7*24*60*60)
+	v.SetDefault("exemptionmaxttl", 90*24*60*60)
+	v.SetDefault("extensions", []string{"permit-pty"})
+	v.SetDefault("forcecmd", false)
+	v.SetDefault("forgeteams", []forgeTeam{})
+	v.SetDefault("forgeurl", "")
+	v.SetDefault("githosts", []gitHost{})
+	v.SetDefault("groupextension", "")
+	v.SetDefault("healthaddr", "127.0.0.1")
+	v.SetDefault("healthport", 0)
+	v.SetDefault("hostduration", 30*24*60*60)
+	v.SetDefault("honeytokenalertemail", "")
+	v.SetDefault("honeytokenprincipals", []string{})
+	v.SetDefault("httpidletimeout", 120)
+	v.SetDefault("httpmaxconns", 0)
+	v.SetDefault("httpreadtimeout", 30)
+	v.SetDefault("httpwritetimeout", 60)
+	v.SetDefault("idempotencyttl", 600)
+	v.SetDefault("infraalertemail", "")
+	v.SetDefault("infraprincipals", []string{})
+	v.SetDefault("instanceid", "")
+	v.SetDefault("inventoryfile", "")
+	v.SetDefault("inventoryinterval", 5*60)
+	v.SetDefault("keyageremediationurl", "")
+	v.SetDefault("keyallowlist", false)
+	v.SetDefault("keyallowlistmaxttl", 365*24*60*60)
+	v.SetDefault("keychangeapproval", false)
+	v.SetDefault("keycontinuitydays", 0)
+	v.SetDefault("keyregistry", "")
+	v.SetDefault("keyreminderdays", 0)
+	v.SetDefault("knownhostsdomains", []string{})
+	v.SetDefault("listeners", []listener{})
+	v.SetDefault("krlfile", "")
+	v.SetDefault("krlinterval", 5*60)
+	v.SetDefault("ldapaccountfilter", "(&(objectClass=posixAccount)(uid=%s))")
+	v.SetDefault("ldapbasedn", "")
+	v.SetDefault("ldapbinddn", "")
+	v.SetDefault("ldapbindpass", "")
+	v.SetDefault("ldapgroupattr", "memberOf")
+	v.SetDefault("ldapkeyattr", "sshPublicKey")
+	v.SetDefault("ldapurl", "")
+	v.SetDefault("ldapuserfilter", "(uid=%s)")
+	v.SetDefault("leasefile", "")
+	v.SetDefault("leasettl", 30)
+	v.SetDefault("localusersfile", "/opt/curse/etc/users")
+	v.SetDefault("loginlockout", 5*60)
+	v.SetDefault("loginmaxfailures", 5)
+	v.SetDefault("logsamplehosts", 1)
+	v.SetDefault("logsampleusers", 1)
+	v.SetDefault("lookupcachestale", 5*60)
+	v.SetDefault("lookupcachettl", 60)
+	v.SetDefault("maintenancemessage", "")
+	v.SetDefault("maxbatchsize", 50)
+	v.SetDefault("maxconcurrentperip", 0)
+	v.SetDefault("maxconcurrentperuser", 0)
+	v.SetDefault("mfaheader", "")
+	v.SetDefault("maxkeyage", 90)
+	v.SetDefault("maxstartdelay", 0)
+	v.SetDefault("metadataextension", false)
+	v.SetDefault("metricsmaxpolicies", 50)
+	v.SetDefault("metricsmaxtenants", 100)
+	v.SetDefault("metricstenantheader", "")
+	v.SetDefault("mirrorpercent", 0)
+	v.SetDefault("mirrorproxypass", "")
+	v.SetDefault("mirrorproxyuser", "")
+	v.SetDefault("mirrorurl", "")
+	v.SetDefault("mode", "normal")
+	v.SetDefault("overrideinterval", 24*60*60)
+	v.SetDefault("overridewarndays", 7)
+	v.SetDefault("panicprincipals", []string{})
+	v.SetDefault("policyversion", "")
+	v.SetDefault("port", 81)
+	v.SetDefault("possessionskew", 120)
+	v.SetDefault("principalscommand", "")
+	v.SetDefault("principalstoken", "")
+	v.SetDefault("principalsurl", "")
+	v.SetDefault("proxyhmackey", "")
+	v.SetDefault("proxyhmacskew", 30)
+	v.SetDefault("proxyuser", "")
+	v.SetDefault("proxypass", "")
+	v.SetDefault("prunearchivedir", "")
+	v.SetDefault("pruneinterval", 60*60)
+	v.SetDefault("pruneretentiondays", 7)
+	v.SetDefault("reminderemaildomain", "")
+	v.SetDefault("reminderinterval", 60)
+	v.SetDefault("requireclientip", true)
+	v.SetDefault("requiredevice", false)
+	v.SetDefault("requirepossession", false)
+	v.SetDefault("responseheaders", []responseHeader{})
+	v.SetDefault("riskapprovalscore", 0)
+	v.SetDefault("riskasnheader", "")
+	v.SetDefault("riskdenyscore", 0)
+	v.SetDefault("riskfailopen", false)
+	v.SetDefault("riskmfascore", 0)
+	v.SetDefault("riskrestrictions", []riskRestriction{})
+	v.SetDefault("riskrestrictscore", 0)
+	v.SetDefault("riskscoretoken", "")
+	v.SetDefault("riskscoreurl", "")
+	v.SetDefault("riskworkdays", []string{"Mon", "Tue", "Wed", "Thu", "Fri"})
+	v.SetDefault("riskworkhours", "")
+	v.SetDefault("riskworkzone", "")
+	v.SetDefault("samlentityid", "")
+	v.SetDefault("samlgroups", []samlGroup{})
+	v.SetDefault("samlgroupsattr", "")
+	v.SetDefault("samlheader", "")
+	v.SetDefault("samlidpcert", "")
+	v.SetDefault("samlprincipalsattr", "")
+	v.SetDefault("samluserattr", "")
+	v.SetDefault("sandbox", false)
+	v.SetDefault("sealedcakeyfile", "")
+	v.SetDefault("sessionextension", false)
+	v.SetDefault("sessionprincipals", false)
+	v.SetDefault("signersocket", "")
+	v.SetDefault("smtpaddr", "")
+	v.SetDefault("smtpfrom", "")
+	v.SetDefault("smtppass", "")
+	v.SetDefault("smtpuser", "")
+	v.SetDefault("sourceaddressmode", "bastion")
+	v.SetDefault("sourceaddresses", []string{})
+	v.SetDefault("sslkey", "/opt/curse/etc/server.key")
+	v.SetDefault("sslcert", "/opt/curse/etc/server.crt")
+	v.SetDefault("standbycafile", "")
+	v.SetDefault("standbyinterval", 60)
+	v.SetDefault("standbyprimary", "")
+	v.SetDefault("standbytoken", "")
+	v.SetDefault("tiers", []tier{})
+	v.SetDefault("usercase", "preserve")
+	v.SetDefault("userheader", "REMOTE_USER")
+	v.SetDefault("userheadermismatch", "deny")
+	v.SetDefault("userheaders", []string{})
+	v.SetDefault("usermaxlength", 32)
+	v.SetDefault("usernormalize", "none")
+	v.SetDefault("userregex", `(?i)^[a-z_][a-z0-9_-]{0,31}$`)
+	v.SetDefault("vaultmount", "")
+	v.SetDefault("webhookretries", 5)
+	v.SetDefault("webhooksecret", "")
+	v.SetDefault("webhookurls", []string{})
 }
 
 func validateExtensions(confExts []string) (map[string]string, []error) {
@@ -150,16 +796,348 @@ func getConf() (*config, error) {
 	// Hardcoding the DB bucket name
 	conf.bucketName = []byte("pubkeybirthdays")
 
+	// Look up any secrets referenced from the config file
+	conf.ProxyUser, err = resolveSecret(conf.ProxyUser)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve proxyuser: %v", err)
+	}
+	conf.ProxyPass, err = resolveSecret(conf.ProxyPass)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve proxypass: %v", err)
+	}
+
 	// Require proxy authentication and SSL for security
-	if conf.ProxyUser == "" || conf.ProxyPass == "" {
-		return nil, fmt.Errorf("proxyuser and proxypass are required fields")
+	conf.ProxyHMACKey, err = resolveSecret(conf.ProxyHMACKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve proxyhmackey: %v", err)
+	}
+	switch conf.AuthMode {
+	case "proxy":
+		if conf.ProxyUser == "" || conf.ProxyPass == "" {
+			return nil, fmt.Errorf("proxyuser and proxypass are required fields")
+		}
+	case "local":
+		conf.localUsers, err = loadLocalUsers(expandHome(conf.LocalUsersFile))
+		if err != nil {
+			return nil, err
+		}
+		if conf.LoginMaxFailures < 1 || conf.LoginLockout < 1 {
+			return nil, fmt.Errorf("loginmaxfailures and loginlockout must be positive")
+		}
+	case "github", "gitlab":
+		if len(conf.ForgeTeams) == 0 {
+			return nil, fmt.Errorf("forgeteams is required with authmode: %s", conf.AuthMode)
+		}
+		conf.forgeURL = strings.TrimSuffix(conf.ForgeURL, "/")
+		if conf.forgeURL == "" && conf.AuthMode == "github" {
+			conf.forgeURL = "https://api.github.com"
+		} else if conf.forgeURL == "" {
+			conf.forgeURL = "https://gitlab.com"
+		}
+	case "saml":
+		if conf.SAMLIdPCert == "" || conf.SAMLEntityID == "" {
+			return nil, fmt.Errorf("samlidpcert and samlentityid are required with authmode: saml")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid authmode %q (valid: proxy, local, github, gitlab, saml)", conf.AuthMode)
+	}
+	// Without an audience to check, an assertion the IdP signed for any other service
+	// provider would log in here
+	if conf.SAMLIdPCert != "" && conf.SAMLEntityID == "" {
+		return nil, fmt.Errorf("samlentityid is required with samlidpcert")
+	}
+	if conf.AuthMode == "saml" || (conf.AuthMode == "proxy" && conf.SAMLHeader != "") {
+		if conf.SAMLPrincipalsAttr == "" && len(conf.SAMLGroups) == 0 {
+			return nil, fmt.Errorf("samlprincipalsattr or samlgroups is required to use SAML assertions")
+		}
+		if len(conf.SAMLGroups) > 0 && conf.SAMLGroupsAttr == "" {
+			return nil, fmt.Errorf("samlgroupsattr is required with samlgroups")
+		}
+		if conf.SAMLIdPCert != "" {
+			conf.samlCerts, err = loadSAMLCerts(expandHome(conf.SAMLIdPCert))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	conf.dbCipher, err = newDBCipher(conf.DBKey, conf.DBPreviousKeys)
+	if err != nil {
+		return nil, err
+	}
+	if conf.dbCipher != nil && conf.DBRekeyInterval <= 0 {
+		return nil, fmt.Errorf("dbrekeyinterval must be positive when dbkey is set")
+	}
+	conf.AdminToken, err = resolveSecret(conf.AdminToken)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve admintoken: %v", err)
+	}
+	if conf.AdminClientCA != "" {
+		caPEM, err := ioutil.ReadFile(conf.AdminClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read adminclientca: %v", err)
+		}
+		conf.adminClientCAs = x509.NewCertPool()
+		if !conf.adminClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in adminclientca %s", conf.AdminClientCA)
+		}
+	}
+	if conf.AdminPort > 0 && conf.AdminToken == "" && conf.adminClientCAs == nil {
+		return nil, fmt.Errorf("admintoken or adminclientca is required when adminport is set")
+	}
+	if conf.AdminTokenMaxTTL < 1 {
+		return nil, fmt.Errorf("admintokenmaxttl must be positive")
+	}
+	if conf.EnrollmentMaxTTL < 1 {
+		return nil, fmt.Errorf("enrollmentmaxttl must be positive")
+	}
+	if conf.ExemptionMaxTTL < 1 || conf.KeyAllowlistMaxTTL < 1 {
+		return nil, fmt.Errorf("exemptionmaxttl and keyallowlistmaxttl must be positive")
+	}
+	if conf.OverrideWarnDays < 0 {
+		return nil, fmt.Errorf("overridewarndays can't be negative, use 0 to stop reporting")
+	}
+	if conf.MetricsMaxTenants < 1 || conf.MetricsMaxPolicies < 1 {
+		return nil, fmt.Errorf("metricsmaxtenants and metricsmaxpolicies must be positive")
 	}
 	if conf.SSLKey == "" || conf.SSLCert == "" {
 		return nil, fmt.Errorf("sslkey and sslcert are required fields")
 	}
+	err = resolveListeners(&conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range conf.Listeners {
+		if conf.HealthPort > 0 && (conf.HealthPort == l.Port || conf.HealthPort == conf.AdminPort) {
+			return nil, fmt.Errorf("healthport must differ from the listeners' ports and adminport")
+		}
+	}
+	conf.WebhookSecret, err = resolveSecret(conf.WebhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve webhooksecret: %v", err)
+	}
+	if conf.CABreakerThreshold > 0 && conf.CABreakerCooldown <= 0 {
+		return nil, fmt.Errorf("cabreakercooldown must be positive when cabreakerthreshold is set")
+	}
+	if conf.ReminderInterval < 0 || conf.PruneInterval < 0 || conf.KRLInterval < 0 || conf.CompactInterval < 0 || conf.ClockCheckInterval < 0 || conf.InventoryInterval < 0 || conf.OverrideInterval < 0 {
+		return nil, fmt.Errorf("Task intervals can't be negative, use 0 to disable a task")
+	}
+	if conf.DecisionLogURL != "" && conf.DecisionLogInterval <= 0 {
+		return nil, fmt.Errorf("decisionloginterval must be positive when decisionlogurl is set")
+	}
+	if conf.VaultMount != "" && !validVaultMount.MatchString(conf.VaultMount) {
+		return nil, fmt.Errorf("Invalid vaultmount %q (a path like ssh or ssh-client-signer, without leading or trailing slashes)", conf.VaultMount)
+	}
+	switch conf.ClockSkewAction {
+	case "refuse", "warn", "correct":
+	default:
+		return nil, fmt.Errorf("Invalid clockskewaction %q (valid: refuse, warn, correct)", conf.ClockSkewAction)
+	}
+	if conf.ClockMaxSkew <= 0 {
+		return nil, fmt.Errorf("clockmaxskew must be positive")
+	}
+	if conf.MaxConcurrentPerIP < 0 || conf.MaxConcurrentPerUser < 0 {
+		return nil, fmt.Errorf("Concurrency limits can't be negative, use 0 for no limit")
+	}
+	if conf.LogSampleHosts < 1 || conf.LogSampleUsers < 1 {
+		return nil, fmt.Errorf("logsamplehosts and logsampleusers must be at least 1 (log every request)")
+	}
+	if conf.Backdate < 0 {
+		return nil, fmt.Errorf("backdate can't be negative")
+	}
+	if conf.PruneRetentionDays < 0 {
+		return nil, fmt.Errorf("pruneretentiondays can't be negative")
+	}
+	if conf.PossessionSkew <= 0 {
+		return nil, fmt.Errorf("possessionskew must be positive, it's how far a key signature's timestamp may be from now")
+	}
+	conf.principalsCmd = strings.Fields(conf.PrincipalsCommand)
+	if len(conf.principalsCmd) > 0 && conf.PrincipalsURL != "" {
+		return nil, fmt.Errorf("principalscommand and principalsurl are mutually exclusive")
+	}
+	conf.PrincipalsToken, err = resolveSecret(conf.PrincipalsToken)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve principalstoken: %v", err)
+	}
+	if conf.LookupCacheTTL < 0 || conf.LookupCacheStale < 0 {
+		return nil, fmt.Errorf("lookupcachettl and lookupcachestale can't be negative, use lookupcachettl: 0 to look up every request")
+	}
+	conf.groupCache = newLookupCache("groups", conf.LookupCacheTTL, conf.LookupCacheStale)
+	conf.principalCache = newLookupCache("principals", conf.LookupCacheTTL, conf.LookupCacheStale)
+	if conf.KeyAgeRemediationURL != "" {
+		u, err := url.Parse(conf.KeyAgeRemediationURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid keyageremediationurl %q, must be an http(s) URL", conf.KeyAgeRemediationURL)
+		}
+	}
+	if conf.MirrorURL != "" {
+		u, err := url.Parse(conf.MirrorURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid mirrorurl %q, must be an http(s) URL", conf.MirrorURL)
+		}
+	}
+	if conf.MirrorPercent < 0 || conf.MirrorPercent > 100 {
+		return nil, fmt.Errorf("mirrorpercent must be between 0 and 100")
+	}
+	conf.MirrorProxyUser, err = resolveSecret(conf.MirrorProxyUser)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve mirrorproxyuser: %v", err)
+	}
+	conf.MirrorProxyPass, err = resolveSecret(conf.MirrorProxyPass)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve mirrorproxypass: %v", err)
+	}
+	conf.StandbyToken, err = resolveSecret(conf.StandbyToken)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve standbytoken: %v", err)
+	}
+	if conf.StandbyPrimary != "" && conf.StandbyInterval <= 0 {
+		return nil, fmt.Errorf("standbyinterval must be positive")
+	}
+	conf.RiskScoreToken, err = resolveSecret(conf.RiskScoreToken)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve riskscoretoken: %v", err)
+	}
+	if conf.RiskMFAScore < 0 || conf.RiskApprovalScore < 0 || conf.RiskDenyScore < 0 || conf.RiskRestrictScore < 0 {
+		return nil, fmt.Errorf("riskmfascore, riskapprovalscore, riskdenyscore and riskrestrictscore can't be negative")
+	}
+	if conf.RiskScoreURL != "" {
+		conf.riskScorer = newURLScorer(conf.RiskScoreURL, conf.RiskScoreToken)
+	}
+	conf.riskHours, err = parseWorkHours(conf.RiskWorkHours, conf.RiskWorkDays, conf.RiskWorkZone)
+	if err != nil {
+		return nil, err
+	}
+	err = validateRiskRestrictions(&conf)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.KeyRegistry {
+	case "", "github", "ldap":
+	default:
+		return nil, fmt.Errorf("Invalid keyregistry %q (valid: ldap, github)", conf.KeyRegistry)
+	}
+	switch conf.GroupExtension {
+	case "", "ldap":
+	case "forge":
+		if conf.AuthMode != "github" && conf.AuthMode != "gitlab" {
+			return nil, fmt.Errorf("groupextension: forge requires authmode github or gitlab")
+		}
+	case "saml":
+		if conf.SAMLGroupsAttr == "" || (conf.AuthMode != "saml" && conf.SAMLHeader == "") {
+			return nil, fmt.Errorf("groupextension: saml requires samlgroupsattr, and authmode saml or samlheader")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid groupextension %q (valid: ldap, forge, saml)", conf.GroupExtension)
+	}
+	switch conf.AccountCheck {
+	case "", "nss":
+	case "ldap":
+		if strings.Count(conf.LDAPAccountFilter, "%s") != 1 {
+			return nil, fmt.Errorf("ldapaccountfilter must contain exactly one %%s")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid accountcheck %q (valid: nss, ldap)", conf.AccountCheck)
+	}
+	if conf.KeyRegistry == "ldap" || conf.GroupExtension == "ldap" || conf.AccountCheck == "ldap" {
+		if conf.LDAPURL == "" || conf.LDAPBaseDN == "" {
+			return nil, fmt.Errorf("ldapurl and ldapbasedn are required for LDAP lookups")
+		}
+		if strings.Count(conf.LDAPUserFilter, "%s") != 1 {
+			return nil, fmt.Errorf("ldapuserfilter must contain exactly one %%s")
+		}
+		conf.LDAPBindPass, err = resolveSecret(conf.LDAPBindPass)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve ldapbindpass: %v", err)
+		}
+	}
+	conf.SMTPPass, err = resolveSecret(conf.SMTPPass)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve smtppass: %v", err)
+	}
+	if conf.HoneytokenAlertEmail != "" && conf.SMTPAddr == "" {
+		return nil, fmt.Errorf("smtpaddr is required when honeytokenalertemail is set")
+	}
+	if conf.SMTPAddr != "" && conf.SMTPFrom == "" {
+		return nil, fmt.Errorf("smtpfrom is required when smtpaddr is set")
+	}
+
+	// Check how we pin certificates to source addresses
+	err = validateSourceAddresses(conf.SourceAddressMode, conf.SourceAddresses)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateTiers(conf.Tiers)
+	if err != nil {
+		return nil, err
+	}
+	err = validateGitHosts(conf.GitHosts, conf.GroupExtension)
+	if err != nil {
+		return nil, err
+	}
+	err = validateHostCertRequesters(&conf)
+	if err != nil {
+		return nil, err
+	}
+	err = validateTransferProfiles(conf.TransferProfiles)
+	if err != nil {
+		return nil, err
+	}
+	err = validateHoneytokens(conf.HoneytokenPrincipals)
+	if err != nil {
+		return nil, err
+	}
+	err = validateInfraPrincipals(conf.InfraPrincipals)
+	if err != nil {
+		return nil, err
+	}
+	err = validateResponseHeaders(conf.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start in the configured service mode, which can be changed at runtime via the admin API
+	conf.mode, err = newServiceMode(conf.Mode, conf.MaintenanceMessage)
+	if err != nil {
+		return nil, err
+	}
 
 	// Expand $HOME into service user's home path
 	conf.DBFile = expandHome(conf.DBFile)
+	conf.CAAgentSocket = expandHome(conf.CAAgentSocket)
+	conf.SealedCAKeyFile = expandHome(conf.SealedCAKeyFile)
+	if conf.SealedCAKeyFile != "" && conf.CAAgentSocket != "" {
+		return nil, fmt.Errorf("sealedcakeyfile and caagentsocket can't both be set")
+	}
+	conf.LeaseFile = expandHome(conf.LeaseFile)
+	conf.InventoryFile = expandHome(conf.InventoryFile)
+	conf.PruneArchiveDir = expandHome(conf.PruneArchiveDir)
+	if conf.PruneArchiveDir == "" {
+		conf.PruneArchiveDir = filepath.Dir(conf.DBFile)
+	}
+	err = loadCAChain(&conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ClientConfigFile != "" {
+		conf.clientConfig, err = loadClientConfig(expandHome(conf.ClientConfigFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.LeaseFile != "" && conf.LeaseTTL < 3 {
+		return nil, fmt.Errorf("leasettl must be at least 3 seconds")
+	}
+
+	// Load enrolled device keys for device-bound certificates
+	if conf.DeviceKeysFile != "" {
+		conf.devices, err = loadDeviceKeys(expandHome(conf.DeviceKeysFile))
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.RequireDevice {
+		return nil, fmt.Errorf("devicekeysfile is required when requiredevice is enabled")
+	}
 
 	// Check our certificate extensions (permissions) for validity
 	var errSlice []error
@@ -170,9 +1148,71 @@ func getConf() (*config, error) {
 		}
 	}
 
-	// Compile our user-matching regex (usernames are limited to 32 characters, must start
-	// with a-z or _, and contain only these characters: a-z, 0-9, - and _
-	conf.userRegex = regexp.MustCompile(`(?i)^[a-z_][a-z0-9_-]{0,31}$`)
+	// Compile our user-matching regex. By default usernames are limited to 32 characters, must
+	// start with a-z or _, and contain only these characters: a-z, 0-9, - and _
+	conf.userRegex, err = regexp.Compile(conf.UserRegex)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid userregex: %v", err)
+	}
+	for _, pattern := range conf.CmdRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cmdregex %q: %v", pattern, err)
+		}
+		conf.cmdRegexes = append(conf.cmdRegexes, re)
+	}
+	conf.identitySources, err = parseIdentitySources(conf.UserHeader, conf.UserHeaders)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.UserHeaderMismatch {
+	case "deny", "log":
+	default:
+		return nil, fmt.Errorf("Invalid userheadermismatch %q (valid: deny, log)", conf.UserHeaderMismatch)
+	}
+	switch conf.UserCase {
+	case "preserve", "lower", "fold":
+	default:
+		return nil, fmt.Errorf("Invalid usercase %q (valid: preserve, lower, fold)", conf.UserCase)
+	}
+	switch conf.UserNormalize {
+	case "none", "nfc", "nfkc":
+	default:
+		return nil, fmt.Errorf("Invalid usernormalize %q (valid: none, nfc, nfkc)", conf.UserNormalize)
+	}
+
+	conf.clock = newTimeSource(&conf)
+
+	// State that outlives a config snapshot starts out empty here, and a reload carries the
+	// running process's over in its place
+	conf.caResponse = &caCache{}
+	conf.inventoryMu = &sync.Mutex{}
+	conf.krlMu = &sync.Mutex{}
+	conf.krlResponse = &krlCache{}
+	conf.lastTOTPSteps = &totpSteps{steps: make(map[string]int64)}
+	conf.localFailures = &loginFailures{entries: make(map[string]*failureCount)}
+	conf.tasks = &taskTable{status: make(map[string]*taskStatus)}
+	conf.tenantLabels = &labelSets{tenants: make(map[string]bool), policies: make(map[string]bool)}
+
+	// Convert our cert validity duration and pubkey lifespan from int to time.Duration
+	conf.dur = time.Duration(conf.Duration) * time.Second
+	conf.hostDur = time.Duration(conf.HostDuration) * time.Second
+	if conf.MaxKeyAge < 0 {
+		// Negative MaxKeyAge means unlimited age keys, set lifespan to 100 years
+		conf.keyLifeSpan = 100 * 365 * 24 * time.Hour
+	} else {
+		conf.keyLifeSpan = time.Duration(conf.MaxKeyAge) * 24 * time.Hour
+	}
+
+	// Identify ourselves and the policy revision in the metadata extension
+	conf.instanceID = conf.InstanceID
+	if conf.instanceID == "" {
+		conf.instanceID, _ = os.Hostname()
+	}
+	conf.policyVersion, err = policyVersion(conf.PolicyVersion)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compute policy version: %v", err)
+	}
 
 	return &conf, nil
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// Certificate extension tracing a certificate back to the cursed that signed it, the policy
+// it was signed under and the request that asked for it, as JSON. sshd ignores extensions it
+// doesn't know
+const metadataExtension = "metadata@curse"
+
+type certMetadata struct {
+	Instance string `json:"instance"`
+	Policy   string `json:"policy"`
+	Request  string `json:"request,omitempty"`
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID withRequestID gave the request ctx belongs to
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestIDContext makes the request ID available to code that only gets the context
+func withRequestIDContext(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// policyVersion is policyversion, or failing that a digest of the effective configuration,
+// which changes whenever an option does
+func policyVersion(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	settings, err := json.Marshal(viper.AllSettings())
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:6]), nil
+}
+
+// withMetadata adds the metadata extension to exts when metadataextension is set
+func withMetadata(ctx context.Context, conf *config, exts map[string]string) map[string]string {
+	if !conf.MetadataExtension {
+		return exts
+	}
+	md, _ := json.Marshal(certMetadata{
+		Instance: conf.instanceID,
+		Policy:   conf.policyVersion,
+		Request:  requestID(ctx),
+	})
+	return withExtension(exts, metadataExtension, string(md))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Labels for tenants and policies past metricsmaxtenants or metricsmaxpolicies, and for
+// requests without a tenant or a tier
+const (
+	otherLabel   = "other"
+	noneLabel    = "none"
+	defaultLabel = "default"
+)
+
+// Policy label for host certificates, which tiers don't apply to
+const hostPolicy = "host"
+
+// Issued certificates and denials by tenant, policy and outcome, published on the admin
+// listener's /debug/vars as {"tenant": {"policy": {"issued": n, "QUOTA": n, ...}}}. The
+// policy is the tier the request fell under, host for host certificates, or default
+var tenantCounts = expvar.NewMap("tenants")
+
+// labelSets holds the values seen so far for each label. Once a cap is reached new values
+// count under other, so a proxy passing arbitrary tenant names can't grow the series without
+// bound
+type labelSets struct {
+	sync.Mutex
+	tenants  map[string]bool
+	policies map[string]bool
+}
+
+func capLabel(seen map[string]bool, v string, max int) string {
+	if seen[v] {
+		return v
+	}
+	if len(seen) >= max {
+		return otherLabel
+	}
+	seen[v] = true
+	return v
+}
+
+// countRequest adds a request's outcome, "issued" or its denial reason, to tenantCounts
+func countRequest(conf *config, a *auditContext, outcome string) {
+	a.mu.Lock()
+	tenant, policy := a.tenant, a.policy
+	a.mu.Unlock()
+	if tenant == "" {
+		tenant = noneLabel
+	}
+	if policy == "" {
+		policy = defaultLabel
+	}
+
+	labels := conf.tenantLabels
+	labels.Lock()
+	defer labels.Unlock()
+	tenant = capLabel(labels.tenants, tenant, conf.MetricsMaxTenants)
+	policy = capLabel(labels.policies, policy, conf.MetricsMaxPolicies)
+	tm, _ := tenantCounts.Get(tenant).(*expvar.Map)
+	if tm == nil {
+		tm = new(expvar.Map).Init()
+		tenantCounts.Set(tenant, tm)
+	}
+	pm, _ := tm.Get(policy).(*expvar.Map)
+	if pm == nil {
+		pm = new(expvar.Map).Init()
+		tm.Set(policy, pm)
+	}
+	pm.Add(outcome, 1)
+}
+
+// tenantAsserted returns the tenant the reverse proxy put the user in, if it does
+func tenantAsserted(r *http.Request, conf *config) string {
+	if conf.MetricsTenantHeader == "" {
+		return ""
+	}
+	tenant := strings.TrimSpace(r.Header.Get(conf.MetricsTenantHeader))
+	if len(tenant) > 64 {
+		tenant = tenant[:64]
+	}
+	return tenant
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schemaversion")
+)
+
+type migration struct {
+	desc string
+	up   func(tx *bolt.Tx, conf *config) error
+}
+
+// Migrations are applied in order and never edited once released. Add new ones to the end
+var migrations = []migration{
+	{"Create key age, exemption and audit spool buckets", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, conf.bucketName, exemptionBucket, spoolBucket)
+	}},
+	{"Create expiry reminder and approval buckets", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, expiryBucket, approvalBucket)
+	}},
+	{"Create host certificate bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, hostBucket)
+	}},
+	{"Create key history bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, keyHistoryBucket)
+	}},
+	{"Create idempotency bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, idempotencyBucket)
+	}},
+	{"Create key list bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, keyListBucket)
+	}},
+	{"Create delegation bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, delegationBucket)
+	}},
+	{"Create session principal bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, sessionPrincipalBucket)
+	}},
+	{"Create issued certificate bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, issuedBucket)
+	}},
+	{"Create freeze bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, freezeBucket)
+	}},
+	{"Create admin token bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, adminTokenBucket)
+	}},
+	{"Create enrollment bucket", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, enrollmentBucket)
+	}},
+	{"Expire allowlist entries and exemptions by their maximum lifetimes", limitOverrides},
+	{"Create audit spool delivery and dead letter buckets", func(tx *bolt.Tx, conf *config) error {
+		return createBuckets(tx, spoolDeliveredBucket, deadLetterBucket)
+	}},
+	{"Encrypt records with dbkey", sealRecords},
+}
+
+func createBuckets(tx *bolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		_, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return fmt.Errorf("Failed to create bucket %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// limitOverrides gives allowlist entries added before they expired keyallowlistmaxttl from
+// now, and brings exemptions expiring later than exemptionmaxttl from now forward to it
+func limitOverrides(tx *bolt.Tx, conf *config) error {
+	now := time.Now()
+	allowUntil := now.Add(time.Duration(conf.KeyAllowlistMaxTTL) * time.Second)
+	exemptUntil := now.Add(time.Duration(conf.ExemptionMaxTTL) * time.Second)
+
+	updates := make(map[string][]byte)
+	if bucket := tx.Bucket(keyListBucket); bucket != nil {
+		err := bucket.ForEach(func(k, v []byte) error {
+			var e keyListEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return fmt.Errorf("Key list record corrupted for key %s: %v", k, err)
+			}
+			if e.List != keyListAllow || e.Expires != nil {
+				return nil
+			}
+			e.Expires = &allowUntil
+			updates[string(k)], err = json.Marshal(e)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for k, val := range updates {
+			err = bucket.Put([]byte(k), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	updates = make(map[string][]byte)
+	if bucket := tx.Bucket(exemptionBucket); bucket != nil {
+		err := bucket.ForEach(func(k, v []byte) error {
+			var ex exemption
+			err := json.Unmarshal(v, &ex)
+			if err != nil {
+				return fmt.Errorf("Exemption record corrupted for key %s: %v", k, err)
+			}
+			if !ex.Expires.After(exemptUntil) {
+				return nil
+			}
+			ex.Expires = exemptUntil
+			updates[string(k)], err = json.Marshal(ex)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for k, val := range updates {
+			err = bucket.Put([]byte(k), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	bucket := tx.Bucket(metaBucket)
+	if bucket == nil {
+		return 0, nil
+	}
+	val := bucket.Get(schemaVersionKey)
+	if val == nil {
+		return 0, nil
+	}
+
+	v, err := strconv.Atoi(string(val))
+	if err != nil {
+		return 0, fmt.Errorf("Schema version in db corrupted: %v", err)
+	}
+	return v, nil
+}
+
+// migrate applies any pending migrations, each in its own transaction, and returns the
+// schema versions before and after
+func migrate(conf *config) (int, int, error) {
+	var from int
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		var err error
+		from, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("Database schema version %d is newer than this cursed supports (%d)", from, len(migrations))
+	}
+
+	for v := from; v < len(migrations); v++ {
+		m := migrations[v]
+		err = conf.db.Update(func(tx *bolt.Tx) error {
+			err := m.up(tx, conf)
+			if err != nil {
+				return err
+			}
+			bucket, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(schemaVersionKey, []byte(strconv.Itoa(v+1)))
+		})
+		if err != nil {
+			return from, v, fmt.Errorf("Migration %d (%s) failed: %v", v+1, m.desc, err)
+		}
+		log.Printf("Applied migration %d: %s", v+1, m.desc)
+	}
+
+	return from, len(migrations), nil
+}
+
+// checkSchema makes sure the database is at the schema version this binary expects,
+// migrating it if automigrate is enabled
+func checkSchema(conf *config) error {
+	var v int
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v == len(migrations):
+		return nil
+	case v > len(migrations):
+		return fmt.Errorf("Database schema version %d is newer than this cursed supports (%d)", v, len(migrations))
+	case !conf.AutoMigrate:
+		return fmt.Errorf("Database schema version %d is out of date (want %d), run `cursed migrate`", v, len(migrations))
+	}
+
+	_, _, err = migrate(conf)
+	return err
+}
+
+func runMigrate(conf *config) error {
+	// Don't wait forever on the file lock if the daemon is still running
+	db, err := bolt.Open(conf.DBFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("Could not open database file (is cursed running?): %v", err)
+	}
+	defer db.Close()
+	conf.db = db
+
+	from, to, err := migrate(conf)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Printf("Database is up to date at schema version %d\n", to)
+	} else {
+		fmt.Printf("Migrated database from schema version %d to %d\n", from, to)
+	}
+
+	return nil
+}
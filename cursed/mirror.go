@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"expvar"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Mirrored requests by outcome (sent, agreed, disagreed, failed, dropped), published on the
+// admin listener's /debug/vars
+var mirrorCounts = expvar.NewMap("mirror")
+
+// mirrorRequest is a signing request on its way to staging, with what we decided about it
+type mirrorRequest struct {
+	ctx     context.Context
+	form    url.Values
+	headers http.Header
+	outcome string
+}
+
+// mirror copies a sample of signing requests to a staging cursed, so a new policy or release
+// meets real traffic before it's trusted with any. Staging's answers never reach the client:
+// they're only compared with ours, and disagreements logged
+type mirror struct {
+	client  *http.Client
+	percent float64
+	queue   chan mirrorRequest
+	url     string
+	user    string
+	pass    string
+	header  string
+}
+
+func startMirror(conf *config) *mirror {
+	if conf.MirrorURL == "" || conf.MirrorPercent <= 0 {
+		return nil
+	}
+
+	m := &mirror{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		percent: conf.MirrorPercent,
+		queue:   make(chan mirrorRequest, 100),
+		url:     conf.MirrorURL,
+		user:    conf.MirrorProxyUser,
+		pass:    conf.MirrorProxyPass,
+		header:  conf.UserHeader,
+	}
+	go m.run()
+
+	return m
+}
+
+// send queues a sample of requests for staging, once we've answered them ourselves. The key
+// is swapped for a throwaway one, and with it the proofs made with the real key and device:
+// staging sees the shape of the request, not anything it could use
+func (m *mirror) send(ctx context.Context, conf *config, p httpParams, res signResult) {
+	if m == nil || mrand.Float64()*100 >= m.percent {
+		return
+	}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return
+	}
+
+	form := url.Values{}
+	form.Set("key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))))
+	for name, val := range map[string]string{
+		"bastionIP":  p.bastionIP,
+		"cmd":        p.cmd,
+		"remoteUser": p.remoteUser,
+		"userIP":     p.userIP,
+		"validAfter": p.validAfter,
+	} {
+		if val != "" {
+			form.Set(name, val)
+		}
+	}
+	if p.breakGlass {
+		form.Set("breakGlass", "true")
+	}
+
+	// What the reverse proxy told us about the user goes along, for staging's policy
+	headers := http.Header{}
+	headers.Set(m.header, p.bastionUser)
+	headers.Set(requestIDHeader, requestID(ctx))
+	if conf.MFAHeader != "" && p.mfa {
+		headers.Set(conf.MFAHeader, "true")
+	}
+	if conf.RiskASNHeader != "" && p.asn != "" {
+		headers.Set(conf.RiskASNHeader, p.asn)
+	}
+	if conf.MetricsTenantHeader != "" && p.tenant != "" {
+		headers.Set(conf.MetricsTenantHeader, p.tenant)
+	}
+
+	outcome := "issued"
+	if res.Error != "" {
+		outcome = res.Reason
+		if outcome == "" {
+			outcome = fmt.Sprintf("error %d", res.status)
+		}
+	}
+
+	// Never hold up production on staging
+	select {
+	case m.queue <- mirrorRequest{ctx: ctx, form: form, headers: headers, outcome: outcome}:
+	default:
+		mirrorCounts.Add("dropped", 1)
+	}
+}
+
+func (m *mirror) run() {
+	for mr := range m.queue {
+		mirrorCounts.Add("sent", 1)
+		outcome, err := m.post(mr)
+		switch {
+		case err != nil:
+			mirrorCounts.Add("failed", 1)
+			logf(mr.ctx, "Mirroring to %s failed: %v", m.url, err)
+		case outcome != mr.outcome:
+			mirrorCounts.Add("disagreed", 1)
+			logf(mr.ctx, "Mirror disagrees: production %s, staging %s", mr.outcome, outcome)
+		default:
+			mirrorCounts.Add("agreed", 1)
+		}
+	}
+}
+
+// post sends a request to staging and returns its outcome, described as send describes ours
+func (m *mirror) post(mr mirrorRequest) (string, error) {
+	req, err := http.NewRequest("POST", m.url, strings.NewReader(mr.form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header = mr.headers
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(m.user, m.pass)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return "issued", nil
+	}
+	if reason := resp.Header.Get(reasonHeader); reason != "" {
+		return reason, nil
+	}
+	return fmt.Sprintf("error %d", resp.StatusCode), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	modeNormal      = "normal"
+	modeReadOnly    = "readonly"
+	modeMaintenance = "maintenance"
+	modeFrozen      = "frozen"
+)
+
+// serviceMode is switched at runtime through the admin API, e.g. during planned CA rotations
+type serviceMode struct {
+	mu      sync.RWMutex
+	mode    string
+	message string
+}
+
+func newServiceMode(mode, message string) (*serviceMode, error) {
+	m := &serviceMode{}
+	err := m.set(mode, message)
+	return m, err
+}
+
+func (m *serviceMode) get() (string, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mode, m.message
+}
+
+func (m *serviceMode) set(mode, message string) error {
+	switch mode {
+	case modeNormal, modeReadOnly, modeMaintenance:
+	default:
+		return fmt.Errorf("Invalid mode %q (valid: normal, readonly, maintenance)", mode)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Only lifting the freeze itself may end it, so it's on record who did
+	if m.mode == modeFrozen {
+		return fmt.Errorf("Certificate issuance is frozen, lift the freeze with DELETE /freeze")
+	}
+	m.mode = mode
+	m.message = message
+	return nil
+}
+
+// freeze is read-only with no way out through set, see freezeHandler
+func (m *serviceMode) freeze(message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode = modeFrozen
+	m.message = message
+}
+
+func (m *serviceMode) unfreeze(mode, message string) error {
+	m.mu.Lock()
+	if m.mode == modeFrozen {
+		m.mode = modeNormal
+	}
+	m.mu.Unlock()
+	return m.set(mode, message)
+}
+
+// checkMode turns requests away while in maintenance mode, and requests that would issue
+// certificates while read-only or frozen. Endpoints like /knownhosts keep working in read-only mode
+func checkMode(w http.ResponseWriter, conf *config, issues bool) bool {
+	mode, message := conf.mode.get()
+	if mode == modeNormal || ((mode == modeReadOnly || mode == modeFrozen) && !issues) {
+		return true
+	}
+
+	if message == "" {
+		message = "Service temporarily unavailable"
+	}
+	switch mode {
+	case modeReadOnly:
+		w.Header().Set(reasonHeader, reasonReadOnly)
+	case modeFrozen:
+		w.Header().Set(reasonHeader, reasonFrozen)
+	default:
+		w.Header().Set(reasonHeader, reasonMaintenance)
+	}
+	problemError(w, message, http.StatusServiceUnavailable)
+	return false
+}
+
+func modeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Mode    string `json:"mode"`
+			Message string `json:"message"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			problemError(w, "Unable to parse mode", http.StatusBadRequest)
+			return
+		}
+		err = conf.mode.set(req.Mode, req.Message)
+		if err != nil {
+			problemError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Service mode set to %s: %s", req.Mode, req.Message)
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode, message := conf.mode.get()
+	writeJSON(w, struct {
+		Mode    string `json:"mode"`
+		Message string `json:"message,omitempty"`
+	}{mode, message})
+}
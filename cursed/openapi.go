@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Descriptions for generated schema properties, keyed by field name, or by tag and field
+// name where a request parameter and a response field share a name
+var apiDescriptions = map[string]string{
+	"account":            "Account on the host being logged in to",
+	"approval":           "ID of the pending approval when the request is held for sign-off",
+	"bastionIP":          "IP address of the bastion, used as the certificate source-address",
+	"bastion_ip":         "As bastionIP",
+	"bastion_user":       "Must be the user authenticated by the proxy",
+	"bastion_user_ip":    "As userIP",
+	"breakGlass":         "Allow principals of the CA infrastructure (see infraprincipals), raising an alert",
+	"caFingerprint":      "SHA256 fingerprint of the key that signed the certificate",
+	"caKey":              "CA public key in authorized_keys format, to check against the fingerprint given to jinx setup",
+	"cert":               "Certificate to inspect in authorized_keys format",
+	"certType":           "Certificate type: user (default) or host",
+	"cert_type":          "Must be user, or left out",
+	"certificate":        "Signed certificate in authorized_keys format",
+	"cmd":                "Command to force in the certificate (required if forcecmd is enabled)",
+	"command":            "As cmd",
+	"config":             "jinx.yaml for clients, from clientconfigfile",
+	"criticalOptions":    "Critical options, such as force-command and source-address",
+	"critical_options":   "force-command and source-address are applied like cmd and bastionIP, others are ignored with a warning",
+	"delegation":         "ID of a delegation granting remoteUser, in place of team mappings and tier approval (see cursectl delegations)",
+	"detail":             "Human-readable explanation of the error",
+	"deviceKey":          "Enrolled device public key in authorized_keys format (see devicekeysfile)",
+	"deviceSig":          "Base64 SSH signature by the device key over the device assertion payload",
+	"deviceTime":         "Unix timestamp included in the device assertion payload",
+	"enrollment":         "Enrollment code registering this key as the user's first (see cursectl enrollments)",
+	"error":              "Reason this key was not signed",
+	"errorMessage":       "Why the key wasn't signed",
+	"errorType":          "BLESS error type, such as InputValidationError",
+	"expired":            "Whether validBefore has passed",
+	"extensions":         "Certificate extensions, such as permit-pty",
+	"fingerprint":        "MD5 fingerprint of the submitted public key",
+	"function":           "Lambda function name, any is answered",
+	"form:validAfter":    "Unix timestamp for the certificate to start at, if later than now (see maxstartdelay)",
+	"key":                "Public key to sign, as a single authorized_keys line without options (at most 8192 bytes)",
+	"keyBlob":            "Public key to sign as the standard base64 of its SSH wire encoding, instead of key",
+	"keyId":              "Key ID, as logged by sshd when the certificate is used",
+	"keySig":             "Base64 SSH signature by the key to sign over the possession payload, proving the client holds it",
+	"keyTime":            "Unix timestamp included in the possession payload",
+	"key_id":             "Ignored with a warning, cursed sets its own key ID",
+	"keys":               "Public keys to sign",
+	"kmsauth_token":      "Ignored, the proxy authenticates the user",
+	"otp":                "Current TOTP code from the user's authenticator",
+	"password":           "The user's password from localusersfile",
+	"principals":         "Host principals for this key (host certificates only)",
+	"public_key":         "Public key to sign, as for key",
+	"public_key_to_sign": "Public key to sign, as for key",
+	"reason":             "Machine-readable denial reason code",
+	"remoteUser":         "Principal (remote account) the certificate is valid for",
+	"remote_usernames":   "The one principal to request, as remoteUser",
+	"requestId":          "Request ID, also returned in the X-Request-Id header and logged by the server",
+	"results":            "Per-key results in request order",
+	"role":               "Vault role, taken as the principal to request when valid_principals is left out",
+	"revoked":            "Whether the certificate's key is on the denylist",
+	"revokedReason":      "Why the key was blocked",
+	"serial":             "Certificate serial number",
+	"signature":          "Armored SSHSIG by caKey over config, namespace curse-client-config",
+	"signedByCA":         "Whether this server's CA key made the certificate's signature",
+	"status":             "HTTP status code",
+	"title":              "Summary of the HTTP status",
+	"ttl":                "Ignored with a warning, certificates are valid for up to duration",
+	"type":               "urn:curse:reason:<reason> for denials, otherwise about:blank",
+	"userIP":             "IP address of the end user, recorded in the certificate key ID",
+	"username":           "Local user to log in as",
+	"valid":              "Signed by this CA, not revoked, and within its validity period now",
+	"validAfter":         "Start of the validity period",
+	"validBefore":        "End of the validity period, the zero time for certificates that never expire",
+	"validPrincipals":    "Principals the certificate is valid for",
+	"valid_principals":   "The one principal to request, by default the role",
+	"warnings":           "Parameters that have no cursed equivalent and were ignored",
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec(conf))
+}
+
+// openAPISpec describes the routes of the main listener under conf
+func openAPISpec(conf *config) map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, rt := range mainRoutes(conf) {
+		item := make(map[string]interface{})
+		if len(rt.params) > 0 {
+			var params []interface{}
+			for _, name := range rt.params {
+				params = append(params, apiParameter(name, "path", true))
+			}
+			item["parameters"] = params
+		}
+		for method, op := range rt.ops {
+			item[method] = op.spec(conf)
+		}
+		path := rt.path
+		if path == "" {
+			path = rt.pattern
+		}
+		paths[path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "cursed",
+			"version": version,
+		},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"proxyAuth": map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"proxyAuth": []string{}}},
+		"paths":    paths,
+	}
+}
+
+// spec builds the OpenAPI operation object for op
+func (op apiOp) spec(conf *config) map[string]interface{} {
+	var params []interface{}
+	if op.user {
+		params = append(params, map[string]interface{}{
+			"name":        conf.UserHeader,
+			"in":          "header",
+			"required":    true,
+			"description": "Authenticated username, set by the reverse proxy",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if op.idempotent {
+		params = append(params, map[string]interface{}{
+			"name":        idempotencyHeader,
+			"in":          "header",
+			"description": "Client-chosen key for safely retrying a request. Repeating it with the same parameters returns the certificate issued the first time",
+			"schema":      map[string]interface{}{"type": "string", "pattern": validIdempotencyKey.String()},
+		})
+	}
+	if op.query != nil {
+		t := reflect.TypeOf(op.query)
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("query"), ",")
+			if tag[0] != "" && tag[0] != "-" {
+				params = append(params, apiParameter(tag[0], "query", len(tag) > 1 && tag[1] == "required"))
+			}
+		}
+	}
+
+	res := map[string]interface{}{
+		"summary": op.summary,
+	}
+	if op.desc != "" {
+		res["description"] = op.desc
+	}
+	if op.public {
+		res["security"] = []interface{}{}
+	}
+	if len(params) > 0 {
+		res["parameters"] = params
+	}
+	switch {
+	case op.form != nil:
+		res["requestBody"] = apiRequestBody("application/x-www-form-urlencoded", schemaFor(reflect.TypeOf(op.form), "form"))
+	case op.body != nil:
+		res["requestBody"] = apiRequestBody("application/json", schemaFor(reflect.TypeOf(op.body), "json"))
+	}
+
+	responses := make(map[string]interface{})
+	if op.result != nil {
+		responses["200"] = jsonResponse(op.ok, op.result)
+	} else {
+		responses["200"] = bodyResponse(op.ok, op.okType)
+	}
+	if op.cached {
+		responses["304"] = map[string]interface{}{"description": "Unchanged since the ETag or date given"}
+	}
+	for _, status := range op.problems {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": "RFC 7807 problem details",
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{
+					"schema": schemaFor(reflect.TypeOf(problem{}), "json"),
+				},
+			},
+		}
+	}
+	for _, status := range op.errors {
+		if op.errResult != nil {
+			responses[strconv.Itoa(status)] = jsonResponse(op.errDesc, op.errResult)
+		} else {
+			responses[strconv.Itoa(status)] = bodyResponse(op.errDesc, op.errType)
+		}
+	}
+	res["responses"] = responses
+	return res
+}
+
+// apiParameter describes a string parameter in path or query, from apiDescriptions
+func apiParameter(name, in string, required bool) map[string]interface{} {
+	param := map[string]interface{}{
+		"name":   name,
+		"in":     in,
+		"schema": map[string]interface{}{"type": "string"},
+	}
+	if required {
+		param["required"] = true
+	}
+	if desc, ok := apiDescriptions[in+":"+name]; ok {
+		param["description"] = desc
+	} else if desc, ok := apiDescriptions[name]; ok {
+		param["description"] = desc
+	}
+	return param
+}
+
+// apiRequestBody describes a required request body of contentType
+func apiRequestBody(contentType string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"required": true,
+		"content": map[string]interface{}{
+			contentType: map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// jsonResponse describes a response whose body is v encoded as JSON
+func jsonResponse(desc string, v interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": desc,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": schemaFor(reflect.TypeOf(v), "json"),
+			},
+		},
+	}
+}
+
+// bodyResponse describes a successful response whose body is a string of contentType
+func bodyResponse(desc, contentType string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": desc,
+		"content": map[string]interface{}{
+			contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+func schemaFor(t reflect.Type, tagName string) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), tagName)}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get(tagName), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			prop := schemaFor(f.Type, tagName)
+			if desc, ok := apiDescriptions[tagName+":"+name]; ok {
+				prop["description"] = desc
+			} else if desc, ok := apiDescriptions[name]; ok {
+				prop["description"] = desc
+			}
+			props[name] = prop
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), tagName)}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
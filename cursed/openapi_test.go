@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// TestOpenAPICoversRoutes checks every route of the main listener, with all the optional ones
+// enabled, is in the spec with its operations, and every path in the spec is served by the
+// route describing it
+func TestOpenAPICoversRoutes(t *testing.T) {
+	conf := &config{AuthMode: "local", BLESS: true, VaultMount: "ssh", UserHeader: "X-Forwarded-User"}
+	store := &confStore{}
+	store.store(conf)
+	mux := mainMux(store)
+	paths := openAPISpec(conf)["paths"].(map[string]interface{})
+
+	patterns := make(map[string]string)
+	for _, rt := range mainRoutes(conf) {
+		path := rt.path
+		if path == "" {
+			path = rt.pattern
+		}
+		patterns[path] = rt.pattern
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			t.Errorf("route %s is missing from the spec as %s", rt.pattern, path)
+			continue
+		}
+		if len(rt.ops) == 0 {
+			t.Errorf("route %s describes no operations", rt.pattern)
+		}
+		for method, op := range rt.ops {
+			if _, ok := item[method]; !ok || op.summary == "" {
+				t.Errorf("%s %s is missing from the spec or has no summary", method, path)
+			}
+		}
+	}
+
+	param := regexp.MustCompile(`\{[a-z]+\}`)
+	for path := range paths {
+		want, ok := patterns[path]
+		if !ok {
+			t.Errorf("%s is in the spec but not a route", path)
+			continue
+		}
+		_, got := mux.Handler(httptest.NewRequest("GET", param.ReplaceAllString(path, "x"), nil))
+		if got != want {
+			t.Errorf("%s is served by %s, want %s", path, got, want)
+		}
+	}
+}
+
+// TestOpenAPIFormFields checks form parameters come from the form: tags of the structs the
+// handlers read, and optional routes are only described when enabled
+func TestOpenAPIFormFields(t *testing.T) {
+	paths := openAPISpec(&config{})["paths"].(map[string]interface{})
+	for _, path := range []string{"/login", "/bless", "/v1/ssh/sign/{role}"} {
+		if _, ok := paths[path]; ok {
+			t.Errorf("%s described though it isn't enabled", path)
+		}
+	}
+
+	op := paths["/"].(map[string]interface{})["post"].(map[string]interface{})
+	schema := op["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["application/x-www-form-urlencoded"].(map[string]interface{})["schema"].(map[string]interface{})
+	props := schema["properties"].(map[string]interface{})
+	for _, name := range []string{"key", "remoteUser", "bastionIP", "validAfter", "enrollment"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("form parameter %s missing", name)
+		}
+	}
+	for _, name := range []string{"mfa", "tenant", "identity"} {
+		if _, ok := props[name]; ok {
+			t.Errorf("internal field %s described as a form parameter", name)
+		}
+	}
+}
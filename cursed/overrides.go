@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Kinds of override
+const (
+	overrideAllowlist  = "allowlist"
+	overrideDelegation = "delegation"
+	overrideEnrollment = "enrollment"
+	overrideExemption  = "exemption"
+)
+
+// override is an exception to policy an admin granted: a key age exemption, an allowlisted
+// key, or an outstanding delegation or enrollment. Every one of them expires, and is pruned
+// once it has; the overrides task reports those about to, so "temporary" exceptions get
+// renewed on purpose or left to lapse rather than forgotten. ID is the fingerprint, the
+// delegation's ID or the enrolled user
+type override struct {
+	Kind    string    `json:"kind"`
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+// listOverrides returns the overrides in force, soonest to expire first
+func listOverrides(conf *config) ([]override, error) {
+	now := time.Now()
+	overrides := make([]override, 0)
+
+	exemptions, err := listExemptions(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, ex := range exemptions {
+		overrides = append(overrides, override{Kind: overrideExemption, ID: ex.Fingerprint, Reason: ex.Reason, Expires: ex.Expires})
+	}
+	allowed, err := listKeyLists(conf, keyListAllow)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range allowed {
+		if e.Expires != nil {
+			overrides = append(overrides, override{Kind: overrideAllowlist, ID: e.Fingerprint, Reason: e.Reason, Expires: *e.Expires})
+		}
+	}
+	delegations, err := listDelegations(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range delegations {
+		// A used delegation has issued its one certificate
+		if d.Used == nil {
+			overrides = append(overrides, override{Kind: overrideDelegation, ID: d.ID, User: d.User, Reason: d.Reason, Expires: d.Expires})
+		}
+	}
+	enrollments, err := listEnrollments(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, en := range enrollments {
+		overrides = append(overrides, override{Kind: overrideEnrollment, ID: en.User, User: en.User, Reason: en.Reason, Expires: en.Expires})
+	}
+
+	active := overrides[:0]
+	for _, o := range overrides {
+		if o.Expires.After(now) {
+			active = append(active, o)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool { return active[i].Expires.Before(active[j].Expires) })
+	return active, nil
+}
+
+// expiringOverrides returns the overrides in force that expire within d
+func expiringOverrides(conf *config, d time.Duration) ([]override, error) {
+	overrides, err := listOverrides(conf)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(d)
+	for i, o := range overrides {
+		if o.Expires.After(cutoff) {
+			return overrides[:i], nil
+		}
+	}
+	return overrides, nil
+}
+
+// reportOverrides sends an override_expiring event for each override expiring within
+// overridewarndays. It runs every overrideinterval, so a daily run reports each one daily
+// until it's renewed, removed or lapses
+func reportOverrides(conf *config) (string, error) {
+	overrides, err := expiringOverrides(conf, time.Duration(conf.OverrideWarnDays)*24*time.Hour)
+	if err != nil {
+		return "", err
+	}
+
+	for _, o := range overrides {
+		expires := o.Expires
+		log.Printf("Override expiring: %s[%s] user[%s] expires[%s]: %s", o.Kind, o.ID, o.User, expires.Format(time.RFC3339), o.Reason)
+		ev := auditEvent{
+			Event:       "override_expiring",
+			User:        o.User,
+			ValidBefore: &expires,
+			Reason:      o.Kind,
+			Message:     fmt.Sprintf("%s %s expires at %s: %s", o.Kind, o.ID, expires.Format(time.RFC1123), o.Reason),
+		}
+		switch o.Kind {
+		case overrideAllowlist, overrideExemption:
+			ev.Fingerprint = o.ID
+		case overrideDelegation:
+			ev.Delegation = o.ID
+		}
+		conf.webhooks.send(ev)
+	}
+
+	if len(overrides) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%d overrides expire within %dd", len(overrides), conf.OverrideWarnDays), nil
+}
+
+// overridesHandler lists the overrides in force, or with ?within=SECONDS those expiring
+// within that long
+func overridesHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var overrides []override
+	var err error
+	if within := r.URL.Query().Get("within"); within != "" {
+		secs, perr := strconv.Atoi(within)
+		if perr != nil || secs < 0 {
+			problemError(w, "within must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		overrides, err = expiringOverrides(conf, time.Duration(secs)*time.Second)
+	} else {
+		overrides, err = listOverrides(conf)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, overrides)
+}
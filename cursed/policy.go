@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// policyCase is an example request in a `cursed policy test` file, with the decision it
+// should get. Nothing is looked up: groups stand in for the user's forge teams or SAML
+// groups, samlprincipals for the principals their SAML assertion lists, and principals for
+// what principalscommand or principalsurl would answer
+type policyCase struct {
+	Name           string
+	User           string
+	Principal      string
+	Groups         []string
+	SAMLPrincipals []string
+	Principals     []string
+	MFA            bool
+	BreakGlass     bool
+	// issued, denied or approval, the denial reason, and the tier ("" for none) if they matter
+	Expect string
+	Reason string
+	Tier   *string
+}
+
+type policyDecision struct {
+	result string
+	reason string
+	tier   string
+	detail string
+}
+
+// policyGrant is a forgeteams or samlgroups entry: the principals members of group get
+type policyGrant struct {
+	from       string
+	group      string
+	principals []string
+}
+
+// policyCommand runs `cursed policy test [file]`
+func policyCommand(conf *config, args []string) error {
+	if len(args) == 0 || args[0] != "test" || len(args) > 2 {
+		return fmt.Errorf("Usage: cursed policy test [file]")
+	}
+	file := ""
+	if len(args) > 1 {
+		file = args[1]
+	}
+	return runPolicyTest(conf, file)
+}
+
+// runPolicyTest lints the tiers and principal mappings in the config, then checks the
+// example requests in file against the decisions they should get. It fails if anything is
+// wrong, so a policy change can be gated on it in CI
+func runPolicyTest(conf *config, file string) error {
+	problems := lintPolicy(conf)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if file == "" {
+		if len(problems) > 0 {
+			return fmt.Errorf("%d policy problems", len(problems))
+		}
+		fmt.Println("Policy: OK")
+		return nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	err := v.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	var cases []policyCase
+	err = v.UnmarshalKey("requests", &cases)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if len(cases) == 0 {
+		return fmt.Errorf("%s: no requests to test", file)
+	}
+
+	failed := 0
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("request %d (%s as %s)", i+1, c.User, c.Principal)
+		}
+		if msg := checkPolicyCase(conf, c); msg != "" {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, msg)
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	if len(problems) > 0 || failed > 0 {
+		return fmt.Errorf("%d policy problems, %d of %d example requests failed", len(problems), failed, len(cases))
+	}
+	fmt.Printf("%s: OK\n", file)
+	return nil
+}
+
+// checkPolicyCase returns what's wrong with the decision c gets, or "" if it's as expected
+func checkPolicyCase(conf *config, c policyCase) string {
+	switch c.Expect {
+	case "issued", "denied", "approval":
+	default:
+		return fmt.Sprintf("expect must be issued, denied or approval, not %q", c.Expect)
+	}
+	if c.User == "" || c.Principal == "" {
+		return "user and principal are required"
+	}
+
+	d := evaluatePolicy(conf, c)
+	got := d.result
+	if d.reason != "" {
+		got += " " + d.reason
+	}
+	if d.tier != "" {
+		got += " in tier " + d.tier
+	}
+	if d.detail != "" {
+		got += " (" + d.detail + ")"
+	}
+	switch {
+	case d.result != c.Expect:
+		return fmt.Sprintf("expected %s, got %s", c.Expect, got)
+	case c.Reason != "" && d.reason != c.Reason:
+		return fmt.Sprintf("expected reason %s, got %s", c.Reason, got)
+	case c.Tier != nil && d.tier != *c.Tier:
+		return fmt.Sprintf("expected tier %q, got %s", *c.Tier, got)
+	}
+	return ""
+}
+
+// evaluatePolicy decides c the way signUserKey would as far as the config alone decides it:
+// honeytokens, group mappings, infrastructure principals and the tier's MFA and approval
+// requirements. Keys, devices, approvals already given and risk scores aren't considered
+func evaluatePolicy(conf *config, c policyCase) policyDecision {
+	if principal := matchHoneytoken(conf, c.Principal); principal != "" {
+		return policyDecision{result: "denied", reason: reasonHoneytoken, detail: "honeytoken principal " + principal}
+	}
+	t := matchTier(conf, c.Principal)
+
+	if groupsGrantPrincipals(conf) {
+		// As forgeIdentity.allows, with the principals the user's groups and assertion grant
+		id := &forgeIdentity{}
+		if conf.SAMLPrincipalsAttr != "" {
+			id.principals = append(id.principals, c.SAMLPrincipals...)
+		}
+		for _, g := range policyGrants(conf) {
+			if !memberOf(c.Groups, g.group) {
+				continue
+			}
+			id.principals = append(id.principals, g.principals...)
+		}
+		if !id.allows(c.Principal) {
+			return policyDecision{result: "denied", reason: reasonPrincipalDenied, tier: tierName(t), detail: "none of the groups grant " + c.Principal}
+		}
+	}
+
+	principals := []string{c.Principal}
+	if (len(conf.principalsCmd) > 0 || conf.PrincipalsURL != "") && len(c.Principals) > 0 {
+		principals = c.Principals
+	}
+	if principal := matchHoneytoken(conf, principals...); principal != "" {
+		return policyDecision{result: "denied", reason: reasonHoneytoken, detail: "honeytoken principal " + principal}
+	}
+	if principal := matchInfra(conf, false, principals...); principal != "" && !c.BreakGlass {
+		return policyDecision{result: "denied", reason: reasonInfraPrincipal, detail: "infrastructure principal " + principal}
+	}
+	if len(principals) != 1 || principals[0] != c.Principal {
+		t = matchTier(conf, principals...)
+	}
+
+	switch {
+	case t != nil && t.RequireMFA && !c.MFA:
+		return policyDecision{result: "denied", reason: reasonNoMFA, tier: t.Name}
+	case t != nil && t.RequireApproval:
+		return policyDecision{result: "approval", reason: reasonApprovalRequired, tier: t.Name}
+	}
+	return policyDecision{result: "issued", tier: tierName(t)}
+}
+
+func memberOf(groups []string, group string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsGrantPrincipals reports whether users only get the principals their forge teams or
+// SAML groups are mapped to
+func groupsGrantPrincipals(conf *config) bool {
+	switch conf.AuthMode {
+	case "github", "gitlab", "saml":
+		return true
+	}
+	return conf.AuthMode == "proxy" && conf.SAMLHeader != ""
+}
+
+// policyGrants lists the forgeteams or samlgroups entries in use
+func policyGrants(conf *config) []policyGrant {
+	var grants []policyGrant
+	switch conf.AuthMode {
+	case "github", "gitlab":
+		for _, ft := range conf.ForgeTeams {
+			grants = append(grants, policyGrant{"forgeteams team " + ft.Team, ft.Team, ft.Principals})
+		}
+	default:
+		for _, sg := range conf.SAMLGroups {
+			grants = append(grants, policyGrant{"samlgroups group " + sg.Group, sg.Group, sg.Principals})
+		}
+	}
+	return grants
+}
+
+// lintPolicy finds what's likely a mistake in the tiers and principal mappings: patterns
+// matching no principal anyone can get, tiers or transfer profiles earlier ones always win
+// over, tiers overlapping so that order decides, and mappings granting principals that are
+// always denied
+func lintPolicy(conf *config) []string {
+	var problems []string
+
+	// Principals only come from the mappings unless something else can name them
+	var known []string
+	enumerable := groupsGrantPrincipals(conf) && conf.SAMLPrincipalsAttr == "" && len(conf.principalsCmd) == 0 && conf.PrincipalsURL == ""
+	for _, g := range policyGrants(conf) {
+		for _, p := range g.principals {
+			known = append(known, p)
+			switch {
+			case matchHoneytoken(conf, p) != "":
+				problems = append(problems, fmt.Sprintf("%s grants honeytoken principal %s, which is always denied", g.from, p))
+			case matchInfra(conf, false, p) != "":
+				problems = append(problems, fmt.Sprintf("%s grants infrastructure principal %s, which is denied without break-glass", g.from, p))
+			}
+		}
+	}
+	if enumerable {
+		for _, t := range conf.Tiers {
+			for _, pattern := range t.Principals {
+				if !matchesAny(pattern, known) {
+					problems = append(problems, fmt.Sprintf("tier %s: principal pattern %q matches no principal that's granted", t.Name, pattern))
+				}
+			}
+		}
+		for _, tp := range conf.TransferProfiles {
+			for _, pattern := range tp.Principals {
+				if !matchesAny(pattern, known) {
+					problems = append(problems, fmt.Sprintf("transfer profile %s: principal pattern %q matches no principal that's granted", tp.Name, pattern))
+				}
+			}
+		}
+	}
+
+	// The first tier matching wins, and honeytokens are denied before tiers are looked at
+	for i, t := range conf.Tiers {
+		unreachable := 0
+		for _, pattern := range t.Principals {
+			if by := shadowedBy(conf, i, pattern); by != "" {
+				unreachable++
+				problems = append(problems, fmt.Sprintf("tier %s: principal pattern %q is unreachable, %s matches it first", t.Name, pattern, by))
+			}
+		}
+		if unreachable > 0 && unreachable == len(t.Principals) {
+			problems = append(problems, fmt.Sprintf("tier %s is unreachable", t.Name))
+		}
+	}
+	for i, tp := range conf.TransferProfiles {
+		for _, pattern := range tp.Principals {
+			for _, earlier := range conf.TransferProfiles[:i] {
+				if coversAny(earlier.Principals, pattern) {
+					problems = append(problems, fmt.Sprintf("transfer profile %s: principal pattern %q is unreachable, transfer profile %s matches it first", tp.Name, pattern, earlier.Name))
+					break
+				}
+			}
+		}
+	}
+
+	// Tiers that partly overlap aren't wrong, but the order silently decides between them
+	for i, t := range conf.Tiers {
+		for _, later := range conf.Tiers[i+1:] {
+			for _, q := range later.Principals {
+				if coversAny(t.Principals, q) {
+					continue
+				}
+				if w := overlapWitness(t.Principals, q, known); w != "" {
+					problems = append(problems, fmt.Sprintf("tiers %s and %s overlap: %q matches both, and %s applies", t.Name, later.Name, w, t.Name))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// shadowedBy names what matches every principal pattern does before tier i gets to it
+func shadowedBy(conf *config, i int, pattern string) string {
+	if coversAny(conf.HoneytokenPrincipals, pattern) {
+		return "honeytokenprincipals"
+	}
+	for _, earlier := range conf.Tiers[:i] {
+		if coversAny(earlier.Principals, pattern) {
+			return "tier " + earlier.Name
+		}
+	}
+	return ""
+}
+
+func coversAny(patterns []string, q string) bool {
+	for _, p := range patterns {
+		if patternCovers(p, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternCovers reports whether every principal matching q matches p, as far as can be told
+// without comparing the patterns' languages: q is p, or a plain name p matches, or p is *
+// and q can't match a slash
+func patternCovers(p, q string) bool {
+	switch {
+	case p == q:
+		return true
+	case !hasGlobMeta(q):
+		ok, _ := path.Match(p, q)
+		return ok
+	}
+	return p == "*" && !strings.Contains(q, "/")
+}
+
+// overlapWitness returns a principal matching q and one of patterns, from the principals
+// granted or the simplest matches of the patterns themselves
+func overlapWitness(patterns []string, q string, known []string) string {
+	candidates := append([]string(nil), known...)
+	if s, ok := globSample(q); ok {
+		candidates = append(candidates, s)
+	}
+	for _, p := range patterns {
+		if s, ok := globSample(p); ok {
+			candidates = append(candidates, s)
+		}
+	}
+	for _, c := range candidates {
+		if ok, _ := path.Match(q, c); ok && matchesPatterns(patterns, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+func matchesPatterns(patterns []string, principal string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, principal); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(pattern string, principals []string) bool {
+	for _, principal := range principals {
+		if ok, _ := path.Match(pattern, principal); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// globSample returns the simplest principal pattern matches: stars match nothing, question
+// marks and character classes their first possibility
+func globSample(pattern string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+		case '?':
+			b.WriteByte('x')
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteByte(pattern[i])
+			}
+		case '[':
+			if i+1 < len(pattern) && pattern[i+1] != '^' {
+				b.WriteByte(pattern[i+1])
+			}
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", false
+			}
+			i += end + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	s := b.String()
+	ok, _ := path.Match(pattern, s)
+	return s, ok
+}
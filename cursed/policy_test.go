@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func policyTestConf() *config {
+	return &config{
+		AuthMode: "github",
+		ForgeTeams: []forgeTeam{
+			{Team: "org/ops", Principals: []string{"root", "deploy", "admin-db"}},
+			{Team: "org/dev", Principals: []string{"deploy", "canary"}},
+		},
+		HoneytokenPrincipals: []string{"canary"},
+		InfraPrincipals:      []string{"cursed"},
+		Tiers: []tier{
+			{Name: "prod", Principals: []string{"root", "admin-*"}, RequireApproval: true, RequireMFA: true},
+			{Name: "db", Principals: []string{"admin-db", "*-db"}},
+			{Name: "shadowed", Principals: []string{"root"}},
+			{Name: "typo", Principals: []string{"dploy"}},
+		},
+	}
+}
+
+// TestLintPolicy checks each kind of problem is found, and nothing more
+func TestLintPolicy(t *testing.T) {
+	problems := lintPolicy(policyTestConf())
+	want := []string{
+		`forgeteams team org/dev grants honeytoken principal canary`,
+		`tier typo: principal pattern "dploy" matches no principal`,
+		`tier db: principal pattern "admin-db" is unreachable, tier prod matches it first`,
+		`tier shadowed is unreachable`,
+		`tiers prod and db overlap: "admin-db" matches both`,
+	}
+	for _, w := range want {
+		found := false
+		for _, p := range problems {
+			found = found || strings.Contains(p, w)
+		}
+		if !found {
+			t.Errorf("missing %q in:\n%s", w, strings.Join(problems, "\n"))
+		}
+	}
+	if len(problems) != len(want)+1 {
+		// shadowed's only pattern is reported along with the tier
+		t.Errorf("got %d problems, want %d:\n%s", len(problems), len(want)+1, strings.Join(problems, "\n"))
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	conf := policyTestConf()
+	none, prod := "", "prod"
+	cases := []policyCase{
+		{User: "alice", Principal: "root", Groups: []string{"org/ops"}, MFA: true, Expect: "approval", Tier: &prod},
+		{User: "alice", Principal: "root", Groups: []string{"org/ops"}, Expect: "denied", Reason: reasonNoMFA},
+		{User: "bob", Principal: "root", Groups: []string{"org/dev"}, Expect: "denied", Reason: reasonPrincipalDenied},
+		{User: "bob", Principal: "deploy", Groups: []string{"ORG/DEV"}, Expect: "issued", Tier: &none},
+		{User: "bob", Principal: "canary", Groups: []string{"org/dev"}, Expect: "denied", Reason: reasonHoneytoken},
+	}
+	for _, c := range cases {
+		if msg := checkPolicyCase(conf, c); msg != "" {
+			t.Errorf("%s as %s: %s", c.User, c.Principal, msg)
+		}
+	}
+
+	// A wrong expectation is reported
+	c := policyCase{User: "bob", Principal: "deploy", Groups: []string{"org/dev"}, Expect: "denied"}
+	if msg := checkPolicyCase(conf, c); !strings.Contains(msg, "expected denied, got issued") {
+		t.Errorf("wrong expectation reported as %q", msg)
+	}
+}
+
+func TestGlobSample(t *testing.T) {
+	for pattern, want := range map[string]string{"admin-*": "admin-", "web?": "webx", "db[0-9]": "db0", `a\*b`: "a*b"} {
+		got, ok := globSample(pattern)
+		if !ok || got != want {
+			t.Errorf("globSample(%q) = %q, %v, want %q", pattern, got, ok, want)
+		}
+	}
+}
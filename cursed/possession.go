@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Clients prove they hold the private half of the key they want certified by signing this
+// payload with it, so a stolen public key alone gets nobody a certificate. The client side
+// lives in jinx/possession.go and must stay in sync
+func possessionPayload(ts, key, remoteUser, bastionIP string) []byte {
+	return []byte("curse-possession-v1\n" + ts + "\n" + remoteUser + "\n" + bastionIP + "\n" + strings.TrimSpace(key))
+}
+
+// verifyPossession checks the key signature sent with a request, if any. Without one the
+// request is only denied when requirepossession is set, but a bad one is always denied
+func verifyPossession(p httpParams, pk ssh.PublicKey, conf *config) error {
+	if p.keySig == "" {
+		if conf.RequirePossession {
+			return denyf(reasonBadKey, "proof of key possession missing from request")
+		}
+		return nil
+	}
+
+	// The timestamp keeps a captured request from being replayed indefinitely
+	ts, err := strconv.ParseInt(p.keyTime, 10, 64)
+	if err != nil {
+		return denyf(reasonBadKey, "invalid key signature timestamp")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(conf.PossessionSkew)*time.Second {
+		return denyf(reasonBadKey, "key signature timestamp outside allowed window")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(p.keySig)
+	if err != nil {
+		return denyf(reasonBadKey, "invalid key signature encoding")
+	}
+	var sig ssh.Signature
+	err = ssh.Unmarshal(sigBytes, &sig)
+	if err != nil {
+		return denyf(reasonBadKey, "invalid key signature")
+	}
+	err = pk.Verify(possessionPayload(p.keyTime, p.key, p.remoteUser, p.bastionIP), &sig)
+	if err != nil {
+		return denyf(reasonBadKey, "key signature verification failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const principalsTimeout = 10 * time.Second
+
+// expandPrincipals asks principalscommand or principalsurl, if configured, which principals
+// the user's certificate should carry, like sshd's AuthorizedPrincipalsCommand but at
+// issuance time. Without either the requested principal is used as is. Either is given up on
+// after principalsTimeout, or as soon as ctx is done. Answers are cached for lookupcachettl
+// seconds
+func expandPrincipals(ctx context.Context, conf *config, p httpParams) ([]string, error) {
+	if len(conf.principalsCmd) == 0 && conf.PrincipalsURL == "" {
+		return []string{p.remoteUser}, nil
+	}
+
+	// Answers are keyed by everything the command or service is told
+	key := lookupKey(p.bastionUser, p.remoteUser)
+	if len(conf.principalsCmd) == 0 {
+		key = lookupKey(p.bastionUser, p.remoteUser, p.userIP, p.bastionIP)
+	}
+	return conf.principalCache.fetch(ctx, key, func(ctx context.Context) ([]string, error) {
+		return lookupPrincipals(ctx, conf, p)
+	})
+}
+
+// lookupPrincipals runs principalscommand or asks principalsurl, and checks the answer
+func lookupPrincipals(ctx context.Context, conf *config, p httpParams) ([]string, error) {
+	var principals []string
+	var err error
+	if len(conf.principalsCmd) > 0 {
+		principals, err = principalsFromCommand(ctx, conf, p)
+	} else {
+		principals, err = principalsFromURL(ctx, conf, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pr := range principals {
+		if strings.IndexFunc(pr, func(r rune) bool { return r <= ' ' || r == ',' }) >= 0 {
+			return nil, fmt.Errorf("Principal expansion returned invalid principal %q", pr)
+		}
+	}
+	if len(principals) == 0 {
+		return nil, denyf(reasonPrincipalDenied, "No principals granted to %s for %s", p.bastionUser, p.remoteUser)
+	}
+
+	return principals, nil
+}
+
+func principalsFromCommand(ctx context.Context, conf *config, p httpParams) ([]string, error) {
+	// Expand sshd-style tokens in the arguments: %u for the user, %p for the requested principal
+	r := strings.NewReplacer("%u", p.bastionUser, "%p", p.remoteUser, "%%", "%")
+	args := make([]string, len(conf.principalsCmd)-1)
+	for i, arg := range conf.principalsCmd[1:] {
+		args[i] = r.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, principalsTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, conf.principalsCmd[0], args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		// The command was killed, which says nothing about the command itself
+		return nil, fmt.Errorf("Principals command for %s: %w", p.bastionUser, ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Principals command failed for %s: %v: %s", p.bastionUser, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// One principal per line, as in an AuthorizedPrincipalsFile
+	var principals []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			principals = append(principals, line)
+		}
+	}
+
+	return principals, nil
+}
+
+func principalsFromURL(ctx context.Context, conf *config, p httpParams) ([]string, error) {
+	body, err := json.Marshal(struct {
+		User      string `json:"user"`
+		Principal string `json:"principal"`
+		UserIP    string `json:"userIP,omitempty"`
+		BastionIP string `json:"bastionIP,omitempty"`
+	}{p.bastionUser, p.remoteUser, p.userIP, p.bastionIP})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", conf.PrincipalsURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conf.PrincipalsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.PrincipalsToken)
+	}
+
+	client := &http.Client{Timeout: principalsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Principals lookup for %s failed: %w", p.bastionUser, err)
+	}
+	defer resp.Body.Close()
+
+	// A 403 is the service's way of saying no, rather than a failure
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Principals lookup for %s returned %s", p.bastionUser, resp.Status)
+	}
+
+	var res struct {
+		Principals []string `json:"principals"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse principals lookup response: %v", err)
+	}
+
+	return res.Principals, nil
+}
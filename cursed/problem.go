@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// Request IDs passed in by the reverse proxy are reused as long as they're sane to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// problem is an RFC 7807 error response. Reason carries our denial reason (if any) so clients
+// can act on it, Action and Remediation say what to do about it, and RequestID ties the
+// response to our logs
+type problem struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Status      int    `json:"status"`
+	Detail      string `json:"detail,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Action      string `json:"action,omitempty"`
+	Remediation string `json:"remediation,omitempty"`
+	RequestID   string `json:"requestId,omitempty"`
+}
+
+// withRequestID tags every request and response with an ID
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, withRequestIDContext(r, id))
+	})
+}
+
+// problemError is our replacement for http.Error. It picks up the reason, remediation URL
+// and request ID already set on the response headers
+func problemError(w http.ResponseWriter, detail string, status int) {
+	p := problem{
+		Type:        "about:blank",
+		Title:       http.StatusText(status),
+		Status:      status,
+		Detail:      detail,
+		Reason:      w.Header().Get(reasonHeader),
+		Remediation: w.Header().Get(remediationHeader),
+		RequestID:   w.Header().Get(requestIDHeader),
+	}
+	p.Action = reasonActions[p.Reason]
+	if p.Reason != "" {
+		p.Type = "urn:curse:reason:" + p.Reason
+	}
+
+	log.Printf("Request %s failed: %d %s", p.RequestID, status, detail)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
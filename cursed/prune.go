@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets whose records stop mattering once they expire
+var prunableBuckets = [][]byte{approvalBucket, delegationBucket, enrollmentBucket, exemptionBucket, expiryBucket, hostBucket, idempotencyBucket, keyListBucket, sessionPrincipalBucket, issuedBucket}
+
+// expiryOf returns when a record in one of prunableBuckets expires, whichever of the
+// expiry fields its type uses. The zero time means it never does
+func expiryOf(val []byte) (time.Time, error) {
+	var rec struct {
+		Expires     time.Time `json:"expires"`
+		ValidBefore time.Time `json:"validBefore"`
+		KeyExpires  time.Time `json:"keyExpires"`
+		CertExpires time.Time `json:"certExpires"`
+	}
+	err := json.Unmarshal(val, &rec)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	latest := rec.Expires
+	for _, t := range []time.Time{rec.ValidBefore, rec.KeyExpires, rec.CertExpires} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// Records deleted by pruning, by bucket, published on the admin listener at /debug/vars
+var prunedCounts = expvar.NewMap("pruned")
+
+// staleRecords returns the keys of records in bucket that expired before cutoff
+func staleRecords(conf *config, bucket *bolt.Bucket, name []byte, cutoff time.Time) ([][]byte, error) {
+	// Deleting while iterating confuses bolt's cursor, so collect the keys first
+	var stale [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		plain, err := conf.dbCipher.open(name, k, v)
+		if err != nil {
+			return fmt.Errorf("Record %s in %s: %v", k, name, err)
+		}
+		expires, err := expiryOf(plain)
+		if err != nil {
+			return fmt.Errorf("Record %s in %s corrupted: %v", k, name, err)
+		}
+		if !expires.IsZero() && expires.Before(cutoff) {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	return stale, err
+}
+
+// pruneExpired deletes records that expired more than pruneretentiondays ago, leaving recent
+// ones for admins to look back on. Idempotency records are only useful until they expire
+func pruneExpired(conf *config) (string, error) {
+	cutoff := time.Now().AddDate(0, 0, -conf.PruneRetentionDays)
+	var counts []string
+	pruned := make(map[string]int)
+	total := 0
+
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range prunableBuckets {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+			bucketCutoff := cutoff
+			if string(name) == string(idempotencyBucket) {
+				bucketCutoff = time.Now()
+			}
+
+			stale, err := staleRecords(conf, bucket, name, bucketCutoff)
+			if err != nil {
+				return err
+			}
+			for _, k := range stale {
+				err = bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+			if len(stale) > 0 {
+				counts = append(counts, fmt.Sprintf("%d from %s", len(stale), name))
+				pruned[string(name)] = len(stale)
+				total += len(stale)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if total == 0 {
+		return "", nil
+	}
+	for name, n := range pruned {
+		prunedCounts.Add(name, int64(n))
+	}
+	return fmt.Sprintf("pruned %d records (%s)", total, strings.Join(counts, ", ")), nil
+}
+
+// pruneReport is the result of an admin prune, or what one would delete with dryRun
+type pruneReport struct {
+	Before     time.Time      `json:"before"`
+	DryRun     bool           `json:"dryRun"`
+	Archive    string         `json:"archive,omitempty"`
+	Pruned     map[string]int `json:"pruned"`
+	Total      int            `json:"total"`
+	Compaction string         `json:"compaction,omitempty"`
+}
+
+// archivedRecord is one line of a prune archive. Spooled audit events stay encrypted with
+// auditspoolkeyfile, nonce first, and records of encryptedBuckets with dbkey as stored
+type archivedRecord struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Sealed []byte          `json:"sealed,omitempty"`
+}
+
+// pruneBefore deletes what the prune task does, with before in place of pruneretentiondays,
+// plus key history entries last seen before then and spooled audit events from before then
+// that never got delivered. Everything deleted is first written to an archive file in
+// prunearchivedir. Key birthdays are kept whatever their age: without one, an old key would
+// pass for a new one
+func pruneBefore(conf *config, before time.Time, dryRun bool) (pruneReport, error) {
+	rep := pruneReport{Before: before.UTC(), DryRun: dryRun, Pruned: make(map[string]int)}
+
+	var archive *json.Encoder
+	var f *os.File
+	if !dryRun {
+		var err error
+		f, err = os.OpenFile(filepath.Join(conf.PruneArchiveDir, "prune-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl"),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return rep, fmt.Errorf("Unable to create prune archive: %v", err)
+		}
+		archive = json.NewEncoder(f)
+		rep.Archive = f.Name()
+	}
+	keep := func(rec archivedRecord) error {
+		rep.Pruned[rec.Bucket]++
+		rep.Total++
+		if archive == nil {
+			return nil
+		}
+		return archive.Encode(rec)
+	}
+
+	prune := func(tx *bolt.Tx) error {
+		for _, name := range prunableBuckets {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+			cutoff := before
+			if string(name) == string(idempotencyBucket) {
+				cutoff = time.Now()
+			}
+			stale, err := staleRecords(conf, bucket, name, cutoff)
+			if err != nil {
+				return err
+			}
+			for _, k := range stale {
+				err = keep(archiveRecord(name, k, bucket.Get(k)))
+				if err == nil && !dryRun {
+					err = bucket.Delete(k)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err := pruneKeyHistory(tx, conf, before, dryRun, keep)
+		if err != nil {
+			return err
+		}
+		return pruneSpool(tx, conf, before, dryRun, keep)
+	}
+
+	var err error
+	if dryRun {
+		err = conf.db.View(prune)
+	} else {
+		err = conf.db.Update(prune)
+	}
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil || rep.Total == 0 {
+			os.Remove(f.Name())
+			rep.Archive = ""
+		}
+	}
+	if err != nil {
+		return rep, err
+	}
+
+	if !dryRun {
+		for name, n := range rep.Pruned {
+			prunedCounts.Add(name, int64(n))
+		}
+		rep.Compaction, _ = checkCompaction(conf)
+	}
+	return rep, nil
+}
+
+// archiveRecord copies a record for the prune archive, leaving encrypted ones encrypted
+func archiveRecord(name, k, val []byte) archivedRecord {
+	rec := archivedRecord{Bucket: string(name), Key: string(k)}
+	if isSealed(val) {
+		rec.Sealed = append([]byte(nil), val...)
+	} else {
+		rec.Value = append(json.RawMessage(nil), val...)
+	}
+	return rec
+}
+
+// pruneKeyHistory drops keys last seen before before from users' key histories, and users
+// left with none. Keys seen within keycontinuitydays are kept for the continuity check
+func pruneKeyHistory(tx *bolt.Tx, conf *config, before time.Time, dryRun bool, keep func(archivedRecord) error) error {
+	bucket := tx.Bucket(keyHistoryBucket)
+	if bucket == nil {
+		return nil
+	}
+	if conf.KeyContinuityDays > 0 {
+		if continuity := time.Now().AddDate(0, 0, -conf.KeyContinuityDays); continuity.Before(before) {
+			before = continuity
+		}
+	}
+
+	updates := make(map[string][]seenKey)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var history, current, stale []seenKey
+		err := unmarshalRecord(conf, keyHistoryBucket, k, v, &history)
+		if err != nil {
+			return fmt.Errorf("Key history corrupted for user %s: %v", k, err)
+		}
+		for _, sk := range history {
+			if sk.LastSeen.Before(before) {
+				stale = append(stale, sk)
+			} else {
+				current = append(current, sk)
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		val, err := marshalRecord(conf, keyHistoryBucket, k, stale)
+		if err == nil {
+			err = keep(archiveRecord(keyHistoryBucket, k, val))
+		}
+		updates[string(k)] = current
+		return err
+	})
+	if err != nil || dryRun {
+		return err
+	}
+
+	for user, current := range updates {
+		if len(current) == 0 {
+			err = bucket.Delete([]byte(user))
+		} else {
+			var val []byte
+			val, err = marshalRecord(conf, keyHistoryBucket, []byte(user), current)
+			if err == nil {
+				err = bucket.Put([]byte(user), val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSpool drops spooled audit events from before before, which needs auditspoolkeyfile to
+// tell their age
+func pruneSpool(tx *bolt.Tx, conf *config, before time.Time, dryRun bool, keep func(archivedRecord) error) error {
+	bucket := tx.Bucket(spoolBucket)
+	if bucket == nil || conf.webhooks == nil || conf.webhooks.gcm == nil {
+		return nil
+	}
+	gcm := conf.webhooks.gcm
+
+	var stale [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		if len(v) < gcm.NonceSize() {
+			return fmt.Errorf("Spooled audit event %x truncated", k)
+		}
+		body, err := gcm.Open(nil, v[:gcm.NonceSize()], v[gcm.NonceSize():], nil)
+		if err != nil {
+			return fmt.Errorf("Unable to decrypt spooled audit event %x: %v", k, err)
+		}
+		var ev auditEvent
+		err = json.Unmarshal(body, &ev)
+		if err != nil || !ev.Time.Before(before) {
+			return nil
+		}
+		stale = append(stale, append([]byte(nil), k...))
+		return keep(archivedRecord{Bucket: string(spoolBucket), Key: hex.EncodeToString(k), Sealed: append([]byte(nil), v...)})
+	})
+	if err != nil || dryRun {
+		return err
+	}
+	for _, k := range stale {
+		err = deleteSpooled(tx, k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneHandler prunes everything from before a time given by an admin, e.g. by
+// `cursectl prune --older-than 180d`
+func pruneHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Before time.Time `json:"before"`
+		DryRun bool      `json:"dryRun"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		problemError(w, "Unable to parse prune request", http.StatusBadRequest)
+		return
+	}
+	if req.Before.IsZero() || req.Before.After(time.Now().AddDate(0, 0, -1)) {
+		problemError(w, "before must be at least a day ago", http.StatusBadRequest)
+		return
+	}
+
+	rep, err := pruneBefore(conf, req.Before, req.DryRun)
+	if err != nil {
+		log.Printf("Prune failed: %v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !req.DryRun && rep.Total > 0 {
+		log.Printf("Pruned %d records from before %s, archived to %s", rep.Total, rep.Before.Format(time.RFC3339), rep.Archive)
+	}
+	writeJSON(w, rep)
+}
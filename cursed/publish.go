@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// cachedResponse is a body every host polls for, kept in memory with its validators so a
+// poller that already has it gets a 304 without the database being read
+type cachedResponse struct {
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+func newCachedResponse(body []byte) *cachedResponse {
+	sum := sha256.Sum256(body)
+	return &cachedResponse{
+		body: body,
+		etag: `"` + hex.EncodeToString(sum[:16]) + `"`,
+		// Last-Modified only has second precision, and ServeContent compares it as such
+		modified: time.Now().Truncate(time.Second),
+	}
+}
+
+func (c *cachedResponse) serve(w http.ResponseWriter, r *http.Request, contentType, cacheControl string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", c.etag)
+	http.ServeContent(w, r, "", c.modified, bytes.NewReader(c.body))
+}
+
+// caCache holds the CA public key response. The CA key can't change without a restart, so
+// it's built once for the life of the process
+type caCache struct {
+	sync.Once
+	*cachedResponse
+}
+
+// caHandler serves the CA public key, for hosts' TrustedUserCAKeys
+func caHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ca := conf.caResponse
+	ca.Do(func() {
+		ca.cachedResponse = newCachedResponse(ssh.MarshalAuthorizedKey(conf.caSigner.PublicKey()))
+	})
+	ca.serve(w, r, "text/plain", "public, max-age=3600")
+}
+
+// krlCache holds the KRL response, rebuilt on the first request after the denylist or the
+// revoked certificates change. The lock is held while building, so a fleet polling right
+// after a change waits for one build rather than each starting its own
+type krlCache struct {
+	sync.Mutex
+	*cachedResponse
+}
+
+// invalidateKRL is called after anything that goes into the KRL has been committed
+func invalidateKRL(conf *config) {
+	conf.krlResponse.Lock()
+	conf.krlResponse.cachedResponse = nil
+	conf.krlResponse.Unlock()
+}
+
+// krlHandler serves the same KRL writeKRL writes to krlfile, for hosts that fetch their
+// RevokedKeys over HTTP. Responses must be revalidated, which is a 304 while it hasn't changed
+func krlHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Changes made by the instance that took over never reach our cache
+	if !conf.lease.valid() {
+		w.Header().Set(reasonHeader, reasonCAUnavailable)
+		problemError(w, errLeaseLost.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	cache := conf.krlResponse
+	cache.Lock()
+	if cache.cachedResponse == nil {
+		krl, _, err := buildKRL(conf)
+		if err != nil {
+			cache.Unlock()
+			log.Printf("Unable to build KRL: %v", err)
+			problemError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		cache.cachedResponse = newCachedResponse(krl)
+	}
+	c := cache.cachedResponse
+	cache.Unlock()
+
+	c.serve(w, r, "application/octet-stream", "no-cache")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// confStore holds the current config snapshot. A snapshot is never modified once stored:
+// reloading builds a new one and swaps it in, and handlers load it once per request so a
+// reload can't change settings halfway through one. Reloads from SIGHUP and /reload take
+// turns, since viper isn't safe to read from two at once and the later one must build on
+// what the earlier one stored
+type confStore struct {
+	v         atomic.Value
+	reloading sync.Mutex
+}
+
+func (s *confStore) load() *config {
+	return s.v.Load().(*config)
+}
+
+func (s *confStore) store(conf *config) {
+	s.v.Store(conf)
+}
+
+// reload reads the config file again and swaps in a snapshot of it, returning the file read
+func (s *confStore) reload() (string, error) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read config file: %v", err)
+	}
+	conf, err := getConf()
+	if err != nil {
+		return "", err
+	}
+
+	// Long-lived resources carry over. Changing the listeners, database, lease, CA key,
+	// webhook destinations or mirror still needs a restart
+	old := s.load()
+	conf.adminClientCAs = old.adminClientCAs
+	conf.caSigner = old.caSigner
+	conf.seal = old.seal
+	err = checkCAChain(conf)
+	if err != nil {
+		return "", err
+	}
+	err = conf.dbCipher.keepSealed(old.dbCipher)
+	if err != nil {
+		return "", err
+	}
+	conf.db = old.db
+	conf.lease = old.lease
+	conf.mode = old.mode
+	conf.caResponse = old.caResponse
+	conf.inventoryMu = old.inventoryMu
+	conf.krlMu = old.krlMu
+	conf.krlResponse = old.krlResponse
+	conf.lastTOTPSteps = old.lastTOTPSteps
+	conf.localFailures = old.localFailures
+	conf.tasks = old.tasks
+	conf.tenantLabels = old.tenantLabels
+	conf.webhooks = old.webhooks
+	conf.decisions = old.decisions
+	conf.mirror = old.mirror
+
+	s.store(conf)
+	return viper.ConfigFileUsed(), nil
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request, store *confStore) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, err := store.reload()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current config: %v", err)
+		problemError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Reloaded config from %s via the admin API, policy version %s", file, store.load().policyVersion)
+
+	writeJSON(w, struct {
+		Config string `json:"config"`
+	}{file})
+}
+
+func watchReload(s *confStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		file, err := s.reload()
+		if err != nil {
+			log.Printf("Config reload failed, keeping the current config: %v", err)
+			continue
+		}
+		log.Printf("Reloaded config from %s, policy version %s", file, s.load().policyVersion)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const reloadTestConfig = `proxyuser: proxy
+proxypass: secret
+sslcert: /dev/null
+sslkey: /dev/null
+policyversion: race
+`
+
+// TestReloadRace reloads from SIGHUP's path and /reload at once while requests load the
+// config. Run it with -race
+func TestReloadRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursed-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cursed.yaml")
+	err = ioutil.WriteFile(file, []byte(reloadTestConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+	err = viper.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := getConf()
+	if err != nil {
+		t.Fatalf("getConf: %v", err)
+	}
+	store := &confStore{}
+	store.store(conf)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := store.reload()
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w := httptest.NewRecorder()
+				reloadHandler(w, httptest.NewRequest(http.MethodPost, "/reload", nil), store)
+				if w.Code != http.StatusOK {
+					t.Errorf("/reload returned %d: %s", w.Code, w.Body)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				openAPIHandler(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil), store.load())
+				if w.Code != http.StatusOK {
+					t.Errorf("/openapi.json returned %d", w.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("reload: %v", err)
+	}
+
+	if v := store.load().PolicyVersion; v != "race" {
+		t.Errorf("policy version after reloads is %q, want race", v)
+	}
+
+	// Lockouts, used TOTP codes, caches and task status outlive the snapshots
+	now := store.load()
+	if now.localFailures != conf.localFailures || now.lastTOTPSteps != conf.lastTOTPSteps ||
+		now.caResponse != conf.caResponse || now.krlResponse != conf.krlResponse || now.krlMu != conf.krlMu ||
+		now.inventoryMu != conf.inventoryMu || now.tasks != conf.tasks || now.tenantLabels != conf.tenantLabels {
+		t.Errorf("reload replaced the process's state")
+	}
+}
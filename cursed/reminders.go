@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var expiryBucket = []byte("userexpiry")
+
+// userExpiry tracks the most recent key and certificate issued to each user
+type userExpiry struct {
+	Fingerprint  string    `json:"fingerprint"`
+	KeyExpires   time.Time `json:"keyExpires"`
+	CertExpires  time.Time `json:"certExpires"`
+	KeyNotified  bool      `json:"keyNotified"`
+	CertNotified bool      `json:"certNotified"`
+}
+
+func remindersEnabled(conf *config) bool {
+	return conf.KeyReminderDays > 0 || conf.CertReminderMins > 0
+}
+
+func recordExpiry(conf *config, user, fp string, certExpires time.Time) error {
+	if !remindersEnabled(conf) {
+		return nil
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(expiryBucket)
+		if err != nil {
+			return err
+		}
+
+		var ue userExpiry
+		if val := bucket.Get([]byte(user)); len(val) > 0 {
+			err = unmarshalRecord(conf, expiryBucket, []byte(user), val, &ue)
+			if err != nil {
+				return fmt.Errorf("Expiry record corrupted for user %s: %v", user, err)
+			}
+		}
+
+		// A new key starts a fresh age countdown
+		if ue.Fingerprint != fp {
+			ue = userExpiry{Fingerprint: fp}
+			if conf.MaxKeyAge >= 0 {
+				kb, err := getBirthday(tx, conf, fp)
+				if err == nil && kb > 0 {
+					ue.KeyExpires = time.Unix(kb, 0).Add(conf.keyLifeSpan)
+				}
+			}
+		}
+		ue.CertExpires = certExpires
+		ue.CertNotified = false
+
+		val, err := marshalRecord(conf, expiryBucket, []byte(user), ue)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), val)
+	})
+}
+
+func runReminderSweep(conf *config) (string, error) {
+	sent, err := sendReminders(conf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sent %d reminders", sent), nil
+}
+
+type reminder struct {
+	user    string
+	ue      userExpiry
+	keyDue  bool
+	certDue bool
+}
+
+func sendReminders(conf *config) (int, error) {
+	keyLead := time.Duration(conf.KeyReminderDays) * 24 * time.Hour
+	certLead := time.Duration(conf.CertReminderMins) * time.Minute
+	now := time.Now()
+
+	// Find who is due a reminder. Notifications are sent outside the transaction, since
+	// spooled webhook delivery needs to write to the same database
+	var due []reminder
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(expiryBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var ue userExpiry
+			err := unmarshalRecord(conf, expiryBucket, k, v, &ue)
+			if err != nil {
+				log.Printf("Expiry record corrupted for user %s: %v", k, err)
+				return nil
+			}
+			rem := reminder{
+				user: string(k),
+				ue:   ue,
+				keyDue: keyLead > 0 && !ue.KeyNotified && !ue.KeyExpires.IsZero() &&
+					now.After(ue.KeyExpires.Add(-keyLead)) && now.Before(ue.KeyExpires),
+				certDue: certLead > 0 && !ue.CertNotified &&
+					now.After(ue.CertExpires.Add(-certLead)) && now.Before(ue.CertExpires),
+			}
+			if rem.keyDue || rem.certDue {
+				due = append(due, rem)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, rem := range due {
+		if rem.keyDue {
+			notifyExpiry(conf, rem.user, "key_expiring", rem.ue.Fingerprint, rem.ue.KeyExpires,
+				fmt.Sprintf("Your SSH key %s reaches its maximum age on %s. Generate a new key before then to keep logging in.",
+					rem.ue.Fingerprint, rem.ue.KeyExpires.Format(time.RFC1123)))
+		}
+		if rem.certDue {
+			notifyExpiry(conf, rem.user, "cert_expiring", rem.ue.Fingerprint, rem.ue.CertExpires,
+				fmt.Sprintf("Your SSH certificate expires at %s. Run jinx again to renew it.",
+					rem.ue.CertExpires.Format(time.RFC1123)))
+		}
+		err = markNotified(conf, rem)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(due), nil
+}
+
+func markNotified(conf *config, rem reminder) error {
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(expiryBucket)
+		val := bucket.Get([]byte(rem.user))
+		if len(val) == 0 {
+			return nil
+		}
+		var ue userExpiry
+		err := unmarshalRecord(conf, expiryBucket, []byte(rem.user), val, &ue)
+		if err != nil {
+			return fmt.Errorf("Expiry record corrupted for user %s: %v", rem.user, err)
+		}
+
+		// Leave the flags alone if a new key or certificate was issued while we were notifying
+		if rem.keyDue && ue.Fingerprint == rem.ue.Fingerprint {
+			ue.KeyNotified = true
+		}
+		if rem.certDue && ue.CertExpires.Equal(rem.ue.CertExpires) {
+			ue.CertNotified = true
+		}
+
+		val, err = marshalRecord(conf, expiryBucket, []byte(rem.user), ue)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(rem.user), val)
+	})
+}
+
+func notifyExpiry(conf *config, user, event, fp string, expires time.Time, msg string) {
+	log.Printf("Reminder: %s user[%s] sshKey[%s] expires[%s]", event, user, fp, expires.Format(time.RFC3339))
+
+	// Webhook receivers can relay these to chat, e.g. as a Slack DM
+	conf.webhooks.send(auditEvent{
+		Event:       event,
+		User:        user,
+		Fingerprint: fp,
+		ValidBefore: &expires,
+		Message:     msg,
+	})
+
+	if conf.SMTPAddr != "" && conf.ReminderEmailDomain != "" {
+		err := sendEmail(conf, user+"@"+conf.ReminderEmailDomain, "SSH access expiry reminder", msg)
+		if err != nil {
+			log.Printf("Failed to email reminder to %s: %v", user, err)
+		}
+	}
+}
+
+func sendEmail(conf *config, to, subject, body string) error {
+	var auth smtp.Auth
+	if conf.SMTPUser != "" {
+		host := conf.SMTPAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", conf.SMTPUser, conf.SMTPPass, host)
+	}
+
+	msg := "From: " + conf.SMTPFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body + "\r\n"
+
+	return smtp.SendMail(conf.SMTPAddr, auth, conf.SMTPFrom, []string{to}, []byte(msg))
+}
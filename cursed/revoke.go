@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+)
+
+var issuedBucket = []byte("issued")
+
+// issuedCert records a certificate we signed, keyed by its key ID, so certificates can be
+// revoked after the fact. Revoked ones go into the KRL by key ID until they expire
+type issuedCert struct {
+	KeyID         string     `json:"keyId"`
+	User          string     `json:"user"`
+	Fingerprint   string     `json:"fingerprint"`
+	SHA256        string     `json:"sha256"`
+	Serial        uint64     `json:"serial,omitempty"`
+	Principals    []string   `json:"principals"`
+	Issued        time.Time  `json:"issued"`
+	ValidBefore   time.Time  `json:"validBefore"`
+	Revoked       *time.Time `json:"revoked,omitempty"`
+	RevokedReason string     `json:"revokedReason,omitempty"`
+}
+
+// revokeRequest selects the unexpired certificates to revoke. Every filter given must match,
+// principals by holding any one of them
+type revokeRequest struct {
+	User        string     `json:"user,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Principals  []string   `json:"principals,omitempty"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+	Reason      string     `json:"reason"`
+	DryRun      bool       `json:"dryRun,omitempty"`
+}
+
+func (rr revokeRequest) matches(ic issuedCert) bool {
+	switch {
+	case rr.User != "" && ic.User != rr.User:
+		return false
+	case rr.Fingerprint != "" && ic.Fingerprint != rr.Fingerprint && ic.SHA256 != rr.Fingerprint:
+		return false
+	case len(rr.Principals) > 0 && !anyPrincipal(ic.Principals, rr.Principals):
+		return false
+	case rr.From != nil && ic.Issued.Before(*rr.From):
+		return false
+	case rr.To != nil && ic.Issued.After(*rr.To):
+		return false
+	}
+	return true
+}
+
+func anyPrincipal(have, want []string) bool {
+	for _, p := range have {
+		for _, w := range want {
+			if p == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func recordIssued(conf *config, user string, pk ssh.PublicKey, cc certConfig) error {
+	val, err := marshalRecord(conf, issuedBucket, []byte(cc.keyID), issuedCert{
+		KeyID:       cc.keyID,
+		User:        user,
+		Fingerprint: ssh.FingerprintLegacyMD5(pk),
+		SHA256:      ssh.FingerprintSHA256(pk),
+		Serial:      cc.serial,
+		Principals:  cc.principals,
+		Issued:      time.Now(),
+		ValidBefore: cc.validBefore,
+	})
+	if err != nil {
+		return err
+	}
+
+	return conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(issuedBucket)
+		if bucket == nil {
+			return fmt.Errorf("Issued certificate bucket missing, run cursed migrate")
+		}
+		return bucket.Put([]byte(cc.keyID), val)
+	})
+}
+
+// revokeIssued marks every matching certificate revoked in one transaction, so a KRL built
+// afterwards has all of them or, if it fails, none
+func revokeIssued(conf *config, rr revokeRequest) ([]issuedCert, error) {
+	revoked := make([]issuedCert, 0)
+	now := time.Now()
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(issuedBucket)
+		if bucket == nil {
+			return nil
+		}
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var ic issuedCert
+			err := unmarshalRecord(conf, issuedBucket, k, v, &ic)
+			if err != nil {
+				return fmt.Errorf("Issued certificate record %s corrupted: %v", k, err)
+			}
+			if ic.Revoked != nil || !now.Before(ic.ValidBefore) || !rr.matches(ic) {
+				return nil
+			}
+			ic.Revoked = &now
+			ic.RevokedReason = rr.Reason
+			revoked = append(revoked, ic)
+
+			val, err := marshalRecord(conf, issuedBucket, k, ic)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = val
+			return nil
+		})
+		if err != nil || rr.DryRun {
+			return err
+		}
+		// Writing while iterating confuses bolt's cursor
+		for k, val := range updates {
+			err = bucket.Put([]byte(k), val)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && !rr.DryRun && len(revoked) > 0 {
+		invalidateKRL(conf)
+	}
+
+	return revoked, err
+}
+
+// revokedKeyIDs returns the key IDs of revoked certificates that haven't expired yet
+func revokedKeyIDs(conf *config) ([]string, error) {
+	var ids []string
+	now := time.Now()
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(issuedBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var ic issuedCert
+			err := unmarshalRecord(conf, issuedBucket, k, v, &ic)
+			if err != nil {
+				return fmt.Errorf("Issued certificate record %s corrupted: %v", k, err)
+			}
+			if ic.Revoked != nil && now.Before(ic.ValidBefore) {
+				ids = append(ids, ic.KeyID)
+			}
+			return nil
+		})
+	})
+
+	return ids, err
+}
+
+// certRevocation returns the issued record for a revoked certificate, or nil
+func certRevocation(conf *config, keyID string) (*issuedCert, error) {
+	var ic *issuedCert
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(issuedBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(keyID))
+		if val == nil {
+			return nil
+		}
+		ic = &issuedCert{}
+		return unmarshalRecord(conf, issuedBucket, []byte(keyID), val, ic)
+	})
+	if err != nil || ic == nil || ic.Revoked == nil {
+		return nil, err
+	}
+
+	return ic, nil
+}
+
+func announceRevoked(conf *config, revoked []issuedCert, reason string) {
+	for _, ic := range revoked {
+		vb := ic.ValidBefore
+		log.Printf("Revoked certificate |%s|: %s", ic.KeyID, reason)
+		conf.webhooks.send(auditEvent{
+			Event:       "revoked",
+			User:        ic.User,
+			Fingerprint: ic.Fingerprint,
+			KeyID:       ic.KeyID,
+			Principals:  ic.Principals,
+			ValidBefore: &vb,
+			Reason:      reason,
+		})
+	}
+}
+
+func revokeHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rr revokeRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&rr)
+	if err != nil {
+		problemError(w, "Unable to parse revocation request", http.StatusBadRequest)
+		return
+	}
+	rr.Fingerprint = normalizeFingerprint(rr.Fingerprint)
+	if rr.User == "" && rr.Fingerprint == "" && len(rr.Principals) == 0 && rr.From == nil && rr.To == nil {
+		problemError(w, "At least one of user, fingerprint, principals, from and to is required", http.StatusBadRequest)
+		return
+	}
+	if rr.Reason == "" && !rr.DryRun {
+		problemError(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := revokeIssued(conf, rr)
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Revoked []issuedCert `json:"revoked"`
+		DryRun  bool         `json:"dryRun,omitempty"`
+		KRL     string       `json:"krl,omitempty"`
+	}{Revoked: revoked, DryRun: rr.DryRun}
+	if rr.DryRun || len(revoked) == 0 {
+		writeJSON(w, res)
+		return
+	}
+
+	announceRevoked(conf, revoked, rr.Reason)
+
+	// Hosts only learn about the revocations from the KRL, so don't wait for the schedule
+	if conf.KRLFile != "" {
+		res.KRL, err = writeKRL(conf)
+		if err != nil {
+			log.Printf("Unable to regenerate KRL after revoking %d certificates: %v", len(revoked), err)
+			res.KRL = "error: " + err.Error()
+		}
+	}
+	writeJSON(w, res)
+}
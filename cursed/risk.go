@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const riskTimeout = 5 * time.Second
+
+// riskFeatures describes a request to the risk scorer. ASN comes from riskasnheader, for
+// proxies that already look it up (e.g. nginx with a GeoIP2 ASN database)
+type riskFeatures struct {
+	User        string      `json:"user"`
+	Principals  []string    `json:"principals"`
+	Time        time.Time   `json:"time"`
+	UserIP      string      `json:"userIP,omitempty"`
+	BastionIP   string      `json:"bastionIP,omitempty"`
+	ASN         string      `json:"asn,omitempty"`
+	Fingerprint string      `json:"fingerprint"`
+	Device      string      `json:"device,omitempty"`
+	MFA         bool        `json:"mfa"`
+	History     riskHistory `json:"history"`
+}
+
+// riskHistory is what we remember of the user, from their key history
+type riskHistory struct {
+	LastIssued *time.Time `json:"lastIssued,omitempty"`
+	KnownKey   bool       `json:"knownKey"`
+	KeyChanged bool       `json:"keyChanged"`
+	RecentKeys int        `json:"recentKeys"`
+}
+
+type riskScore struct {
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+// riskScorer rates how unusual a request looks, 0 being entirely ordinary. The thresholds
+// in riskmfascore, riskapprovalscore and riskdenyscore decide what a score means
+type riskScorer interface {
+	score(ctx context.Context, f riskFeatures) (riskScore, error)
+}
+
+// urlScorer POSTs the features as JSON to riskscoreurl and expects a riskScore back
+type urlScorer struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newURLScorer(url, token string) *urlScorer {
+	return &urlScorer{url: url, token: token, client: &http.Client{Timeout: riskTimeout}}
+}
+
+func (s *urlScorer) score(ctx context.Context, f riskFeatures) (riskScore, error) {
+	var rs riskScore
+	body, err := json.Marshal(f)
+	if err != nil {
+		return rs, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return rs, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return rs, fmt.Errorf("Risk scoring for %s failed: %w", f.User, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rs, fmt.Errorf("Risk scoring for %s returned %s", f.User, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&rs)
+	if err != nil {
+		return rs, fmt.Errorf("Unable to parse risk scoring response: %v", err)
+	}
+	return rs, nil
+}
+
+// riskHistoryFor summarizes user's key history for the scorer
+func riskHistoryFor(conf *config, user, fp string, keyChanged bool) (riskHistory, error) {
+	rh := riskHistory{KeyChanged: keyChanged}
+	history, err := loadKeyHistory(conf, user)
+	if err != nil {
+		return rh, err
+	}
+
+	rh.RecentKeys = len(history)
+	if len(history) > 0 {
+		lastIssued := history[0].LastSeen.UTC()
+		rh.LastIssued = &lastIssued
+	}
+	for _, sk := range history {
+		if sk.Fingerprint == fp {
+			rh.KnownKey = true
+		}
+	}
+	return rh, nil
+}
+
+// scoreRequest asks the scorer about the request
+func scoreRequest(ctx context.Context, conf *config, p httpParams, principals []string, fp, deviceID string, keyChanged bool) (riskScore, error) {
+	history, err := riskHistoryFor(conf, p.bastionUser, fp, keyChanged)
+	if err != nil {
+		return riskScore{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, riskTimeout)
+	defer cancel()
+	return conf.riskScorer.score(ctx, riskFeatures{
+		User:        p.bastionUser,
+		Principals:  principals,
+		Time:        time.Now().UTC(),
+		UserIP:      p.userIP,
+		BastionIP:   p.bastionIP,
+		ASN:         p.asn,
+		Fingerprint: fp,
+		Device:      deviceID,
+		MFA:         p.mfa,
+		History:     history,
+	})
+}
+
+// asnAsserted returns the user's ASN as looked up by the reverse proxy, if it does
+func asnAsserted(r *http.Request, conf *config) string {
+	if conf.RiskASNHeader == "" {
+		return ""
+	}
+	return r.Header.Get(conf.RiskASNHeader)
+}
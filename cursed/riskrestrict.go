@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Risk signals riskrestrictions can act on
+const (
+	signalNewDevice  = "newdevice"
+	signalNewIP      = "newip"
+	signalNewKey     = "newkey"
+	signalOutOfHours = "outofhours"
+	signalScore      = "score"
+)
+
+var riskSignals = []string{signalNewDevice, signalNewIP, signalNewKey, signalOutOfHours, signalScore}
+
+// Set on certificates issued with extensions stripped, with the signals that stripped them
+const restrictedHeader = "X-Curse-Restricted"
+
+// Networks and devices remembered with each key in a user's key history
+const seenSourcesSize = 5
+
+// riskRestriction strips extensions from a user's certificate when Signal is present, so an
+// unusual request still gets a certificate, just one that can do less
+type riskRestriction struct {
+	Signal string
+	Strip  []string
+}
+
+func validateRiskRestrictions(conf *config) error {
+	for _, rr := range conf.RiskRestrictions {
+		if !stringInSlice(rr.Signal, riskSignals) {
+			return fmt.Errorf("Invalid riskrestrictions signal %q (valid: %s)", rr.Signal, strings.Join(riskSignals, ", "))
+		}
+		if len(rr.Strip) == 0 {
+			return fmt.Errorf("riskrestrictions for %s strips nothing", rr.Signal)
+		}
+		if rr.Signal == signalOutOfHours && conf.riskHours == nil {
+			return fmt.Errorf("riskrestrictions for %s requires riskworkhours", rr.Signal)
+		}
+		if rr.Signal == signalScore && (conf.riskScorer == nil || conf.RiskRestrictScore <= 0) {
+			return fmt.Errorf("riskrestrictions for %s requires riskscoreurl and riskrestrictscore", rr.Signal)
+		}
+	}
+	return nil
+}
+
+// workHours is when requests are expected, from riskworkhours, riskworkdays and riskworkzone
+type workHours struct {
+	start time.Duration
+	end   time.Duration
+	days  map[time.Weekday]bool
+	loc   *time.Location
+}
+
+// parseWorkHours reads hours as HH:MM-HH:MM, which may run past midnight, and days as
+// three-letter day names
+func parseWorkHours(hours string, days []string, zone string) (*workHours, error) {
+	if hours == "" {
+		return nil, nil
+	}
+	wh := &workHours{days: make(map[time.Weekday]bool), loc: time.Local}
+	bounds := strings.Split(hours, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Invalid riskworkhours %q, expected e.g. 08:00-18:00", hours)
+	}
+	for i, b := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid riskworkhours %q, expected e.g. 08:00-18:00", hours)
+		}
+		since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			wh.start = since
+		} else {
+			wh.end = since
+		}
+	}
+	for _, d := range days {
+		found := false
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			if strings.EqualFold(d, wd.String()[:3]) {
+				wh.days[wd] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Invalid riskworkdays entry %q, expected e.g. Mon", d)
+		}
+	}
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid riskworkzone: %v", err)
+		}
+		wh.loc = loc
+	}
+	return wh, nil
+}
+
+// contains reports whether t is within working hours. Hours past midnight belong to the day
+// they started on
+func (wh *workHours) contains(t time.Time) bool {
+	t = t.In(wh.loc)
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if wh.start <= wh.end {
+		return wh.days[t.Weekday()] && since >= wh.start && since < wh.end
+	}
+	if since >= wh.start {
+		return wh.days[t.Weekday()]
+	}
+	return since < wh.end && wh.days[t.AddDate(0, 0, -1).Weekday()]
+}
+
+// sourceNetwork returns the network ip belongs to, its /24 or /48, so moving between
+// addresses of the same office or ISP doesn't count as a new one
+func sourceNetwork(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// rememberSource puts v at the front of seen, keeping the most recent seenSourcesSize
+func rememberSource(seen []string, v string) []string {
+	if v == "" {
+		return seen
+	}
+	res := []string{v}
+	for _, s := range seen {
+		if s != v && len(res) < seenSourcesSize {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// riskSignalsFor returns the signals present in a request. Networks and devices are only
+// new once there are some on record to compare with, so a user's first request, or the
+// first since upgrading, doesn't count
+func riskSignalsFor(conf *config, p httpParams, deviceID string, keyChanged bool, rs *riskScore) ([]string, error) {
+	var signals []string
+	history, err := loadKeyHistory(conf, p.bastionUser)
+	if err != nil {
+		return nil, err
+	}
+	var networks, devices []string
+	for _, sk := range history {
+		networks = append(networks, sk.Networks...)
+		devices = append(devices, sk.Devices...)
+	}
+	if deviceID != "" && len(devices) > 0 && !stringInSlice(deviceID, devices) {
+		signals = append(signals, signalNewDevice)
+	}
+	if network := sourceNetwork(p.userIP); network != "" && len(networks) > 0 && !stringInSlice(network, networks) {
+		signals = append(signals, signalNewIP)
+	}
+	if keyChanged {
+		signals = append(signals, signalNewKey)
+	}
+	if conf.riskHours != nil && !conf.riskHours.contains(conf.clock.Now()) {
+		signals = append(signals, signalOutOfHours)
+	}
+	if rs != nil && conf.RiskRestrictScore > 0 && rs.Score >= conf.RiskRestrictScore {
+		signals = append(signals, signalScore)
+	}
+	return signals, nil
+}
+
+// restrictExtensions strips the extensions riskrestrictions calls for with signals present,
+// returning what's left and the signals that took something away
+func restrictExtensions(conf *config, exts map[string]string, signals []string) (map[string]string, []string) {
+	var applied []string
+	for _, rr := range conf.RiskRestrictions {
+		if !stringInSlice(rr.Signal, signals) {
+			continue
+		}
+		stripped := false
+		for _, name := range rr.Strip {
+			if _, ok := exts[name]; !ok {
+				continue
+			}
+			if !stripped {
+				// Never modify the shared map from the config
+				exts = withExtension(exts, name, "")
+			}
+			delete(exts, name)
+			stripped = true
+		}
+		if stripped && !stringInSlice(rr.Signal, applied) {
+			applied = append(applied, rr.Signal)
+		}
+	}
+	sort.Strings(applied)
+	return exts, applied
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
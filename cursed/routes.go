@@ -0,0 +1,247 @@
+package main
+
+import "net/http"
+
+// route is an endpoint of the main listener. The mux is built from the routes, and so is
+// the OpenAPI document at /openapi.json, so an endpoint can't be served without being
+// described, or described without being served
+type route struct {
+	pattern string
+	handler func(w http.ResponseWriter, r *http.Request, conf *config)
+	// Whether it issues certificates, and so is refused in read-only and frozen modes as well
+	// as maintenance (see checkMode)
+	issues bool
+	// Answered in every mode, for load balancers
+	always bool
+	// OpenAPI path, when pattern is a prefix for it, and its path parameters
+	path   string
+	params []string
+	// Operations by lower-case HTTP method
+	ops map[string]apiOp
+}
+
+// apiOp describes an operation of a route. Request parameters and bodies are given as the
+// structs their handlers read, and described from their form:, json: and query: tags
+type apiOp struct {
+	summary string
+	desc    string
+	// Needs no proxy authentication
+	public bool
+	// Needs the user header set by the proxy
+	user bool
+	// Takes an Idempotency-Key header
+	idempotent bool
+	query      interface{}
+	form       interface{}
+	body       interface{}
+	// 200 response: result encoded as JSON, or otherwise a string of okType
+	ok     string
+	okType string
+	result interface{}
+	// Answers 304 to conditional requests
+	cached bool
+	// Error statuses answered with problem details
+	problems []int
+	// Error statuses answered in errType instead, with errResult as JSON if set
+	errors    []int
+	errDesc   string
+	errType   string
+	errResult interface{}
+}
+
+// mainRoutes lists the endpoints of the main listener under conf
+func mainRoutes(conf *config) []route {
+	routes := []route{
+		{pattern: "/", handler: webHandler, issues: true, ops: map[string]apiOp{
+			"post": {
+				summary:    "Sign a user public key",
+				user:       true,
+				idempotent: true,
+				form:       httpParams{},
+				ok:         "Signed certificate in authorized_keys format",
+				okType:     "text/plain",
+				problems:   []int{400, 401, 403, 422, 500, 503},
+			},
+		}},
+		{pattern: "/batch", handler: batchHandler, issues: true, ops: map[string]apiOp{
+			"post": {
+				summary: "Sign multiple public keys with shared parameters",
+				user:    true,
+				body:    batchRequest{},
+				ok:      "Per-key signing results",
+				result: struct {
+					Results []signResult `json:"results"`
+				}{},
+				problems: []int{400, 401, 403, 413, 503},
+			},
+		}},
+		{pattern: "/openapi.json", handler: openAPIHandler, ops: map[string]apiOp{
+			"get": {
+				summary: "This OpenAPI document",
+				ok:      "OpenAPI 3 description of the endpoints enabled on this server",
+				okType:  "application/json",
+			},
+		}},
+		{pattern: "/readyz", handler: readyzHandler, always: true, ops: map[string]apiOp{
+			"get": {
+				summary: "Readiness for load balancers: whether this node can sign now",
+				desc: "Not ready, such as with the CA backend down or the lease lost, is a 503. " + reasonHeader + " gives the reason, and " +
+					clockSkewHeader + " the clock's offset from clockntpserver in seconds when set",
+				ok:       "ok",
+				okType:   "text/plain",
+				problems: []int{503},
+			},
+		}},
+		{pattern: "/inspect", handler: inspectHandler, ops: map[string]apiOp{
+			"post": {
+				summary:  "Parse a certificate and check it against this CA",
+				form:     inspectRequest{},
+				ok:       "Parsed certificate",
+				result:   inspectResult{},
+				problems: []int{400, 500},
+			},
+		}},
+		{pattern: "/ca", handler: caHandler, ops: map[string]apiOp{
+			"get": {
+				summary: "CA public key, for sshd's TrustedUserCAKeys",
+				ok:      "CA public key in authorized_keys format",
+				okType:  "text/plain",
+				cached:  true,
+			},
+		}},
+		{pattern: "/.well-known/curse-client", handler: clientConfigHandler, ops: map[string]apiOp{
+			"get": {
+				summary:  "Client configuration signed by the CA key, for `jinx setup`",
+				ok:       "jinx.yaml with the CA key and its signature",
+				result:   clientBundle{},
+				cached:   true,
+				problems: []int{404, 503},
+			},
+		}},
+		{pattern: "/ca/chain", handler: caChainHandler, ops: map[string]apiOp{
+			"get": {
+				summary:  "Certificates chaining the CA key to its root, for `cursed trust` on hosts (see cachain)",
+				ok:       "Intermediate CA certificates in authorized_keys format, one per line",
+				okType:   "text/plain",
+				cached:   true,
+				problems: []int{404},
+			},
+		}},
+		{pattern: "/krl", handler: krlHandler, ops: map[string]apiOp{
+			"get": {
+				summary:  "Key revocation list, for sshd's RevokedKeys",
+				ok:       "OpenSSH KRL of denylisted keys and revoked certificates",
+				okType:   "application/octet-stream",
+				cached:   true,
+				problems: []int{500, 503},
+			},
+		}},
+		{pattern: "/knownhosts", handler: knownHostsHandler, ops: map[string]apiOp{
+			"get": {
+				summary:  "known_hosts lines trusting host certificates from this CA",
+				ok:       "@cert-authority line for each of knownhostsdomains",
+				okType:   "text/plain",
+				problems: []int{404},
+			},
+		}},
+		{pattern: "/principals", handler: sessionPrincipalsHandler, ops: map[string]apiOp{
+			"get": {
+				summary:  "Principals allowed to log in as an account, for sshd's AuthorizedPrincipalsCommand (see sessionprincipals)",
+				query:    sessionPrincipalsRequest{},
+				ok:       "Principals in AuthorizedPrincipalsFile format, one per line",
+				okType:   "text/plain",
+				problems: []int{400, 404, 500},
+			},
+		}},
+	}
+
+	// Standalone mode authenticates users itself, with a login form in place of the proxy
+	if conf.AuthMode == "local" {
+		routes = append(routes, route{pattern: "/login", handler: loginHandler, issues: true, ops: map[string]apiOp{
+			"get": {
+				summary: "Login form for users without a client",
+				public:  true,
+				ok:      "Login form",
+				okType:  "text/html",
+			},
+			"post": {
+				summary:  "Log in with password and TOTP code and sign a user public key",
+				public:   true,
+				form:     loginRequest{},
+				ok:       "Signed certificate in authorized_keys format, as an id-cert.pub attachment",
+				okType:   "text/plain",
+				problems: []int{429},
+				errors:   []int{400, 401, 403, 500, 503},
+				errDesc:  "Login form, with the reason signing failed",
+				errType:  "text/html",
+			},
+		}})
+	}
+
+	// BLESS's Lambda payload, on /bless and the Lambda Invoke API path
+	if conf.BLESS {
+		bless := map[string]apiOp{
+			"post": {
+				summary:  "Sign a user public key for a BLESS request",
+				user:     true,
+				body:     blessRequest{},
+				ok:       "The certificate, or like BLESS an errorType and errorMessage",
+				result:   blessResponse{},
+				problems: []int{401, 429},
+			},
+		}
+		routes = append(routes,
+			route{pattern: "/bless", handler: blessHandler, issues: true, ops: bless},
+			route{pattern: "/2015-03-31/functions/", handler: blessHandler, issues: true, ops: bless,
+				path: "/2015-03-31/functions/{function}/invocations", params: []string{"function"}})
+	}
+
+	// Vault's SSH secrets engine API, for tooling written against it
+	if conf.VaultMount != "" {
+		sign := apiOp{
+			summary:  "Sign a user public key like Vault's SSH secrets engine",
+			user:     true,
+			body:     vaultSignRequest{},
+			ok:       "Vault response with signed_key and serial_number (hex) in data",
+			result:   vaultResponse{},
+			problems: []int{401, 429},
+			errors:   []int{400, 403, 422, 500, 503},
+			errDesc:  "Vault-style error",
+			errType:  "application/json",
+			errResult: struct {
+				Errors []string `json:"errors"`
+			}{},
+		}
+		routes = append(routes,
+			route{pattern: "/v1/" + conf.VaultMount + "/sign/", handler: vaultSignHandler, issues: true,
+				path: "/v1/" + conf.VaultMount + "/sign/{role}", params: []string{"role"},
+				ops: map[string]apiOp{"post": sign, "put": sign}},
+			route{pattern: "/v1/" + conf.VaultMount + "/public_key", handler: vaultPublicKeyHandler, ops: map[string]apiOp{
+				"get": {
+					summary: "CA public key, like Vault's",
+					ok:      "CA public key in authorized_keys format",
+					okType:  "text/plain",
+				},
+			}})
+	}
+
+	return routes
+}
+
+// mainMux serves the routes of the main listener, each with the config current when the
+// request arrives. It's our own mux so nothing registered on the default mux (like expvar's
+// /debug/vars) is exposed on the main listener
+func mainMux(store *confStore) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range mainRoutes(store.load()) {
+		rt := rt
+		mux.HandleFunc(rt.pattern, func(w http.ResponseWriter, r *http.Request) {
+			conf := store.load()
+			if !rt.always && !checkMode(w, conf, rt.issues) {
+				return
+			}
+			rt.handler(w, r, conf)
+		})
+	}
+	return mux
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Header jinx sends a SAML assertion in with authmode: saml
+const samlAssertionHeader = "X-Curse-SAML"
+
+// How far our clock and the IdP's may drift apart before an assertion's validity window is
+// enforced against us
+const samlClockSkew = 3 * time.Minute
+
+// samlGroup maps a value of samlgroupsattr to the principals its members may request
+type samlGroup struct {
+	Group      string
+	Principals []string
+}
+
+// samlAssertion is the part of a SAML 2.0 assertion we read. encoding/xml matches the
+// elements whatever their namespace prefix
+type samlAssertion struct {
+	Subject struct {
+		NameID string `xml:"NameID"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore    string   `xml:"NotBefore,attr"`
+		NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+		Audiences    []string `xml:"AudienceRestriction>Audience"`
+	} `xml:"Conditions"`
+	Attributes []struct {
+		Name         string   `xml:"Name,attr"`
+		FriendlyName string   `xml:"FriendlyName,attr"`
+		Values       []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+// attr returns the values of the attribute with the given Name or FriendlyName
+func (a *samlAssertion) attr(name string) []string {
+	var values []string
+	for _, at := range a.Attributes {
+		if at.Name == name || (at.FriendlyName != "" && at.FriendlyName == name) {
+			for _, v := range at.Values {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// loadSAMLCerts reads the IdP's signing certificates from samlidpcert
+func loadSAMLCerts(file string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read samlidpcert: %v", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate in samlidpcert %s: %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificates found in samlidpcert %s", file)
+	}
+	return certs, nil
+}
+
+// samlAuth reads the user, their groups and the principals they may request from the SAML
+// assertion in header, a base64 Response or Assertion as the IdP posts it. With samlidpcert
+// set the assertion, or the response around it, must be signed by the IdP, and only what the
+// signature covers is read. Without it, the assertion is trusted like userheader, because
+// only the authenticated reverse proxy can send it
+func samlAuth(r *http.Request, conf *config, header string) (*forgeIdentity, error) {
+	val := strings.TrimSpace(r.Header.Get(header))
+	if val == "" {
+		return nil, fmt.Errorf("%s missing from request", header)
+	}
+	raw, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64: %v", header, err)
+	}
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(raw)
+	if err != nil || doc.Root() == nil {
+		return nil, fmt.Errorf("%s is not XML: %v", header, err)
+	}
+
+	el := doc.Root()
+	verified := false
+	if el.Tag == "Response" {
+		if code := el.FindElement("./Status/StatusCode"); code == nil || !strings.HasSuffix(code.SelectAttrValue("Value", ""), ":Success") {
+			return nil, fmt.Errorf("SAML response is not a success")
+		}
+		if el.SelectElement("EncryptedAssertion") != nil {
+			return nil, fmt.Errorf("Encrypted SAML assertions aren't supported")
+		}
+		// A signed response covers its assertion, otherwise the assertion must be signed
+		if conf.samlCerts != nil && el.SelectElement("Signature") != nil {
+			el, err = verifySAML(conf, el)
+			if err != nil {
+				return nil, err
+			}
+			verified = true
+		}
+		if el = el.SelectElement("Assertion"); el == nil {
+			return nil, fmt.Errorf("SAML response has no assertion")
+		}
+	} else if el.Tag != "Assertion" {
+		return nil, fmt.Errorf("%s holds a %s, expected a SAML Response or Assertion", header, el.Tag)
+	}
+	if conf.samlCerts != nil && !verified {
+		el, err = verifySAML(conf, el)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signed := etree.NewDocument()
+	signed.SetRoot(el.Copy())
+	b, err := signed.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	var a samlAssertion
+	err = xml.Unmarshal(b, &a)
+	if err != nil {
+		return nil, fmt.Errorf("Unreadable SAML assertion: %v", err)
+	}
+	err = checkSAMLConditions(&a, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &forgeIdentity{login: strings.TrimSpace(a.Subject.NameID), saml: true}
+	if conf.SAMLUserAttr != "" {
+		users := a.attr(conf.SAMLUserAttr)
+		if len(users) != 1 {
+			return nil, fmt.Errorf("SAML assertion has %d values for %s, expected one", len(users), conf.SAMLUserAttr)
+		}
+		id.login = users[0]
+	}
+	if id.login == "" {
+		return nil, fmt.Errorf("SAML assertion doesn't name the user")
+	}
+	if conf.SAMLGroupsAttr != "" {
+		id.groups = a.attr(conf.SAMLGroupsAttr)
+	}
+	if conf.SAMLPrincipalsAttr != "" {
+		id.principals = a.attr(conf.SAMLPrincipalsAttr)
+	}
+	for _, sg := range conf.SAMLGroups {
+		for _, g := range id.groups {
+			if strings.EqualFold(sg.Group, g) {
+				id.principals = append(id.principals, sg.Principals...)
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// verifySAML checks el's enveloped signature against samlidpcert, returning el as signed
+func verifySAML(conf *config, el *etree.Element) (*etree.Element, error) {
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: conf.samlCerts})
+	signed, err := ctx.Validate(el)
+	if err != nil {
+		return nil, fmt.Errorf("SAML %s signature: %v", strings.ToLower(el.Tag), err)
+	}
+	return signed, nil
+}
+
+// checkSAMLConditions enforces the assertion's validity window and that it was issued for
+// us. Only an assertion forwarded by the proxy without samlidpcert may skip the audience
+func checkSAMLConditions(a *samlAssertion, conf *config) error {
+	now := time.Now()
+	c := a.Conditions
+	if c.NotBefore != "" {
+		nb, err := time.Parse(time.RFC3339, c.NotBefore)
+		if err != nil {
+			return fmt.Errorf("Invalid SAML NotBefore %q", c.NotBefore)
+		}
+		if now.Add(samlClockSkew).Before(nb) {
+			return fmt.Errorf("SAML assertion not valid before %s", c.NotBefore)
+		}
+	}
+	if c.NotOnOrAfter != "" {
+		na, err := time.Parse(time.RFC3339, c.NotOnOrAfter)
+		if err != nil {
+			return fmt.Errorf("Invalid SAML NotOnOrAfter %q", c.NotOnOrAfter)
+		}
+		if !now.Add(-samlClockSkew).Before(na) {
+			return fmt.Errorf("SAML assertion expired at %s", c.NotOnOrAfter)
+		}
+	} else if conf.samlCerts != nil {
+		// A signed assertion that never expires would be a password that can't be changed
+		return fmt.Errorf("SAML assertion has no NotOnOrAfter")
+	}
+	if conf.SAMLEntityID == "" {
+		if conf.samlCerts != nil {
+			return fmt.Errorf("samlentityid isn't set, so the SAML assertion's audience can't be checked")
+		}
+		return nil
+	}
+	for _, aud := range c.Audiences {
+		if strings.TrimSpace(aud) == conf.SAMLEntityID {
+			return nil
+		}
+	}
+	return fmt.Errorf("SAML assertion isn't addressed to %s", conf.SAMLEntityID)
+}
@@ -0,0 +1,170 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set in the environment of the re-executed, sandboxed process
+const sandboxEnv = "CURSED_SANDBOXED"
+
+// sandbox confines the process so a bug in the HTTP handling can't be turned into much: with
+// Landlock, files can only be created or written beneath the writable directories, and a
+// seccomp filter refuses syscalls cursed never needs (ptrace, mount, module loading, bpf,
+// and execve unless allowExec). Landlock restrictions only cover the calling thread, so the
+// first call restricts this thread and re-executes the binary from it, which carries them
+// over to every thread of the new process. The seccomp filter is then applied there.
+func sandbox(writable []string, allowExec bool) error {
+	if os.Getenv(sandboxEnv) != "" {
+		return applySeccomp(allowExec)
+	}
+
+	runtime.LockOSThread()
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to set no_new_privs: %v", err)
+	}
+	err = applyLandlock(writable)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	err = syscall.Exec(exe, os.Args, append(os.Environ(), sandboxEnv+"=1"))
+	return fmt.Errorf("Failed to re-execute into the sandbox: %v", err)
+}
+
+// Every write-type access right, by Landlock ABI version
+var landlockWriteAccess = []uint64{
+	1: unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_SYM,
+	2: unix.LANDLOCK_ACCESS_FS_REFER,
+	3: unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+}
+
+// applyLandlock restricts writes on this thread. Reads are left alone since TLS roots,
+// resolver configuration and reloaded config files live all over the filesystem, and the
+// CA key is better protected by running the signer as its own user
+func applyLandlock(writable []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		log.Printf("Landlock unavailable (%v), file writes are not restricted", errno)
+		return nil
+	}
+	var access uint64
+	for v := 1; v <= int(abi) && v < len(landlockWriteAccess); v++ {
+		access |= landlockWriteAccess[v]
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to create Landlock ruleset: %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	for _, dir := range writable {
+		err := allowWrites(fd, dir, access)
+		if err != nil {
+			return err
+		}
+	}
+	// os/exec points unset stdout and stderr of commands at /dev/null
+	err := allowWrites(fd, os.DevNull, access&(unix.LANDLOCK_ACCESS_FS_WRITE_FILE|unix.LANDLOCK_ACCESS_FS_TRUNCATE))
+	if err != nil {
+		return err
+	}
+
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to apply Landlock ruleset: %v", errno)
+	}
+
+	return nil
+}
+
+func allowWrites(rulesetFd uintptr, path string, access uint64) error {
+	pathFd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s for the sandbox: %v", path, err)
+	}
+	defer unix.Close(pathFd)
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pathFd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, rulesetFd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to allow writes to %s in the sandbox: %v", path, errno)
+	}
+
+	return nil
+}
+
+// Syscalls refused inside the sandbox
+var seccompDenied = []uint32{
+	unix.SYS_ADD_KEY, unix.SYS_BPF, unix.SYS_CHROOT, unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE, unix.SYS_INIT_MODULE, unix.SYS_KEXEC_LOAD, unix.SYS_KEYCTL,
+	unix.SYS_MOUNT, unix.SYS_PERF_EVENT_OPEN, unix.SYS_PIVOT_ROOT, unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV, unix.SYS_PTRACE, unix.SYS_REBOOT, unix.SYS_REQUEST_KEY,
+	unix.SYS_SETNS, unix.SYS_SWAPOFF, unix.SYS_SWAPON, unix.SYS_UMOUNT2, unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+}
+
+func applySeccomp(allowExec bool) error {
+	arch := uint32(unix.AUDIT_ARCH_X86_64)
+	if runtime.GOARCH == "arm64" {
+		arch = unix.AUDIT_ARCH_AARCH64
+	}
+	denied := seccompDenied
+	if !allowExec {
+		denied = append(denied, unix.SYS_EXECVE, unix.SYS_EXECVEAT)
+	}
+
+	// Load the arch and refuse other ABIs, load the syscall number and refuse x32 calls
+	// (which share the x86_64 arch value), then refuse each denied syscall
+	const (
+		ld  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret = unix.BPF_RET | unix.BPF_K
+	)
+	n := uint8(len(denied))
+	filter := []unix.SockFilter{
+		{Code: ld, K: 4},
+		{Code: jeq, Jt: 1, K: arch},
+		{Code: ret, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		{Code: ld, K: 0},
+		{Code: jge, Jt: n + 1, K: 0x40000000},
+	}
+	for i, nr := range denied {
+		filter = append(filter, unix.SockFilter{Code: jeq, Jt: n - uint8(i), K: nr})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+	)
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("Failed to apply seccomp filter: %v", errno)
+	}
+	log.Printf("Sandbox enabled")
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func sandbox(writable []string, allowExec bool) error {
+	return fmt.Errorf("sandbox is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maintenanceTask is a periodic job run by the scheduler. interval returns how often it
+// runs under conf, or 0 if it's disabled
+type maintenanceTask struct {
+	name     string
+	interval func(conf *config) int
+	run      func(conf *config) (string, error)
+}
+
+var maintenanceTasks = []maintenanceTask{
+	{"reminders", func(conf *config) int {
+		if !remindersEnabled(conf) {
+			return 0
+		}
+		return conf.ReminderInterval
+	}, runReminderSweep},
+	{"prune", func(conf *config) int { return conf.PruneInterval }, pruneExpired},
+	{"krl", func(conf *config) int {
+		if conf.KRLFile == "" {
+			return 0
+		}
+		return conf.KRLInterval
+	}, writeKRL},
+	{"inventory", func(conf *config) int {
+		if conf.InventoryFile == "" {
+			return 0
+		}
+		return conf.InventoryInterval
+	}, writeInventory},
+	{"compact", func(conf *config) int { return conf.CompactInterval }, checkCompaction},
+	{"clock", func(conf *config) int {
+		if conf.ClockNTPServer == "" {
+			return 0
+		}
+		return conf.ClockCheckInterval
+	}, checkClock},
+	{"rekey", func(conf *config) int {
+		if conf.dbCipher == nil {
+			return 0
+		}
+		return conf.DBRekeyInterval
+	}, rekeyRecords},
+	{"overrides", func(conf *config) int {
+		if conf.OverrideWarnDays == 0 {
+			return 0
+		}
+		return conf.OverrideInterval
+	}, reportOverrides},
+}
+
+type taskStatus struct {
+	Name         string     `json:"name"`
+	Interval     int        `json:"interval"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration float64    `json:"lastDuration,omitempty"`
+	Result       string     `json:"result,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+// taskTable holds the last-run status of each task, served on the admin listener at /tasks
+type taskTable struct {
+	sync.Mutex
+	status map[string]*taskStatus
+}
+
+func runScheduler(store *confStore) {
+	tasks := store.load().tasks
+	tasks.Lock()
+	for _, t := range maintenanceTasks {
+		tasks.status[t.name] = &taskStatus{Name: t.name}
+	}
+	tasks.Unlock()
+
+	for _, t := range maintenanceTasks {
+		go scheduleTask(store, t)
+
+		// Don't wait a whole interval to find out whether our clock can be trusted
+		if t.name == "clock" && t.interval(store.load()) > 0 {
+			go runTask(store.load(), t)
+		}
+	}
+}
+
+// scheduleTask runs t every interval seconds. The interval is read again after each run, so
+// a reload can change or disable a schedule without a restart
+func scheduleTask(store *confStore, t maintenanceTask) {
+	for {
+		conf := store.load()
+		interval := t.interval(conf)
+		tasks := conf.tasks
+		tasks.Lock()
+		st := tasks.status[t.name]
+		st.Interval = interval
+		st.NextRun = nil
+		if interval > 0 {
+			next := time.Now().Add(time.Duration(interval) * time.Second)
+			st.NextRun = &next
+		}
+		tasks.Unlock()
+
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		runTask(store.load(), t)
+	}
+}
+
+// runTask runs t unless it's already running, as happens when an admin triggers a task the
+// schedule has just started
+func runTask(conf *config, t maintenanceTask) taskStatus {
+	tasks := conf.tasks
+	tasks.Lock()
+	st := tasks.status[t.name]
+	if st.Running {
+		defer tasks.Unlock()
+		return *st
+	}
+	st.Running = true
+	tasks.Unlock()
+
+	start := time.Now()
+	result, err := t.run(conf)
+
+	tasks.Lock()
+	defer tasks.Unlock()
+	st.Running = false
+	st.LastRun = &start
+	st.LastDuration = time.Since(start).Seconds()
+	st.Result = result
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+		log.Printf("Maintenance task %s failed: %v", t.name, err)
+	} else if result != "" {
+		log.Printf("Maintenance task %s: %s", t.name, result)
+	}
+	return *st
+}
+
+func tasksHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	switch r.Method {
+	case http.MethodGet:
+		tasks := conf.tasks
+		tasks.Lock()
+		list := make([]taskStatus, 0, len(maintenanceTasks))
+		for _, t := range maintenanceTasks {
+			if st, ok := tasks.status[t.name]; ok {
+				list = append(list, *st)
+			}
+		}
+		tasks.Unlock()
+		writeJSON(w, list)
+	case http.MethodPost:
+		// Run a task now, e.g. to push a fresh KRL right after blocking a key
+		name := r.URL.Query().Get("name")
+		for _, t := range maintenanceTasks {
+			if t.name != name {
+				continue
+			}
+			if t.interval(conf) <= 0 {
+				problemError(w, "Task "+name+" is disabled", http.StatusConflict)
+				return
+			}
+			writeJSON(w, runTask(conf, t))
+			return
+		}
+		problemError(w, "Unknown task "+name, http.StatusNotFound)
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sealedKey is the file sealedcakeyfile points at: the CA key encrypted with a random AES
+// key, which only exists as Shamir shares held by the operators. Any Threshold of the shares
+// rebuild it, fewer say nothing about it
+type sealedKey struct {
+	PublicKey  string `json:"publicKey"`
+	Shares     int    `json:"shares"`
+	Threshold  int    `json:"threshold"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// unsealStatus is what the admin API reports about the sealed CA key
+type unsealStatus struct {
+	Sealed      bool     `json:"sealed"`
+	CA          string   `json:"ca"`
+	Threshold   int      `json:"threshold"`
+	Progress    int      `json:"progress"`
+	SubmittedBy []string `json:"submittedBy,omitempty"`
+}
+
+// sealedSigner holds the CA key once enough operators have submitted their shares through
+// /unseal. Until then, and again after /seal, every signature fails with errCAUnavailable
+type sealedSigner struct {
+	sealed sealedKey
+	pubKey ssh.PublicKey
+
+	mu     sync.Mutex
+	signer ssh.Signer
+	shares [][]byte
+	by     []string
+}
+
+// Shares are prefixed with the first bytes of the CA key's digest, so one from another
+// sealed key is turned away before it spoils the unseal
+func shareID(pubKey ssh.PublicKey) []byte {
+	sum := sha256.Sum256(pubKey.Marshal())
+	return sum[:4]
+}
+
+func loadSealedSigner(file string) (*sealedSigner, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sealed CA key file: '%v'", err)
+	}
+	s := &sealedSigner{}
+	err = json.Unmarshal(data, &s.sealed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse sealed CA key file: '%v'", err)
+	}
+	s.pubKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(s.sealed.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse sealed CA public key: '%v'", err)
+	}
+	if s.sealed.Threshold < 2 || s.sealed.Threshold > s.sealed.Shares {
+		return nil, fmt.Errorf("Sealed CA key file %s has an invalid threshold of %d of %d shares", file, s.sealed.Threshold, s.sealed.Shares)
+	}
+	return s, nil
+}
+
+func (s *sealedSigner) PublicKey() ssh.PublicKey {
+	return s.pubKey
+}
+
+func (s *sealedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *sealedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return s.SignContext(context.Background(), rand, data, algorithm)
+}
+
+func (s *sealedSigner) SignContext(ctx context.Context, rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.mu.Lock()
+	signer := s.signer
+	s.mu.Unlock()
+	if signer == nil {
+		return nil, errCAUnavailable
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+func (s *sealedSigner) isSealed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signer == nil
+}
+
+func (s *sealedSigner) status() unsealStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statusLocked()
+}
+
+func (s *sealedSigner) statusLocked() unsealStatus {
+	return unsealStatus{
+		Sealed:      s.signer == nil,
+		CA:          ssh.FingerprintSHA256(s.pubKey),
+		Threshold:   s.sealed.Threshold,
+		Progress:    len(s.shares),
+		SubmittedBy: append([]string(nil), s.by...),
+	}
+}
+
+// submit adds an operator's share. The one that completes the quorum unseals the key, or,
+// if the shares don't add up to it, throws them all away to start over
+func (s *sealedSigner) submit(share, by string) (unsealStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.signer != nil {
+		return s.statusLocked(), nil
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(share))
+	id := shareID(s.pubKey)
+	if err != nil || len(raw) != len(id)+1+32 || string(raw[:len(id)]) != string(id) || raw[len(id)] == 0 {
+		return s.statusLocked(), fmt.Errorf("Not a share of CA key %s", ssh.FingerprintSHA256(s.pubKey))
+	}
+	raw = raw[len(id):]
+	for i, prev := range s.shares {
+		if prev[0] == raw[0] {
+			return s.statusLocked(), fmt.Errorf("Share %d has already been submitted", raw[0])
+		}
+		if s.by[i] == by {
+			return s.statusLocked(), fmt.Errorf("%s has already submitted a share", by)
+		}
+	}
+	s.shares = append(s.shares, raw)
+	s.by = append(s.by, by)
+	if len(s.shares) < s.sealed.Threshold {
+		return s.statusLocked(), nil
+	}
+
+	key := combineShares(s.shares)
+	for _, sh := range s.shares {
+		zero(sh)
+	}
+	s.shares, s.by = nil, nil
+	signer, err := s.open(key)
+	zero(key)
+	if err != nil {
+		return s.statusLocked(), err
+	}
+	s.signer = signer
+	return s.statusLocked(), nil
+}
+
+func (s *sealedSigner) open(key []byte) (ssh.Signer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes, err := gcm.Open(nil, s.sealed.Nonce, s.sealed.Ciphertext, []byte(s.sealed.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("The submitted shares don't unseal the CA key, start over")
+	}
+	defer zero(pemBytes)
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse unsealed CA key: '%v'", err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(s.pubKey.Marshal()) {
+		return nil, fmt.Errorf("Unsealed key is not CA key %s", ssh.FingerprintSHA256(s.pubKey))
+	}
+	return signer, nil
+}
+
+// seal forgets the CA key and any shares submitted so far
+func (s *sealedSigner) seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sh := range s.shares {
+		zero(sh)
+	}
+	s.signer, s.shares, s.by = nil, nil, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, which is a's inverse for any a but 0
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 254; i++ {
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// splitSecret returns n Shamir shares of secret, any threshold of which rebuild it. Each
+// share is its x coordinate followed by a point on a random polynomial per secret byte
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	coeffs := make([]byte, threshold)
+	defer zero(coeffs)
+	for j, b := range secret {
+		coeffs[0] = b
+		_, err := rand.Read(coeffs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, sh := range shares {
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, sh[0]) ^ coeffs[k]
+			}
+			sh[1+j] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares interpolates the shares' polynomials at 0. The x coordinates must differ
+func combineShares(shares [][]byte) []byte {
+	secret := make([]byte, len(shares[0])-1)
+	for i, si := range shares {
+		num, den := byte(1), byte(1)
+		for j, sj := range shares {
+			if i != j {
+				num = gfMul(num, sj[0])
+				den = gfMul(den, sj[0]^si[0])
+			}
+		}
+		l := gfMul(num, gfInv(den))
+		for k := range secret {
+			secret[k] ^= gfMul(l, si[1+k])
+		}
+	}
+	return secret
+}
+
+func sealShares(args []string) (int, int, error) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid number of shares %q", args[0])
+	}
+	threshold, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid threshold %q", args[1])
+	}
+	return n, threshold, nil
+}
+
+// runSeal encrypts cakeyfile into sealedcakeyfile and prints the shares of the key that
+// unlocks it, one for each operator
+func runSeal(conf *config, n, threshold int) error {
+	if conf.SealedCAKeyFile == "" {
+		return fmt.Errorf("sealedcakeyfile must be set to seal the CA key")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return fmt.Errorf("Need 2 to 255 shares and a threshold of at least 2 and at most the number of shares")
+	}
+	pemBytes, err := ioutil.ReadFile(conf.CAKeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read CA key file: '%v'", err)
+	}
+	defer zero(pemBytes)
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse CA key: '%v'", err)
+	}
+
+	key := make([]byte, 32)
+	defer zero(key)
+	_, err = rand.Read(key)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	sk := sealedKey{
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Shares:    n,
+		Threshold: threshold,
+		Nonce:     make([]byte, gcm.NonceSize()),
+	}
+	_, err = rand.Read(sk.Nonce)
+	if err != nil {
+		return err
+	}
+	sk.Ciphertext = gcm.Seal(nil, sk.Nonce, pemBytes, []byte(sk.PublicKey))
+	shares, err := splitSecret(key, n, threshold)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(sk, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(conf.SealedCAKeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(conf.SealedCAKeyFile)
+		return err
+	}
+
+	fmt.Printf("Sealed CA key %s into %s. Any %d of these shares unseal it:\n\n",
+		ssh.FingerprintSHA256(signer.PublicKey()), conf.SealedCAKeyFile, threshold)
+	id := shareID(signer.PublicKey())
+	for _, sh := range shares {
+		fmt.Printf("  %d: %s%s\n", sh[0], hex.EncodeToString(id), hex.EncodeToString(sh))
+		zero(sh)
+	}
+	fmt.Printf("\nGive each share to a different operator, then securely delete %s.\n", conf.CAKeyFile)
+	return nil
+}
+
+func unsealHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if conf.seal == nil {
+		problemError(w, "sealedcakeyfile is not set", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, conf.seal.status())
+		return
+	case http.MethodPost:
+	default:
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Each share counts for whoever the admin credential belongs to, so one operator can't
+	// make up a quorum by submitting everyone's shares under different names
+	by := adminIdentity(r, conf)
+	if by == "" {
+		problemError(w, "Unsealing needs a credential naming the operator: a client certificate or an admin token", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Share string `json:"share"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		problemError(w, "Unable to parse unseal request", http.StatusBadRequest)
+		return
+	}
+	if req.Share == "" {
+		problemError(w, "share is required", http.StatusBadRequest)
+		return
+	}
+	wasSealed := conf.seal.isSealed()
+	st, err := conf.seal.submit(req.Share, by)
+	if err != nil {
+		log.Printf("Unseal share from %s refused: %v", by, err)
+		conf.webhooks.send(auditEvent{Event: "unseal_failed", User: by, Reason: err.Error()})
+		problemError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wasSealed && !st.Sealed {
+		log.Printf("CA key %s unsealed, share from %s completed the quorum", st.CA, by)
+		conf.webhooks.send(auditEvent{Event: "unsealed", User: by})
+	} else if wasSealed {
+		log.Printf("Unseal share %d of %d submitted by %s", st.Progress, st.Threshold, by)
+		conf.webhooks.send(auditEvent{Event: "unseal_share", User: by})
+	}
+	writeJSON(w, st)
+}
+
+// sealHandler locks the CA key away again, e.g. when the host may be compromised. Unsealing
+// needs the quorum of shares once more
+func sealHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if conf.seal == nil {
+		problemError(w, "sealedcakeyfile is not set", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		problemError(w, "Unable to parse seal request", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		problemError(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	// Sealing only takes the key away, so the shared admintoken may do it in a hurry, but it's
+	// recorded as such rather than under a name of the caller's choosing
+	by := adminIdentity(r, conf)
+	if by == "" {
+		by = "admintoken"
+	}
+	conf.seal.seal()
+	log.Printf("CA key sealed by %s: %s", by, req.Reason)
+	conf.webhooks.send(auditEvent{Event: "sealed", User: by, Reason: req.Reason})
+	writeJSON(w, conf.seal.status())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestShamirRoundTrip checks any threshold of the shares rebuild the secret, in any order,
+// and fewer don't
+func TestShamirRoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var subset [][]byte
+		for _, i := range pick {
+			subset = append(subset, shares[i])
+		}
+		if got := combineShares(subset); !bytes.Equal(got, secret) {
+			t.Errorf("shares %v rebuilt %x, want %x", pick, got, secret)
+		}
+	}
+
+	for _, pick := range [][]int{{0, 1}, {3, 4}, {2}} {
+		var subset [][]byte
+		for _, i := range pick {
+			subset = append(subset, shares[i])
+		}
+		if got := combineShares(subset); bytes.Equal(got, secret) {
+			t.Errorf("shares %v below the threshold rebuilt the secret", pick)
+		}
+	}
+}
+
+// TestGFInverse checks gfInv against gfMul for every nonzero element
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%#x * gfInv(%#x) = %#x, want 1", a, a, p)
+		}
+	}
+}
+
+// TestSubmitRefusesDuplicates checks a share can't be submitted twice, and an operator can't
+// submit two shares, so neither counts twice towards the threshold
+func TestSubmitRefusesDuplicates(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 32)
+	shares, err := splitSecret(key, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sealedSigner{sealed: sealedKey{Shares: 3, Threshold: 3}, pubKey: pubKey}
+	encode := func(share []byte) string {
+		return hex.EncodeToString(shareID(pubKey)) + hex.EncodeToString(share)
+	}
+
+	st, err := s.submit(encode(shares[0]), "alice")
+	if err != nil || st.Progress != 1 {
+		t.Fatalf("first share: progress %d, %v", st.Progress, err)
+	}
+	st, err = s.submit(encode(shares[0]), "bob")
+	if err == nil || st.Progress != 1 {
+		t.Errorf("same share from another operator: progress %d, %v", st.Progress, err)
+	}
+	st, err = s.submit(encode(shares[1]), "alice")
+	if err == nil || st.Progress != 1 {
+		t.Errorf("second share from the same operator: progress %d, %v", st.Progress, err)
+	}
+	st, err = s.submit(hex.EncodeToString([]byte{0, 0, 0, 0})+hex.EncodeToString(shares[1]), "bob")
+	if err == nil || st.Progress != 1 {
+		t.Errorf("share of another key: progress %d, %v", st.Progress, err)
+	}
+	st, err = s.submit(encode(shares[1]), "bob")
+	if err != nil || st.Progress != 2 || !st.Sealed {
+		t.Errorf("second operator's share: progress %d, sealed %v, %v", st.Progress, st.Sealed, err)
+	}
+}
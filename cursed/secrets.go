@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// resolveSecret expands config values that reference a secret source instead of holding the
+// secret itself: env:NAME, file:/path/to/secret or vault:path/to/secret#field. Values without
+// a recognized prefix are returned unchanged.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		path := expandHome(strings.TrimPrefix(value, "file:"))
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read secret file: %v", err)
+		}
+		return strings.TrimSpace(string(secret)), nil
+	case strings.HasPrefix(value, "vault:"):
+		return readVaultSecret(strings.TrimPrefix(value, "vault:"))
+	}
+
+	return value, nil
+}
+
+func readVaultSecret(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Vault secret reference must be of the form vault:path#field")
+	}
+	path, field := parts[0], parts[1]
+
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to read %s", path)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("Invalid Vault request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Vault request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Vault response: %v", err)
+	}
+
+	// KV version 2 nests the secret under data.data
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Field %q not found in Vault secret %s", field, path)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/netutil"
+)
+
+// newServer applies our timeout settings to a listener. HTTP/2 is negotiated automatically
+// by net/http over TLS, which lets high-volume clients multiplex requests on one connection
+func newServer(conf *config, addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           withGzip(h),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Duration(conf.HTTPReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(conf.HTTPWriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(conf.HTTPIdleTimeout) * time.Second,
+	}
+}
+
+// serveTLS is http.Server.ListenAndServeTLS with an optional cap on concurrent connections
+func serveTLS(conf *config, srv *http.Server) error {
+	return serveTLSOn(conf, srv, "tcp", conf.SSLCert, conf.SSLKey)
+}
+
+func serveTLSOn(conf *config, srv *http.Server, network, certFile, keyFile string) error {
+	ln, err := net.Listen(network, srv.Addr)
+	if err != nil {
+		return err
+	}
+	if conf.HTTPMaxConns > 0 {
+		ln = netutil.LimitListener(ln, conf.HTTPMaxConns)
+	}
+
+	return srv.ServeTLS(ln, certFile, keyFile)
+}
+
+// listener is an address the signing service is served on, with its own certificate and
+// TLS settings. family is dual by default, taking IPv4 and IPv6 on a wildcard address such
+// as ::, or ipv4 or ipv6 to bind only that family
+type listener struct {
+	Addr          string
+	Port          int
+	Family        string
+	SSLCert       string
+	SSLKey        string
+	TLSMinVersion string
+}
+
+// Networks to listen on for each listener family
+var listenerNetworks = map[string]string{"dual": "tcp", "ipv4": "tcp4", "ipv6": "tcp6"}
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+func (l listener) address() string {
+	return net.JoinHostPort(l.Addr, strconv.Itoa(l.Port))
+}
+
+// resolveListeners fills in listeners from addr, port, sslcert and sslkey, which are also the
+// defaults for each listener's own settings, and checks them
+func resolveListeners(conf *config) error {
+	if len(conf.Listeners) == 0 {
+		conf.Listeners = []listener{{Addr: conf.Addr}}
+	}
+	seen := make(map[string]bool)
+	for i := range conf.Listeners {
+		l := &conf.Listeners[i]
+		if l.Port == 0 {
+			l.Port = conf.Port
+		}
+		if l.Family == "" {
+			l.Family = "dual"
+		}
+		if l.SSLCert == "" {
+			l.SSLCert = conf.SSLCert
+		}
+		if l.SSLKey == "" {
+			l.SSLKey = conf.SSLKey
+		}
+		l.SSLCert, l.SSLKey = expandHome(l.SSLCert), expandHome(l.SSLKey)
+		if l.TLSMinVersion == "" {
+			l.TLSMinVersion = "1.2"
+		}
+
+		if l.Port < 1 || l.Port > 65535 {
+			return fmt.Errorf("Invalid port %d for listener %s", l.Port, l.Addr)
+		}
+		if _, ok := listenerNetworks[l.Family]; !ok {
+			return fmt.Errorf("Invalid family %q for listener %s (valid: dual, ipv4, ipv6)", l.Family, l.address())
+		}
+		if ip := net.ParseIP(l.Addr); ip != nil && (l.Family == "ipv4") != (ip.To4() != nil) && l.Family != "dual" {
+			return fmt.Errorf("Listener %s isn't an %s address", l.address(), l.Family)
+		}
+		if _, ok := tlsVersions[l.TLSMinVersion]; !ok {
+			return fmt.Errorf("Invalid tlsminversion %q for listener %s (valid: 1.2, 1.3)", l.TLSMinVersion, l.address())
+		}
+		if seen[l.address()] {
+			return fmt.Errorf("Listener %s is configured twice", l.address())
+		}
+		seen[l.address()] = true
+	}
+	return nil
+}
+
+// serveListener serves h on l until the listener fails
+func serveListener(conf *config, l listener, h http.Handler) error {
+	srv := newServer(conf, l.address(), h)
+	srv.TLSConfig = &tls.Config{MinVersion: tlsVersions[l.TLSMinVersion]}
+	return serveTLSOn(conf, srv, listenerNetworks[l.Family], l.SSLCert, l.SSLKey)
+}
+
+// gzipWriter compresses JSON responses, which is where the volume is (batch results, OpenAPI
+// spec, admin listings). Certificates and other small text responses are sent as is
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.decided = true
+		if strings.Contains(g.Header().Get("Content-Type"), "json") {
+			g.Header().Del("Content-Length")
+			g.Header().Set("Content-Encoding", "gzip")
+			g.gz = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func withGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		g := &gzipWriter{ResponseWriter: w}
+		h.ServeHTTP(g, r)
+		if g.gz != nil {
+			g.gz.Close()
+		}
+	})
+}
+
+// requestBody transparently decompresses gzip request bodies. Callers still limit the size
+// of what they read, which bounds the decompressed size too
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return r.Body, nil
+	}
+
+	return gzip.NewReader(r.Body)
+}
+
+// Sent on every response. Certificates, CA keys and admin data must never sit in a shared
+// cache, and nothing we serve is meant to be rendered or framed by a browser
+var securityHeaders = map[string]string{
+	"Cache-Control":             "no-store",
+	"Content-Security-Policy":   "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":           "no-referrer",
+	"Strict-Transport-Security": "max-age=31536000",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+}
+
+// responseHeader is an operator-supplied header for responses whose path matches Path (a
+// shell-style pattern, or every path if empty). An empty Value removes the header
+type responseHeader struct {
+	Path  string
+	Name  string
+	Value string
+}
+
+func validateResponseHeaders(headers []responseHeader) error {
+	for _, h := range headers {
+		if !httpguts.ValidHeaderFieldName(h.Name) {
+			return fmt.Errorf("Invalid responseheaders name %q", h.Name)
+		}
+		if !httpguts.ValidHeaderFieldValue(h.Value) {
+			return fmt.Errorf("Invalid responseheaders value for %s", h.Name)
+		}
+		_, err := path.Match(h.Path, "")
+		if err != nil {
+			return fmt.Errorf("Invalid responseheaders path %q: %v", h.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// withHeaders sets our security headers, then any responseheaders for the path, before the
+// handler runs so handlers can still override them
+func withHeaders(store *confStore, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range securityHeaders {
+			w.Header().Set(name, value)
+		}
+		for _, rh := range store.load().ResponseHeaders {
+			if ok, _ := path.Match(rh.Path, r.URL.Path); rh.Path != "" && !ok {
+				continue
+			}
+			if rh.Value == "" {
+				w.Header().Del(rh.Name)
+			} else {
+				w.Header().Set(rh.Name, rh.Value)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
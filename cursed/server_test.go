@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// benchServer serves a JSON listing the size of a busy /approvals through newServer, so
+// the gzip middleware and timeouts are those in production
+func benchServer(b *testing.B, tls bool) *httptest.Server {
+	approvals := make([]approval, 200)
+	for i := range approvals {
+		approvals[i] = approval{
+			ID:          fmt.Sprintf("%016x", i),
+			User:        fmt.Sprintf("user%d", i%20),
+			Fingerprint: "SHA256:Gn3PZqvQ8C5p7cLyA4v6XtFh2mJbE9kWdRsNoUiYxTz",
+			Principal:   "root",
+			Reason:      "tier prod",
+			Status:      approvalPending,
+			Created:     time.Now(),
+			Expires:     time.Now().Add(time.Hour),
+		}
+	}
+	conf := &config{HTTPReadTimeout: 30, HTTPWriteTimeout: 30, HTTPIdleTimeout: 120}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer(conf, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, approvals)
+	}))
+	if tls {
+		ts.StartTLS()
+	} else {
+		ts.Start()
+	}
+	b.Cleanup(ts.Close)
+	return ts
+}
+
+func benchGet(b *testing.B, ts *httptest.Server, client *http.Client, gz bool) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if gz {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var body io.Reader = resp.Body
+			if resp.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				body = zr
+			}
+			_, err = io.Copy(ioutil.Discard, body)
+			resp.Body.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkJSONEndpoint compares a JSON listing sent as is and gzipped, decompression on the
+// client's side included
+func BenchmarkJSONEndpoint(b *testing.B) {
+	for _, gz := range []bool{false, true} {
+		name := "identity"
+		if gz {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			ts := benchServer(b, false)
+			// Ask for gzip ourselves, so the transport doesn't on the identity run
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true, MaxIdleConnsPerHost: 64}}
+			benchGet(b, ts, client, gz)
+		})
+	}
+}
+
+// BenchmarkKeepAlive compares clients reusing TLS connections with ones making a new
+// connection, and handshake, for every request
+func BenchmarkKeepAlive(b *testing.B) {
+	for _, reuse := range []bool{true, false} {
+		name := "reuse"
+		if !reuse {
+			name = "new-conn"
+		}
+		b.Run(name, func(b *testing.B) {
+			ts := benchServer(b, true)
+			tr := ts.Client().Transport.(*http.Transport).Clone()
+			tr.DisableKeepAlives = !reuse
+			tr.MaxIdleConnsPerHost = 64
+			benchGet(b, ts, &http.Client{Transport: tr}, true)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Session recording gateways read this extension to file each recording under the
+// certificate that opened it. The client side lives in jinx/cache.go
+const sessionExtension = "session-id@curse"
+
+var sessionPrincipalBucket = []byte("sessionprincipals")
+
+// sessionPrincipal maps a per-certificate principal like alice-7f3a to the accounts it may
+// log in to. Hosts fetch the mapping from /principals with an AuthorizedPrincipalsCommand
+type sessionPrincipal struct {
+	Principal string    `json:"principal"`
+	User      string    `json:"user"`
+	Accounts  []string  `json:"accounts"`
+	Session   string    `json:"session,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// newSessionPrincipal reserves a principal for one certificate of user, good for accounts
+// until expires. The suffix is short enough to read in logs, so it's checked against the
+// user's other live session principals
+func newSessionPrincipal(conf *config, user string, accounts []string, sessionID string, expires time.Time) (string, error) {
+	var principal string
+	err := conf.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionPrincipalBucket)
+		if bucket == nil {
+			return fmt.Errorf("Session principal bucket missing, run cursed migrate")
+		}
+		for i := 0; i < 10; i++ {
+			suffix := make([]byte, 2)
+			_, err := rand.Read(suffix)
+			if err != nil {
+				return err
+			}
+			candidate := fmt.Sprintf("%s-%x", user, suffix)
+			if val := bucket.Get([]byte(candidate)); val != nil {
+				var sp sessionPrincipal
+				if unmarshalRecord(conf, sessionPrincipalBucket, []byte(candidate), val, &sp) == nil && time.Now().Before(sp.Expires) {
+					continue
+				}
+			}
+
+			val, err := marshalRecord(conf, sessionPrincipalBucket, []byte(candidate), sessionPrincipal{
+				Principal: candidate,
+				User:      user,
+				Accounts:  accounts,
+				Session:   sessionID,
+				Created:   time.Now(),
+				Expires:   expires,
+			})
+			if err != nil {
+				return err
+			}
+			principal = candidate
+			return bucket.Put([]byte(candidate), val)
+		}
+		return fmt.Errorf("No free session principal for %s", user)
+	})
+
+	return principal, err
+}
+
+// sessionPrincipalsFor lists the unexpired session principals that may log in as account
+func sessionPrincipalsFor(conf *config, account string) ([]string, error) {
+	var principals []string
+	now := time.Now()
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionPrincipalBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var sp sessionPrincipal
+			err := unmarshalRecord(conf, sessionPrincipalBucket, k, v, &sp)
+			if err != nil {
+				return fmt.Errorf("Session principal %s corrupted: %v", k, err)
+			}
+			if !now.Before(sp.Expires) {
+				return nil
+			}
+			for _, a := range sp.Accounts {
+				if a == account {
+					principals = append(principals, sp.Principal)
+					break
+				}
+			}
+			return nil
+		})
+	})
+	sort.Strings(principals)
+
+	return principals, err
+}
+
+// sessionPrincipalsRequest is the query read by sessionPrincipalsHandler
+type sessionPrincipalsRequest struct {
+	Account string `query:"account,required"`
+}
+
+// sessionPrincipalsHandler serves the principals allowed to log in as ?account= in
+// AuthorizedPrincipalsFile format, one per line
+func sessionPrincipalsHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !conf.SessionPrincipals {
+		problemError(w, "Session principals are not enabled", http.StatusNotFound)
+		return
+	}
+	account := r.URL.Query().Get("account")
+	if account == "" {
+		problemError(w, "account is required", http.StatusBadRequest)
+		return
+	}
+
+	principals, err := sessionPrincipalsFor(conf, account)
+	if err != nil {
+		log.Printf("%v", err)
+		problemError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if len(principals) > 0 {
+		fmt.Fprintln(w, strings.Join(principals, "\n"))
+	}
+}
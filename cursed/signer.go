@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const agentTimeout = 10 * time.Second
+
+// contextSigner is a CA signer that makes its signatures somewhere else, so waiting for one
+// can be given up on when the request that wants it is gone. See signPubKey
+type contextSigner interface {
+	ssh.Signer
+	SignContext(ctx context.Context, rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error)
+}
+
+// agentSigner signs with a CA key held by an ssh-agent, so the private key can live on a
+// hardware token or a separate locked-down host that forwards its agent socket to us. The
+// socket is dialed for every signature so a restarted or re-forwarded agent is picked up.
+type agentSigner struct {
+	socket string
+	pubKey ssh.PublicKey
+}
+
+func loadAgentSigner(socket, pubKeyFile string) (ssh.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA public key file: '%v'", err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CA public key: '%v'", err)
+	}
+
+	// Make sure the agent actually holds our CA key before we start serving requests
+	s := &agentSigner{socket: socket, pubKey: pubKey}
+	var keys []*agent.Key
+	err = s.withAgent(context.Background(), func(a agent.ExtendedAgent) error {
+		keys, err = a.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if string(k.Marshal()) == string(pubKey.Marshal()) {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("CA key %s not found in agent at %s", ssh.FingerprintSHA256(pubKey), socket)
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pubKey
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return s.SignContext(context.Background(), rand, data, algorithm)
+}
+
+func (s *agentSigner) SignContext(ctx context.Context, rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	var sig *ssh.Signature
+	err := s.withAgent(ctx, func(a agent.ExtendedAgent) error {
+		var err error
+		sig, err = a.SignWithFlags(s.pubKey, data, flags)
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("Agent signing abandoned: %w", ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Agent signing failed: %v", err)
+	}
+
+	return sig, nil
+}
+
+func (s *agentSigner) withAgent(ctx context.Context, f func(agent.ExtendedAgent) error) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", s.socket)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to CA agent: %v", err)
+	}
+	defer conn.Close()
+
+	// A wedged agent shouldn't hold requests forever, nor one whose client has gone
+	deadline := time.Now().Add(agentTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return f(agent.NewClient(conn))
+}
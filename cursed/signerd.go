@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errSignerReadOnly = errors.New("operation not supported by the curse signer")
+
+// signerAgent is the privileged half of a split deployment. It holds the CA key and speaks
+// just enough of the ssh-agent protocol for agentSigner, listing the CA key and signing
+// certificates with it. Anything that doesn't parse as a certificate for our CA is refused,
+// so a compromised network-facing process can't use it as a general signing oracle.
+type signerAgent struct {
+	conf   *config
+	signer ssh.Signer
+}
+
+func (s *signerAgent) List() ([]*agent.Key, error) {
+	pk := s.signer.PublicKey()
+	return []*agent.Key{{Format: pk.Type(), Blob: pk.Marshal(), Comment: "curse CA"}}, nil
+}
+
+func (s *signerAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *signerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	caKey := s.signer.PublicKey().Marshal()
+	if string(key.Marshal()) != string(caKey) {
+		return nil, fmt.Errorf("unknown key %s", ssh.FingerprintSHA256(key))
+	}
+	cert, err := certFromSigningData(data)
+	if err != nil {
+		log.Printf("Refusing to sign: %v", err)
+		return nil, err
+	}
+	if string(cert.SignatureKey.Marshal()) != string(caKey) {
+		log.Printf("Refusing to sign certificate %q naming a different CA", cert.KeyId)
+		return nil, fmt.Errorf("certificate names a different CA")
+	}
+
+	algorithm := ""
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		algorithm = ssh.KeyAlgoRSASHA256
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		algorithm = ssh.KeyAlgoRSASHA512
+	}
+	kind := "user"
+	if cert.CertType == ssh.HostCert {
+		kind = "host"
+	}
+	rl := logRequest(s.conf, kind, "Signing certificate: serial[%d] keyID[%s] principals%v", cert.Serial, cert.KeyId, cert.ValidPrincipals)
+	var sig *ssh.Signature
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, algorithm)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, data)
+	}
+	rl.finish(err != nil)
+	return sig, err
+}
+
+// certFromSigningData parses the data a certificate signature covers, which is the whole
+// certificate minus the trailing signature field
+func certFromSigningData(data []byte) (*ssh.Certificate, error) {
+	placeholder := ssh.Marshal(&ssh.Signature{Format: "none"})
+	full := append(append([]byte{}, data...), ssh.Marshal(struct{ Sig []byte }{placeholder})...)
+	pk, err := ssh.ParsePublicKey(full)
+	if err != nil {
+		return nil, fmt.Errorf("data is not an SSH certificate: %v", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("data is not an SSH certificate")
+	}
+
+	return cert, nil
+}
+
+func (s *signerAgent) Add(key agent.AddedKey) error   { return errSignerReadOnly }
+func (s *signerAgent) Remove(key ssh.PublicKey) error { return errSignerReadOnly }
+func (s *signerAgent) RemoveAll() error               { return errSignerReadOnly }
+func (s *signerAgent) Lock(passphrase []byte) error   { return errSignerReadOnly }
+func (s *signerAgent) Unlock(passphrase []byte) error { return errSignerReadOnly }
+func (s *signerAgent) Signers() ([]ssh.Signer, error) { return nil, errSignerReadOnly }
+func (s *signerAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// runSigner serves the CA key on signersocket for a cursed running with caagentsocket
+// pointed at it, typically as a different user with no network access
+func runSigner(conf *config) error {
+	if conf.SignerSocket == "" {
+		return fmt.Errorf("signersocket must be set to run the signer")
+	}
+	if conf.Sandbox {
+		err := sandbox([]string{filepath.Dir(conf.SignerSocket)}, false)
+		if err != nil {
+			return err
+		}
+	}
+	signer, err := loadCAKey(conf.CAKeyFile)
+	if err != nil {
+		return err
+	}
+
+	// Clear out the socket left behind by a previous run
+	if fi, err := os.Lstat(conf.SignerSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(conf.SignerSocket)
+	}
+	ln, err := net.Listen("unix", conf.SignerSocket)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	// Only the signer's user and group (which the network-facing cursed user should be in)
+	// may connect
+	err = os.Chmod(conf.SignerSocket, 0660)
+	if err != nil {
+		return err
+	}
+
+	sa := &signerAgent{conf: conf, signer: signer}
+	log.Printf("Serving CA key %s on %s", ssh.FingerprintSHA256(signer.PublicKey()), conf.SignerSocket)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := agent.ServeAgent(sa, conn)
+			if err != nil && err != io.EOF {
+				log.Printf("Signer connection: %v", err)
+			}
+		}()
+	}
+}
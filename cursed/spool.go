@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var spoolBucket = []byte("auditspool")
+
+// Which webhook URLs each spooled event has reached, newline-separated, by the event's key
+var spoolDeliveredBucket = []byte("auditspooldelivered")
+
+// Spooled events that couldn't be read, kept as they were stored
+var deadLetterBucket = []byte("auditdeadletter")
+
+func loadSpoolKey(keyFile string) (cipher.AEAD, error) {
+	// The key file holds 32 hex-encoded bytes, e.g. from `openssl rand -hex 32`
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read audit spool key file: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Audit spool key must be 32 hex-encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// spool encrypts an event and appends it to the on-disk spool, refusing once the spool holds
+// auditspoolmax events so an extended outage can't fill the disk
+func (ws *webhookSender) spool(body []byte) error {
+	nonce := make([]byte, ws.gcm.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := ws.gcm.Seal(nonce, nonce, body, nil)
+
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(spoolBucket)
+		if err != nil {
+			return err
+		}
+		if bucket.Stats().KeyN >= ws.spoolMax {
+			return fmt.Errorf("Audit spool full (%d events)", ws.spoolMax)
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, sealed)
+	})
+}
+
+// replaySpool delivers spooled events in order, stopping at the first failure so ordering is
+// kept and the rest are retried on the next pass. Each endpoint an event reached is recorded,
+// so a retry only goes to those it didn't. An event that can't be read, truncated or sealed
+// with another auditspoolkeyfile, would block everything behind it, so it's moved to the
+// dead letter bucket instead
+func (ws *webhookSender) replaySpool() {
+	for {
+		var key, body []byte
+		var delivered []string
+		poisoned := false
+		err := ws.db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(spoolBucket)
+			if bucket == nil {
+				return nil
+			}
+			k, v := bucket.Cursor().First()
+			if k == nil {
+				return nil
+			}
+			key = append([]byte{}, k...)
+			nonceSize := ws.gcm.NonceSize()
+			if len(v) < nonceSize {
+				poisoned = true
+				log.Printf("Spooled audit event %x truncated, moving it to %s", k, deadLetterBucket)
+				return nil
+			}
+			var err error
+			body, err = ws.gcm.Open(nil, v[:nonceSize], v[nonceSize:], nil)
+			if err != nil {
+				poisoned = true
+				log.Printf("Unable to decrypt spooled audit event %x, moving it to %s: %v", k, deadLetterBucket, err)
+				return nil
+			}
+			if done := tx.Bucket(spoolDeliveredBucket); done != nil {
+				if urls := done.Get(k); len(urls) > 0 {
+					delivered = strings.Split(string(urls), "\n")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		if key == nil {
+			return
+		}
+		if poisoned {
+			err = ws.deadLetter(key)
+			if err != nil {
+				log.Printf("Unable to move audit event %x to %s: %v", key, deadLetterBucket, err)
+				return
+			}
+			continue
+		}
+
+		for _, url := range ws.urls {
+			if stringInSlice(url, delivered) {
+				continue
+			}
+			err = ws.post(url, body)
+			if err != nil {
+				log.Printf("Webhook delivery to %s failed, keeping event spooled: %v", url, err)
+				return
+			}
+			delivered = append(delivered, url)
+			err = ws.db.Update(func(tx *bolt.Tx) error {
+				done, err := tx.CreateBucketIfNotExists(spoolDeliveredBucket)
+				if err != nil {
+					return err
+				}
+				return done.Put(key, []byte(strings.Join(delivered, "\n")))
+			})
+			if err != nil {
+				log.Printf("Unable to record delivery of audit event %x to %s: %v", key, url, err)
+				return
+			}
+		}
+
+		err = ws.db.Update(func(tx *bolt.Tx) error {
+			return deleteSpooled(tx, key)
+		})
+		if err != nil {
+			log.Printf("Unable to remove delivered audit event from spool: %v", err)
+			return
+		}
+	}
+}
+
+// deadLetter moves spooled event key, as it's stored, to the dead letter bucket, where an
+// admin can look into it without it holding up delivery
+func (ws *webhookSender) deadLetter(key []byte) error {
+	return ws.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spoolBucket)
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get(key)
+		if val == nil {
+			return nil
+		}
+		dead, err := tx.CreateBucketIfNotExists(deadLetterBucket)
+		if err != nil {
+			return err
+		}
+		err = dead.Put(key, append([]byte(nil), val...))
+		if err != nil {
+			return err
+		}
+		return deleteSpooled(tx, key)
+	})
+}
+
+// deleteSpooled removes spooled event key along with the record of where it was delivered
+func deleteSpooled(tx *bolt.Tx, key []byte) error {
+	err := tx.Bucket(spoolBucket).Delete(key)
+	if err != nil {
+		return err
+	}
+	if done := tx.Bucket(spoolDeliveredBucket); done != nil {
+		return done.Delete(key)
+	}
+	return nil
+}
+
+func (ws *webhookSender) runSpool() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		ws.replaySpool()
+		select {
+		case <-ws.wake:
+		case <-ticker.C:
+		}
+	}
+}
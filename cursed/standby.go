@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// standbyState is written next to dbfile while it's a standby copy, and keeps the daemon
+// from starting on it until `cursed promote`
+type standbyState struct {
+	Primary      string    `json:"primary"`
+	PID          int       `json:"pid"`
+	LastSnapshot time.Time `json:"lastSnapshot,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+}
+
+func standbyFile(conf *config) string {
+	return conf.DBFile + ".standby"
+}
+
+func readStandbyState(conf *config) (*standbyState, error) {
+	data, err := ioutil.ReadFile(standbyFile(conf))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st standbyState
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		return nil, fmt.Errorf("%s corrupted: %v", standbyFile(conf), err)
+	}
+	return &st, nil
+}
+
+func writeStandbyState(conf *config, st standbyState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(standbyFile(conf), data, 0600)
+}
+
+// checkNotStandby keeps the daemon off a standby copy, which the next snapshot would
+// overwrite along with anything issued in the meantime
+func checkNotStandby(conf *config) error {
+	st, err := readStandbyState(conf)
+	if err != nil {
+		return err
+	}
+	if st != nil {
+		return fmt.Errorf("%s is a standby copy of %s (last snapshot %s), run `cursed promote` to take over",
+			conf.DBFile, st.Primary, st.LastSnapshot.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// snapshotHandler streams a consistent copy of the database to a standby. bolt writes it
+// from a read transaction, so issuing carries on meanwhile
+func snapshotHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		problemError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := conf.db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		// Too late for an error response once the copy has started
+		log.Printf("Snapshot to %s failed: %v", r.RemoteAddr, err)
+	}
+}
+
+// runStandby keeps dbfile a recent copy of the primary's database, fetching a snapshot from
+// its admin API every standbyinterval seconds, until `cursed promote`
+func runStandby(conf *config) error {
+	if conf.StandbyPrimary == "" {
+		return fmt.Errorf("standbyprimary must be set to run as a standby")
+	}
+	st, err := readStandbyState(conf)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(conf.DBFile); st == nil && err == nil {
+		return fmt.Errorf("Refusing to overwrite %s, which isn't a standby copy. Move it aside first", conf.DBFile)
+	}
+	if st == nil {
+		st = &standbyState{}
+	}
+	st.Primary = conf.StandbyPrimary
+	st.PID = os.Getpid()
+	err = writeStandbyState(conf, *st)
+	if err != nil {
+		return err
+	}
+
+	client, err := standbyClient(conf)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replicating %s from %s every %d seconds", conf.DBFile, conf.StandbyPrimary, conf.StandbyInterval)
+	for {
+		size, err := fetchSnapshot(conf, client)
+		if err != nil {
+			log.Printf("Snapshot from %s failed: %v", conf.StandbyPrimary, err)
+		}
+
+		// Promotion removes the state file, and the copy is no longer ours to replace
+		cur, rerr := readStandbyState(conf)
+		if rerr != nil {
+			return rerr
+		}
+		if cur == nil {
+			log.Printf("%s has been promoted, stopping replication", conf.DBFile)
+			return nil
+		}
+		if err == nil {
+			st.LastSnapshot = time.Now()
+			st.Size = size
+			err = writeStandbyState(conf, *st)
+			if err != nil {
+				return err
+			}
+			log.Printf("Copied %d bytes from %s", size, conf.StandbyPrimary)
+		}
+		time.Sleep(time.Duration(conf.StandbyInterval) * time.Second)
+	}
+}
+
+func standbyClient(conf *config) (*http.Client, error) {
+	tlsConf := &tls.Config{}
+	if conf.StandbyCAFile != "" {
+		caPEM, err := ioutil.ReadFile(conf.StandbyCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read standbycafile: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in standbycafile %s", conf.StandbyCAFile)
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}, Timeout: 10 * time.Minute}, nil
+}
+
+// fetchSnapshot downloads a snapshot and swaps it in for dbfile once it has been checked
+func fetchSnapshot(conf *config, client *http.Client) (int64, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(conf.StandbyPrimary, "/")+"/snapshot", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.StandbyToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary returned %s", resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(conf.DBFile), ".standby")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && size != resp.ContentLength {
+		err = fmt.Errorf("snapshot truncated at %d of %d bytes", size, resp.ContentLength)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Make sure bolt can read it and it has a schema before replacing a good copy
+	err = checkSnapshot(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), conf.DBFile)
+}
+
+func checkSnapshot(file string) error {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("snapshot unreadable: %v", err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil || meta.Get(schemaVersionKey) == nil {
+			return fmt.Errorf("snapshot has no schema version")
+		}
+		return nil
+	})
+}
+
+// runPromote turns a standby copy into the live database, once `cursed standby` has stopped.
+// Nothing stops the old primary from issuing, so make sure it's down first
+func runPromote(conf *config) error {
+	st, err := readStandbyState(conf)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("%s is not a standby copy", conf.DBFile)
+	}
+	if st.PID > 0 && st.PID != os.Getpid() {
+		if proc, err := os.FindProcess(st.PID); err == nil && proc.Signal(syscall.Signal(0)) == nil {
+			return fmt.Errorf("cursed standby (pid %d) is still running, stop it first", st.PID)
+		}
+	}
+	if st.LastSnapshot.IsZero() {
+		return fmt.Errorf("No snapshot of %s has been copied yet", st.Primary)
+	}
+
+	err = os.Remove(standbyFile(conf))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Promoted %s, copied from %s at %s (%s ago). Start cursed to take over.\n",
+		conf.DBFile, st.Primary, st.LastSnapshot.Format(time.RFC3339), time.Since(st.LastSnapshot).Round(time.Second))
+	return nil
+}
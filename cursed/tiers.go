@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tier groups principals by sensitivity, e.g. tier0 for root and production accounts,
+// with stricter rules than the global defaults
+type tier struct {
+	Name              string
+	Principals        []string
+	Backdate          int
+	MaxDuration       int
+	MaxStartDelay     int
+	RequireApproval   bool
+	RequireMFA        bool
+	SourceAddressMode string
+	SourceAddresses   []string
+}
+
+func validateTiers(tiers []tier) error {
+	for _, t := range tiers {
+		if t.Name == "" {
+			return fmt.Errorf("Every tier needs a name")
+		}
+		if len(t.Principals) == 0 {
+			return fmt.Errorf("Tier %s has no principals", t.Name)
+		}
+		if t.Backdate < 0 {
+			return fmt.Errorf("Tier %s backdate can't be negative", t.Name)
+		}
+		for _, pattern := range t.Principals {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Invalid principal pattern %q in tier %s: %v", pattern, t.Name, err)
+			}
+		}
+		if t.SourceAddressMode != "" || len(t.SourceAddresses) > 0 {
+			err := validateSourceAddresses(t.SourceAddressMode, t.SourceAddresses)
+			if err != nil {
+				return fmt.Errorf("Tier %s: %v", t.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tierName is t's name, or empty for requests outside any tier
+func tierName(t *tier) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// matchTier returns the first tier with a principal pattern matching any of the principals
+func matchTier(conf *config, principals ...string) *tier {
+	for i, t := range conf.Tiers {
+		for _, pattern := range t.Principals {
+			for _, principal := range principals {
+				if ok, _ := path.Match(pattern, principal); ok {
+					return &conf.Tiers[i]
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *tier) maxDuration() time.Duration {
+	return time.Duration(t.MaxDuration) * time.Second
+}
+
+// sourceAddressMode returns the sourceaddressmode and sourceaddresses for certificates
+// under t. A tier without its own mode uses the global one
+func sourceAddressMode(conf *config, t *tier) (string, []string) {
+	if t != nil && t.SourceAddressMode != "" {
+		return t.SourceAddressMode, t.SourceAddresses
+	}
+	return conf.SourceAddressMode, conf.SourceAddresses
+}
+
+// backdate is how long before it's issued a certificate under t becomes valid, for hosts
+// whose clocks run behind. A tier without its own setting uses the global one
+func backdate(conf *config, t *tier) time.Duration {
+	if t != nil && t.Backdate > 0 {
+		return time.Duration(t.Backdate) * time.Second
+	}
+	return time.Duration(conf.Backdate) * time.Second
+}
+
+// maxStartDelay is how far ahead a certificate under t may be requested to start. A tier
+// without its own setting uses the global one, and a negative setting allows no delay
+func maxStartDelay(conf *config, t *tier) time.Duration {
+	delay := conf.MaxStartDelay
+	if t != nil && t.MaxStartDelay != 0 {
+		delay = t.MaxStartDelay
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay) * time.Second
+}
+
+// startTime returns when a certificate should become valid: now, or the requested
+// validAfter (unix seconds) for access pre-staged for a scheduled change
+func startTime(conf *config, t *tier, requested string) (time.Time, error) {
+	now := conf.clock.Now()
+	if requested == "" {
+		return now, nil
+	}
+	ts, err := strconv.ParseInt(requested, 10, 64)
+	if err != nil {
+		return time.Time{}, denyf(reasonBadRequest, "validAfter must be a unix timestamp")
+	}
+	start := time.Unix(ts, 0)
+	if !start.After(now) {
+		return now, nil
+	}
+
+	max := maxStartDelay(conf, t)
+	switch {
+	case max == 0 && t != nil:
+		return time.Time{}, denyf(reasonBadRequest, "Tier %s doesn't allow certificates starting later", t.Name)
+	case max == 0:
+		return time.Time{}, denyf(reasonBadRequest, "Certificates starting later aren't allowed")
+	case start.Sub(now) > max:
+		return time.Time{}, denyf(reasonBadRequest, "validAfter may be at most %v ahead", max)
+	}
+	return start, nil
+}
+
+// mfaAsserted reports whether the user authenticated with a second factor. Standalone
+// mode always requires a TOTP code, behind a proxy we rely on the proxy telling us
+func mfaAsserted(r *http.Request, conf *config) bool {
+	if conf.AuthMode == "local" {
+		return true
+	}
+	if conf.MFAHeader == "" {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(conf.MFAHeader))) {
+	case "", "0", "false", "no":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Modes of transferprofiles
+const (
+	transferSFTP = "sftp"
+	transferSCP  = "scp"
+)
+
+// transferProfile limits certificates for Principals, patterns as in tiers, to moving files.
+// The certificate is forced to run the SFTP server, or scp receiving into Directory, with no
+// pty or forwarding, so a file drop or a vendor's upload account can be granted through the
+// same CA as shell access without handing out a shell. %u in Directory or Command is replaced
+// with the user's name
+type transferProfile struct {
+	Name       string
+	Principals []string
+	Mode       string
+	Directory  string
+	Command    string
+}
+
+func validateTransferProfiles(profiles []transferProfile) error {
+	for _, tp := range profiles {
+		if tp.Name == "" {
+			return fmt.Errorf("Every transferprofiles entry needs a name")
+		}
+		if len(tp.Principals) == 0 {
+			return fmt.Errorf("Transfer profile %s has no principals", tp.Name)
+		}
+		for _, pattern := range tp.Principals {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Invalid principal pattern %q in transfer profile %s: %v", pattern, tp.Name, err)
+			}
+		}
+		switch tp.Mode {
+		case transferSFTP:
+		case transferSCP:
+			// Legacy scp can't be held to one direction or directory by sshd, only by what
+			// the forced command runs
+			if tp.Directory == "" && tp.Command == "" {
+				return fmt.Errorf("Transfer profile %s in scp mode needs a directory or command", tp.Name)
+			}
+		default:
+			return fmt.Errorf("Invalid mode %q for transfer profile %s (valid: sftp, scp)", tp.Mode, tp.Name)
+		}
+	}
+
+	return nil
+}
+
+// matchTransferProfile returns the first transfer profile with a pattern matching principal
+func matchTransferProfile(conf *config, principal string) *transferProfile {
+	for i, tp := range conf.TransferProfiles {
+		for _, pattern := range tp.Principals {
+			if ok, _ := path.Match(pattern, principal); ok {
+				return &conf.TransferProfiles[i]
+			}
+		}
+	}
+	return nil
+}
+
+// command returns the forced command for user. SFTP goes to sshd's own server, which needs
+// no binary or shell on the host, starting in Directory if there is one. scp gets the sink
+// end, so files can be uploaded into Directory and nothing else
+func (tp *transferProfile) command(user string) string {
+	r := strings.NewReplacer("%u", user, "%%", "%")
+	switch {
+	case tp.Command != "":
+		return r.Replace(tp.Command)
+	case tp.Mode == transferSCP:
+		return "scp -t -d " + r.Replace(tp.Directory)
+	case tp.Directory != "":
+		return "internal-sftp -d " + r.Replace(tp.Directory)
+	}
+	return "internal-sftp"
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"net"
+	"net/http"
 	"os"
 	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 func expandHome(path string) string {
@@ -16,8 +20,36 @@ func expandHome(path string) string {
 	return path
 }
 
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 func validIP(ip string) bool {
 	res := net.ParseIP(ip)
 
 	return res != nil
 }
+
+func normalizeUser(user string, conf *config) string {
+	// Apply unicode normalization first so case handling sees composed characters
+	switch conf.UserNormalize {
+	case "nfc":
+		user = norm.NFC.String(user)
+	case "nfkc":
+		user = norm.NFKC.String(user)
+	}
+
+	switch conf.UserCase {
+	case "lower":
+		user = strings.ToLower(user)
+	case "fold":
+		user = cases.Fold().String(user)
+	}
+
+	return user
+}
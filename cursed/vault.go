@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var validVaultMount = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// vaultSignRequest is the body of Vault's POST /v1/<mount>/sign/<role>. Only what has a
+// cursed equivalent is used, the rest is answered with a warning
+type vaultSignRequest struct {
+	PublicKey       string            `json:"public_key"`
+	ValidPrincipals string            `json:"valid_principals"`
+	CertType        string            `json:"cert_type"`
+	TTL             json.RawMessage   `json:"ttl"`
+	KeyID           string            `json:"key_id"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      map[string]string `json:"extensions"`
+}
+
+// vaultResponse is Vault's response envelope
+type vaultResponse struct {
+	RequestID     string            `json:"request_id"`
+	LeaseID       string            `json:"lease_id"`
+	Renewable     bool              `json:"renewable"`
+	LeaseDuration int               `json:"lease_duration"`
+	Data          map[string]string `json:"data"`
+	WrapInfo      interface{}       `json:"wrap_info"`
+	Warnings      []string          `json:"warnings"`
+	Auth          interface{}       `json:"auth"`
+}
+
+// vaultError answers the way Vault does, so its clients surface the message
+func vaultError(w http.ResponseWriter, msg string, status int) {
+	log.Printf("Request %s failed: %d %s", w.Header().Get(requestIDHeader), status, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []string `json:"errors"`
+	}{[]string{msg}})
+}
+
+// vaultSignHandler signs a user key for tooling written against Vault's SSH secrets engine.
+// Vault tokens mean nothing to us: like every other signing request, this one has to come
+// through the reverse proxy, which authenticates the caller and sets the user header
+func vaultSignHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		vaultError(w, "unsupported operation", http.StatusMethodNotAllowed)
+		return
+	}
+	release, ok := limitIP(w, r, conf)
+	if !ok {
+		return
+	}
+	defer release()
+	bastionUser, identity, ok := authenticate(w, r, conf)
+	if !ok {
+		return
+	}
+	releaseUser, ok := limitUser(w, r, conf, bastionUser)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	var vr vaultSignRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&vr)
+	if err != nil {
+		vaultError(w, "failed to parse JSON input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if vr.CertType != "" && vr.CertType != "user" {
+		vaultError(w, "only user certificates can be signed here, use /batch for host certificates", http.StatusBadRequest)
+		return
+	}
+
+	// Roles are usually named after the account they grant, so a request without
+	// valid_principals asks for the role's name like Vault's default_user would
+	role := strings.TrimPrefix(r.URL.Path, "/v1/"+conf.VaultMount+"/sign/")
+	principal := role
+	if vr.ValidPrincipals != "" {
+		principals := strings.Split(vr.ValidPrincipals, ",")
+		if len(principals) > 1 {
+			vaultError(w, "only one of valid_principals may be requested, cursed expands it to the principals the user is granted", http.StatusBadRequest)
+			return
+		}
+		principal = strings.TrimSpace(principals[0])
+	}
+
+	var warnings []string
+	if len(vr.TTL) > 0 && string(vr.TTL) != `""` {
+		warnings = append(warnings, fmt.Sprintf("ttl is ignored, certificates are valid for up to %d seconds", conf.Duration))
+	}
+	if vr.KeyID != "" {
+		warnings = append(warnings, "key_id is ignored, cursed sets its own")
+	}
+	if len(vr.Extensions) > 0 {
+		warnings = append(warnings, "extensions are ignored, cursed sets its own")
+	}
+	p := httpParams{
+		identity:    identity,
+		bastionUser: bastionUser,
+		key:         vr.PublicKey,
+		asn:         asnAsserted(r, conf),
+		mfa:         mfaAsserted(r, conf),
+		remoteUser:  principal,
+		tenant:      tenantAsserted(r, conf),
+		userIP:      clientIP(r, conf),
+	}
+	for name, value := range vr.CriticalOptions {
+		switch name {
+		case "force-command":
+			p.cmd = value
+		case "source-address":
+			p.bastionIP = value
+		default:
+			warnings = append(warnings, "critical option "+name+" is ignored")
+		}
+	}
+
+	res := signUserKey(r.Context(), conf, p)
+	if res.Error != "" {
+		if res.Reason != "" {
+			w.Header().Set(reasonHeader, res.Reason)
+		}
+		if res.Approval != "" {
+			w.Header().Set(approvalHeader, res.Approval)
+		}
+		// Vault clients take any 2xx as a signed key, including our 202 for a pending approval
+		status := res.status
+		if status < http.StatusBadRequest {
+			status = http.StatusForbidden
+		}
+		vaultError(w, res.Error, status)
+		return
+	}
+
+	cert, _, _, _, err := ssh.ParseAuthorizedKey([]byte(res.Certificate))
+	serial := ""
+	if c, ok := cert.(*ssh.Certificate); ok && err == nil {
+		serial = strconv.FormatUint(c.Serial, 16)
+	}
+	writeJSON(w, vaultResponse{
+		RequestID: w.Header().Get(requestIDHeader),
+		Data:      map[string]string{"serial_number": serial, "signed_key": res.Certificate},
+		Warnings:  warnings,
+	})
+}
+
+// vaultPublicKeyHandler serves the CA public key like Vault's GET /v1/<mount>/public_key
+func vaultPublicKeyHandler(w http.ResponseWriter, r *http.Request, conf *config) {
+	if r.Method != http.MethodGet {
+		vaultError(w, "unsupported operation", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(ssh.MarshalAuthorizedKey(conf.caSigner.PublicKey()))
+}
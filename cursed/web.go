@@ -1,125 +1,927 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// The form tags name the POST fields read by webHandler and are used to generate /openapi.json
 type httpParams struct {
-	bastionIP   string
-	bastionUser string
-	cmd         string
-	key         string
-	remoteUser  string
-	userIP      string
+	asn         string         `form:"-"`
+	bastionIP   string         `form:"bastionIP"`
+	bastionUser string         `form:"-"`
+	breakGlass  bool           `form:"breakGlass"`
+	cmd         string         `form:"cmd"`
+	delegation  string         `form:"delegation"`
+	deviceKey   string         `form:"deviceKey"`
+	deviceSig   string         `form:"deviceSig"`
+	deviceTime  string         `form:"deviceTime"`
+	enrollment  string         `form:"enrollment"`
+	identity    *forgeIdentity `form:"-"`
+	key         string         `form:"key"`
+	keyBlob     string         `form:"keyBlob"`
+	keySig      string         `form:"keySig"`
+	keyTime     string         `form:"keyTime"`
+	mfa         bool           `form:"-"`
+	remoteUser  string         `form:"remoteUser"`
+	tenant      string         `form:"-"`
+	userIP      string         `form:"userIP"`
+	validAfter  string         `form:"validAfter"`
 }
 
 func webHandler(w http.ResponseWriter, r *http.Request, conf *config) {
-	// Do basic auth with the reverse proxy to prevent side-stepping it
-	user, pass, ok := r.BasicAuth()
+	release, ok := limitIP(w, r, conf)
 	if !ok {
-		http.Error(w, "Authorization Failure", http.StatusUnauthorized)
 		return
 	}
-	if user != conf.ProxyUser || pass != conf.ProxyPass {
-		log.Printf("Invalid proxy credentials")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	defer release()
+	bastionUser, identity, ok := authenticate(w, r, conf)
+	if !ok {
 		return
 	}
+	releaseUser, ok := limitUser(w, r, conf, bastionUser)
+	if !ok {
+		return
+	}
+	defer releaseUser()
+
+	// Nothing in a signing request comes close, so don't let ParseForm buffer 10MB
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
 
 	// Load our form parameters into a struct
 	p := httpParams{
+		identity:    identity,
+		asn:         asnAsserted(r, conf),
 		bastionIP:   r.PostFormValue("bastionIP"),
-		bastionUser: r.Header.Get(conf.UserHeader),
+		bastionUser: bastionUser,
+		breakGlass:  r.PostFormValue("breakGlass") == "true",
 		cmd:         r.PostFormValue("cmd"),
+		delegation:  r.PostFormValue("delegation"),
+		deviceKey:   r.PostFormValue("deviceKey"),
+		deviceSig:   r.PostFormValue("deviceSig"),
+		deviceTime:  r.PostFormValue("deviceTime"),
+		enrollment:  r.PostFormValue("enrollment"),
 		key:         r.PostFormValue("key"),
+		keyBlob:     r.PostFormValue("keyBlob"),
+		keySig:      r.PostFormValue("keySig"),
+		keyTime:     r.PostFormValue("keyTime"),
+		mfa:         mfaAsserted(r, conf),
 		remoteUser:  r.PostFormValue("remoteUser"), // FIXME this should be re-evaluated as a daemon config option
+		tenant:      tenantAsserted(r, conf),
 		userIP:      r.PostFormValue("userIP"),
+		validAfter:  r.PostFormValue("validAfter"),
+	}
+
+	// A key sent as a bare blob is turned into an authorized_keys line here, so everything
+	// from idempotency to proof of possession sees the one form
+	key, err := submittedKey(p.key, p.keyBlob)
+	if err != nil {
+		deny(w, r, conf, reasonBadKey, bastionUser, "Param validation failure: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.key = key
+	ctx := withAudit(r.Context(), p)
+
+	// Retries carrying the same Idempotency-Key get the certificate issued the first time,
+	// rather than a new one with its own serial and audit trail
+	idemKey := r.Header.Get(idempotencyHeader)
+	if conf.IdempotencyTTL <= 0 {
+		idemKey = ""
 	}
+	if idemKey != "" {
+		if !validIdempotencyKey.MatchString(idemKey) {
+			w.Header().Set(reasonHeader, reasonBadRequest)
+			problemError(w, "Invalid "+idempotencyHeader, http.StatusBadRequest)
+			return
+		}
+		cert, found, err := lookupIdempotent(conf, bastionUser, idemKey, p)
+		if err == errIdempotencyMismatch {
+			w.Header().Set(reasonHeader, reasonBadRequest)
+			problemError(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+		}
+		if found {
+			err = checkReplay(conf, cert)
+			if err == nil {
+				logf(ctx, "Replaying certificate for %s %s", idempotencyHeader, idemKey)
+				w.Header().Set(replayedHeader, "true")
+				w.Write([]byte(cert))
+				return
+			}
+			// Sign afresh instead, under the policy as it stands now
+			logf(ctx, "Not replaying certificate for %s %s: %v", idempotencyHeader, idemKey, err)
+		}
+	}
+
+	res := signUserKey(ctx, conf, p)
+	conf.mirror.send(ctx, conf, p, res)
+	if res.Error != "" {
+		if res.Reason != "" {
+			w.Header().Set(reasonHeader, res.Reason)
+		}
+		if res.Approval != "" {
+			w.Header().Set(approvalHeader, res.Approval)
+		}
+		if res.Remediation != "" {
+			w.Header().Set(remediationHeader, res.Remediation)
+		}
+		if res.Reason == reasonCAUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(conf.CABreakerCooldown))
+		}
+		problemError(w, res.Error, res.status)
+		return
+	}
+	if idemKey != "" {
+		err := storeIdempotent(conf, bastionUser, idemKey, p, res.Certificate)
+		if err != nil {
+			logf(ctx, "Unable to store idempotency record: %v", err)
+		}
+	}
+
+	if len(res.Restricted) > 0 {
+		w.Header().Set(restrictedHeader, strings.Join(res.Restricted, ","))
+	}
+	w.Write([]byte(res.Certificate))
+}
 
-	// Set our certificate validity times
-	va := time.Now()
-	vb := time.Now().Add(conf.dur)
+type signResult struct {
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Certificate string   `json:"certificate,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	Approval    string   `json:"approval,omitempty"`
+	Action      string   `json:"action,omitempty"`
+	Remediation string   `json:"remediation,omitempty"`
+	Restricted  []string `json:"restricted,omitempty"`
+
+	status int
+}
+
+// lookupFailed is the result for a request we couldn't decide because a lookup failed. One
+// cut short because the client went away or ran out of time isn't a server error, and is
+// reported as such
+func lookupFailed(ctx context.Context, fp string, err error) signResult {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		logf(ctx, "Request abandoned: %v", err)
+		return signResult{Fingerprint: fp, Error: "Request timed out", Reason: reasonTimeout, status: http.StatusServiceUnavailable}
+	}
+	logf(ctx, "%v", err)
+	return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+}
+
+func signUserKey(ctx context.Context, conf *config, p httpParams) (res signResult) {
+	ctx = withAudit(ctx, p)
+
+	// Honeytoken principals trip the alarm whatever else is wrong with the request
+	if principal := matchHoneytoken(conf, p.remoteUser); principal != "" {
+		fp := ""
+		if pk, err := parseSubmittedKey(p.key); err == nil {
+			fp = ssh.FingerprintLegacyMD5(pk)
+		}
+		return honeytokenDenial(ctx, conf, p, fp, principal)
+	}
+
+	// Validity windows mean nothing if our own clock is off
+	err := clockDenial(conf)
+	if err != nil {
+		logDenial(ctx, conf, reasonClockSkew, p.bastionUser, "", err.Error())
+		return signResult{Error: err.Error(), Reason: reasonClockSkew, status: http.StatusServiceUnavailable}
+	}
+
+	// Set our certificate validity times. Certificates start now or, for a scheduled change,
+	// at the requested time within the tier's maxstartdelay
+	t := matchTier(conf, p.remoteUser)
+	auditFrom(ctx).notePolicy(tierName(t))
+	va, err := startTime(conf, t, p.validAfter)
+	if err != nil {
+		logDenial(ctx, conf, reasonOf(err), p.bastionUser, "", err.Error())
+		return signResult{Error: err.Error(), Reason: reasonOf(err), status: http.StatusBadRequest}
+	}
+	vb := va.Add(conf.dur)
+
+	// Sensitive principals may be held to a shorter maximum duration
+	if t != nil && t.MaxDuration > 0 && vb.After(va.Add(t.maxDuration())) {
+		vb = va.Add(t.maxDuration())
+	}
 
 	// Generate a fingerprint of the received public key for our key_id string
-	fp := ""
-	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.key))
+	pk, err := parseSubmittedKey(p.key)
 	if err != nil {
-		log.Printf("Unable to parse authorized key |%s|", p.key)
-		http.Error(w, "Unable to parse authorized key", http.StatusBadRequest)
-		return
+		logf(ctx, "Rejected key %.64q: %v", p.key, err)
+		logDenial(ctx, conf, reasonBadKey, p.bastionUser, "", err.Error())
+		return signResult{Error: err.Error(), Reason: reasonBadKey, status: http.StatusBadRequest}
 	}
-	fp = ssh.FingerprintLegacyMD5(pk)
+	fp := ssh.FingerprintLegacyMD5(pk)
 
 	// Generate our key_id for the certificate
-	//keyID := fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s] ca[%s] valid to[%s]",
-	keyID := fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s] valid to[%s]",
-		p.bastionUser, p.userIP, p.cmd, fp, vb.Format(time.RFC3339))
+	keyID := userKeyID(p, fp, vb)
+	auditFrom(ctx).note("", fp, keyID)
 
-	// Log the request
-	log.Printf("Request: |%s|", keyID)
+	// Log the request, or a sample of them (see logsampleusers)
+	rl := logRequest(conf, "user", "Request: |%s|", keyID)
+	defer func() { rl.finish(res.Error != "") }()
 
 	// Make sure we have everything we need from our parameters
-	err = validateHTTPParams(p, conf)
+	err = validateHTTPParams(p, conf, t)
 	if err != nil {
 		errMsg := fmt.Sprintf("Param validation failure: %v", err)
-		log.Printf(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
+		logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonOf(err), status: http.StatusBadRequest}
+	}
+
+	// Git servers get a certificate that can only run their git shell
+	gh := matchGitHost(conf, p.remoteUser)
+	if gh != nil {
+		if p.cmd != "" {
+			errMsg := fmt.Sprintf("Param validation failure: cmd can't be set for git host %s", gh.Name)
+			logDenial(ctx, conf, reasonCmdDenied, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonCmdDenied, status: http.StatusBadRequest}
+		}
+		p.cmd = gh.command(p.bastionUser)
+		keyID = userKeyID(p, fp, vb)
+	}
+
+	// Transfer profiles give accounts certificates that can only move files
+	var tp *transferProfile
+	if gh == nil {
+		tp = matchTransferProfile(conf, p.remoteUser)
+	}
+	if tp != nil {
+		if p.cmd != "" {
+			errMsg := fmt.Sprintf("Param validation failure: cmd can't be set for transfer profile %s", tp.Name)
+			logDenial(ctx, conf, reasonCmdDenied, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonCmdDenied, status: http.StatusBadRequest}
+		}
+		p.cmd = tp.command(p.bastionUser)
+		keyID = userKeyID(p, fp, vb)
+		logf(ctx, "Transfer profile %s applies, forcing %q", tp.Name, p.cmd)
+	}
+
+	// A signature by the key itself shows the requester holds its private half
+	err = verifyPossession(p, pk, conf)
+	if err != nil {
+		logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonOf(err), status: http.StatusForbidden}
+	}
+
+	// Refuse blocked keys, and with keyallowlist anything not explicitly allowed
+	err = checkKeyLists(conf, pk, conf.KeyAllowlist)
+	if _, denied := err.(*denial); denied {
+		logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonOf(err), status: http.StatusForbidden}
+	}
+	if err != nil {
+		logf(ctx, "%v", err)
+		return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+	}
+
+	// A delegation token from an admin grants its principals until it expires, in place of
+	// team mappings, principal expansion and tier approval
+	var dg *delegation
+	if p.delegation != "" {
+		dg, err = checkDelegation(conf, p.bastionUser, p.remoteUser, p.delegation)
+		if _, denied := err.(*denial); denied {
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		// The delegation only caps the certificate, which is as long as any other
+		if vb.After(dg.Expires) {
+			vb = dg.Expires
+		}
+		if !vb.After(va) {
+			errMsg := fmt.Sprintf("Delegation %s expires before the certificate would start", dg.ID)
+			logDenial(ctx, conf, reasonBadRequest, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonBadRequest, status: http.StatusBadRequest}
+		}
+		keyID = userKeyID(p, fp, vb) + " delegation[" + dg.ID + "]"
+		auditFrom(ctx).note("", "", keyID)
+		logf(ctx, "Request uses delegation %s from %s", dg.ID, dg.Issuer)
+	}
+
+	// An enrollment code from an admin registers a new user's first key, which then stands in
+	// for the key registry and their groups until the enrollment expires
+	var en *enrollment
+	if dg == nil {
+		en, err = checkEnrollment(conf, p.bastionUser, fp, p.enrollment)
+		if err == nil && en != nil && !en.allows(p.remoteUser) {
+			if p.enrollment != "" {
+				err = denyf(reasonPrincipalDenied, "Enrollment %s doesn't grant principal %s", en.ID, p.remoteUser)
+			}
+			en = nil
+		}
+		if _, denied := err.(*denial); denied {
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+	} else if p.enrollment != "" {
+		errMsg := "Param validation failure: delegation and enrollment can't be combined"
+		logDenial(ctx, conf, reasonBadRequest, p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonBadRequest, status: http.StatusBadRequest}
+	}
+	if en != nil {
+		if vb.After(en.Expires) {
+			vb = en.Expires
+		}
+		if !vb.After(va) {
+			errMsg := fmt.Sprintf("Enrollment %s expires before the certificate would start", en.ID)
+			logDenial(ctx, conf, reasonBadRequest, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonBadRequest, status: http.StatusBadRequest}
+		}
+		keyID = userKeyID(p, fp, vb) + " enrollment[" + en.ID + "]"
+		auditFrom(ctx).note("", "", keyID)
+		logf(ctx, "Request uses enrollment %s from %s", en.ID, en.Issuer)
+	}
+
+	// GitHub and GitLab users may only sign keys from their profile, for principals their
+	// teams are mapped to
+	if p.identity != nil && !p.identity.saml && en == nil && !p.identity.hasKey(pk) {
+		errMsg := fmt.Sprintf("Submitted key is not registered on your %s profile", conf.AuthMode)
+		logDenial(ctx, conf, reasonBadKey, p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonBadKey, status: http.StatusForbidden}
+	}
+	if p.identity != nil && dg == nil && en == nil && !p.identity.allows(p.remoteUser) {
+		errMsg := fmt.Sprintf("None of your teams grant principal %s", p.remoteUser)
+		if p.identity.saml {
+			errMsg = fmt.Sprintf("Your SAML assertion doesn't grant principal %s", p.remoteUser)
+		}
+		logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+	}
+
+	// Everyone else may only sign keys registered in LDAP or on GitHub, if so configured
+	if (p.identity == nil || p.identity.saml) && en == nil {
+		ok, err := registeredKey(ctx, conf, p.bastionUser, pk)
+		if err != nil {
+			return lookupFailed(ctx, fp, err)
+		}
+		if !ok {
+			errMsg := fmt.Sprintf("Submitted key is not registered for %s in %s", p.bastionUser, conf.KeyRegistry)
+			logDenial(ctx, conf, reasonBadKey, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonBadKey, status: http.StatusForbidden}
+		}
+	}
+
+	// Don't certify accounts that don't exist on the targets. Git hosts' accounts are local
+	// to the git server
+	if conf.AccountCheck != "" && gh == nil {
+		ok, err := accountExists(ctx, conf, p.remoteUser)
+		if err != nil {
+			return lookupFailed(ctx, fp, err)
+		}
+		if !ok {
+			errMsg := fmt.Sprintf("Account %s does not exist", p.remoteUser)
+			logDenial(ctx, conf, reasonUnknownAccount, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonUnknownAccount, status: http.StatusForbidden}
+		}
+	}
+
+	// Sites with their own identity systems may map the request to different principals, and
+	// git hosts map the user's groups to repo roles
+	principals := []string{p.remoteUser}
+	var groups []string
+	switch {
+	case gh != nil:
+		groups, err = userGroups(ctx, conf, p)
+		if err == nil {
+			principals = gh.principals(p.bastionUser, groups)
+		}
+		if err == nil && len(principals) == 0 {
+			err = denyf(reasonPrincipalDenied, "None of your groups grant a role on git host %s", gh.Name)
+		}
+	case dg == nil && en == nil:
+		principals, err = expandPrincipals(ctx, conf, p)
+	}
+	if _, denied := err.(*denial); denied {
+		logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+	}
+	if err != nil {
+		return lookupFailed(ctx, fp, err)
+	}
+	if principal := matchHoneytoken(conf, principals...); principal != "" {
+		return honeytokenDenial(ctx, conf, p, fp, principal)
+	}
+	err = checkInfra(ctx, conf, p.bastionUser, fp, false, p.breakGlass, principals...)
+	if err != nil {
+		logDenial(ctx, conf, reasonInfraPrincipal, p.bastionUser, fp, err.Error())
+		return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonInfraPrincipal, status: http.StatusForbidden}
+	}
+	if len(principals) != 1 || principals[0] != p.remoteUser {
+		logf(ctx, "Principals expanded to %v", principals)
+
+		// The expanded principals may belong to a stricter tier than the requested one
+		t = matchTier(conf, principals...)
+		auditFrom(ctx).notePolicy(tierName(t))
+		_, err = startTime(conf, t, p.validAfter)
+		if err != nil {
+			logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonOf(err), status: http.StatusBadRequest}
+		}
+		if t != nil && t.MaxDuration > 0 && vb.After(va.Add(t.maxDuration())) {
+			vb = va.Add(t.maxDuration())
+			keyID = userKeyID(p, fp, vb)
+		}
+		err = checkSourceIPs(p, conf, t)
+		if err != nil {
+			logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonOf(err), status: http.StatusBadRequest}
+		}
+	}
+
+	// Check the device assertion, if any, against our enrolled devices
+	deviceID, err := verifyDevice(p, conf, en)
+	if err != nil {
+		errMsg := fmt.Sprintf("Device verification failure: %v", err)
+		logDenial(ctx, conf, reasonOf(err), p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonOf(err), status: http.StatusForbidden}
+	}
+	extensions := conf.exts
+	if gh != nil || tp != nil {
+		extensions = map[string]string{}
+	}
+	if deviceID != "" {
+		logf(ctx, "Request from device %s", deviceID)
+		extensions = withExtension(extensions, deviceExtension, deviceID)
+	}
+
+	// Record group memberships for target host tooling. Enrolled users aren't in them yet
+	if conf.GroupExtension != "" && en == nil {
+		if gh == nil {
+			groups, err = userGroups(ctx, conf, p)
+		}
+		if err != nil {
+			return lookupFailed(ctx, fp, err)
+		}
+		if len(groups) > 0 {
+			extensions = withExtension(extensions, groupsExtension, strings.Join(groups, ","))
+		}
 	}
 
 	// Check if we've seen this pubkey before and if it's too old
 	expired, err := checkPubKeyAge(conf, fp)
 	if expired {
-		http.Error(w, "Submitted pubkey is too old. Please generate new key.", http.StatusUnprocessableEntity)
-		return
+		errMsg := "Submitted pubkey is too old. Please generate new key."
+		if conf.KeyAgeRemediationURL != "" {
+			errMsg += " See " + conf.KeyAgeRemediationURL
+		}
+		logDenial(ctx, conf, reasonKeyTooOld, p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonKeyTooOld, Action: reasonActions[reasonKeyTooOld],
+			Remediation: conf.KeyAgeRemediationURL, status: http.StatusUnprocessableEntity}
+	}
+
+	// Alert when a user shows up with a key we haven't seen from them recently, which may mean
+	// someone else has their credentials
+	keyChanged, prevFP, err := checkKeyContinuity(conf, p.bastionUser, fp)
+	if err != nil {
+		logf(ctx, "Unable to check key continuity: %v", err)
+	}
+	if keyChanged {
+		keyChanges.Add(1)
+		logf(ctx, "Key change: previous sshKey[%s]", prevFP)
+		conf.webhooks.send(auditFrom(ctx).event(auditEvent{
+			Event:   "key_changed",
+			Message: "previous key " + prevFP,
+		}))
+	}
+
+	// An external scorer may find the request unusual enough to need more than usual
+	riskApproval := false
+	var score *riskScore
+	if conf.riskScorer != nil {
+		rs, err := scoreRequest(ctx, conf, p, principals, fp, deviceID, keyChanged)
+		if err != nil && !conf.RiskFailOpen {
+			return lookupFailed(ctx, fp, err)
+		}
+		if err != nil {
+			logf(ctx, "Going ahead without a risk score, riskfailopen is set: %v", err)
+		} else {
+			logf(ctx, "Risk score %g (%s)", rs.Score, rs.Reason)
+			score = &rs
+		}
+		if err == nil && conf.RiskDenyScore > 0 && rs.Score >= conf.RiskDenyScore {
+			logDenial(ctx, conf, reasonRisk, p.bastionUser, fp, fmt.Sprintf("Risk score %g: %s", rs.Score, rs.Reason))
+			return signResult{Fingerprint: fp, Error: "Request denied by risk policy", Reason: reasonRisk, status: http.StatusForbidden}
+		}
+		if err == nil && conf.RiskMFAScore > 0 && rs.Score >= conf.RiskMFAScore && !p.mfa {
+			errMsg := "This request requires multi-factor authentication"
+			logDenial(ctx, conf, reasonNoMFA, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonNoMFA, status: http.StatusForbidden}
+		}
+		riskApproval = err == nil && conf.RiskApprovalScore > 0 && rs.Score >= conf.RiskApprovalScore
+	}
+
+	// Signals that don't warrant a denial may still take away what the certificate can do
+	var restricted []string
+	if len(conf.RiskRestrictions) > 0 {
+		signals, err := riskSignalsFor(conf, p, deviceID, keyChanged, score)
+		if err != nil {
+			return lookupFailed(ctx, fp, err)
+		}
+		extensions, restricted = restrictExtensions(conf, extensions, signals)
+		if len(restricted) > 0 {
+			logf(ctx, "Extensions restricted for %s", strings.Join(restricted, ", "))
+			keyID += " restricted[" + strings.Join(restricted, ",") + "]"
+		}
+	}
+
+	// Apply the stricter requirements of the principal's tier
+	if t != nil && t.RequireMFA && !p.mfa {
+		errMsg := fmt.Sprintf("Tier %s requires multi-factor authentication", t.Name)
+		logDenial(ctx, conf, reasonNoMFA, p.bastionUser, fp, errMsg)
+		return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonNoMFA, status: http.StatusForbidden}
+	}
+
+	// One approval covers every reason the request needs one
+	var approvalFor []string
+	if t != nil && t.RequireApproval && dg == nil {
+		approvalFor = append(approvalFor, "tier "+t.Name)
+	}
+	if keyChanged && conf.KeyChangeApproval {
+		approvalFor = append(approvalFor, "a new key")
+	}
+	if riskApproval {
+		approvalFor = append(approvalFor, "an unusual request")
+	}
+	approvalID := ""
+	if len(approvalFor) > 0 {
+		why := strings.Join(approvalFor, " and ")
+		ap, err := checkApproval(conf, p.bastionUser, fp, p.remoteUser, why)
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		switch ap.Status {
+		case approvalPending:
+			errMsg := fmt.Sprintf("Approval is required for %s. Request %s is pending, run again once it has been approved", why, ap.ID)
+			logf(ctx, "Approval pending: %s", errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonApprovalRequired, Approval: ap.ID, status: http.StatusAccepted}
+		case approvalRejected:
+			errMsg := fmt.Sprintf("Request %s was rejected by %s", ap.ID, ap.Approver)
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, errMsg)
+			return signResult{Fingerprint: fp, Error: errMsg, Reason: reasonPrincipalDenied, Approval: ap.ID, status: http.StatusForbidden}
+		}
+		approvalID = ap.ID
+	}
+
+	// Give the certificate its own session ID, which sshd also logs as part of the key ID, so
+	// recordings can be traced back to the issued event
+	sessionID := ""
+	if conf.SessionExtension {
+		sessionID, err = newSessionID()
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		extensions = withExtension(extensions, sessionExtension, sessionID)
+		keyID += " session[" + sessionID + "]"
+	}
+
+	// On shared accounts, a principal of its own lets hosts authorize and log each
+	// certificate separately. Hosts learn which accounts it opens from /principals
+	if conf.SessionPrincipals {
+		sp, err := newSessionPrincipal(conf, p.bastionUser, principals, sessionID, vb)
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		logf(ctx, "Session principal %s grants %v", sp, principals)
+		principals = []string{sp}
+		keyID += " principal[" + sp + "]"
 	}
 
 	// Set all of our certificate options
+	auditFrom(ctx).note("", "", keyID)
+	extensions = withMetadata(ctx, conf, extensions)
 	cc := certConfig{
 		certType:    ssh.UserCert,
 		command:     p.cmd,
-		extensions:  conf.exts,
+		extensions:  extensions,
 		keyID:       keyID,
-		principals:  []string{p.remoteUser},
-		srcAddr:     p.bastionIP,
-		validAfter:  va,
+		principals:  principals,
+		srcAddr:     sourceAddress(p, conf, t),
+		validAfter:  va.Add(-backdate(conf, t)),
 		validBefore: vb,
 	}
+	if va.After(conf.clock.Now()) {
+		logf(ctx, "Scheduled certificate starting %s", va.Format(time.RFC3339))
+	}
 
-	// Sign the public key
-	authorizedKey, err := signPubKey(conf.caSigner, []byte(p.key), cc)
+	// Sign the public key, unless another instance has taken over our storage
+	cc.serial, err = conf.lease.serial()
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		logf(ctx, "Not signing: %v", err)
+		return signResult{Fingerprint: fp, Error: "CA backend is unavailable, try again shortly", Reason: reasonCAUnavailable, status: http.StatusServiceUnavailable}
+	}
+	authorizedKey, err := signPubKey(ctx, conf.caSigner, pk, cc)
+	if err == errCAUnavailable {
+		return signResult{Fingerprint: fp, Error: "CA backend is unavailable, try again shortly", Reason: reasonCAUnavailable, status: http.StatusServiceUnavailable}
+	}
+	if err != nil {
+		return lookupFailed(ctx, fp, err)
+	}
+
+	// Only a signed certificate uses up its approval, and a race for it gets just the one
+	if approvalID != "" {
+		err = consumeApproval(conf, approvalID)
+		if _, denied := err.(*denial); denied {
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+	}
+
+	// Likewise the delegation's one certificate, so a signing failure doesn't waste it
+	delegationID := ""
+	if dg != nil {
+		err = consumeDelegation(conf, dg.ID)
+		if _, denied := err.(*denial); denied {
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		delegationID = dg.ID
+	}
+
+	// And the enrollment's code, which only the first signed key may redeem
+	if en != nil && en.Redeemed == nil {
+		en, err = redeemEnrollment(conf, en, fp, p.deviceKey)
+		if _, denied := err.(*denial); denied {
+			logDenial(ctx, conf, reasonPrincipalDenied, p.bastionUser, fp, err.Error())
+			return signResult{Fingerprint: fp, Error: err.Error(), Reason: reasonPrincipalDenied, status: http.StatusForbidden}
+		}
+		if err != nil {
+			logf(ctx, "%v", err)
+			return signResult{Fingerprint: fp, Error: "Server error", status: http.StatusInternalServerError}
+		}
+		logf(ctx, "Enrollment %s redeemed", en.ID)
+		conf.webhooks.send(auditFrom(ctx).event(auditEvent{
+			Event:   "enrollment_redeemed",
+			Message: "enrollment " + en.ID,
+		}))
+	}
+
+	// Remember the certificate in case it has to be revoked
+	err = recordIssued(conf, p.bastionUser, pk, cc)
+	if err != nil {
+		logf(ctx, "Unable to record certificate: %v", err)
+	}
+
+	// Track the user's latest key and certificate for expiry reminders
+	err = recordExpiry(conf, p.bastionUser, fp, vb)
+	if err != nil {
+		logf(ctx, "Unable to record expiry: %v", err)
+	}
+	err = recordKeySeen(conf, p.bastionUser, fp, sourceNetwork(p.userIP), deviceID)
+	if err != nil {
+		logf(ctx, "Unable to record key history: %v", err)
+	}
+
+	countRequest(conf, auditFrom(ctx), "issued")
+	ev := auditFrom(ctx).event(auditEvent{
+		Event:       "issued",
+		KeyID:       keyID,
+		Principals:  cc.principals,
+		ValidBefore: &vb,
+		Delegation:  delegationID,
+		Session:     sessionID,
+		Restricted:  restricted,
+	})
+	conf.decisions.record(ev)
+	err = conf.webhooks.send(ev)
+	if err != nil && conf.AuditStrict {
+		logf(ctx, "Refusing to issue certificate, audit event not persisted: %v", err)
+		return signResult{Fingerprint: fp, Error: "Audit log unavailable", status: http.StatusServiceUnavailable}
+	}
+
+	return signResult{Fingerprint: fp, Certificate: string(authorizedKey), Restricted: restricted}
+}
+
+// authenticate returns the bastion user for a request, either as asserted by the reverse proxy
+// or checked against the local users file when running standalone
+func authenticate(w http.ResponseWriter, r *http.Request, conf *config) (string, *forgeIdentity, bool) {
+	switch conf.AuthMode {
+	case "github", "gitlab":
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		id, err := forgeAuth(r.Context(), strings.TrimPrefix(auth, "Bearer "), conf)
+		if err != nil {
+			logf(r.Context(), "Failed %s login from %s: %v", conf.AuthMode, r.RemoteAddr, err)
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		return normalizeUser(id.login, conf), id, true
+	case "local":
+		user, pass, ok := r.BasicAuth()
+		user = normalizeUser(user, conf)
+		if !ok {
+			deny(w, r, conf, reasonAuthFailed, user, "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		err := checkLocalAuth(user, pass, r.Header.Get(otpHeader), clientIP(r, conf), conf)
+		if err != nil {
+			logf(r.Context(), "Failed local login for %q from %s", user, r.RemoteAddr)
+			deny(w, r, conf, reasonOf(err), user, "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		return user, nil, true
+	case "saml":
+		id, err := samlAuth(r, conf, samlAssertionHeader)
+		if err != nil {
+			logf(r.Context(), "Failed SAML login from %s: %v", r.RemoteAddr, err)
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		id.login = normalizeUser(id.login, conf)
+		return id.login, id, true
 	}
 
-	w.Write(authorizedKey)
+	if !checkProxyAuth(w, r, conf) {
+		return "", nil, false
+	}
+
+	// The SSO proxy forwards the assertion, which names the user in place of userheader
+	if conf.SAMLHeader != "" {
+		id, err := samlAuth(r, conf, conf.SAMLHeader)
+		if err != nil {
+			logf(r.Context(), "Unusable SAML assertion from %s: %v", r.RemoteAddr, err)
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+		id.login = normalizeUser(id.login, conf)
+		return id.login, id, true
+	}
+
+	user, ok := proxyUser(w, r, conf)
+	return user, nil, ok
+}
+
+func checkProxyAuth(w http.ResponseWriter, r *http.Request, conf *config) bool {
+	// Do basic auth with the reverse proxy to prevent side-stepping it
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		deny(w, r, conf, reasonAuthFailed, "", "Authorization Failure", http.StatusUnauthorized)
+		return false
+	}
+	if user != conf.ProxyUser || pass != conf.ProxyPass {
+		logf(r.Context(), "Invalid proxy credentials")
+		deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if conf.ProxyHMACKey != "" {
+		err := verifyProxyHMAC(r, conf)
+		if err != nil {
+			logf(r.Context(), "Proxy request signature check failed: %v", err)
+			deny(w, r, conf, reasonAuthFailed, "", "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateSourceAddresses checks a sourceaddressmode and the sourceaddresses it may need
+func validateSourceAddresses(mode string, cidrs []string) error {
+	switch mode {
+	case "bastion", "both", "user", "none":
+	case "cidr":
+		if len(cidrs) == 0 {
+			return fmt.Errorf("sourceaddresses is required with sourceaddressmode: cidr")
+		}
+		for _, cidr := range cidrs {
+			_, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("Invalid sourceaddresses entry %q: %v", cidr, err)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid sourceaddressmode %q (valid: bastion, both, user, cidr, none)", mode)
+	}
+	return nil
+}
+
+// sourceAddress returns the source-address critical option for the certificate according to
+// the sourceaddressmode of its tier, or an empty string to omit the option
+func sourceAddress(p httpParams, conf *config, t *tier) string {
+	mode, cidrs := sourceAddressMode(conf, t)
+	switch mode {
+	case "user":
+		return p.userIP
+	case "both":
+		// The user's own address only helps where hosts can see it, so skip loopback,
+		// link-local and the like
+		if ip := net.ParseIP(p.userIP); ip != nil && ip.IsGlobalUnicast() && p.userIP != p.bastionIP {
+			return p.bastionIP + "," + p.userIP
+		}
+	case "cidr":
+		return strings.Join(cidrs, ",")
+	case "none":
+		return ""
+	}
+
+	return p.bastionIP
 }
 
-func validateHTTPParams(p httpParams, conf *config) error {
-	if conf.ForceCmd && p.cmd == "" {
+// Characters that let a forced command do more than run the one program it names
+const shellMetaChars = ";&|`$<>(){}[]*?~!#\\\"'\n\r"
+
+func validateCmd(cmd string, conf *config) error {
+	if !conf.CmdAllowMeta && strings.ContainsAny(cmd, shellMetaChars) {
+		return denyf(reasonCmdDenied, "cmd contains shell metacharacters")
+	}
+
+	// With no allowlist or regexes configured any metacharacter-free command is accepted
+	if len(conf.CmdAllowlist) == 0 && len(conf.cmdRegexes) == 0 {
+		return nil
+	}
+	for _, allowed := range conf.CmdAllowlist {
+		if cmd == allowed {
+			return nil
+		}
+	}
+	for _, re := range conf.cmdRegexes {
+		if re.MatchString(cmd) {
+			return nil
+		}
+	}
+
+	return denyf(reasonCmdDenied, "cmd is not allowed")
+}
+
+func userKeyID(p httpParams, fp string, vb time.Time) string {
+	//return fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s] ca[%s] valid to[%s]",
+	return fmt.Sprintf("user[%s] from[%s] command[%s] sshKey[%s] valid to[%s]",
+		p.bastionUser, p.userIP, p.cmd, fp, vb.Format(time.RFC3339))
+}
+
+// checkSourceIPs makes sure the request has the addresses certificates under t are pinned to
+func checkSourceIPs(p httpParams, conf *config, t *tier) error {
+	mode, _ := sourceAddressMode(conf, t)
+	// bastionIP is only mandatory when it's what we pin the certificate to
+	if (mode == "bastion" || mode == "both" || p.bastionIP != "") && !validIP(p.bastionIP) {
+		return denyf(reasonBadIP, "bastionIP is invalid")
+	}
+	if mode == "user" && !validIP(p.userIP) {
+		return denyf(reasonBadIP, "userIP is required for source address pinning")
+	}
+	return nil
+}
+
+func validateHTTPParams(p httpParams, conf *config, t *tier) error {
+	if conf.ForceCmd && p.cmd == "" && matchGitHost(conf, p.remoteUser) == nil && matchTransferProfile(conf, p.remoteUser) == nil {
 		err := fmt.Errorf("cmd missing from request")
 		return err
 	}
-	if p.bastionIP == "" || !validIP(p.bastionIP) {
-		err := fmt.Errorf("bastionIP is invalid")
+	if p.cmd != "" {
+		err := validateCmd(p.cmd, conf)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkSourceIPs(p, conf, t)
+	if err != nil {
 		return err
 	}
 	if p.bastionUser == "" {
-		err := fmt.Errorf("%s missing from request", conf.UserHeader)
+		err := denyf(reasonBadUser, "%s missing from request", describeIdentitySources(conf))
+		return err
+	} else if conf.UserMaxLength > 0 && utf8.RuneCountInString(p.bastionUser) > conf.UserMaxLength {
+		err := denyf(reasonBadUser, "username is too long")
 		return err
-	} else if len(p.bastionUser) > 32 || !conf.userRegex.MatchString(p.bastionUser) {
-		err := fmt.Errorf("username is invalid")
+	} else if !conf.userRegex.MatchString(p.bastionUser) {
+		err := denyf(reasonBadUser, "username is invalid")
 		return err
 	}
 	if p.key == "" {
-		err := fmt.Errorf("key missing from request")
+		err := denyf(reasonBadKey, "key missing from request")
 		return err
 	}
 	if p.remoteUser == "" {
@@ -127,8 +929,7 @@ func validateHTTPParams(p httpParams, conf *config) error {
 		return err
 	}
 	if conf.RequireClientIP && !validIP(p.userIP) {
-		err := fmt.Errorf("invalid userIP")
-		log.Printf("invalid userIP: |%s|", p.userIP) // FIXME This should be re-evaluated in the logging refactor
+		err := denyf(reasonBadIP, "invalid userIP")
 		return err
 	}
 
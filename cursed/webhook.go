@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// auditEvent is the record sent to webhooks for every issuance and denial
+type auditEvent struct {
+	Event       string     `json:"event"`
+	Time        time.Time  `json:"time"`
+	User        string     `json:"user,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	KeyID       string     `json:"keyId,omitempty"`
+	Principals  []string   `json:"principals,omitempty"`
+	ValidBefore *time.Time `json:"validBefore,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	Approval    string     `json:"approval,omitempty"`
+	Delegation  string     `json:"delegation,omitempty"`
+	Session     string     `json:"session,omitempty"`
+	Restricted  []string   `json:"restricted,omitempty"`
+	Request     string     `json:"request,omitempty"`
+}
+
+type webhookSender struct {
+	client   *http.Client
+	db       *bolt.DB
+	gcm      cipher.AEAD
+	queue    chan []byte
+	retries  int
+	secret   []byte
+	spoolMax int
+	urls     []string
+	wake     chan struct{}
+}
+
+func startWebhooks(conf *config) (*webhookSender, error) {
+	if len(conf.WebhookURLs) == 0 {
+		if conf.AuditStrict {
+			return nil, fmt.Errorf("auditstrict requires webhookurls and auditspoolkeyfile")
+		}
+		return nil, nil
+	}
+
+	ws := &webhookSender{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		db:       conf.db,
+		queue:    make(chan []byte, 1000),
+		retries:  conf.WebhookRetries,
+		secret:   []byte(conf.WebhookSecret),
+		spoolMax: conf.AuditSpoolMax,
+		urls:     conf.WebhookURLs,
+		wake:     make(chan struct{}, 1),
+	}
+
+	// With a spool key, every event is written to the encrypted on-disk spool before being
+	// delivered, so events survive webhook outages and restarts
+	if conf.AuditSpoolKeyFile != "" {
+		var err error
+		ws.gcm, err = loadSpoolKey(conf.AuditSpoolKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go ws.runSpool()
+	} else if conf.AuditStrict {
+		return nil, fmt.Errorf("auditstrict requires webhookurls and auditspoolkeyfile")
+	} else {
+		go ws.run()
+	}
+
+	return ws, nil
+}
+
+// send queues an event for delivery without waiting on the webhooks. It is a no-op when no
+// webhooks are configured, and returns an error if the event could not be queued or spooled.
+func (ws *webhookSender) send(ev auditEvent) error {
+	if ws == nil {
+		return nil
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Unable to encode webhook event: %v", err)
+		return err
+	}
+
+	if ws.gcm != nil {
+		err = ws.spool(body)
+		if err != nil {
+			log.Printf("Unable to spool %s event for %s: %v", ev.Event, ev.User, err)
+			return err
+		}
+		select {
+		case ws.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	select {
+	case ws.queue <- body:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for %s", ev.Event, ev.User)
+		return fmt.Errorf("Webhook queue full")
+	}
+
+	return nil
+}
+
+func (ws *webhookSender) run() {
+	for body := range ws.queue {
+		for _, url := range ws.urls {
+			ws.deliver(url, body)
+		}
+	}
+}
+
+func (ws *webhookSender) deliver(url string, body []byte) {
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		err := ws.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= ws.retries {
+			log.Printf("Webhook delivery to %s failed, giving up: %v", url, err)
+			return
+		}
+		log.Printf("Webhook delivery to %s failed, retrying in %v: %v", url, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (ws *webhookSender) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// Sign the timestamp and body the same way we expect the proxy to sign requests to us
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hmacTimestampHeader, ts)
+	if len(ws.secret) > 0 {
+		mac := hmac.New(sha256.New, ws.secret)
+		fmt.Fprintf(mac, "%s\n", ts)
+		mac.Write(body)
+		req.Header.Set(hmacSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func addToAgent(conf *config, certBytes []byte) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse signed certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Server response is not a certificate")
+	}
+
+	keyBytes, err := ioutil.ReadFile(conf.privKeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read private key file: %v", err)
+	}
+	privKey, err := ssh.ParseRawPrivateKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse private key (passphrase protected keys are not supported): %v", err)
+	}
+
+	conn, err := dialAgent(conf.AgentSocket)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	// Have the agent drop the key when the certificate expires
+	lifetime := int64(cert.ValidBefore) - time.Now().Unix()
+	if lifetime <= 0 {
+		return fmt.Errorf("Certificate already expired")
+	}
+	err = agent.NewClient(conn).Add(agent.AddedKey{
+		PrivateKey:   privKey,
+		Certificate:  cert,
+		Comment:      cert.KeyId,
+		LifetimeSecs: uint32(lifetime),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to add certificate to ssh-agent: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+
+	// Fall back to the launchd-managed, keychain-backed agent when the shell didn't inherit it
+	if socket == "" {
+		out, err := exec.Command("launchctl", "getenv", "SSH_AUTH_SOCK").Output()
+		if err == nil {
+			socket = strings.TrimSpace(string(out))
+		}
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK not set and no launchd agent found")
+	}
+
+	return net.Dial("unix", socket)
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK not set")
+	}
+
+	return net.Dial("unix", socket)
+}
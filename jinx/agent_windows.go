@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Windows OpenSSH's agent listens on a fixed named pipe. Pageant users should set
+// agentsocket to the pipe path from `pageant --openssh-config`.
+const windowsAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		socket = windowsAgentPipe
+	}
+
+	// Named pipes can be opened like regular files on Windows
+	return os.OpenFile(socket, os.O_RDWR, 0)
+}
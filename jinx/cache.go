@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// cachedCert returns the certificate already in certFile if it was issued for pubKey and our
+// principal, and stays valid for at least certminvalidity seconds, so opening another terminal
+// doesn't need a round trip to the server
+func cachedCert(conf *config, pubKey []byte) ([]byte, bool) {
+	certBytes, err := ioutil.ReadFile(conf.certFile)
+	if err != nil {
+		return nil, false
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, false
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, false
+	}
+
+	// A certificate tied to a recorded session is only good for that session
+	if _, ok := cert.Extensions["session-id@curse"]; ok {
+		return nil, false
+	}
+
+	// The key may have been regenerated since the certificate was issued
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil || string(cert.Key.Marshal()) != string(pk.Marshal()) {
+		return nil, false
+	}
+
+	principal := false
+	for _, p := range cert.ValidPrincipals {
+		if p == conf.SSHUser {
+			principal = true
+		}
+	}
+	if !principal {
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.Before(time.Unix(int64(cert.ValidAfter), 0)) {
+		return nil, false
+	}
+	if now.Add(time.Duration(conf.CertMinValidity) * time.Second).After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, false
+	}
+
+	return certBytes, true
+}
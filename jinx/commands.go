@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"github.com/spf13/viper"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "jinx",
+	Short: "Request a signed SSH certificate from a CURSE server",
+	Long: `jinx sends your SSH public key to a CURSE server and saves the signed,
+short-lived certificate next to it. Run without a subcommand to request a
+certificate.`,
+	Args:          cobra.NoArgs,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		conf.force, _ = cmd.Flags().GetBool("force")
+		conf.delegation, _ = cmd.Flags().GetString("delegation")
+		conf.enrollment, _ = cmd.Flags().GetString("enroll")
+		conf.breakGlass, _ = cmd.Flags().GetBool("break-glass")
+		conf.samlFile, _ = cmd.Flags().GetString("saml-assertion")
+		// A delegated or enrolled certificate carries different principals than the one we have
+		if conf.delegation != "" || conf.enrollment != "" || conf.breakGlass {
+			conf.force = true
+		}
+		if start, _ := cmd.Flags().GetString("start"); start != "" {
+			conf.start, err = time.Parse(time.RFC3339, start)
+			if err != nil {
+				return fmt.Errorf("Invalid --start %q, expected an RFC 3339 time like 2026-10-14T22:00:00Z", start)
+			}
+		}
+		return sign(conf)
+	},
+}
+
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Log in with the OAuth 2.0 device code flow and cache the token",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return login(conf)
+	},
+}
+
+var knownHostsCmd = &cobra.Command{
+	Use:   "known-hosts",
+	Short: "Fetch a known_hosts file trusting host certificates signed by the CA",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		creds, err := getCredentials(conf)
+		if err != nil {
+			return err
+		}
+		return knownHosts(conf, creds)
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [CERT]",
+	Short: "Check a certificate with the server: signature, validity and revocation",
+	Long: `verify sends a certificate (by default the one jinx saved next to your
+key) to the server, prints its contents and exits non-zero unless it was signed
+by the server's CA, is currently valid and its key hasn't been revoked.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		creds, err := getCredentials(conf)
+		if err != nil {
+			return err
+		}
+		certFile := ""
+		if len(args) > 0 {
+			certFile = args[0]
+		}
+		return verify(conf, creds, certFile)
+	},
+}
+
+var proxyJumpCmd = &cobra.Command{
+	Use:   "proxyjump",
+	Short: "Get certificates for both the jump host and the target, and write an ssh_config for ProxyJump",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return proxyJump(conf)
+	},
+}
+
+var setupCmd = &cobra.Command{
+	Use:   "setup URL",
+	Short: "Configure jinx from the server's signed client configuration",
+	Long: `setup fetches the jinx.yaml the server at URL publishes, checks it was
+signed by the CA key with the fingerprint given in --ca-fingerprint, and writes
+it to --file. Get the fingerprint from your onboarding instructions, not from
+the server.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		fp, _ := cmd.Flags().GetString("ca-fingerprint")
+		file, _ := cmd.Flags().GetString("file")
+		force, _ := cmd.Flags().GetBool("force")
+		return setup(conf, args[0], fp, expandHome(file), force)
+	},
+}
+
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Show the servers and bastion jinx would use from here",
+	Long: `discover runs the discovery set up with discoveryurl or discoverdomain
+and prints the servers, bastion IP and jump host jinx ends up with, whether
+they came from the network or from jinx.yaml.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := getConf()
+		if err != nil {
+			return err
+		}
+		return printDiscovery(conf)
+	},
+}
+
+var pamCmd = &cobra.Command{
+	Use:   "pam",
+	Short: "Request a certificate at login, run by pam_exec on a bastion",
+	Long: `pam is run by pam_exec as root when a user logs in to a bastion, and gets
+a certificate for them (PAM_USER) using the settings in /etc/jinx/jinx.yaml. In
+the auth stack with expose_authtok, the login password is sent to the server.
+In the session stack, the token from the user's jinx login is used and the
+certificate is also loaded into their ssh-agent if addtoagent is set.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pamLogin()
+	},
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Get a certificate and start the user's shell, run by sshd as a ForceCommand on a bastion",
+	Long: `shell is run by sshd as the ForceCommand for users logging in to a bastion.
+For interactive logins it gets a certificate for the user's key with the token
+from their jinx login, unless the current one is still valid, then starts their
+login shell. Commands passed to ssh are run without requesting a certificate.
+The login goes ahead whether or not a certificate could be had.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prompt, _ := cmd.Flags().GetBool("prompt")
+		return forceCommand(prompt)
+	},
+}
+
+var manCmd = &cobra.Command{
+	Use:    "man DIR",
+	Short:  "Generate man pages into DIR",
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := os.MkdirAll(args[0], 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create man page directory: %v", err)
+		}
+		header := &doc.GenManHeader{Title: "JINX", Section: "1"}
+		return doc.GenManTree(rootCmd, header, args[0])
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringP("output", "o", "text", "output format: text or json")
+	viper.BindPFlag("output", rootCmd.PersistentFlags().Lookup("output"))
+	rootCmd.PersistentFlags().Bool("json", false, "same as --output json")
+	cobra.OnInitialize(func() {
+		if asJSON, _ := rootCmd.PersistentFlags().GetBool("json"); asJSON {
+			viper.Set("output", "json")
+		}
+	})
+	rootCmd.Flags().BoolP("force", "f", false, "request a new certificate even if the current one is still valid")
+	rootCmd.Flags().String("delegation", "", "delegation token from an admin granting extra principals")
+	rootCmd.Flags().String("enroll", "", "one-time enrollment code from an admin, registering your key as a new user")
+	rootCmd.Flags().Bool("break-glass", false, "request a principal of the CA infrastructure itself, alerting security")
+	rootCmd.Flags().String("saml-assertion", "", "file (or - for stdin) holding a SAML assertion from your IdP, for servers using SAML")
+	rootCmd.Flags().String("start", "", "request a certificate that becomes valid at this time (RFC 3339), for a scheduled change")
+	rootCmd.Flags().String("sshuser", "", "principal to request (default sshuser from jinx.yaml)")
+	viper.BindPFlag("sshuser", rootCmd.Flags().Lookup("sshuser"))
+
+	setupCmd.Flags().String("ca-fingerprint", "", "SHA256 fingerprint of the CA key the configuration must be signed by")
+	setupCmd.MarkFlagRequired("ca-fingerprint")
+	setupCmd.Flags().String("file", "$HOME/.jinx/jinx.yaml", "where to write the configuration")
+	setupCmd.Flags().Bool("force", false, "replace an existing configuration file")
+
+	shellCmd.Flags().Bool("prompt", false, "ask for a username and password when there's no login token")
+
+	rootCmd.AddCommand(loginCmd, discoverCmd, knownHostsCmd, pamCmd, proxyJumpCmd, setupCmd, shellCmd, verifyCmd, manCmd)
+}
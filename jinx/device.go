@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Must match devicePayload in cursed/device.go
+func devicePayload(ts, key string) []byte {
+	return []byte("curse-device-v1\n" + ts + "\n" + strings.TrimSpace(key))
+}
+
+func addDeviceAssertion(conf *config, form url.Values, pubKey string) error {
+	keyBytes, err := ioutil.ReadFile(conf.DeviceKey)
+	if err != nil {
+		return fmt.Errorf("Failed to read device key: %v", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// A private key file is used directly. A public key means the private half lives in an
+	// ssh-agent, such as one backed by a TPM or secure enclave
+	var sig *ssh.Signature
+	var devicePub ssh.PublicKey
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err == nil {
+		devicePub = signer.PublicKey()
+		sig, err = signer.Sign(rand.Reader, devicePayload(ts, pubKey))
+	} else {
+		devicePub, _, _, _, err = ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("Failed to parse device key: %v", err)
+		}
+		sig, err = agentSign(conf, devicePub, devicePayload(ts, pubKey))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to sign device assertion: %v", err)
+	}
+
+	form.Add("deviceKey", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(devicePub))))
+	form.Add("deviceSig", base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+	form.Add("deviceTime", ts)
+
+	return nil
+}
+
+func agentSign(conf *config, pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	conn, err := dialAgent(conf.AgentSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return client.Sign(pub, data)
+		}
+	}
+
+	return nil, fmt.Errorf("key %s not found in ssh-agent", ssh.FingerprintSHA256(pub))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discovery is what an office or region publishes about the curse servers and bastion its
+// laptops should use. Anything left empty keeps the setting from jinx.yaml
+type discovery struct {
+	URLs         []string `json:"urls"`
+	BastionIP    string   `json:"bastionip"`
+	JumpHost     string   `json:"jumphost"`
+	JumpSourceIP string   `json:"jumpsourceip"`
+}
+
+// discover tries discoveryurl, then the DNS records of discoverdomain. If both fail jinx
+// carries on with the configured servers, so a laptop off the office network still works
+func discover(conf *config) {
+	var errs []string
+	if conf.DiscoveryURL != "" {
+		d, err := fetchDiscovery(conf)
+		if err == nil {
+			applyDiscovery(conf, d, conf.DiscoveryURL)
+			return
+		}
+		errs = append(errs, err.Error())
+	}
+	if conf.DiscoverDomain != "" {
+		d, err := lookupDiscovery(conf)
+		if err == nil {
+			applyDiscovery(conf, d, "DNS for "+conf.DiscoverDomain)
+			return
+		}
+		errs = append(errs, err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Discovery failed, using the configured servers: %s\n", strings.Join(errs, "; "))
+}
+
+func applyDiscovery(conf *config, d *discovery, source string) {
+	conf.discovered = source
+	if len(d.URLs) > 0 {
+		conf.URLs = d.URLs
+	}
+	// Settings in jinx.yaml win over what the network says
+	if conf.BastionIP == "" {
+		conf.BastionIP = d.BastionIP
+	}
+	if conf.JumpHost == "" {
+		conf.JumpHost = d.JumpHost
+	}
+	if conf.JumpSourceIP == "" {
+		conf.JumpSourceIP = d.JumpSourceIP
+	}
+}
+
+// fetchDiscovery reads the metadata document at discoveryurl, e.g.
+// {"urls": ["https://curse-fra.example.com/"], "bastionip": "203.0.113.10"}
+func fetchDiscovery(conf *config) (*discovery, error) {
+	client := &http.Client{
+		Transport: newTransport(conf, true),
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}
+	resp, err := client.Get(conf.DiscoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Connection failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", conf.DiscoveryURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<16))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", conf.DiscoveryURL, err)
+	}
+
+	var d discovery
+	err = json.Unmarshal(body, &d)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid discovery document at %s: %v", conf.DiscoveryURL, err)
+	}
+	for _, u := range d.URLs {
+		if !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("Discovery document at %s lists a non-https server: %s", conf.DiscoveryURL, u)
+		}
+	}
+	if len(d.URLs) == 0 && d.BastionIP == "" && d.JumpHost == "" && d.JumpSourceIP == "" {
+		return nil, fmt.Errorf("Discovery document at %s is empty", conf.DiscoveryURL)
+	}
+	return &d, nil
+}
+
+// lookupDiscovery builds the server list from the _curse._tcp SRV records of discoverdomain,
+// in the resolver's priority and weight order, and reads the other settings from its
+// _curse TXT record, e.g. "path=/curse/ bastionip=203.0.113.10 jumphost=bastion-fra.example.com".
+// Plain DNS can be spoofed, so servers and the jump host must be within discoverdomain for
+// the TLS and SSH host checks to mean anything
+func lookupDiscovery(conf *config) (*discovery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Timeout)*time.Second)
+	defer cancel()
+	domain := strings.ToLower(strings.TrimSuffix(conf.DiscoverDomain, "."))
+	inDomain := func(host string) bool {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+
+	var d discovery
+	path := "/"
+	txts, err := net.DefaultResolver.LookupTXT(ctx, "_curse."+domain)
+	if err != nil && !dnsNotFound(err) {
+		return nil, fmt.Errorf("TXT lookup for _curse.%s failed: %v", domain, err)
+	}
+	for _, txt := range txts {
+		for _, field := range strings.Fields(txt) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "path":
+				path = kv[1]
+			case "bastionip":
+				d.BastionIP = kv[1]
+			case "jumphost":
+				if !inDomain(kv[1]) {
+					return nil, fmt.Errorf("TXT record for _curse.%s names a jump host outside the domain: %s", domain, kv[1])
+				}
+				d.JumpHost = kv[1]
+			case "jumpsourceip":
+				d.JumpSourceIP = kv[1]
+			}
+		}
+	}
+
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "curse", "tcp", domain)
+	if err != nil && !dnsNotFound(err) {
+		return nil, fmt.Errorf("SRV lookup for _curse._tcp.%s failed: %v", domain, err)
+	}
+	for _, srv := range srvs {
+		if !inDomain(srv.Target) {
+			fmt.Fprintf(os.Stderr, "Ignoring SRV target outside %s: %s\n", domain, srv.Target)
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		if srv.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: path}
+		d.URLs = append(d.URLs, u.String())
+	}
+
+	if len(d.URLs) == 0 && d.BastionIP == "" && d.JumpHost == "" && d.JumpSourceIP == "" {
+		return nil, fmt.Errorf("No _curse records found for %s", domain)
+	}
+	return &d, nil
+}
+
+func dnsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// printDiscovery shows the settings jinx ends up with, for `jinx discover`
+func printDiscovery(conf *config) error {
+	source := conf.discovered
+	if source == "" {
+		source = "jinx.yaml"
+	}
+	if conf.Output == "json" {
+		return printJSON(struct {
+			Source string `json:"source"`
+			discovery
+		}{source, discovery{conf.URLs, conf.BastionIP, conf.JumpHost, conf.JumpSourceIP}})
+	}
+
+	fmt.Printf("Source: %s\n", source)
+	for _, u := range conf.URLs {
+		fmt.Printf("Server: %s\n", u)
+	}
+	fmt.Printf("Bastion IP: %s\n", conf.BastionIP)
+	if conf.JumpHost != "" {
+		fmt.Printf("Jump host: %s\n", conf.JumpHost)
+	}
+	if conf.JumpSourceIP != "" {
+		fmt.Printf("Jump source IP: %s\n", conf.JumpSourceIP)
+	}
+	return nil
+}
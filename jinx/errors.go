@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Exit codes for failed certificate requests, so wrapper scripts and CI can tell them apart
+// without parsing messages. Anything else that fails exits 1
+const (
+	exitAuth     = 2 // the server didn't accept our credentials
+	exitDenied   = 3 // policy refused the request
+	exitKeyAge   = 4 // the key is too old and has to be replaced
+	exitPending  = 5 // the request is held for approval, run again once approved
+	exitNetwork  = 6 // no server could be reached, or none could answer
+	exitRejected = 7 // the server found the request itself invalid
+)
+
+// Names for the exit codes in --output json
+var exitClasses = map[int]string{
+	exitAuth:     "auth",
+	exitDenied:   "denied",
+	exitKeyAge:   "key_too_old",
+	exitPending:  "pending",
+	exitNetwork:  "network",
+	exitRejected: "rejected",
+}
+
+// requestError is a certificate request that failed, with its exit code and what the
+// server said about it
+type requestError struct {
+	exit    int
+	status  int
+	problem problem
+	err     error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// responseError classifies a response other than a certificate
+func responseError(status int, respBody []byte) *requestError {
+	e := &requestError{status: status, problem: parseProblem(respBody), err: errors.New(problemMessage(respBody))}
+	switch {
+	case status == http.StatusAccepted:
+		e.exit = exitPending
+	case status == http.StatusUnauthorized:
+		e.exit = exitAuth
+	case status == http.StatusForbidden:
+		e.exit = exitDenied
+	case status == http.StatusUnprocessableEntity && keyTooOld(e.problem):
+		e.exit = exitKeyAge
+	case status >= 500:
+		e.exit = exitNetwork
+	default:
+		e.exit = exitRejected
+	}
+	return e
+}
+
+// exitCode returns the exit code for err
+func exitCode(err error) int {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.exit
+	}
+	return 1
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/mikesmitty/edkey"
 
@@ -104,7 +105,7 @@ func genKeyPair(conf *config) ([]byte, []byte, error) {
 			return nil, nil, fmt.Errorf("Unable to convert ecdsa private key format: %v", err)
 		}
 		pemKey := &pem.Block{
-			Type:  "EC PARAMETERS",
+			Type:  "EC PRIVATE KEY",
 			Bytes: ecBytes,
 		}
 		privateKeyPEM = pem.EncodeToMemory(pemKey)
@@ -145,6 +146,11 @@ func saveNewKeyPair(conf *config) error {
 		return fmt.Errorf("Failed to generate new keys: %v\n", err)
 	}
 
+	// A user who has never run ssh, e.g. on their first login to a bastion, has no ~/.ssh
+	err = os.MkdirAll(filepath.Dir(conf.privKeyFile), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create key directory: %v\n", err)
+	}
 	err = ioutil.WriteFile(conf.privKeyFile, privateKey, 0600)
 	if err != nil {
 		return fmt.Errorf("Failed to write private key file: %v\n", err)
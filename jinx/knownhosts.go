@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+func knownHosts(conf *config, creds credentials) error {
+	client := newHTTPClient(conf)
+
+	// Fetch the @cert-authority lines from the first server that answers
+	var lastErr error
+	for _, server := range conf.URLs {
+		khURL, err := endpointURL(server, "knownhosts")
+		if err != nil {
+			return err
+		}
+		respBody, statusCode, err := sendRequest(client, "GET", khURL, creds, nil, "")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if statusCode != http.StatusOK {
+			lastErr = fmt.Errorf("Failed to fetch known_hosts from %s: %d %s", server, statusCode, problemMessage(respBody))
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(conf.KnownHostsFile), 0700)
+		if err != nil {
+			return fmt.Errorf("Failed to create known_hosts directory: %v", err)
+		}
+		err = ioutil.WriteFile(conf.KnownHostsFile, respBody, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write known_hosts file: %v", err)
+		}
+		if conf.Output == "json" {
+			return printJSON(struct {
+				KnownHostsFile string `json:"knownHostsFile"`
+			}{conf.KnownHostsFile})
+		}
+		fmt.Printf("Wrote %s. To use it, add this to your ~/.ssh/config:\n", conf.KnownHostsFile)
+		fmt.Printf("    UserKnownHostsFile ~/.ssh/known_hosts %s\n", conf.KnownHostsFile)
+		return nil
+	}
+
+	return lastErr
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// expires_in is optional in token responses, and some identity providers leave it out of
+// device code responses too. Device codes are then given RFC 8628's example lifetime, and
+// tokens are cached only briefly, since the IdP may expire them at any time
+const (
+	defaultDeviceCodeLifetime = 300 * time.Second
+	defaultTokenLifetime      = 5 * time.Minute
+)
+
+type deviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Error       string `json:"error"`
+}
+
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+func login(conf *config) error {
+	if conf.OAuthClientID == "" || conf.OAuthDeviceURL == "" || conf.OAuthTokenURL == "" {
+		return fmt.Errorf("oauthclientid, oauthdeviceurl and oauthtokenurl are required for login")
+	}
+	client := &http.Client{
+		Transport: newTransport(conf, false),
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}
+
+	// Ask the identity provider for a device code
+	form := url.Values{}
+	form.Add("client_id", conf.OAuthClientID)
+	form.Add("scope", strings.Join(conf.OAuthScopes, " "))
+	resp, err := postForm(client, conf.OAuthDeviceURL, form)
+	if err != nil {
+		return fmt.Errorf("Device code request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Device code request failed: %s", resp.Status)
+	}
+	var dc deviceCode
+	err = json.NewDecoder(resp.Body).Decode(&dc)
+	if err != nil {
+		return fmt.Errorf("Failed to process device code response: %v", err)
+	}
+
+	if dc.VerificationURIComplete != "" {
+		fmt.Fprintf(conf.console, "To log in, visit %s\n", dc.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(conf.console, "To log in, visit %s\n", dc.VerificationURI)
+	}
+	fmt.Fprintf(conf.console, "and enter the code: %s\n", dc.UserCode)
+
+	// Poll the token endpoint until the user finishes authenticating in their browser
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	lifetime := time.Duration(dc.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultDeviceCodeLifetime
+	}
+	deadline := time.Now().Add(lifetime)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		form := url.Values{}
+		form.Add("client_id", conf.OAuthClientID)
+		form.Add("device_code", dc.DeviceCode)
+		form.Add("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		tr, err := pollToken(client, conf.OAuthTokenURL, form)
+		if err != nil {
+			return err
+		}
+
+		switch tr.Error {
+		case "":
+			lifetime := time.Duration(tr.ExpiresIn) * time.Second
+			if lifetime <= 0 {
+				lifetime = defaultTokenLifetime
+			}
+			token := cachedToken{
+				AccessToken: tr.AccessToken,
+				Expiry:      time.Now().Add(lifetime),
+			}
+			err = saveToken(conf.TokenFile, token)
+			if err != nil {
+				return err
+			}
+			if conf.Output == "json" {
+				return printJSON(struct {
+					TokenFile string    `json:"tokenFile"`
+					Expiry    time.Time `json:"expiry"`
+				}{conf.TokenFile, token.Expiry})
+			}
+			fmt.Println("Login successful.")
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return fmt.Errorf("Login was denied")
+		case "expired_token":
+			return fmt.Errorf("Device code expired, please run login again")
+		default:
+			return fmt.Errorf("Login failed: %s", tr.Error)
+		}
+	}
+
+	return fmt.Errorf("Device code expired, please run login again")
+}
+
+func pollToken(client *http.Client, tokenURL string, form url.Values) (*tokenResponse, error) {
+	resp, err := postForm(client, tokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("Token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Pending and denied states come back as 400s with an error field, so decode regardless of status
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to process token response: %v", err)
+	}
+	if tr.Error == "" && tr.AccessToken == "" {
+		return nil, fmt.Errorf("Token response missing access_token: %s", resp.Status)
+	}
+
+	return &tr, nil
+}
+
+func postForm(client *http.Client, u string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub answers with form encoding unless asked for JSON
+	req.Header.Set("Accept", "application/json")
+
+	return client.Do(req)
+}
+
+func saveToken(tokenFile string, token cachedToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("Failed to encode token: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(tokenFile), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create token directory: %v", err)
+	}
+	err = ioutil.WriteFile(tokenFile, data, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write token file: %v", err)
+	}
+
+	return nil
+}
+
+func loadToken(tokenFile string) (string, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	var token cachedToken
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return "", fmt.Errorf("Cached token corrupted: %v", err)
+	}
+
+	// Leave a little headroom so the token doesn't expire in flight
+	if time.Now().Add(30 * time.Second).After(token.Expiry) {
+		return "", fmt.Errorf("Cached token expired")
+	}
+
+	return token.AccessToken, nil
+}
@@ -2,107 +2,280 @@ package main
 
 import (
 	"bufio"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/bgentry/speakeasy"
 	"github.com/spf13/viper"
 )
 
 type config struct {
-	certFile    string
-	privKeyFile string
-	pubKeyFile  string
-	userIP      string
-
-	AutoGenKeys   bool
-	BastionIP     string
-	Insecure      bool
-	KeyGenBitSize int
-	KeyGenPubKey  string
-	KeyGenType    string
-	PubKey        string
-	SSHUser       string
-	Timeout       int
-	URL           string
+	breakGlass   bool
+	certFile     string
+	console      *os.File
+	delegation   string
+	enrollment   string
+	discovered   string
+	force        bool
+	jumpCertFile string
+	pinnedKeys   [][]byte
+	privKeyFile  string
+	proxy        func(*http.Request) (*url.URL, error)
+	pubKeyFile   string
+	rootCAs      *x509.CertPool
+	samlFile     string
+	start        time.Time
+	userIP       string
+
+	AddToAgent      bool
+	AgentSocket     string
+	AutoGenKeys     bool
+	BastionIP       string
+	CABundle        string
+	CertMinValidity int
+	DeviceKey       string
+	DiscoverDomain  string
+	DiscoveryURL    string
+	Insecure        bool
+	JumpHost        string
+	JumpSourceIP    string
+	JumpTargets     []string
+	JumpUser        string
+	KeyGenBitSize   int
+	KeyGenPubKey    string
+	KeyGenType      string
+	KnownHostsFile  string
+	OAuthClientID   string
+	OAuthDeviceURL  string
+	OAuthScopes     []string
+	OAuthTokenURL   string
+	OTP             bool
+	Output          string
+	PinnedKeys      []string
+	ProveKey        bool
+	Proxy           string
+	PubKey          string
+	Retries         int
+	RetryMaxWait    int
+	RetryWait       int
+	SSHConfigFile   string
+	SSHUser         string
+	Timeout         int
+	TokenFile       string
+	URL             string
+	URLs            []string
+}
+
+type credentials struct {
+	user  string
+	pass  string
+	otp   string
+	token string
+	saml  string
 }
 
 func main() {
-	// Process/load our config options
-	conf, err := getConf()
+	err := rootCmd.Execute()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		printError(err)
+		os.Exit(exitCode(err))
 	}
+}
 
+func sign(conf *config) error {
 	// Get our pubkey
 	pubKey, err := getPubKey(conf)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	// Nag-mode for inadvertent/malicious insecure setting
-	if conf.Insecure {
-		fmt.Println("Warning, your password is about to be sent insecurely. ctrl+c to quit")
+		return err
 	}
 
-	// Read in our username and password
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Username: ")
-	user, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Input error: %v\n", err)
-		os.Exit(1)
+	// Reuse our current certificate unless it's about to expire
+	if !conf.force && conf.start.IsZero() {
+		certBytes, ok := cachedCert(conf, pubKey)
+		if ok {
+			return useCert(conf, certBytes)
+		}
 	}
-	user = strings.TrimSpace(user)
 
-	pass, err := speakeasy.Ask("Password: ")
+	creds, err := getCredentials(conf)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Shell error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
 	// Send our pubkey to be signed
-	respBody, statusCode, err := requestCert(conf, user, pass, string(pubKey))
+	respBody, statusCode, err := requestCert(conf, creds, string(pubKey))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
 
 	switch statusCode {
 	case http.StatusOK:
+		// A certificate for later goes next to the current one rather than replacing it
+		if !conf.start.IsZero() {
+			return saveScheduledCert(conf, respBody)
+		}
 		err = ioutil.WriteFile(conf.certFile, respBody, 0644)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to write cert file: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("Failed to write cert file: %v", err)
 		}
+		return useCert(conf, respBody)
+	case http.StatusAccepted:
+		// The server is holding the request for approval, rerunning once approved gets the cert
+		return responseError(statusCode, respBody)
 	case http.StatusUnprocessableEntity:
-		if conf.AutoGenKeys {
-			fmt.Fprintln(os.Stderr, "Server denied pubkey due to age. Regenerating keypairs. Run command again after keys are regenerated.")
-			err = saveNewKeyPair(conf)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to generate key pair: %v\n", err)
-				os.Exit(1)
+		re := responseError(statusCode, respBody)
+		p := re.problem
+		if !keyTooOld(p) {
+			return re
+		}
+		if !conf.AutoGenKeys {
+			msg := "Server denied pubkey due to age and automatic regeneration disabled. Please manually regenerate your SSH keys."
+			if p.Remediation != "" {
+				msg += " See " + p.Remediation
 			}
-		} else {
-			fmt.Fprintln(os.Stderr, "Server denied pubkey due to age and automatic regeneration disabled. Please manually regenerate your SSH keys.")
-			os.Exit(1)
+			re.err = errors.New(msg)
+			return re
+		}
+		fmt.Fprintln(os.Stderr, "Server denied pubkey due to age. Regenerating keypairs. Run command again after keys are regenerated.")
+		err = saveNewKeyPair(conf)
+		if err != nil {
+			return fmt.Errorf("Failed to generate key pair: %v", err)
+		}
+		if conf.Output == "json" {
+			return printJSON(struct {
+				Regenerated bool   `json:"regenerated"`
+				PubKeyFile  string `json:"pubKeyFile"`
+				Remediation string `json:"remediation,omitempty"`
+			}{true, conf.pubKeyFile, p.Remediation})
 		}
 	default:
-		fmt.Fprintf(os.Stderr, string(respBody))
-		os.Exit(statusCode)
+		return responseError(statusCode, respBody)
+	}
+
+	return nil
+}
+
+func useCert(conf *config, certBytes []byte) error {
+	if conf.AddToAgent {
+		err := addToAgent(conf, certBytes)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Output == "json" {
+		return printCert(conf, certBytes)
+	}
+
+	return nil
+}
+
+// saveScheduledCert writes a certificate that starts later to a file of its own, named for
+// its start time, leaving the current certificate alone. ssh picks it up with
+// -o CertificateFile once the change window opens
+func saveScheduledCert(conf *config, certBytes []byte) error {
+	conf.certFile = strings.TrimSuffix(conf.certFile, "-cert.pub") + "-" + conf.start.UTC().Format("20060102T150405Z") + "-cert.pub"
+	err := ioutil.WriteFile(conf.certFile, certBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cert file: %v", err)
+	}
+	if conf.Output == "json" {
+		conf.AddToAgent = false
+		return printCert(conf, certBytes)
+	}
+
+	fmt.Fprintf(conf.console, "Certificate valid from %s saved to %s\n", conf.start.Format(time.RFC3339), conf.certFile)
+	return nil
+}
+
+func getCredentials(conf *config) (credentials, error) {
+	if conf.samlFile != "" {
+		return samlCredentials(conf.samlFile)
+	}
+
+	// Use a cached login token if we have one, otherwise fall back to username and password
+	token, err := loadToken(conf.TokenFile)
+	if err == nil {
+		return credentials{token: token}, nil
+	}
+
+	return askCredentials(conf)
+}
+
+// samlCredentials reads a SAML assertion for servers with authmode: saml, either base64 as the
+// IdP posts it or the XML itself
+func samlCredentials(file string) (credentials, error) {
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return credentials{}, fmt.Errorf("Failed to read SAML assertion: %v", err)
+	}
+	saml := strings.TrimSpace(string(b))
+	if strings.HasPrefix(saml, "<") {
+		saml = base64.StdEncoding.EncodeToString([]byte(saml))
+	}
+	if saml == "" {
+		return credentials{}, fmt.Errorf("SAML assertion %s is empty", file)
 	}
+	return credentials{saml: saml}, nil
+}
+
+func askCredentials(conf *config) (credentials, error) {
+	var creds credentials
+
+	// Nag-mode for inadvertent/malicious insecure setting
+	if conf.Insecure {
+		fmt.Fprintln(conf.console, "Warning, your password is about to be sent insecurely. ctrl+c to quit")
+	}
+
+	// Read in our username and password
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Fprintf(conf.console, "Username: ")
+	user, err := reader.ReadString('\n')
+	if err != nil {
+		return creds, fmt.Errorf("Input error: %v", err)
+	}
+	creds.user = strings.TrimSpace(user)
+
+	creds.pass, err = speakeasy.FAsk(conf.console, "Password: ")
+	if err != nil {
+		return creds, fmt.Errorf("Shell error: %v", err)
+	}
+
+	// Servers running in standalone mode also want a TOTP code
+	if conf.OTP {
+		fmt.Fprintf(conf.console, "Authenticator code: ")
+		otp, err := reader.ReadString('\n')
+		if err != nil {
+			return creds, fmt.Errorf("Input error: %v", err)
+		}
+		creds.otp = strings.TrimSpace(otp)
+	}
+
+	return creds, nil
 }
 
 func init() {
 	viper.SetConfigName("jinx") // name of config file (without extension)
 	viper.AddConfigPath("/etc/jinx")
 	viper.AddConfigPath("$HOME/.jinx/")
+	if dir, err := os.UserConfigDir(); err == nil {
+		viper.AddConfigPath(filepath.Join(dir, "jinx"))
+	}
 	viper.ReadInConfig()
 
 	// If a config file is found, read it in.
@@ -110,16 +283,43 @@ func init() {
 		//log.Printf("Using config file: %s", viper.ConfigFileUsed())
 	}
 
+	viper.SetDefault("addtoagent", false)
+	viper.SetDefault("agentsocket", "")
 	viper.SetDefault("autogenkeys", true)
 	viper.SetDefault("bastionip", "")
+	viper.SetDefault("cabundle", "")
+	viper.SetDefault("certminvalidity", 60)
+	viper.SetDefault("devicekey", "")
+	viper.SetDefault("discoverdomain", "")
+	viper.SetDefault("discoveryurl", "")
 	viper.SetDefault("insecure", false)
+	viper.SetDefault("jumphost", "")
+	viper.SetDefault("jumpsourceip", "")
+	viper.SetDefault("jumptargets", []string{"*"})
+	viper.SetDefault("jumpuser", "")
 	viper.SetDefault("keygenbitsize", 2048)
 	viper.SetDefault("keygenpubkey", "$HOME/.ssh/id_jinx.pub")
 	viper.SetDefault("keygentype", "ed25519")
+	viper.SetDefault("knownhostsfile", "$HOME/.ssh/jinx_known_hosts")
+	viper.SetDefault("oauthclientid", "")
+	viper.SetDefault("oauthdeviceurl", "")
+	viper.SetDefault("oauthscopes", []string{"openid"})
+	viper.SetDefault("oauthtokenurl", "")
+	viper.SetDefault("otp", false)
+	viper.SetDefault("output", "text")
+	viper.SetDefault("pinnedkeys", []string{})
+	viper.SetDefault("provekey", true)
+	viper.SetDefault("proxy", "")
 	viper.SetDefault("pubkey", "$HOME/.ssh/id_ed25519.pub")
+	viper.SetDefault("retries", 2)
+	viper.SetDefault("retrymaxwait", 10000)
+	viper.SetDefault("retrywait", 500)
+	viper.SetDefault("sshconfigfile", "$HOME/.ssh/jinx_config")
 	viper.SetDefault("sshuser", "root") // FIXME Need to revisit this?
 	viper.SetDefault("timeout", 30)
+	viper.SetDefault("tokenfile", "$HOME/.jinx/token")
 	viper.SetDefault("url", "https://localhost/")
+	viper.SetDefault("urls", []string{})
 }
 
 func getConf() (*config, error) {
@@ -131,19 +331,33 @@ func getConf() (*config, error) {
 	}
 
 	// Verify config options
-	if conf.BastionIP == "" {
-		conf.BastionIP, _ = getBastionIP()
-		if conf.BastionIP == "" {
-			return nil, fmt.Errorf("Could not find server's public IP. bastionip field required")
-		}
-	}
 	if conf.PubKey == "" {
 		return nil, fmt.Errorf("pubkey is a required configuration field")
 	}
 
+	// Keep stdout clean for scripts consuming JSON by sending prompts and messages to stderr
+	switch conf.Output {
+	case "text":
+		conf.console = os.Stdout
+	case "json":
+		conf.console = os.Stderr
+	default:
+		return nil, fmt.Errorf("Invalid output format (must be text or json): %s", conf.Output)
+	}
+
 	// Replace $HOME with the current user's home directory
 	conf.PubKey = expandHome(conf.PubKey)
 	conf.KeyGenPubKey = expandHome(conf.KeyGenPubKey)
+	conf.DeviceKey = expandHome(conf.DeviceKey)
+	conf.KnownHostsFile = expandHome(conf.KnownHostsFile)
+	conf.SSHConfigFile = expandHome(conf.SSHConfigFile)
+	conf.TokenFile = expandHome(conf.TokenFile)
+	conf.CABundle = expandHome(conf.CABundle)
+
+	err = loadTransportConf(&conf)
+	if err != nil {
+		return nil, err
+	}
 
 	// Generate our key and certificate filepaths
 	r := regexp.MustCompile(`\.pub$`)
@@ -155,13 +369,36 @@ func getConf() (*config, error) {
 		conf.pubKeyFile = conf.PubKey
 	}
 	conf.privKeyFile = r.ReplaceAllString(conf.pubKeyFile, "")
+	conf.jumpCertFile = r.ReplaceAllString(conf.pubKeyFile, "-jump-cert.pub")
 	if conf.privKeyFile == conf.pubKeyFile {
 		return nil, fmt.Errorf("Invalid public key name (must end in .pub): %s", conf.pubKeyFile)
 	}
 
+	// A list of servers takes precedence over the single url setting
+	if len(conf.URLs) == 0 {
+		conf.URLs = []string{conf.URL}
+	}
+
+	// Servers and bastion published for the network we're on replace the configured ones
+	if conf.DiscoveryURL != "" && !strings.HasPrefix(conf.DiscoveryURL, "https://") {
+		return nil, fmt.Errorf("Invalid discoveryurl (must be https): %s", conf.DiscoveryURL)
+	}
+	if conf.DiscoveryURL != "" || conf.DiscoverDomain != "" {
+		discover(&conf)
+	}
+
+	if conf.BastionIP == "" {
+		conf.BastionIP, _ = getBastionIP()
+		if conf.BastionIP == "" {
+			return nil, fmt.Errorf("Could not find server's public IP. bastionip field required")
+		}
+	}
+
 	// Check for non-SSL URL configuration (for warning)
-	if strings.HasPrefix(conf.URL, "http://") {
-		conf.Insecure = true
+	for _, u := range conf.URLs {
+		if strings.HasPrefix(u, "http://") {
+			conf.Insecure = true
+		}
 	}
 
 	// Try to get the user's local IP from env variables
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+type certOutput struct {
+	CertFile     string    `json:"certFile"`
+	KeyID        string    `json:"keyId"`
+	Principals   []string  `json:"principals"`
+	ValidAfter   time.Time `json:"validAfter"`
+	ValidBefore  time.Time `json:"validBefore"`
+	SessionID    string    `json:"sessionId,omitempty"`
+	AddedToAgent bool      `json:"addedToAgent"`
+}
+
+func printCert(conf *config, certBytes []byte) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse signed certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Server response is not a certificate")
+	}
+
+	return printJSON(certOutput{
+		CertFile:     conf.certFile,
+		KeyID:        cert.KeyId,
+		Principals:   cert.ValidPrincipals,
+		ValidAfter:   time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:  time.Unix(int64(cert.ValidBefore), 0),
+		SessionID:    cert.Extensions["session-id@curse"],
+		AddedToAgent: conf.AddToAgent,
+	})
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printError(err error) {
+	// getConf may be what failed, so check the setting directly
+	if viper.GetString("output") == "json" {
+		out := struct {
+			Error       string `json:"error"`
+			ExitCode    int    `json:"exitCode"`
+			Class       string `json:"class,omitempty"`
+			Status      int    `json:"status,omitempty"`
+			Reason      string `json:"reason,omitempty"`
+			Action      string `json:"action,omitempty"`
+			Remediation string `json:"remediation,omitempty"`
+			RequestID   string `json:"requestId,omitempty"`
+		}{Error: err.Error(), ExitCode: exitCode(err)}
+		var re *requestError
+		if errors.As(err, &re) {
+			out.Class = exitClasses[re.exit]
+			out.Status = re.status
+			out.Reason = re.problem.Reason
+			out.Action = re.problem.Action
+			out.Remediation = re.problem.Remediation
+			out.RequestID = re.problem.RequestID
+		}
+		json.NewEncoder(os.Stderr).Encode(out)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
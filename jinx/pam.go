@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// pamLogin requests a certificate for the user logging in, when run by pam_exec on a
+// bastion. In the auth stack (with expose_authtok) the login password doubles as the
+// credentials for the reverse proxy. In the session stack the user's cached login token is
+// used, and the certificate is loaded into their agent if addtoagent is set and the agent can
+// be reached. Without credentials there's nothing to do, so the login goes ahead and the
+// user can still run jinx by hand
+func pamLogin() error {
+	user := os.Getenv("PAM_USER")
+	if user == "" {
+		return fmt.Errorf("PAM_USER not set, jinx pam is meant to be run by pam_exec")
+	}
+	pamType := os.Getenv("PAM_TYPE")
+	if pamType != "auth" && pamType != "open_session" {
+		return nil
+	}
+
+	// The helper runs as root, so only trust settings the admin put in place
+	if filepath.Dir(viper.ConfigFileUsed()) != "/etc/jinx" {
+		return fmt.Errorf("jinx pam reads its settings from /etc/jinx/jinx.yaml, which is missing")
+	}
+
+	var authtok string
+	if pamType == "auth" {
+		tok, err := bufio.NewReader(os.Stdin).ReadString(0)
+		if err != nil && tok == "" {
+			return fmt.Errorf("No password on stdin, add expose_authtok to the pam_exec line")
+		}
+		authtok = strings.TrimRight(tok, "\x00\r\n")
+	}
+
+	// Keys, certificate and token live in the user's home, and must end up owned by them
+	err := becomeUser(user)
+	if err != nil {
+		return err
+	}
+	conf, err := getConf()
+	if err != nil {
+		return err
+	}
+	conf.console = os.Stderr
+	if rhost := os.Getenv("PAM_RHOST"); rhost != "" {
+		conf.userIP = rhost
+	}
+	// There's no session, let alone a forwarded agent, while authenticating
+	if pamType == "auth" {
+		conf.AddToAgent = false
+	}
+
+	pubKey, err := getPubKey(conf)
+	if err != nil {
+		return err
+	}
+	if certBytes, ok := cachedCert(conf, pubKey); ok {
+		return pamUseCert(conf, certBytes)
+	}
+
+	var creds credentials
+	if pamType == "auth" {
+		creds = credentials{user: user, pass: authtok}
+	} else {
+		creds.token, err = loadToken(conf.TokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "jinx: not requesting a certificate for %s: %v\n", user, err)
+			return nil
+		}
+	}
+
+	certBytes, err := fetchCert(conf, creds, string(pubKey))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(conf.certFile, certBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cert file: %v", err)
+	}
+	return pamUseCert(conf, certBytes)
+}
+
+// pamUseCert loads the certificate into the agent. The certificate is already saved next to
+// the key, where ssh finds it without an agent, so failing to reach one isn't an error
+func pamUseCert(conf *config, certBytes []byte) error {
+	if !conf.AddToAgent {
+		return nil
+	}
+	err := addToAgent(conf, certBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jinx: %v\n", err)
+	}
+	return nil
+}
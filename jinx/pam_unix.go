@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// becomeUser drops root for the given user, with their groups and home directory
+func becomeUser(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("Unable to look up %s: %v", name, err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if os.Geteuid() != uid {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("jinx pam must run as root or as %s", name)
+		}
+		groups, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("Unable to look up groups of %s: %v", name, err)
+		}
+		gids := make([]int, 0, len(groups))
+		for _, g := range groups {
+			id, err := strconv.Atoi(g)
+			if err == nil {
+				gids = append(gids, id)
+			}
+		}
+		// Groups and gid have to go first, they can't be changed once we're no longer root
+		err = syscall.Setgroups(gids)
+		if err == nil {
+			err = syscall.Setgid(gid)
+		}
+		if err == nil {
+			err = syscall.Setuid(uid)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to switch to %s: %v", name, err)
+		}
+	}
+
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Must match possessionPayload in cursed/possession.go
+func possessionPayload(ts, key, remoteUser, bastionIP string) []byte {
+	return []byte("curse-possession-v1\n" + ts + "\n" + remoteUser + "\n" + bastionIP + "\n" + strings.TrimSpace(key))
+}
+
+// addKeyProof signs the request with the key to be certified, so the server knows we hold
+// its private half. The key is signed with in ssh-agent if it's there, or read from disk
+// if it isn't protected by a passphrase
+func addKeyProof(conf *config, form url.Values, pubKey string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return fmt.Errorf("Failed to parse public key: %v", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	payload := possessionPayload(ts, pubKey, form.Get("remoteUser"), form.Get("bastionIP"))
+
+	sig, err := agentSign(conf, pub, payload)
+	if err != nil {
+		keyBytes, rerr := ioutil.ReadFile(conf.privKeyFile)
+		if rerr != nil {
+			return fmt.Errorf("Failed to sign with key: %v", err)
+		}
+		signer, perr := ssh.ParsePrivateKey(keyBytes)
+		if perr != nil {
+			return fmt.Errorf("Failed to sign with key: %v, and %s can't be read without a passphrase", err, conf.privKeyFile)
+		}
+		sig, err = signer.Sign(rand.Reader, payload)
+		if err != nil {
+			return fmt.Errorf("Failed to sign with key: %v", err)
+		}
+	}
+
+	form.Add("keySig", base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+	form.Add("keyTime", ts)
+
+	return nil
+}
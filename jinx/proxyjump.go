@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func proxyJump(conf *config) error {
+	if conf.JumpHost == "" || conf.JumpUser == "" {
+		return fmt.Errorf("jumphost and jumpuser are required for proxyjump")
+	}
+
+	pubKey, err := getPubKey(conf)
+	if err != nil {
+		return err
+	}
+	creds, err := getCredentials(conf)
+	if err != nil {
+		return err
+	}
+
+	// The jump host sees connections straight from us rather than from the bastion, so
+	// its certificate is requested for the jump principal and our own source address
+	jc := *conf
+	jc.SSHUser = conf.JumpUser
+	if conf.JumpSourceIP != "" {
+		jc.BastionIP = conf.JumpSourceIP
+	}
+	jumpCert, err := fetchCert(&jc, creds, string(pubKey))
+	if err != nil {
+		return fmt.Errorf("Jump host certificate: %v", err)
+	}
+	targetCert, err := fetchCert(conf, creds, string(pubKey))
+	if err != nil {
+		return fmt.Errorf("Target certificate: %v", err)
+	}
+
+	err = ioutil.WriteFile(conf.jumpCertFile, jumpCert, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cert file: %v", err)
+	}
+	err = ioutil.WriteFile(conf.certFile, targetCert, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cert file: %v", err)
+	}
+	if conf.AddToAgent {
+		for _, cert := range [][]byte{jumpCert, targetCert} {
+			err = addToAgent(conf, cert)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = writeJumpConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	if conf.Output == "json" {
+		return printJSON(struct {
+			JumpCertFile  string `json:"jumpCertFile"`
+			CertFile      string `json:"certFile"`
+			SSHConfigFile string `json:"sshConfigFile"`
+		}{conf.jumpCertFile, conf.certFile, conf.SSHConfigFile})
+	}
+	fmt.Printf("Wrote %s. To use it, add this to the top of your ~/.ssh/config:\n", conf.SSHConfigFile)
+	fmt.Printf("    Include %s\n", conf.SSHConfigFile)
+	return nil
+}
+
+func fetchCert(conf *config, creds credentials, pubKey string) ([]byte, error) {
+	respBody, statusCode, err := requestCert(conf, creds, pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch statusCode {
+	case http.StatusOK:
+		return respBody, nil
+	default:
+		re := responseError(statusCode, respBody)
+		if re.exit == exitKeyAge {
+			re.err = fmt.Errorf("Server denied pubkey due to age. Run jinx without a subcommand to regenerate your keys")
+		} else {
+			re.err = fmt.Errorf("Server returned %d: %s", statusCode, problemMessage(respBody))
+		}
+		return nil, re
+	}
+}
+
+func writeJumpConfig(conf *config) error {
+	// ProxyJump none stops the catch-all target block from looping the jump host through itself
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by jinx proxyjump\n")
+	fmt.Fprintf(&b, "Host %s\n", conf.JumpHost)
+	fmt.Fprintf(&b, "    User %s\n", conf.JumpUser)
+	fmt.Fprintf(&b, "    IdentityFile %s\n", conf.privKeyFile)
+	fmt.Fprintf(&b, "    CertificateFile %s\n", conf.jumpCertFile)
+	fmt.Fprintf(&b, "    ProxyJump none\n\n")
+	fmt.Fprintf(&b, "Host %s\n", strings.Join(conf.JumpTargets, " "))
+	fmt.Fprintf(&b, "    User %s\n", conf.SSHUser)
+	fmt.Fprintf(&b, "    IdentityFile %s\n", conf.privKeyFile)
+	fmt.Fprintf(&b, "    CertificateFile %s\n", conf.certFile)
+	fmt.Fprintf(&b, "    ProxyJump %s@%s\n", conf.JumpUser, conf.JumpHost)
+
+	err := os.MkdirAll(filepath.Dir(conf.SSHConfigFile), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create ssh config directory: %v", err)
+	}
+	err = ioutil.WriteFile(conf.SSHConfigFile, []byte(b.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write ssh config file: %v", err)
+	}
+
+	return nil
+}
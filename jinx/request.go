@@ -1,27 +1,27 @@
 package main
 
 import (
-	"crypto/tls"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func requestCert(conf *config, user, pass, pubKey string) ([]byte, int, error) {
+func requestCert(conf *config, creds credentials, pubKey string) ([]byte, int, error) {
 	/* Using basic auth for the initial prototype, since presumably this SSL certificate will be valid and
 	relatively insusceptible to MITM. Also, the digest auth client libraries I've seen are kinda bad.
 	I plan to come back and try writing a digest library once I get the prototype functional (and not in
 	a time crunch to make a demo). */
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.Insecure},
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Duration(conf.Timeout) * time.Second,
-	}
+	client := newHTTPClient(conf)
 
 	// Assemble our POST form values
 	form := url.Values{}
@@ -29,21 +29,195 @@ func requestCert(conf *config, user, pass, pubKey string) ([]byte, int, error) {
 	form.Add("key", pubKey)
 	form.Add("remoteUser", conf.SSHUser)
 	form.Add("userIP", conf.userIP)
+	if conf.delegation != "" {
+		form.Add("delegation", conf.delegation)
+	}
+	if conf.enrollment != "" {
+		form.Add("enrollment", conf.enrollment)
+	}
+	if conf.breakGlass {
+		form.Add("breakGlass", "true")
+	}
+	if !conf.start.IsZero() {
+		form.Add("validAfter", strconv.FormatInt(conf.start.Unix(), 10))
+	}
+	if conf.DeviceKey != "" {
+		err := addDeviceAssertion(conf, form, pubKey)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if conf.ProveKey {
+		// Servers that don't require the proof still sign without it
+		err := addKeyProof(conf, form, pubKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Sending request without proof of key possession: %v\n", err)
+		}
+	}
+
+	// The same key on every attempt lets the server hand back the certificate it already issued
+	// if only the response was lost
+	idemKey, err := idempotencyKey()
+	if err != nil {
+		return nil, 0, err
+	}
 
-	req, err := http.NewRequest("POST", conf.URL, strings.NewReader(form.Encode()))
-	req.SetBasicAuth(user, pass)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	// Try each server in turn, moving servers that failed to the back of the line for the next round
+	failures := make(map[string]int)
+	servers := append([]string{}, conf.URLs...)
+	var lastErr error
+	for attempt := 0; attempt <= conf.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt, conf))
+		}
+		sort.SliceStable(servers, func(i, j int) bool {
+			return failures[servers[i]] < failures[servers[j]]
+		})
+
+		for _, server := range servers {
+			respBody, statusCode, err := sendRequest(client, "POST", server, creds, form, idemKey)
+			if err == nil && statusCode < 500 {
+				return respBody, statusCode, nil
+			}
+			if err == nil {
+				re := responseError(statusCode, respBody)
+				re.err = fmt.Errorf("Server error from %s: %d %s", server, statusCode, problemMessage(respBody))
+				err = re
+			} else {
+				err = &requestError{exit: exitNetwork, err: err}
+			}
+			failures[server]++
+			lastErr = err
+			if len(conf.URLs) > 1 || conf.Retries > 0 {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+
+	return nil, 0, lastErr
+}
+
+func idempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate idempotency key: %v", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func newHTTPClient(conf *config) *http.Client {
+	return &http.Client{
+		Transport: newTransport(conf, true),
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}
+}
+
+func sendRequest(client *http.Client, method, server string, creds credentials, form url.Values, idemKey string) ([]byte, int, error) {
+	req, err := http.NewRequest(method, server, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid server URL %s: %v", server, err)
+	}
+	if creds.saml != "" {
+		req.Header.Set("X-Curse-SAML", creds.saml)
+	} else if creds.token != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.token)
+	} else {
+		req.SetBasicAuth(creds.user, creds.pass)
+	}
+	if creds.otp != "" {
+		req.Header.Set("X-Curse-OTP", creds.otp)
+	}
+	if method == "POST" {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idemKey != "" {
+		req.Header.Set("Idempotency-Key", idemKey)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, 0, fmt.Errorf("Connection failed: %v\n", err)
+		return nil, 0, fmt.Errorf("Connection failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, 0, fmt.Errorf("Failed to process response: %v\n", err)
+		return nil, 0, fmt.Errorf("Failed to process response: %v", err)
 	}
 
 	return respBody, resp.StatusCode, nil
 }
+
+// problem is a cursed error response, RFC 7807 problem+json on current servers
+type problem struct {
+	Detail      string `json:"detail"`
+	Reason      string `json:"reason"`
+	Action      string `json:"action"`
+	Remediation string `json:"remediation"`
+	RequestID   string `json:"requestId"`
+}
+
+// parseProblem decodes an error response, leaving everything empty for the plain text
+// responses of older servers
+func parseProblem(respBody []byte) problem {
+	var p problem
+	json.Unmarshal(respBody, &p)
+	return p
+}
+
+// keyTooOld reports whether a 422 response asks for a new key pair. Servers that predate
+// action send the reason, and those that predate problem+json only sent 422 for that
+func keyTooOld(p problem) bool {
+	return p.Action == "regenerate_key" || p.Reason == "KEY_TOO_OLD" || p.Detail == ""
+}
+
+// problemMessage extracts a readable message from a cursed error response, which is RFC 7807
+// problem+json on current servers and plain text on older ones
+func problemMessage(respBody []byte) string {
+	p := parseProblem(respBody)
+	if p.Detail == "" {
+		return strings.TrimSpace(string(respBody))
+	}
+
+	msg := p.Detail
+	if p.Reason != "" {
+		msg += fmt.Sprintf(" [%s]", p.Reason)
+	}
+	if p.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", p.RequestID)
+	}
+	return msg
+}
+
+func endpointURL(server, path string) (string, error) {
+	// Resolve path relative to the server URL so servers hosted under a subpath keep working
+	base, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server URL %s: %v", server, err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+func backoff(attempt int, conf *config) time.Duration {
+	// Exponential backoff capped at retrymaxwait, with full jitter so clients don't retry in lockstep
+	wait := time.Duration(conf.RetryWait) * time.Millisecond << uint(attempt-1)
+	max := time.Duration(conf.RetryMaxWait) * time.Millisecond
+	if wait > max || wait <= 0 {
+		wait = max
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(wait)))
+}
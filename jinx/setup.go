@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace the server signs the client configuration in, see clientconfigfile in cursed.yaml
+const clientConfigNamespace = "curse-client-config"
+
+type clientBundle struct {
+	Config    string `json:"config"`
+	CAKey     string `json:"caKey"`
+	Signature string `json:"signature"`
+}
+
+// setup fetches the server's signed jinx.yaml and writes it to file once the signature checks
+// out against the CA key with the given fingerprint. The fingerprint is all that needs to
+// reach the laptop some trusted way; the server's URL and whatever is in between don't
+func setup(conf *config, server, caFingerprint, file string, force bool) error {
+	if !strings.HasPrefix(caFingerprint, "SHA256:") {
+		return fmt.Errorf("Invalid --ca-fingerprint %q, expected SHA256:... as printed by ssh-keygen -l", caFingerprint)
+	}
+	if _, err := os.Stat(file); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to replace it", file)
+	}
+
+	bundleURL, err := endpointURL(server, ".well-known/curse-client")
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: newTransport(conf, true),
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}
+	resp, err := client.Get(bundleURL)
+	if err != nil {
+		return fmt.Errorf("Connection failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", bundleURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d %s", bundleURL, resp.StatusCode, problemMessage(body))
+	}
+
+	var cb clientBundle
+	err = json.Unmarshal(body, &cb)
+	if err != nil {
+		return fmt.Errorf("Invalid client configuration from %s: %v", bundleURL, err)
+	}
+	caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cb.CAKey))
+	if err != nil {
+		return fmt.Errorf("Invalid CA key from %s: %v", bundleURL, err)
+	}
+	if ssh.FingerprintSHA256(caKey) != caFingerprint {
+		return fmt.Errorf("%s is signed by CA key %s, not %s", bundleURL, ssh.FingerprintSHA256(caKey), caFingerprint)
+	}
+	err = verifySSHSig(caKey, clientConfigNamespace, []byte(cb.Config), []byte(cb.Signature))
+	if err != nil {
+		return fmt.Errorf("Client configuration from %s failed verification: %v", bundleURL, err)
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err = v.ReadConfig(strings.NewReader(cb.Config))
+	if err != nil {
+		return fmt.Errorf("Invalid client configuration from %s: %v", bundleURL, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create configuration directory: %v", err)
+	}
+	header := fmt.Sprintf("# Written by jinx setup from %s, signed by CA key %s\n", server, caFingerprint)
+	err = ioutil.WriteFile(file, []byte(header+cb.Config), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", file, err)
+	}
+
+	if conf.Output == "json" {
+		return printJSON(struct {
+			ConfigFile    string `json:"configFile"`
+			CAFingerprint string `json:"caFingerprint"`
+		}{file, caFingerprint})
+	}
+	fmt.Printf("Wrote %s, signed by CA key %s\n", file, caFingerprint)
+	if used := viper.ConfigFileUsed(); used != "" && used != file {
+		fmt.Printf("%s takes precedence over it, remove it to use the new configuration\n", used)
+	}
+	return nil
+}
+
+// verifySSHSig checks an armored signature in OpenSSH's SSHSIG format (PROTOCOL.sshsig), as
+// `ssh-keygen -Y verify -n <namespace>` would
+func verifySSHSig(pub ssh.PublicKey, namespace string, message, armored []byte) error {
+	armored = bytes.TrimSpace(armored)
+	begin, end := []byte("-----BEGIN SSH SIGNATURE-----"), []byte("-----END SSH SIGNATURE-----")
+	if !bytes.HasPrefix(armored, begin) || !bytes.HasSuffix(armored, end) {
+		return fmt.Errorf("not an SSH signature")
+	}
+	enc := bytes.Join(bytes.Fields(armored[len(begin):len(armored)-len(end)]), nil)
+	blob, err := base64.StdEncoding.DecodeString(string(enc))
+	if err != nil || !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		return fmt.Errorf("malformed SSH signature")
+	}
+
+	var sig struct {
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Signature []byte
+	}
+	err = ssh.Unmarshal(blob[len("SSHSIG"):], &sig)
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature: %v", err)
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+	if !bytes.Equal(sig.PublicKey, pub.Marshal()) {
+		return fmt.Errorf("signed by a different key")
+	}
+	if sig.Namespace != namespace {
+		return fmt.Errorf("signed for %q, not %q", sig.Namespace, namespace)
+	}
+
+	var h hash.Hash
+	switch sig.HashAlg {
+	case "sha512":
+		h = sha512.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return fmt.Errorf("unsupported hash algorithm %q", sig.HashAlg)
+	}
+	h.Write(message)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{namespace, "", sig.HashAlg, h.Sum(nil)})...)
+
+	var s ssh.Signature
+	err = ssh.Unmarshal(sig.Signature, &s)
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature: %v", err)
+	}
+	return pub.Verify(signed, &s)
+}
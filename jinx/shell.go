@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// forceCommand is run by sshd as the ForceCommand of a bastion login. For an interactive
+// login it gets the user a certificate, unless theirs is still good, then hands over to
+// their shell. Commands passed to ssh (scp, rsync, git) are run straight away, with nothing
+// written to stdout that could confuse them. Failing to get a certificate never stops the
+// login: the user can still run jinx by hand
+func forceCommand(prompt bool) error {
+	command := os.Getenv("SSH_ORIGINAL_COMMAND")
+	if command == "" {
+		err := shellCert(prompt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "jinx: no certificate for this session: %v\n", err)
+		}
+	}
+	return execShell(command)
+}
+
+func shellCert(prompt bool) error {
+	conf, err := getConf()
+	if err != nil {
+		return err
+	}
+	conf.console = os.Stderr
+	// sshd puts the client's address first in SSH_CONNECTION
+	if conn := strings.Fields(os.Getenv("SSH_CONNECTION")); len(conn) > 0 {
+		conf.userIP = conn[0]
+	}
+
+	pubKey, err := getPubKey(conf)
+	if err != nil {
+		return err
+	}
+	if certBytes, ok := cachedCert(conf, pubKey); ok {
+		return pamUseCert(conf, certBytes)
+	}
+
+	var creds credentials
+	creds.token, err = loadToken(conf.TokenFile)
+	if err != nil {
+		if !prompt {
+			return fmt.Errorf("%v, run jinx login", err)
+		}
+		creds, err = askCredentials(conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	certBytes, err := fetchCert(conf, creds, string(pubKey))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(conf.certFile, certBytes, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cert file: %v", err)
+	}
+	return pamUseCert(conf, certBytes)
+}
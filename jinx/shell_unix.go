@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// execShell replaces jinx with the user's shell, as sshd would have started it: a login
+// shell, or running command with -c
+func execShell(command string) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	argv := []string{"-" + filepath.Base(shell)}
+	if command != "" {
+		argv = []string{filepath.Base(shell), "-c", command}
+	}
+	err := syscall.Exec(shell, argv, os.Environ())
+	return fmt.Errorf("Unable to run %s: %v", shell, err)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "fmt"
+
+func execShell(command string) error {
+	return fmt.Errorf("jinx shell is only supported on Unix bastions")
+}
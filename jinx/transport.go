@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Pins use curl's --pinnedpubkey format
+const pinPrefix = "sha256//"
+
+// loadTransportConf checks the proxy, cabundle and pinnedkeys settings and prepares them
+// for newHTTPClient
+func loadTransportConf(conf *config) error {
+	// Without a proxy setting, honor HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	conf.proxy = http.ProxyFromEnvironment
+	if conf.Proxy != "" {
+		u, err := url.Parse(conf.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid proxy URL: %s", conf.Proxy)
+		}
+		conf.proxy = http.ProxyURL(u)
+	}
+
+	if conf.CABundle != "" {
+		caPEM, err := ioutil.ReadFile(conf.CABundle)
+		if err != nil {
+			return fmt.Errorf("Failed to read cabundle: %v", err)
+		}
+		// The bundle adds to the system roots, so public servers (e.g. the SSO provider)
+		// still verify. Some platforms can't export their roots, then only the bundle is used
+		conf.rootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			conf.rootCAs = x509.NewCertPool()
+		}
+		if !conf.rootCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("No certificates found in cabundle %s", conf.CABundle)
+		}
+	}
+
+	for _, p := range conf.PinnedKeys {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, pinPrefix))
+		if !strings.HasPrefix(p, pinPrefix) || err != nil || len(pin) != sha256.Size {
+			return fmt.Errorf("Invalid pinned key %q (expected %s<base64 SHA-256 of the public key>)", p, pinPrefix)
+		}
+		conf.pinnedKeys = append(conf.pinnedKeys, pin)
+	}
+
+	return nil
+}
+
+// verifyPinnedKeys accepts a connection only if a certificate in the server's chain has one
+// of the pinned public keys. It runs after normal verification, so a pin narrows what the
+// CA bundle allows; with insecure mode on, the pin alone decides
+func verifyPinnedKeys(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("server certificate does not match any pinnedkeys")
+	}
+}
+
+// newTransport returns a transport using the proxy and CA settings. insecure and pinnedkeys
+// are about the curse servers, so they don't apply to other hosts like the SSO provider
+func newTransport(conf *config, curse bool) *http.Transport {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: curse && conf.Insecure,
+		RootCAs:            conf.rootCAs,
+	}
+	if curse && len(conf.pinnedKeys) > 0 {
+		tlsConf.VerifyPeerCertificate = verifyPinnedKeys(conf.pinnedKeys)
+	}
+
+	return &http.Transport{
+		Proxy:           conf.proxy,
+		TLSClientConfig: tlsConf,
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
 
 func expandHome(path string) string {
-	// Swap out $HOME for service user's home dir in path
+	// Swap out $HOME for the user's home dir in path (%USERPROFILE% on Windows)
 	home := os.Getenv("HOME")
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
 	if strings.HasPrefix(path, "$HOME") && home != "" {
-		path = strings.Replace(path, "$HOME", home, 1)
+		path = filepath.Join(home, strings.TrimPrefix(path, "$HOME"))
 	}
 
 	return path
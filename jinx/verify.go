@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type inspectResult struct {
+	CertType        string            `json:"certType"`
+	Serial          uint64            `json:"serial"`
+	KeyID           string            `json:"keyId"`
+	ValidPrincipals []string          `json:"validPrincipals"`
+	CriticalOptions map[string]string `json:"criticalOptions"`
+	Extensions      map[string]string `json:"extensions"`
+	Fingerprint     string            `json:"fingerprint"`
+	CAFingerprint   string            `json:"caFingerprint"`
+	SignedByCA      bool              `json:"signedByCA"`
+	ValidAfter      time.Time         `json:"validAfter"`
+	ValidBefore     time.Time         `json:"validBefore"`
+	Expired         bool              `json:"expired"`
+	Revoked         bool              `json:"revoked"`
+	RevokedReason   string            `json:"revokedReason,omitempty"`
+	Valid           bool              `json:"valid"`
+}
+
+// verify asks the server to check a certificate, by default the one jinx last saved
+func verify(conf *config, creds credentials, certFile string) error {
+	if certFile == "" {
+		certFile = conf.certFile
+	}
+	certBytes, err := ioutil.ReadFile(expandHome(certFile))
+	if err != nil {
+		return fmt.Errorf("Failed to read certificate: %v", err)
+	}
+
+	client := newHTTPClient(conf)
+	form := url.Values{"cert": {string(certBytes)}}
+
+	var lastErr error
+	for _, server := range conf.URLs {
+		inspectURL, err := endpointURL(server, "inspect")
+		if err != nil {
+			return err
+		}
+		respBody, statusCode, err := sendRequest(client, "POST", inspectURL, creds, form, "")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if statusCode != http.StatusOK {
+			lastErr = fmt.Errorf("Failed to verify certificate with %s: %d %s", server, statusCode, problemMessage(respBody))
+			continue
+		}
+
+		var res inspectResult
+		err = json.Unmarshal(respBody, &res)
+		if err != nil {
+			return fmt.Errorf("Failed to process response: %v", err)
+		}
+		if conf.Output == "json" {
+			err = printJSON(res)
+		} else {
+			printInspect(certFile, res)
+		}
+		if err == nil && !res.Valid {
+			err = fmt.Errorf("%s is not valid", certFile)
+		}
+		return err
+	}
+
+	return lastErr
+}
+
+func printInspect(certFile string, res inspectResult) {
+	validity := "forever"
+	if !res.ValidBefore.IsZero() {
+		validity = fmt.Sprintf("from %s to %s", res.ValidAfter.Format(time.RFC3339), res.ValidBefore.Format(time.RFC3339))
+	}
+	if res.Expired {
+		validity += " (expired)"
+	}
+	signer := res.CAFingerprint + " (not this CA)"
+	if res.SignedByCA {
+		signer = res.CAFingerprint
+	}
+	revoked := "no"
+	if res.Revoked {
+		revoked = "yes, " + res.RevokedReason
+	}
+
+	fmt.Printf("%s:\n", certFile)
+	fmt.Printf("    Type: %s certificate\n", res.CertType)
+	fmt.Printf("    Serial: %d\n", res.Serial)
+	fmt.Printf("    Key ID: %s\n", res.KeyID)
+	fmt.Printf("    Key: %s\n", res.Fingerprint)
+	fmt.Printf("    Signing CA: %s\n", signer)
+	fmt.Printf("    Valid: %s\n", validity)
+	fmt.Printf("    Principals: %s\n", strings.Join(res.ValidPrincipals, ", "))
+	fmt.Printf("    Critical Options: %s\n", formatOptions(res.CriticalOptions))
+	fmt.Printf("    Extensions: %s\n", formatOptions(res.Extensions))
+	fmt.Printf("    Revoked: %s\n", revoked)
+}
+
+func formatOptions(opts map[string]string) string {
+	if len(opts) == 0 {
+		return "(none)"
+	}
+	names := make([]string, 0, len(opts))
+	for name, val := range opts {
+		if val != "" {
+			name += " " + val
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}